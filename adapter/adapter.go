@@ -0,0 +1,275 @@
+// Package adapter adapts server configs of trojan-gfw and trojan-go to
+// Caddy JSON.
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/handler"
+	"github.com/imgk/caddy-trojan/listener"
+)
+
+func init() {
+	caddyconfig.RegisterAdapter("trojan-gfw", Adapter{})
+}
+
+// Config is a server config of trojan-gfw or trojan-go.
+type Config struct {
+	RunType    string   `json:"run_type"`
+	LocalAddr  string   `json:"local_addr"`
+	LocalPort  int      `json:"local_port"`
+	RemoteAddr string   `json:"remote_addr"`
+	RemotePort int      `json:"remote_port"`
+	Password   []string `json:"password"`
+	LogLevel   *int     `json:"log_level"`
+	SSL        struct {
+		Cert string   `json:"cert"`
+		Key  string   `json:"key"`
+		SNI  string   `json:"sni"`
+		ALPN []string `json:"alpn"`
+	} `json:"ssl"`
+	// WebSocket is of trojan-go.
+	WebSocket struct {
+		Enabled bool   `json:"enabled"`
+		Path    string `json:"path"`
+		Host    string `json:"host"`
+	} `json:"websocket"`
+}
+
+// supported are options which are adapted
+var supported = map[string]bool{
+	"run_type":          true,
+	"local_addr":        true,
+	"local_port":        true,
+	"remote_addr":       true,
+	"remote_port":       true,
+	"password":          true,
+	"log_level":         true,
+	"ssl.cert":          true,
+	"ssl.key":           true,
+	"ssl.sni":           true,
+	"ssl.alpn":          true,
+	"websocket.enabled": true,
+	"websocket.path":    true,
+	"websocket.host":    true,
+}
+
+// ignored are options whose usual values match the behaviour of caddy
+var ignored = map[string]bool{
+	"ssl.prefer_server_cipher": true,
+	"ssl.reuse_session":        true,
+	"ssl.session_ticket":       true,
+	"ssl.session_timeout":      true,
+	"ssl.verify":               true,
+	"ssl.verify_hostname":      true,
+	"tcp.no_delay":             true,
+	"tcp.keep_alive":           true,
+}
+
+// hints explain unsupported sections
+var hints = map[string]string{
+	"mux":    "mux is not supported, clients must disable mux",
+	"mysql":  "mysql is not supported, users are taken from password",
+	"router": "router is not supported, use the policy of the trojan app",
+	"api":    "api is not supported, use the admin api of caddy",
+}
+
+// Adapter adapts a trojan-gfw or trojan-go server config to Caddy JSON.
+type Adapter struct{}
+
+// Adapt is ...
+func (Adapter) Adapt(body []byte, options map[string]any) ([]byte, []caddyconfig.Warning, error) {
+	filename, _ := options["filename"].(string)
+	if filename == "" {
+		filename = "config.json"
+	}
+
+	cfg := Config{}
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("decode %v error: %w", filename, err)
+	}
+	if cfg.RunType != "server" {
+		return nil, nil, fmt.Errorf("run_type %q is not supported, only server configs can be adapted", cfg.RunType)
+	}
+	if cfg.LocalPort == 0 {
+		return nil, nil, errors.New("local_port is required")
+	}
+	if len(cfg.Password) == 0 {
+		return nil, nil, errors.New("password is required")
+	}
+	if cfg.SSL.Cert == "" || cfg.SSL.Key == "" {
+		return nil, nil, errors.New("ssl.cert and ssl.key are required")
+	}
+
+	raw := map[string]any{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, nil, err
+	}
+	warnings := []caddyconfig.Warning{}
+	warn := func(option, msg string) {
+		warnings = append(warnings, caddyconfig.Warning{File: filename, Directive: option, Message: msg})
+	}
+	unsupported(raw, "", warn)
+
+	config, err := adapt(&cfg, &warnings, warn)
+	if err != nil {
+		return nil, warnings, err
+	}
+	b, err := json.Marshal(config)
+	return b, warnings, err
+}
+
+// adapt returns the caddy config of cfg
+func adapt(cfg *Config, warnings *[]caddyconfig.Warning, warn func(string, string)) (*caddy.Config, error) {
+	trojan := &app.App{
+		UpstreamRaw: caddyconfig.JSONModuleObject(new(app.MemoryUpstream), "upstream", "memory", warnings),
+		ProxyRaw:    caddyconfig.JSONModuleObject(new(app.NoProxy), "proxy", "no_proxy", warnings),
+		Users:       cfg.Password,
+	}
+
+	// trojan over tls is handled by the listener wrapper and other
+	// traffic is served by routes
+	srv := &caddyhttp.Server{
+		Listen: []string{net.JoinHostPort(cfg.LocalAddr, strconv.Itoa(cfg.LocalPort))},
+		ListenerWrappersRaw: []json.RawMessage{
+			caddyconfig.JSONModuleObject(listener.ListenerWrapper{}, "wrapper", "trojan", warnings),
+		},
+		TLSConnPolicies: caddytls.ConnectionPolicies{{
+			ALPN:        cfg.SSL.ALPN,
+			DefaultSNI:  cfg.SSL.SNI,
+			FallbackSNI: cfg.SSL.SNI,
+		}},
+		AutoHTTPS: &caddyhttp.AutoHTTPSConfig{Disabled: true},
+	}
+
+	if cfg.WebSocket.Enabled {
+		path := cfg.WebSocket.Path
+		if path == "" {
+			path = "/"
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("websocket.path must start with /: %v", path)
+		}
+		matchers := caddy.ModuleMap{"path": caddyconfig.JSON(caddyhttp.MatchPath{path}, warnings)}
+		if cfg.WebSocket.Host != "" {
+			matchers["host"] = caddyconfig.JSON(caddyhttp.MatchHost{cfg.WebSocket.Host}, warnings)
+		}
+		srv.Routes = append(srv.Routes, caddyhttp.Route{
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{matchers},
+			HandlersRaw: []json.RawMessage{
+				caddyconfig.JSONModuleObject(&handler.Handler{WebSocket: true}, "handler", "trojan", warnings),
+			},
+		})
+	}
+
+	// other traffic is proxied to the remote
+	if cfg.RemoteAddr != "" && cfg.RemotePort != 0 {
+		rp := &reverseproxy.Handler{
+			Upstreams: reverseproxy.UpstreamPool{{
+				Dial: net.JoinHostPort(cfg.RemoteAddr, strconv.Itoa(cfg.RemotePort)),
+			}},
+		}
+		srv.Routes = append(srv.Routes, caddyhttp.Route{
+			HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(rp, "handler", "reverse_proxy", warnings)},
+		})
+	} else {
+		warn("remote_addr", "no remote_addr and remote_port, fallback traffic is answered with empty responses")
+	}
+
+	tlsApp := &caddytls.TLS{
+		CertificatesRaw: caddy.ModuleMap{
+			"load_files": caddyconfig.JSON(caddytls.FileLoader{{Certificate: cfg.SSL.Cert, Key: cfg.SSL.Key}}, warnings),
+		},
+	}
+
+	config := &caddy.Config{
+		AppsRaw: caddy.ModuleMap{
+			"http":         caddyconfig.JSON(&caddyhttp.App{Servers: map[string]*caddyhttp.Server{"trojan": srv}}, warnings),
+			"tls":          caddyconfig.JSON(tlsApp, warnings),
+			app.CaddyAppID: caddyconfig.JSON(trojan, warnings),
+		},
+	}
+
+	if cfg.LogLevel != nil && *cfg.LogLevel != 1 {
+		levels := []string{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+		if *cfg.LogLevel < 0 || *cfg.LogLevel >= len(levels) {
+			warn("log_level", fmt.Sprintf("log_level %v is not supported", *cfg.LogLevel))
+		} else {
+			config.Logging = &caddy.Logging{Logs: map[string]*caddy.CustomLog{
+				"default": {BaseLog: caddy.BaseLog{Level: levels[*cfg.LogLevel]}},
+			}}
+		}
+	}
+	return config, nil
+}
+
+// unsupported warns about options of raw with non-zero values which are
+// not adapted, sections disabled with "enabled": false are skipped
+func unsupported(raw map[string]any, prefix string, warn func(string, string)) {
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := prefix + k
+		v := raw[k]
+		if section, ok := v.(map[string]any); ok {
+			if enabled, ok := section["enabled"].(bool); ok {
+				if !enabled {
+					continue
+				}
+				if !supported[name+".enabled"] {
+					msg, ok := hints[name]
+					if !ok {
+						msg = fmt.Sprintf("%v is not supported and ignored", name)
+					}
+					warn(name, msg)
+					continue
+				}
+			}
+			unsupported(section, name+".", warn)
+			continue
+		}
+		if supported[name] || ignored[name] || isZero(v) {
+			continue
+		}
+		warn(name, fmt.Sprintf("option %v is not supported and ignored", name))
+	}
+}
+
+// isZero returns whether v is a zero JSON value
+func isZero(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case string:
+		return v == ""
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// Interface guard
+var _ caddyconfig.Adapter = (*Adapter)(nil)
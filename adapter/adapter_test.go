@@ -0,0 +1,194 @@
+package adapter
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// trojanGFW is the example server config of trojan-gfw
+const trojanGFW = `{
+    "run_type": "server",
+    "local_addr": "0.0.0.0",
+    "local_port": 443,
+    "remote_addr": "127.0.0.1",
+    "remote_port": 80,
+    "password": ["password1", "password2"],
+    "log_level": 1,
+    "ssl": {
+        "cert": "/path/to/certificate.crt",
+        "key": "/path/to/private.key",
+        "key_password": "",
+        "cipher": "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256",
+        "prefer_server_cipher": true,
+        "alpn": ["http/1.1"],
+        "alpn_port_override": {"h2": 81},
+        "reuse_session": true,
+        "session_ticket": false,
+        "session_timeout": 600,
+        "plain_http_response": "",
+        "curves": "",
+        "dhparam": ""
+    },
+    "tcp": {
+        "prefer_ipv4": false,
+        "no_delay": true,
+        "keep_alive": true,
+        "reuse_port": false,
+        "fast_open": false,
+        "fast_open_qlen": 20
+    },
+    "mysql": {
+        "enabled": false,
+        "server_addr": "127.0.0.1",
+        "server_port": 3306
+    }
+}`
+
+// trojanGo is a server config of trojan-go with websocket and mux
+const trojanGo = `{
+    "run_type": "server",
+    "local_addr": "::",
+    "local_port": 8443,
+    "remote_addr": "example.com",
+    "remote_port": 80,
+    "password": ["password1"],
+    "log_level": 3,
+    "ssl": {
+        "cert": "server.crt",
+        "key": "server.key",
+        "sni": "example.com",
+        "fallback_port": 1234
+    },
+    "websocket": {
+        "enabled": true,
+        "path": "/ws",
+        "host": "example.com"
+    },
+    "mux": {
+        "enabled": true,
+        "concurrency": 8
+    },
+    "shadowsocks": {
+        "enabled": true,
+        "method": "AES-128-GCM",
+        "password": "pass"
+    }
+}`
+
+// decode decodes b into the http, tls and trojan apps
+func decode(t *testing.T, b []byte) (*caddy.Config, *caddyhttp.Server, *caddytls.TLS, *app.App) {
+	cfg := &caddy.Config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		t.Fatal(err)
+	}
+	httpApp, tlsApp, trojan := &caddyhttp.App{}, &caddytls.TLS{}, &app.App{}
+	for name, v := range map[string]any{"http": httpApp, "tls": tlsApp, app.CaddyAppID: trojan} {
+		if err := json.Unmarshal(cfg.AppsRaw[name], v); err != nil {
+			t.Fatalf("decode %v error: %v", name, err)
+		}
+	}
+	srv, ok := httpApp.Servers["trojan"]
+	if !ok {
+		t.Fatalf("servers error: %v", httpApp.Servers)
+	}
+	return cfg, srv, tlsApp, trojan
+}
+
+func TestAdaptTrojanGFW(t *testing.T) {
+	b, warnings, err := Adapter{}.Adapt([]byte(trojanGFW), map[string]any{"filename": "config.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []string{}
+	for _, v := range warnings {
+		list = append(list, v.Directive)
+		if v.File != "config.json" {
+			t.Errorf("warning file error: %v", v.File)
+		}
+	}
+	if !slices.Equal(list, []string{"ssl.alpn_port_override.h2", "ssl.cipher", "tcp.fast_open_qlen"}) {
+		t.Errorf("warnings error: %v", list)
+	}
+
+	cfg, srv, tlsApp, trojan := decode(t, b)
+	if cfg.Logging != nil {
+		t.Error("logging of default log_level")
+	}
+	if !slices.Equal(srv.Listen, []string{"0.0.0.0:443"}) || len(srv.ListenerWrappersRaw) != 1 || !srv.AutoHTTPS.Disabled {
+		t.Errorf("server error: %v %s", srv.Listen, srv.ListenerWrappersRaw)
+	}
+	if len(srv.TLSConnPolicies) != 1 || !slices.Equal(srv.TLSConnPolicies[0].ALPN, []string{"http/1.1"}) {
+		t.Errorf("connection policies error: %+v", srv.TLSConnPolicies)
+	}
+	if len(srv.Routes) != 1 || len(srv.Routes[0].MatcherSetsRaw) != 0 {
+		t.Fatalf("routes error: %+v", srv.Routes)
+	}
+	rp := struct {
+		Handler   string `json:"handler"`
+		Upstreams []struct {
+			Dial string `json:"dial"`
+		} `json:"upstreams"`
+	}{}
+	if err := json.Unmarshal(srv.Routes[0].HandlersRaw[0], &rp); err != nil || rp.Handler != "reverse_proxy" || rp.Upstreams[0].Dial != "127.0.0.1:80" {
+		t.Errorf("fallback error: %+v %v", rp, err)
+	}
+
+	files := caddytls.FileLoader{}
+	if err := json.Unmarshal(tlsApp.CertificatesRaw["load_files"], &files); err != nil || len(files) != 1 || files[0].Key != "/path/to/private.key" {
+		t.Errorf("certificates error: %+v %v", files, err)
+	}
+	if !slices.Equal(trojan.Users, []string{"password1", "password2"}) {
+		t.Errorf("users error: %v", trojan.Users)
+	}
+}
+
+func TestAdaptTrojanGo(t *testing.T) {
+	b, warnings, err := Adapter{}.Adapt([]byte(trojanGo), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []string{}
+	for _, v := range warnings {
+		list = append(list, v.Directive)
+	}
+	if !slices.Equal(list, []string{"mux", "shadowsocks", "ssl.fallback_port"}) || warnings[0].Message != hints["mux"] {
+		t.Errorf("warnings error: %v", warnings)
+	}
+
+	cfg, srv, _, _ := decode(t, b)
+	if cfg.Logging == nil || cfg.Logging.Logs["default"].Level != "ERROR" {
+		t.Errorf("logging error: %+v", cfg.Logging)
+	}
+	if !slices.Equal(srv.Listen, []string{"[::]:8443"}) || srv.TLSConnPolicies[0].FallbackSNI != "example.com" {
+		t.Errorf("server error: %v %+v", srv.Listen, srv.TLSConnPolicies[0])
+	}
+	if len(srv.Routes) != 2 {
+		t.Fatalf("routes error: %+v", srv.Routes)
+	}
+	matchers := srv.Routes[0].MatcherSetsRaw
+	if len(matchers) != 1 || string(matchers[0]["path"]) != `["/ws"]` || string(matchers[0]["host"]) != `["example.com"]` {
+		t.Errorf("websocket matchers error: %v", matchers)
+	}
+	h := map[string]any{}
+	if err := json.Unmarshal(srv.Routes[0].HandlersRaw[0], &h); err != nil || h["handler"] != "trojan" || h["websocket"] != true {
+		t.Errorf("websocket handler error: %v %v", h, err)
+	}
+
+	for _, v := range []string{
+		`{"run_type": "client", "local_port": 1080, "password": ["p"], "ssl": {"cert": "c", "key": "k"}}`,
+		`{"run_type": "server", "local_port": 443, "ssl": {"cert": "c", "key": "k"}}`,
+		`{"run_type": "server", "local_port": 443, "password": ["p"]}`,
+		`{"run_type": "server", "local_port": 443, "password": ["p"], "ssl": {"cert": "c", "key": "k"}, "websocket": {"enabled": true, "path": "ws"}}`,
+	} {
+		if _, _, err := (Adapter{}).Adapt([]byte(v), nil); err == nil {
+			t.Errorf("adapt %v error", v)
+		}
+	}
+}
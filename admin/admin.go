@@ -7,18 +7,28 @@ import (
 	"net/http"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 
 	"github.com/imgk/caddy-trojan/app"
 )
 
 func init() {
 	caddy.RegisterModule(Admin{})
+	caddy.RegisterModule(ResellerAPI{})
+	httpcaddyfile.RegisterHandlerDirective("trojan_reseller", func(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+		m := &ResellerAPI{}
+		err := m.UnmarshalCaddyfile(h.Dispenser)
+		return m, err
+	})
 }
 
 // Admin is ...
 type Admin struct {
 	// Upstream is ...
 	Upstream app.Upstream
+	// App is ...
+	App *app.App
 }
 
 // CaddyModule returns the Caddy module information.
@@ -41,10 +51,12 @@ func (al *Admin) Provision(ctx caddy.Context) error {
 	}
 	app := mod.(*app.App)
 	al.Upstream = app.Upstream()
+	al.App = app
 	return nil
 }
 
-// Routes returns a route for the /trojan/* endpoint.
+// Routes returns a route for the /trojan/* endpoint. The admin endpoint
+// has no authentication, routes of resellers are served by ResellerAPI.
 func (al *Admin) Routes() []caddy.AdminRoute {
 	return []caddy.AdminRoute{
 		{
@@ -59,6 +71,94 @@ func (al *Admin) Routes() []caddy.AdminRoute {
 			Pattern: "/trojan/users/delete",
 			Handler: caddy.AdminHandlerFunc(al.DeleteUser),
 		},
+		{
+			Pattern: "/trojan/traffic",
+			Handler: caddy.AdminHandlerFunc(al.GetTraffic),
+		},
+		{
+			Pattern: "/trojan/sessions",
+			Handler: caddy.AdminHandlerFunc(al.GetSessions),
+		},
+		{
+			Pattern: "/trojan/sessions/terminate",
+			Handler: caddy.AdminHandlerFunc(al.TerminateSessions),
+		},
+		{
+			Pattern: "/trojan/bans",
+			Handler: caddy.AdminHandlerFunc(al.GetBans),
+		},
+		{
+			Pattern: "/trojan/bans/add",
+			Handler: caddy.AdminHandlerFunc(al.AddBan),
+		},
+		{
+			Pattern: "/trojan/bans/delete",
+			Handler: caddy.AdminHandlerFunc(al.DeleteBan),
+		},
+		{
+			Pattern: "/trojan/drain",
+			Handler: caddy.AdminHandlerFunc(al.GetDrain),
+		},
+		{
+			Pattern: "/trojan/drain/start",
+			Handler: caddy.AdminHandlerFunc(al.StartDrain),
+		},
+		{
+			Pattern: "/trojan/drain/stop",
+			Handler: caddy.AdminHandlerFunc(al.StopDrain),
+		},
+		{
+			Pattern: "/trojan/health",
+			Handler: caddy.AdminHandlerFunc(al.GetHealth),
+		},
+		{
+			Pattern: "/trojan/sharing",
+			Handler: caddy.AdminHandlerFunc(al.GetSharing),
+		},
+		{
+			Pattern: "/trojan/sharing/delete",
+			Handler: caddy.AdminHandlerFunc(al.DeleteSharing),
+		},
+		{
+			Pattern: "/trojan/scanning",
+			Handler: caddy.AdminHandlerFunc(al.GetScanning),
+		},
+		{
+			Pattern: "/trojan/scanning/delete",
+			Handler: caddy.AdminHandlerFunc(al.DeleteScanning),
+		},
+		{
+			Pattern: "/trojan/egress",
+			Handler: caddy.AdminHandlerFunc(al.GetEgress),
+		},
+		{
+			Pattern: "/trojan/fingerprints",
+			Handler: caddy.AdminHandlerFunc(al.GetFingerprints),
+		},
+		{
+			Pattern: "/trojan/users/fingerprints",
+			Handler: caddy.AdminHandlerFunc(al.GetUserFingerprints),
+		},
+		{
+			Pattern: "/trojan/users/rewrap",
+			Handler: caddy.AdminHandlerFunc(al.Rewrap),
+		},
+		{
+			Pattern: "/trojan/pools",
+			Handler: caddy.AdminHandlerFunc(al.GetPools),
+		},
+		{
+			Pattern: "/trojan/pools/reset",
+			Handler: caddy.AdminHandlerFunc(al.ResetPool),
+		},
+		{
+			Pattern: "/trojan/resellers",
+			Handler: caddy.AdminHandlerFunc(al.GetResellers),
+		},
+		{
+			Pattern: "/trojan/openapi.json",
+			Handler: caddy.AdminHandlerFunc(al.GetOpenAPI),
+		},
 	}
 }
 
@@ -0,0 +1,137 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// BanInfo is ...
+type BanInfo struct {
+	Key    string     `json:"key"`
+	Reason string     `json:"reason,omitempty"`
+	Start  time.Time  `json:"start"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// NewBanInfo is ...
+func NewBanInfo(b app.Ban) BanInfo {
+	info := BanInfo{Key: b.Key, Reason: b.Reason, Start: b.Start}
+	if !b.Until.IsZero() {
+		info.Until = &b.Until
+	}
+	return info
+}
+
+// userKey returns key, or the key of password if key is empty
+func userKey(key, password string) (string, error) {
+	if key != "" {
+		return key, nil
+	}
+	if password == "" {
+		return "", caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: errors.New("missing key or password")}
+	}
+	b := [trojan.HeaderLen]byte{}
+	trojan.GenKey(password, b[:])
+	return string(b[:]), nil
+}
+
+// GetBans lists bans in effect.
+func (al *Admin) GetBans(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan bans method error")
+	}
+
+	list := make([]BanInfo, 0)
+	for _, b := range al.App.Bans().List() {
+		list = append(list, NewBanInfo(b))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+	return nil
+}
+
+// AddBan bans a user and terminates its live sessions.
+func (al *Admin) AddBan(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodPost {
+		return errors.New("add trojan ban method error")
+	}
+
+	type Request struct {
+		Key      string         `json:"key,omitempty"`
+		Password string         `json:"password,omitempty"`
+		Reason   string         `json:"reason,omitempty"`
+		Duration caddy.Duration `json:"duration,omitempty"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req := Request{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	key, err := userKey(req.Key, req.Password)
+	if err != nil {
+		return err
+	}
+	if req.Duration < 0 {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: errors.New("negative ban duration")}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(NewBanInfo(al.App.Ban(key, req.Reason, time.Duration(req.Duration))))
+	return nil
+}
+
+// DeleteBan lifts the ban of a user.
+func (al *Admin) DeleteBan(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodDelete {
+		return errors.New("delete trojan ban method error")
+	}
+
+	type Request struct {
+		Key      string `json:"key,omitempty"`
+		Password string `json:"password,omitempty"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req := Request{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	key, err := userKey(req.Key, req.Password)
+	if err != nil {
+		return err
+	}
+	if !al.App.Bans().Remove(key) {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.New("ban not found")}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
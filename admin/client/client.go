@@ -0,0 +1,456 @@
+// Package client is a Go client of the trojan admin API, which is described
+// by the OpenAPI document served at /trojan/openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the default address of the Caddy admin endpoint.
+const DefaultBaseURL = "http://localhost:2019"
+
+// Error is an error response of the admin API.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+// Error is ...
+func (e *Error) Error() string {
+	return fmt.Sprintf("trojan admin: %d %v", e.StatusCode, e.Message)
+}
+
+// User is ...
+type User struct {
+	Key  string `json:"key"`
+	Up   int64  `json:"up"`
+	Down int64  `json:"down"`
+}
+
+// Traffic is ...
+type Traffic struct {
+	Users int   `json:"users"`
+	Up    int64 `json:"up"`
+	Down  int64 `json:"down"`
+}
+
+// Session is ...
+type Session struct {
+	Key        string    `json:"key"`
+	Transport  string    `json:"transport"`
+	RemoteAddr string    `json:"remote_addr"`
+	ServerName string    `json:"server_name,omitempty"`
+	Outbound   string    `json:"outbound,omitempty"`
+	Start      time.Time `json:"start"`
+	// JA4 is the fingerprint of the TLS ClientHello if recorded.
+	JA4 string `json:"ja4,omitempty"`
+}
+
+// Ban is ...
+type Ban struct {
+	Key    string     `json:"key"`
+	Reason string     `json:"reason,omitempty"`
+	Start  time.Time  `json:"start"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// Observation is a connection of a user.
+type Observation struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	ASN       uint      `json:"asn,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Latitude  float64   `json:"latitude,omitempty"`
+	Longitude float64   `json:"longitude,omitempty"`
+}
+
+// SharingFlag is a user suspected of credential sharing with evidence.
+type SharingFlag struct {
+	ID        string    `json:"id"`
+	Reasons   []string  `json:"reasons"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+	IPs       []string  `json:"ips,omitempty"`
+	ASNs      []uint    `json:"asns,omitempty"`
+	Countries []string  `json:"countries,omitempty"`
+	Travel    *struct {
+		From     Observation `json:"from"`
+		To       Observation `json:"to"`
+		Distance float64     `json:"distance"`
+		Speed    float64     `json:"speed"`
+	} `json:"travel,omitempty"`
+}
+
+// ScanEvent is a user crossing the thresholds of scanning detection with
+// the counts within the window.
+type ScanEvent struct {
+	ID          string     `json:"id"`
+	Action      string     `json:"action"`
+	Reasons     []string   `json:"reasons"`
+	Time        time.Time  `json:"time"`
+	Until       *time.Time `json:"until,omitempty"`
+	Connections int        `json:"connections"`
+	Hosts       int        `json:"hosts"`
+	Ports       int        `json:"ports"`
+	Failures    int        `json:"failures"`
+}
+
+// Scanning is the users throttled or blocked for scanning and recent
+// events.
+type Scanning struct {
+	Penalties []ScanEvent `json:"penalties"`
+	Events    []ScanEvent `json:"events"`
+}
+
+// EgressRecord is an outbound socket of a session.
+type EgressRecord struct {
+	Network string `json:"network"`
+	// Local is the egress address of the socket.
+	Local string `json:"local"`
+	// Remote is empty for UDP sockets.
+	Remote string    `json:"remote,omitempty"`
+	Start  time.Time `json:"start"`
+	// End is nil if the socket was open when the record was written.
+	End          *time.Time `json:"end,omitempty"`
+	Key          string     `json:"key"`
+	Client       string     `json:"client"`
+	Transport    string     `json:"transport"`
+	SessionStart time.Time  `json:"session_start"`
+}
+
+// EgressQuery selects outbound sockets open on an egress address at a
+// time.
+type EgressQuery struct {
+	// Addr is IP:port, IP or :port of the egress address.
+	Addr string
+	// Remote is IP:port, IP or :port of the remote address, empty for any.
+	Remote string
+	// At is the time of the report, zero for now.
+	At time.Time
+	// Slack extends At to [At-Slack, At+Slack].
+	Slack time.Duration
+}
+
+// Fingerprint is a TLS ClientHello fingerprint seen in sessions of a user.
+type Fingerprint struct {
+	// JA3 is the MD5 hash of JA3Raw.
+	JA3        string    `json:"ja3"`
+	JA3Raw     string    `json:"ja3_raw"`
+	JA4        string    `json:"ja4"`
+	ServerName string    `json:"server_name,omitempty"`
+	ALPN       []string  `json:"alpn,omitempty"`
+	Sessions   int64     `json:"sessions"`
+	First      time.Time `json:"first"`
+	Last       time.Time `json:"last"`
+}
+
+// FingerprintSummary is a fingerprint aggregated over all users.
+type FingerprintSummary struct {
+	JA3      string `json:"ja3"`
+	JA4      string `json:"ja4"`
+	Sessions int64  `json:"sessions"`
+	Users    int    `json:"users"`
+}
+
+// BanRequest bans the user of Key, or of Password if Key is empty.
+type BanRequest struct {
+	Key      string `json:"key,omitempty"`
+	Password string `json:"password,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// Duration is the length of the ban, 0 for a permanent ban.
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Drain is the maintenance state of the node.
+type Drain struct {
+	Draining bool       `json:"draining"`
+	Mode     string     `json:"mode,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Sessions is the number of live sessions.
+	Sessions int `json:"sessions"`
+}
+
+// DrainRequest stops accepting new sessions.
+type DrainRequest struct {
+	// Mode is fallback or reject, default is fallback.
+	Mode string `json:"mode,omitempty"`
+	// Deadline is when live sessions are closed, 0 waits for them to
+	// finish.
+	Deadline time.Duration `json:"deadline,omitempty"`
+}
+
+// Client is ...
+type Client struct {
+	// BaseURL is the address of the Caddy admin endpoint.
+	BaseURL string
+	// HTTPClient is used to send requests, nil for http.DefaultClient.
+	HTTPClient *http.Client
+	// Token is the bearer token sent with requests.
+	Token string
+}
+
+// New is ...
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// Users lists users and their traffic.
+func (c *Client) Users(ctx context.Context) ([]User, error) {
+	users := []User{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/users", nil, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// AddUser is ...
+func (c *Client) AddUser(ctx context.Context, password string) error {
+	return c.do(ctx, http.MethodPost, "/trojan/users/add", map[string]string{"password": password}, nil)
+}
+
+// DeleteUser is ...
+func (c *Client) DeleteUser(ctx context.Context, password string) error {
+	return c.do(ctx, http.MethodDelete, "/trojan/users/delete", map[string]string{"password": password}, nil)
+}
+
+// Traffic returns the total traffic of all users.
+func (c *Client) Traffic(ctx context.Context) (Traffic, error) {
+	return c.UserTraffic(ctx, "")
+}
+
+// UserTraffic returns the traffic of the user of key.
+func (c *Client) UserTraffic(ctx context.Context, key string) (Traffic, error) {
+	traffic := Traffic{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/traffic"+keyQuery(key), nil, &traffic); err != nil {
+		return Traffic{}, err
+	}
+	return traffic, nil
+}
+
+// Sessions lists live sessions, key filters sessions of a user if not empty.
+func (c *Client) Sessions(ctx context.Context, key string) ([]Session, error) {
+	list := []Session{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/sessions"+keyQuery(key), nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// TerminateSessions terminates live sessions of the user of key, or only
+// the one from remoteAddr if not empty, and returns the number of them.
+func (c *Client) TerminateSessions(ctx context.Context, key, remoteAddr string) (int, error) {
+	req := map[string]string{"key": key}
+	if remoteAddr != "" {
+		req["remote_addr"] = remoteAddr
+	}
+	resp := struct {
+		Terminated int `json:"terminated"`
+	}{}
+	if err := c.do(ctx, http.MethodPost, "/trojan/sessions/terminate", req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Terminated, nil
+}
+
+// Bans lists bans in effect.
+func (c *Client) Bans(ctx context.Context) ([]Ban, error) {
+	list := []Ban{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/bans", nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Ban bans a user and terminates its live sessions.
+func (c *Client) Ban(ctx context.Context, req BanRequest) (Ban, error) {
+	ban := Ban{}
+	if err := c.do(ctx, http.MethodPost, "/trojan/bans/add", req, &ban); err != nil {
+		return Ban{}, err
+	}
+	return ban, nil
+}
+
+// Unban lifts the ban of the user of key.
+func (c *Client) Unban(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, "/trojan/bans/delete", map[string]string{"key": key}, nil)
+}
+
+// DrainStatus returns the maintenance state of the node.
+func (c *Client) DrainStatus(ctx context.Context) (Drain, error) {
+	dr := Drain{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/drain", nil, &dr); err != nil {
+		return Drain{}, err
+	}
+	return dr, nil
+}
+
+// StartDrain stops accepting new sessions while live sessions finish.
+func (c *Client) StartDrain(ctx context.Context, req DrainRequest) (Drain, error) {
+	dr := Drain{}
+	if err := c.do(ctx, http.MethodPost, "/trojan/drain/start", req, &dr); err != nil {
+		return Drain{}, err
+	}
+	return dr, nil
+}
+
+// StopDrain accepts new sessions again.
+func (c *Client) StopDrain(ctx context.Context) (Drain, error) {
+	dr := Drain{}
+	if err := c.do(ctx, http.MethodPost, "/trojan/drain/stop", nil, &dr); err != nil {
+		return Drain{}, err
+	}
+	return dr, nil
+}
+
+// SharingFlags lists users suspected of credential sharing.
+func (c *Client) SharingFlags(ctx context.Context) ([]SharingFlag, error) {
+	list := []SharingFlag{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/sharing", nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ClearSharingFlag clears the credential sharing flag of the user of key.
+func (c *Client) ClearSharingFlag(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, "/trojan/sharing/delete", map[string]string{"key": key}, nil)
+}
+
+// Scanning lists users throttled or blocked for scanning and recent events.
+func (c *Client) Scanning(ctx context.Context) (Scanning, error) {
+	sc := Scanning{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/scanning", nil, &sc); err != nil {
+		return Scanning{}, err
+	}
+	return sc, nil
+}
+
+// ClearScanning lifts the throttling or blocking of the user of key.
+func (c *Client) ClearScanning(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, "/trojan/scanning/delete", map[string]string{"key": key}, nil)
+}
+
+// Egress lists outbound sockets of users matching q, which answers which
+// user owned an egress address at a time.
+func (c *Client) Egress(ctx context.Context, q EgressQuery) ([]EgressRecord, error) {
+	v := url.Values{"addr": {q.Addr}}
+	if q.Remote != "" {
+		v.Set("remote", q.Remote)
+	}
+	if !q.At.IsZero() {
+		v.Set("at", q.At.Format(time.RFC3339))
+	}
+	if q.Slack > 0 {
+		v.Set("slack", q.Slack.String())
+	}
+	list := []EgressRecord{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/egress?"+v.Encode(), nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Fingerprints lists TLS ClientHello fingerprints aggregated over all
+// users.
+func (c *Client) Fingerprints(ctx context.Context) ([]FingerprintSummary, error) {
+	list := []FingerprintSummary{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/fingerprints", nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// UserFingerprints lists TLS ClientHello fingerprints of the user of key.
+func (c *Client) UserFingerprints(ctx context.Context, key string) ([]Fingerprint, error) {
+	list := []Fingerprint{}
+	if err := c.do(ctx, http.MethodGet, "/trojan/users/fingerprints"+keyQuery(key), nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// RewrapResult is the number of records written again and of records
+// still not encrypted.
+type RewrapResult struct {
+	Rewrapped int `json:"rewrapped"`
+	Plaintext int `json:"plaintext"`
+}
+
+// Rewrap encrypts user records with the primary encryption key.
+func (c *Client) Rewrap(ctx context.Context) (RewrapResult, error) {
+	resp := RewrapResult{}
+	if err := c.do(ctx, http.MethodPost, "/trojan/users/rewrap", nil, &resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// keyQuery is ...
+func keyQuery(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "?key=" + url.QueryEscape(key)
+}
+
+// do sends a request with the JSON body of in and decodes the response
+// into out if not nil
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	body := io.Reader(nil)
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(base, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(b, &msg) != nil || msg.Error == "" {
+			msg.Error = strings.TrimSpace(string(b))
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: msg.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
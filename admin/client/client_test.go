@@ -0,0 +1,273 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/admin"
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// newServer serves the routes of the trojan admin api, errors are written
+// like the admin endpoint of caddy
+func newServer(t *testing.T) (*Client, *app.App) {
+	u := &app.MemoryUpstream{}
+	if err := u.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	u.Add("pass0")
+	u.Add("pass1")
+	a := app.NewApp(u, &app.NoProxy{}, zap.NewNop())
+	al := &admin.Admin{Upstream: a.Upstream(), App: a}
+
+	mux := http.NewServeMux()
+	for _, route := range al.Routes() {
+		h := route.Handler
+		mux.HandleFunc(route.Pattern, func(w http.ResponseWriter, r *http.Request) {
+			err := h.ServeHTTP(w, r)
+			if err == nil {
+				return
+			}
+			apiErr, ok := err.(caddy.APIError)
+			if !ok {
+				apiErr = caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+			}
+			apiErr.Message = apiErr.Err.Error()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(apiErr.HTTPStatus)
+			json.NewEncoder(w).Encode(apiErr)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return New(srv.URL), a
+}
+
+func genKey(password string) string {
+	b := [trojan.HeaderLen]byte{}
+	trojan.GenKey(password, b[:])
+	return string(b[:])
+}
+
+func TestClient(t *testing.T) {
+	c, a := newServer(t)
+	ctx := context.Background()
+	key0, key1 := genKey("pass0"), genKey("pass1")
+
+	// users and traffic
+	if err := c.AddUser(ctx, "pass2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteUser(ctx, "pass2"); err != nil {
+		t.Fatal(err)
+	}
+	a.Upstream().Consume(key0, 3, 4)
+	users, err := c.Users(ctx)
+	if err != nil || len(users) != 2 {
+		t.Fatalf("users error: %v %v", users, err)
+	}
+	if tr, err := c.Traffic(ctx); err != nil || tr != (Traffic{Users: 2, Up: 3, Down: 4}) {
+		t.Fatalf("traffic error: %v %v", tr, err)
+	}
+	if tr, err := c.UserTraffic(ctx, key1); err != nil || tr != (Traffic{Users: 1}) {
+		t.Fatalf("user traffic error: %v %v", tr, err)
+	}
+	if _, err := c.UserTraffic(ctx, genKey("pass2")); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("unknown user traffic error: %v", err)
+	}
+
+	// sessions
+	closed := make(map[string]bool)
+	for i, key := range []string{key0, key0, key1} {
+		s := app.NewSession(key, app.TransportTLS, fmt.Sprintf("1.2.3.4:%d", i), "example.com")
+		a.Sessions().Add(s, closerFunc(func() { closed[s.RemoteAddr] = true }))
+		defer a.Sessions().Remove(s)
+	}
+	if list, err := c.Sessions(ctx, ""); err != nil || len(list) != 3 {
+		t.Fatalf("sessions error: %v %v", list, err)
+	}
+	list, err := c.Sessions(ctx, key0)
+	if err != nil || len(list) != 2 || list[0].Key != key0 || list[0].Transport != app.TransportTLS || list[0].ServerName != "example.com" {
+		t.Fatalf("user sessions error: %v %v", list, err)
+	}
+	if n, err := c.TerminateSessions(ctx, key0, "1.2.3.4:1"); err != nil || n != 1 || !closed["1.2.3.4:1"] || closed["1.2.3.4:0"] {
+		t.Fatalf("terminate session error: %v %v %v", n, err, closed)
+	}
+	if _, err := c.TerminateSessions(ctx, "", ""); !isStatus(err, http.StatusBadRequest) {
+		t.Fatalf("terminate without key error: %v", err)
+	}
+
+	// bans
+	ban, err := c.Ban(ctx, BanRequest{Password: "pass1", Reason: "abuse", Duration: time.Hour})
+	if err != nil || ban.Key != key1 || ban.Reason != "abuse" || ban.Until == nil {
+		t.Fatalf("ban error: %v %v", ban, err)
+	}
+	if !closed["1.2.3.4:2"] {
+		t.Fatal("sessions of banned user are not terminated")
+	}
+	if a.Upstream().Validate(key1) {
+		t.Fatal("banned user is valid")
+	}
+	if ban, err := c.Ban(ctx, BanRequest{Key: key0}); err != nil || ban.Until != nil {
+		t.Fatalf("permanent ban error: %v %v", ban, err)
+	}
+	bans, err := c.Bans(ctx)
+	if err != nil || len(bans) != 2 || bans[0].Key != key1 || bans[1].Key != key0 {
+		t.Fatalf("bans error: %v %v", bans, err)
+	}
+	if err := c.Unban(ctx, key1); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Upstream().Validate(key1) {
+		t.Fatal("unbanned user is invalid")
+	}
+	if err := c.Unban(ctx, key1); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("unban error: %v", err)
+	}
+
+	// scanning detection is not configured
+	if sc, err := c.Scanning(ctx); err != nil || sc.Penalties == nil || len(sc.Events) != 0 {
+		t.Fatalf("scanning error: %+v %v", sc, err)
+	}
+	if err := c.ClearScanning(ctx, key0); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("clear scanning error: %v", err)
+	}
+
+	// egress records are not configured
+	if _, err := c.Egress(ctx, EgressQuery{Addr: "192.0.2.1:443"}); !isStatus(err, http.StatusBadRequest) {
+		t.Fatalf("egress error: %v", err)
+	}
+
+	// the memory upstream does not encrypt records
+	if _, err := c.Rewrap(ctx); !isStatus(err, http.StatusBadRequest) {
+		t.Fatalf("rewrap error: %v", err)
+	}
+
+	// maintenance
+	health := func() int {
+		resp, err := http.Get(c.BaseURL + "/trojan/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if _, err := c.StartDrain(ctx, DrainRequest{Mode: "pause"}); !isStatus(err, http.StatusBadRequest) {
+		t.Fatalf("drain with unknown mode error: %v", err)
+	}
+	dr, err := c.StartDrain(ctx, DrainRequest{Mode: app.DrainReject})
+	if err != nil || !dr.Draining || dr.Mode != app.DrainReject || dr.Deadline != nil || dr.Sessions != 3 {
+		t.Fatalf("drain error: %+v %v", dr, err)
+	}
+	if code := health(); code != http.StatusServiceUnavailable {
+		t.Fatalf("health of draining node error: %v", code)
+	}
+	if dr, err := c.DrainStatus(ctx); err != nil || !dr.Draining || dr.Since == nil {
+		t.Fatalf("drain status error: %+v %v", dr, err)
+	}
+	if dr, err := c.StopDrain(ctx); err != nil || dr.Draining {
+		t.Fatalf("stop drain error: %+v %v", dr, err)
+	}
+	if code := health(); code != http.StatusOK {
+		t.Fatalf("health error: %v", code)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	c, _ := newServer(t)
+
+	resp, err := http.Get(c.BaseURL + "/trojan/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+
+	doc := struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}{}
+	if err := json.Unmarshal(b, &doc); err != nil || !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("openapi document error: %v %v", doc.OpenAPI, err)
+	}
+	for _, route := range (&admin.Admin{}).Routes() {
+		if len(doc.Paths[route.Pattern]) == 0 {
+			t.Errorf("route %v is not described", route.Pattern)
+		}
+	}
+	if len(doc.Paths) != len((&admin.Admin{}).Routes()) {
+		t.Errorf("paths error: %v", len(doc.Paths))
+	}
+}
+
+func TestResellerAPI(t *testing.T) {
+	c, a := newServer(t)
+
+	// routes of resellers are not served by the admin endpoint
+	resp, err := http.Get(c.BaseURL + "/trojan/reseller/usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("admin endpoint status error: %v", resp.StatusCode)
+	}
+
+	m := &admin.ResellerAPI{App: a}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusTeapot)
+			return nil
+		}))
+	}))
+	defer srv.Close()
+
+	for _, v := range []struct {
+		path, token string
+		status      int
+	}{
+		{"/trojan/reseller/usage", "", http.StatusUnauthorized},
+		{"/trojan/reseller/users", "invalid", http.StatusUnauthorized},
+		{"/trojan/users", "", http.StatusTeapot},
+		{"/config/", "", http.StatusTeapot},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+v.path, nil)
+		if v.token != "" {
+			req.Header.Set("Authorization", "Bearer "+v.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != v.status {
+			t.Errorf("get %v status error: %v", v.path, resp.StatusCode)
+		}
+	}
+}
+
+func isStatus(err error, code int) bool {
+	e := (*Error)(nil)
+	return errors.As(err, &e) && e.StatusCode == code
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,130 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// DrainInfo is the maintenance state of the node.
+type DrainInfo struct {
+	Draining bool       `json:"draining"`
+	Mode     string     `json:"mode,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Sessions is the number of live sessions.
+	Sessions int `json:"sessions"`
+}
+
+// NewDrainInfo is ...
+func NewDrainInfo(ss *app.Sessions) DrainInfo {
+	info := DrainInfo{Sessions: ss.Len()}
+	if dr, ok := ss.Draining(); ok {
+		info.Draining, info.Mode, info.Since = true, dr.Mode, &dr.Since
+		if !dr.Deadline.IsZero() {
+			info.Deadline = &dr.Deadline
+		}
+	}
+	return info
+}
+
+// GetDrain returns the maintenance state and the number of remaining
+// sessions.
+func (al *Admin) GetDrain(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan drain method error")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(NewDrainInfo(al.App.Sessions()))
+	return nil
+}
+
+// StartDrain stops accepting new sessions while live sessions finish,
+// which are closed after the deadline if it is not 0.
+func (al *Admin) StartDrain(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodPost {
+		return errors.New("start trojan drain method error")
+	}
+
+	type Request struct {
+		Mode     string         `json:"mode,omitempty"`
+		Deadline caddy.Duration `json:"deadline,omitempty"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req := Request{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			return err
+		}
+	}
+	if _, err := al.App.Sessions().Drain(req.Mode, time.Duration(req.Deadline)); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(NewDrainInfo(al.App.Sessions()))
+	return nil
+}
+
+// StopDrain accepts new sessions again.
+func (al *Admin) StopDrain(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodPost {
+		return errors.New("stop trojan drain method error")
+	}
+
+	al.App.Sessions().Resume()
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(NewDrainInfo(al.App.Sessions()))
+	return nil
+}
+
+// GetHealth reports whether the node accepts new sessions, it responds
+// 503 while the node is draining so load balancers move new clients to
+// other nodes.
+func (al *Admin) GetHealth(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan health method error")
+	}
+
+	type Response struct {
+		Status   string `json:"status"`
+		Sessions int    `json:"sessions"`
+	}
+
+	resp, code := Response{Status: "ok", Sessions: al.App.Sessions().Len()}, http.StatusOK
+	if _, ok := al.App.Sessions().Draining(); ok {
+		resp.Status, code = "draining", http.StatusServiceUnavailable
+	}
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+	return nil
+}
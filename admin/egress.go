@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// GetEgress lists outbound sockets of users which were open on an egress
+// address at a time, for abuse reports.
+func (al *Admin) GetEgress(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan egress method error")
+	}
+
+	query := r.URL.Query()
+	q := app.EgressQuery{Local: query.Get("addr"), Remote: query.Get("remote"), At: time.Now()}
+	if q.Local == "" {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: errors.New("missing addr")}
+	}
+	if v := query.Get("at"); v != "" {
+		at, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		q.At = at
+	}
+	if v := query.Get("slack"); v != "" {
+		d, err := caddy.ParseDuration(v)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		q.Slack = d
+	}
+
+	records, err := al.App.Egress.Query(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, app.ErrEgressDisabled) || errors.Is(err, app.ErrEgressQuery) {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		return err
+	}
+
+	list := make([]app.EgressRecord, 0)
+	list = append(list, records...)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+	return nil
+}
@@ -0,0 +1,46 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// GetFingerprints lists TLS ClientHello fingerprints aggregated over all
+// users.
+func (al *Admin) GetFingerprints(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan fingerprints method error")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(al.App.Fingerprints().Summary())
+	return nil
+}
+
+// GetUserFingerprints lists TLS ClientHello fingerprints of the user of
+// the key query.
+func (al *Admin) GetUserFingerprints(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan user fingerprints method error")
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: errors.New("missing key")}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(al.App.Fingerprints().User(key))
+	return nil
+}
@@ -0,0 +1,24 @@
+package admin
+
+import (
+	_ "embed"
+	"errors"
+	"net/http"
+)
+
+// OpenAPI is the OpenAPI document of the /trojan/* routes.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// GetOpenAPI serves the OpenAPI document.
+func (al *Admin) GetOpenAPI(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan openapi method error")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(OpenAPI)
+	return nil
+}
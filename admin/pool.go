@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// PoolInfo is ...
+type PoolInfo struct {
+	Name    string                `json:"name"`
+	Usage   int64                 `json:"usage"`
+	Quota   int64                 `json:"quota,omitempty"`
+	Members []app.PoolMemberUsage `json:"members"`
+}
+
+// GetPools lists quota pools with the usage of their members.
+func (al *Admin) GetPools(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan pools method error")
+	}
+
+	list := make([]PoolInfo, 0, len(al.App.Pools))
+	for _, p := range al.App.Pools {
+		info := PoolInfo{Name: p.Name, Usage: p.Usage(), Quota: p.Quota, Members: []app.PoolMemberUsage{}}
+		p.Range(func(v app.PoolMemberUsage) {
+			info.Members = append(info.Members, v)
+		})
+		list = append(list, info)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+	return nil
+}
+
+// ResetPool clears the usage of a quota pool.
+func (al *Admin) ResetPool(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodPost {
+		return errors.New("reset trojan pool method error")
+	}
+
+	type Pool struct {
+		Name string `json:"name"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	pool := Pool{}
+	if err := json.Unmarshal(b, &pool); err != nil {
+		return err
+	}
+	p := al.App.Pool(pool.Name)
+	if p == nil {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.New("pool not found")}
+	}
+	if err := p.Reset(); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,287 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// ResellerAPI serves the routes of resellers, authenticated by reseller
+// tokens, in an HTTP server, so that resellers do not reach the admin
+// endpoint.
+type ResellerAPI struct {
+	// App is ...
+	App *app.App `json:"-"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (ResellerAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.trojan_reseller",
+		New: func() caddy.Module { return new(ResellerAPI) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *ResellerAPI) Provision(ctx caddy.Context) error {
+	ctx.App(app.CaddyAppID)
+	if _, err := ctx.AppIfConfigured(app.CaddyAppID); err != nil {
+		return fmt.Errorf("trojan reseller configure error: %w", err)
+	}
+	mod, err := ctx.App(app.CaddyAppID)
+	if err != nil {
+		return err
+	}
+	m.App = mod.(*app.App)
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (m *ResellerAPI) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	al := &Admin{Upstream: m.App.Upstream(), App: m.App}
+	for _, route := range al.ResellerRoutes() {
+		if route.Pattern != r.URL.Path {
+			continue
+		}
+		err := route.Handler.ServeHTTP(w, r)
+		if err == nil {
+			return nil
+		}
+		// errors are written like the admin endpoint of caddy
+		apiErr, ok := err.(caddy.APIError)
+		if !ok {
+			apiErr = caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+		apiErr.Message = apiErr.Err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apiErr.HTTPStatus)
+		return json.NewEncoder(w).Encode(apiErr)
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// UnmarshalCaddyfile unmarshals Caddyfile tokens into m.
+func (m *ResellerAPI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// ResellerRoutes returns the routes of resellers.
+func (al *Admin) ResellerRoutes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/trojan/reseller/users",
+			Handler: caddy.AdminHandlerFunc(al.GetResellerUsers),
+		},
+		{
+			Pattern: "/trojan/reseller/users/add",
+			Handler: caddy.AdminHandlerFunc(al.AddResellerUser),
+		},
+		{
+			Pattern: "/trojan/reseller/users/delete",
+			Handler: caddy.AdminHandlerFunc(al.DeleteResellerUser),
+		},
+		{
+			Pattern: "/trojan/reseller/usage",
+			Handler: caddy.AdminHandlerFunc(al.GetResellerUsage),
+		},
+	}
+}
+
+// ResellerInfo is ...
+type ResellerInfo struct {
+	Name     string `json:"name"`
+	Users    int    `json:"users"`
+	MaxUsers int    `json:"max_users,omitempty"`
+	Usage    int64  `json:"usage"`
+	Quota    int64  `json:"quota,omitempty"`
+}
+
+// NewResellerInfo is ...
+func NewResellerInfo(r *app.Reseller) ResellerInfo {
+	return ResellerInfo{
+		Name:     r.Name,
+		Users:    r.Count(),
+		MaxUsers: r.MaxUsers,
+		Usage:    r.Usage(),
+		Quota:    r.Quota,
+	}
+}
+
+// reseller authenticates the request with the reseller bearer token
+func (al *Admin) reseller(r *http.Request) (*app.Reseller, error) {
+	if al.App == nil {
+		return nil, caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.New("trojan app is not configured")}
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, caddy.APIError{HTTPStatus: http.StatusUnauthorized, Err: errors.New("missing reseller token")}
+	}
+	rs := al.App.Reseller(token)
+	if rs == nil {
+		return nil, caddy.APIError{HTTPStatus: http.StatusUnauthorized, Err: errors.New("invalid reseller token")}
+	}
+	return rs, nil
+}
+
+// GetResellers lists all resellers and their aggregate usage.
+func (al *Admin) GetResellers(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan resellers method error")
+	}
+
+	list := make([]ResellerInfo, 0, len(al.App.Resellers))
+	for _, v := range al.App.Resellers {
+		list = append(list, NewResellerInfo(v))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+	return nil
+}
+
+// GetResellerUsers lists users owned by the reseller of the token.
+func (al *Admin) GetResellerUsers(w http.ResponseWriter, r *http.Request) error {
+	rs, err := al.reseller(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan user method error")
+	}
+
+	type User struct {
+		Key  string `json:"key"`
+		Up   int64  `json:"up"`
+		Down int64  `json:"down"`
+	}
+
+	users := make([]User, 0)
+	rs.Range(func(key string, up, down int64) {
+		users = append(users, User{Key: key, Up: up, Down: down})
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+	return nil
+}
+
+// AddResellerUser adds a user owned by the reseller of the token.
+func (al *Admin) AddResellerUser(w http.ResponseWriter, r *http.Request) error {
+	rs, err := al.reseller(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method != http.MethodPost {
+		return errors.New("add trojan user method error")
+	}
+
+	type User struct {
+		Password string `json:"password,omitempty"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	user := User{}
+	if err := json.Unmarshal(b, &user); err != nil {
+		return err
+	}
+	if user.Password != "" {
+		if err := rs.Add(user.Password); err != nil {
+			return resellerError(err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// DeleteResellerUser deletes a user owned by the reseller of the token.
+func (al *Admin) DeleteResellerUser(w http.ResponseWriter, r *http.Request) error {
+	rs, err := al.reseller(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method != http.MethodDelete {
+		return errors.New("delete trojan user method error")
+	}
+
+	type User struct {
+		Password string `json:"password,omitempty"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	user := User{}
+	if err := json.Unmarshal(b, &user); err != nil {
+		return err
+	}
+	if user.Password != "" {
+		if err := rs.Delete(user.Password); err != nil {
+			return resellerError(err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// GetResellerUsage returns the aggregate usage of the reseller of the token.
+func (al *Admin) GetResellerUsage(w http.ResponseWriter, r *http.Request) error {
+	rs, err := al.reseller(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan reseller usage method error")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(NewResellerInfo(rs))
+	return nil
+}
+
+// resellerError is ...
+func resellerError(err error) error {
+	switch {
+	case errors.Is(err, app.ErrUserExists):
+		return caddy.APIError{HTTPStatus: http.StatusConflict, Err: err}
+	case errors.Is(err, app.ErrUserNotOwned):
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: err}
+	case errors.Is(err, app.ErrUserLimit):
+		return caddy.APIError{HTTPStatus: http.StatusForbidden, Err: err}
+	}
+	return err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*ResellerAPI)(nil)
+	_ caddyhttp.MiddlewareHandler = (*ResellerAPI)(nil)
+	_ caddyfile.Unmarshaler       = (*ResellerAPI)(nil)
+)
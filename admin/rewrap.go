@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// Rewrap encrypts user records with the primary encryption key after a
+// key rotation.
+func (al *Admin) Rewrap(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodPost {
+		return errors.New("rewrap trojan users method error")
+	}
+
+	res, err := al.App.Rewrap(r.Context())
+	if errors.Is(err, app.ErrEncryptionDisabled) {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+	return nil
+}
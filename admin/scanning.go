@@ -0,0 +1,72 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// GetScanning lists users throttled or blocked for scanning and recent
+// events.
+func (al *Admin) GetScanning(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan scanning method error")
+	}
+
+	type Response struct {
+		Penalties []app.ScanEvent `json:"penalties"`
+		Events    []app.ScanEvent `json:"events"`
+	}
+
+	resp := Response{Penalties: make([]app.ScanEvent, 0), Events: make([]app.ScanEvent, 0)}
+	resp.Penalties = append(resp.Penalties, al.App.Scanning.Penalties()...)
+	resp.Events = append(resp.Events, al.App.Scanning.Events()...)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	return nil
+}
+
+// DeleteScanning lifts the throttling or blocking of a user.
+func (al *Admin) DeleteScanning(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodDelete {
+		return errors.New("delete trojan scanning method error")
+	}
+
+	type Request struct {
+		Key      string `json:"key,omitempty"`
+		Password string `json:"password,omitempty"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req := Request{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	key, err := userKey(req.Key, req.Password)
+	if err != nil {
+		return err
+	}
+	if !al.App.Scanning.Clear(key) {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.New("penalty not found")}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
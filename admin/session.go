@@ -0,0 +1,150 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// errTerminated is the reason of sessions terminated by the admin api
+var errTerminated = errors.New("terminated by admin")
+
+// SessionInfo is ...
+type SessionInfo struct {
+	Key        string    `json:"key"`
+	Transport  string    `json:"transport"`
+	RemoteAddr string    `json:"remote_addr"`
+	ServerName string    `json:"server_name,omitempty"`
+	Outbound   string    `json:"outbound,omitempty"`
+	Start      time.Time `json:"start"`
+	// JA4 is the fingerprint of the TLS ClientHello if recorded.
+	JA4 string `json:"ja4,omitempty"`
+}
+
+// Traffic is ...
+type Traffic struct {
+	Users int   `json:"users"`
+	Up    int64 `json:"up"`
+	Down  int64 `json:"down"`
+}
+
+// GetTraffic returns the total traffic of all users, or of the user of
+// the key query.
+func (al *Admin) GetTraffic(w http.ResponseWriter, r *http.Request) error {
+	if al.Upstream == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan traffic method error")
+	}
+
+	key := r.URL.Query().Get("key")
+	traffic := Traffic{}
+	al.Upstream.Range(func(k string, up, down int64) {
+		if key != "" && k != key {
+			return
+		}
+		traffic.Users++
+		traffic.Up += up
+		traffic.Down += down
+	})
+	if key != "" && traffic.Users == 0 {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.New("user not found")}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(traffic)
+	return nil
+}
+
+// GetSessions lists live sessions, or sessions of the user of the key
+// query.
+func (al *Admin) GetSessions(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan sessions method error")
+	}
+
+	key := r.URL.Query().Get("key")
+	list := make([]SessionInfo, 0)
+	al.App.Sessions().Range(func(s *app.Session) bool {
+		if key == "" || s.Key == key {
+			info := SessionInfo{
+				Key:        s.Key,
+				Transport:  s.Transport,
+				RemoteAddr: s.RemoteAddr,
+				ServerName: s.ServerName,
+				Outbound:   s.Outbound,
+				Start:      s.Start,
+			}
+			if s.Fingerprint != nil {
+				info.JA4 = s.Fingerprint.JA4
+			}
+			list = append(list, info)
+		}
+		return true
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+	return nil
+}
+
+// TerminateSessions terminates live sessions of a user, or only the one
+// from remote_addr.
+func (al *Admin) TerminateSessions(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodPost {
+		return errors.New("terminate trojan sessions method error")
+	}
+
+	type Request struct {
+		Key        string `json:"key,omitempty"`
+		Password   string `json:"password,omitempty"`
+		RemoteAddr string `json:"remote_addr,omitempty"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req := Request{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	key, err := userKey(req.Key, req.Password)
+	if err != nil {
+		return err
+	}
+
+	type Response struct {
+		Terminated int `json:"terminated"`
+	}
+
+	resp := Response{}
+	ss := al.App.Sessions()
+	ss.Range(func(s *app.Session) bool {
+		if s.Key == key && (req.RemoteAddr == "" || s.RemoteAddr == req.RemoteAddr) {
+			ss.Terminate(s, errTerminated)
+			resp.Terminated++
+		}
+		return true
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+	return nil
+}
@@ -0,0 +1,66 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+// GetSharing lists users suspected of credential sharing with evidence.
+func (al *Admin) GetSharing(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return errors.New("get trojan sharing method error")
+	}
+
+	list := make([]app.SharingFlag, 0)
+	list = append(list, al.App.Sharing.Flags()...)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+	return nil
+}
+
+// DeleteSharing clears the flag of a user, such as after its password is
+// changed.
+func (al *Admin) DeleteSharing(w http.ResponseWriter, r *http.Request) error {
+	if al.App == nil {
+		return nil
+	}
+
+	if r.Method != http.MethodDelete {
+		return errors.New("delete trojan sharing method error")
+	}
+
+	type Request struct {
+		Key      string `json:"key,omitempty"`
+		Password string `json:"password,omitempty"`
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	req := Request{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	key, err := userKey(req.Key, req.Password)
+	if err != nil {
+		return err
+	}
+	if !al.App.Sharing.Clear(key) {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.New("flag not found")}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
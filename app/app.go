@@ -1,10 +1,14 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
 )
 
 func init() {
@@ -22,10 +26,44 @@ type App struct {
 	ProxyRaw json.RawMessage `json:"proxy" caddy:"namespace=trojan.proxies inline_key=proxy"`
 	// Users is ...
 	Users []string `json:"users,omitempty"`
+	// Resellers is ...
+	Resellers []*Reseller `json:"resellers,omitempty"`
+	// Pools is ...
+	Pools []*Pool `json:"pools,omitempty"`
+	// Groups maps a group name to passwords of its users.
+	Groups map[string][]string `json:"groups,omitempty"`
+	// OutboundsRaw are named proxies which can be chosen by the policy.
+	OutboundsRaw map[string]json.RawMessage `json:"outbounds,omitempty" caddy:"namespace=trojan.proxies inline_key=proxy"`
+	// Policy is ...
+	Policy *Policy `json:"policy,omitempty"`
+	// Rewrites rewrite targets of trojan requests before dialing.
+	Rewrites []RewriteRule `json:"rewrites,omitempty"`
+	// RevalidateInterval is the interval of validating users of live
+	// sessions again, 0 disables revalidation.
+	RevalidateInterval caddy.Duration `json:"revalidate_interval,omitempty"`
+	// LDAP authenticates user:password credentials of HTTP based
+	// transports.
+	LDAP *LDAP `json:"ldap,omitempty"`
+	// Sharing flags users whose passwords are likely shared.
+	Sharing *Sharing `json:"sharing,omitempty"`
+	// Scanning throttles or blocks users scanning through the outbound.
+	Scanning *Scanning `json:"scanning,omitempty"`
+	// Egress records outbound sockets of users for abuse reports.
+	Egress *Egress `json:"egress,omitempty"`
+	// LocalSites serves targets which are sites of the http app of this
+	// caddy instance in-process instead of dialing them.
+	LocalSites bool `json:"local_sites,omitempty"`
 
 	lg *zap.Logger
 	up Upstream
 	px Proxy
+	rs *resellers
+	ps *pools
+	gs map[string][]string
+	ss *Sessions
+	bs *Bans
+	rw Rewrapper
+	fp *Fingerprints
 }
 
 // CaddyModule is ...
@@ -36,6 +74,18 @@ func (App) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// NewApp returns an App of users of up and proxy px, which is not loaded
+// from a caddy config.
+func NewApp(up Upstream, px Proxy, lg *zap.Logger) *App {
+	app := &App{lg: lg, px: px, bs: NewBans(), gs: make(map[string][]string)}
+	app.rw, _ = up.(Rewrapper)
+	app.up = &banUpstream{Upstream: up, bs: app.bs}
+	app.ss = NewSessions(app.up, nil, lg)
+	app.fp, _ = NewFingerprints(nil)
+	app.ss.fps = app.fp
+	return app
+}
+
 // Provision is ...
 func (app *App) Provision(ctx caddy.Context) error {
 	mod, err := ctx.LoadModule(app, "UpstreamRaw")
@@ -43,6 +93,7 @@ func (app *App) Provision(ctx caddy.Context) error {
 		return err
 	}
 	app.up = mod.(Upstream)
+	app.rw, _ = app.up.(Rewrapper)
 
 	mod, err = ctx.LoadModule(app, "ProxyRaw")
 	if err != nil {
@@ -50,22 +101,149 @@ func (app *App) Provision(ctx caddy.Context) error {
 	}
 	app.px = mod.(Proxy)
 
-	for _, v := range app.Users {
-		app.up.Add(v)
-	}
+	addAll(app.up, app.Users)
 
 	app.lg = ctx.Logger(app)
 
+	if len(app.Resellers) > 0 {
+		app.rs, err = newResellers(ctx.Storage(), app.Resellers, app.up, app.lg)
+		if err != nil {
+			return err
+		}
+		app.up = &resellerUpstream{Upstream: app.up, rs: app.rs}
+	}
+
+	if len(app.Pools) > 0 {
+		app.ps, err = newPools(ctx, app.Pools, app.up, app.lg)
+		if err != nil {
+			return err
+		}
+		app.up = &poolUpstream{Upstream: app.up, ps: app.ps}
+	}
+
+	if app.LDAP != nil {
+		if err := app.LDAP.Provision(app.lg); err != nil {
+			return err
+		}
+		app.up = &ldapUpstream{Upstream: app.up, ldap: app.LDAP}
+	}
+
+	app.bs, err = LoadBans(ctx.Storage(), app.lg)
+	if err != nil {
+		return err
+	}
+	app.up = &banUpstream{Upstream: app.up, bs: app.bs}
+
+	app.gs = make(map[string][]string)
+	for name, users := range app.Groups {
+		for _, v := range users {
+			b := [trojan.HeaderLen]byte{}
+			trojan.GenKey(v, b[:])
+			app.gs[string(b[:])] = append(app.gs[string(b[:])], name)
+		}
+	}
+
+	outbounds := make(map[string]Proxy)
+	if app.OutboundsRaw != nil {
+		mods, err := ctx.LoadModule(app, "OutboundsRaw")
+		if err != nil {
+			return err
+		}
+		for name, mod := range mods.(map[string]any) {
+			outbounds[name] = mod.(Proxy)
+		}
+	}
+	if app.Policy != nil {
+		if err := app.Policy.Provision(outbounds, app.UserAttributes, app.lg); err != nil {
+			return err
+		}
+		app.px = &policyProxy{Proxy: app.px, policy: app.Policy, outbounds: outbounds}
+	} else {
+		for _, v := range outbounds {
+			v.Close()
+		}
+	}
+
+	app.ss = NewSessions(app.up, app.Policy, app.lg)
+	app.ss.share()
+
+	app.fp, err = NewFingerprints(ctx.GetMetricsRegistry())
+	if err != nil {
+		return err
+	}
+	app.ss.fps = app.fp
+
+	if app.Sharing != nil {
+		if err := app.Sharing.Provision(app.Ban, app.lg); err != nil {
+			return err
+		}
+		app.ss.observe = app.Sharing.Observe
+	}
+
+	if app.Egress != nil {
+		if err := app.Egress.Provision(ctx, app.lg); err != nil {
+			return err
+		}
+		app.px = &egressProxy{Proxy: app.px, egress: app.Egress}
+	}
+
+	if app.Scanning != nil {
+		if err := app.Scanning.Provision(ctx.Storage(), app.lg); err != nil {
+			return err
+		}
+		app.px = &scanProxy{Proxy: app.px, sc: app.Scanning}
+	}
+
+	if app.LocalSites {
+		app.px = &localProxy{Proxy: app.px, sites: NewLocalSites(ctx, app.lg), policy: app.Policy}
+	}
+
+	if len(app.Rewrites) > 0 {
+		rw, err := NewRewriter(app.Rewrites, app.lg)
+		if err != nil {
+			return err
+		}
+		app.px = &rewriteProxy{Proxy: app.px, rw: rw}
+	}
+
 	return nil
 }
 
 // Start is ...
 func (app *App) Start() error {
+	if app.rs != nil {
+		app.rs.Start()
+	}
+	if app.ps != nil {
+		app.ps.Start()
+	}
+	if app.RevalidateInterval > 0 {
+		app.ss.Start(time.Duration(app.RevalidateInterval))
+	}
+	if app.Sharing != nil {
+		app.Sharing.Start()
+	}
+	if app.Egress != nil {
+		app.Egress.Start()
+	}
 	return nil
 }
 
 // Stop is ...
 func (app *App) Stop() error {
+	app.ss.Stop()
+	if app.rs != nil {
+		app.rs.Stop()
+	}
+	if app.ps != nil {
+		app.ps.Stop()
+	}
+	if app.Sharing != nil {
+		app.Sharing.Close()
+	}
+	if app.Egress != nil {
+		app.Egress.Stop()
+	}
 	return app.px.Close()
 }
 
@@ -74,11 +252,92 @@ func (app *App) Upstream() Upstream {
 	return app.up
 }
 
+// Sessions is ...
+func (app *App) Sessions() *Sessions {
+	return app.ss
+}
+
+// Bans is ...
+func (app *App) Bans() *Bans {
+	return app.bs
+}
+
+// Ban bans the user of key for d and terminates its live sessions, 0 bans
+// the user permanently.
+func (app *App) Ban(key, reason string, d time.Duration) Ban {
+	b := app.bs.Add(key, reason, d)
+	app.ss.Range(func(s *Session) bool {
+		if s.Key == key {
+			app.ss.Terminate(s, ErrUserBanned)
+		}
+		return true
+	})
+	return b
+}
+
+// Rewrap encrypts user records of the upstream with the primary key.
+func (app *App) Rewrap(ctx context.Context) (RewrapResult, error) {
+	if app.rw == nil {
+		return RewrapResult{}, ErrEncryptionDisabled
+	}
+	return app.rw.Rewrap(ctx)
+}
+
+// Fingerprints is ...
+func (app *App) Fingerprints() *Fingerprints {
+	return app.fp
+}
+
 // Proxy is ...
 func (app *App) Proxy() Proxy {
 	return app.px
 }
 
+// UserAttributes returns the attributes of a user seen by the policy.
+func (app *App) UserAttributes(key string) map[string]any {
+	attrs := map[string]any{
+		"key":      key,
+		"groups":   []string{},
+		"pool":     "",
+		"reseller": "",
+	}
+	if groups, ok := app.gs[key]; ok {
+		attrs["groups"] = groups
+	}
+	if groups := app.LDAP.UserGroups(key); len(groups) > 0 {
+		attrs["groups"] = groups
+	}
+	if app.ps != nil {
+		if p := app.ps.members[key]; p != nil {
+			attrs["pool"] = p.Name
+		}
+	}
+	if app.rs != nil {
+		if r := app.rs.owner(key); r != nil {
+			attrs["reseller"] = r.Name
+		}
+	}
+	return attrs
+}
+
+// Pool returns the quota pool of name or nil.
+func (app *App) Pool(name string) *Pool {
+	for _, p := range app.Pools {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Reseller returns the reseller of the admin token or nil.
+func (app *App) Reseller(token string) *Reseller {
+	if app.rs == nil || token == "" {
+		return nil
+	}
+	return app.rs.ByToken(token)
+}
+
 var (
 	_ caddy.App         = (*App)(nil)
 	_ caddy.Provisioner = (*App)(nil)
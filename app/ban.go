@@ -0,0 +1,190 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// BansKey is the storage key of the ban list, it must not be under the
+// prefix of CaddyUpstream.
+const BansKey = "trojan_bans"
+
+// ErrUserBanned is the reason of sessions terminated by a ban.
+var ErrUserBanned = errors.New("user is banned")
+
+// Ban rejects a user until it expires.
+type Ban struct {
+	// Key is hex(SHA224(password)) of the user
+	Key string
+	// Reason is ...
+	Reason string
+	// Start is ...
+	Start time.Time
+	// Until is the expiry of the ban, zero for a permanent ban.
+	Until time.Time
+}
+
+// Expired is ...
+func (b *Ban) Expired(now time.Time) bool {
+	return !b.Until.IsZero() && !now.Before(b.Until)
+}
+
+// banRecord is a ban in storage
+type banRecord struct {
+	Key    string     `json:"key"`
+	Reason string     `json:"reason,omitempty"`
+	Start  time.Time  `json:"start"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// Bans is the ban list of users, expired bans are removed lazily.
+type Bans struct {
+	mu sync.Mutex
+	m  map[string]*Ban
+
+	// storage keeps the list across reloads and restarts if not nil
+	storage certmagic.Storage
+	logger  *zap.Logger
+	// saving serializes saves
+	saving sync.Mutex
+}
+
+// NewBans returns an in-memory ban list.
+func NewBans() *Bans {
+	return &Bans{m: make(map[string]*Ban)}
+}
+
+// LoadBans returns the ban list kept in storage.
+func LoadBans(storage certmagic.Storage, lg *zap.Logger) (*Bans, error) {
+	bs := &Bans{m: make(map[string]*Ban), storage: storage, logger: lg}
+	b, err := storage.Load(context.Background(), BansKey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return bs, nil
+		}
+		return nil, err
+	}
+	records := []banRecord{}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, fmt.Errorf("load bans error: %w", err)
+	}
+	now := time.Now()
+	for _, v := range records {
+		ban := &Ban{Key: v.Key, Reason: v.Reason, Start: v.Start}
+		if v.Until != nil {
+			ban.Until = *v.Until
+		}
+		if !ban.Expired(now) {
+			bs.m[v.Key] = ban
+		}
+	}
+	return bs, nil
+}
+
+// save stores bans in effect
+func (bs *Bans) save() {
+	if bs.storage == nil {
+		return
+	}
+	bs.saving.Lock()
+	defer bs.saving.Unlock()
+
+	records := []banRecord{}
+	for _, v := range bs.List() {
+		r := banRecord{Key: v.Key, Reason: v.Reason, Start: v.Start}
+		if !v.Until.IsZero() {
+			r.Until = &v.Until
+		}
+		records = append(records, r)
+	}
+	b, err := json.Marshal(records)
+	if err == nil {
+		err = bs.storage.Store(context.Background(), BansKey, b)
+	}
+	if err != nil {
+		bs.logger.Error(fmt.Sprintf("save bans error: %v", err))
+	}
+}
+
+// Add bans the user of key for d, 0 bans it permanently. An existing ban
+// of the user is replaced.
+func (bs *Bans) Add(key, reason string, d time.Duration) Ban {
+	b := &Ban{Key: key, Reason: reason, Start: time.Now()}
+	if d > 0 {
+		b.Until = b.Start.Add(d)
+	}
+	bs.mu.Lock()
+	bs.m[key] = b
+	bs.mu.Unlock()
+	bs.save()
+	return *b
+}
+
+// Remove lifts the ban of key and returns whether it was banned.
+func (bs *Bans) Remove(key string) bool {
+	bs.mu.Lock()
+	b, ok := bs.m[key]
+	delete(bs.m, key)
+	bs.mu.Unlock()
+	if ok {
+		bs.save()
+	}
+	return ok && !b.Expired(time.Now())
+}
+
+// Banned is ...
+func (bs *Bans) Banned(key string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.m[key]
+	if !ok {
+		return false
+	}
+	if b.Expired(time.Now()) {
+		delete(bs.m, key)
+		return false
+	}
+	return true
+}
+
+// List returns bans in effect sorted by start time.
+func (bs *Bans) List() []Ban {
+	now := time.Now()
+	bs.mu.Lock()
+	list := make([]Ban, 0, len(bs.m))
+	for k, b := range bs.m {
+		if b.Expired(now) {
+			delete(bs.m, k)
+			continue
+		}
+		list = append(list, *b)
+	}
+	bs.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+// banUpstream rejects banned users.
+type banUpstream struct {
+	Upstream
+	bs *Bans
+}
+
+// Validate is ...
+func (u *banUpstream) Validate(k string) bool {
+	return !u.bs.Banned(k) && u.Upstream.Validate(k)
+}
+
+// Limited is ...
+func (u *banUpstream) Limited(k string) bool {
+	return limited(u.Upstream, k)
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestBans(t *testing.T) {
+	u, keys := newTestMemoryUpstream(t, 2)
+	bs := NewBans()
+	up := &banUpstream{Upstream: u, bs: bs}
+
+	bs.Add(string(keys[0]), "", 0)
+	bs.Add(string(keys[1]), "", 50*time.Millisecond)
+	if up.Validate(string(keys[0])) || up.Validate(string(keys[1])) {
+		t.Fatal("banned users are valid")
+	}
+	if n := len(bs.List()); n != 2 {
+		t.Fatalf("list error: %v", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !up.Validate(string(keys[1])) || len(bs.List()) != 1 || bs.Remove(string(keys[1])) {
+		t.Fatal("ban does not expire")
+	}
+	if !bs.Remove(string(keys[0])) || !up.Validate(string(keys[0])) {
+		t.Fatal("remove error")
+	}
+}
+
+func TestLoadBans(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	bs, err := LoadBans(storage, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Add("permanent", "abuse", 0)
+	bs.Add("expiring", "", 50*time.Millisecond)
+	bs.Add("lifted", "", time.Hour)
+	bs.Remove("lifted")
+
+	time.Sleep(60 * time.Millisecond)
+	bs, err = LoadBans(storage, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := bs.List()
+	if len(list) != 1 || list[0].Key != "permanent" || list[0].Reason != "abuse" || !list[0].Until.IsZero() {
+		t.Fatalf("load error: %+v", list)
+	}
+}
@@ -1,6 +1,13 @@
 package app
 
 import (
+	"encoding/json"
+	"net"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
@@ -12,9 +19,68 @@ func init() {
 
 /*
 	trojan {
-		caddy
-		no_proxy | env_proxy
+		caddy {
+			encryption_key 2025 {env.TROJAN_KEY_2025}
+			encryption_key 2024 {file./etc/caddy/trojan-2024.key}
+			allow_plaintext
+		}
+		no_proxy | env_proxy | shadowsocks <server> <method> <password>
 		users pass1234 word5678
+		reseller name {
+			token {env.RESELLER_TOKEN}
+			quota 1TB
+			max_users 100
+			users pass0000
+		}
+		pool name {
+			quota 1TB
+			member pass1111
+			member pass2222 100GB
+		}
+		group staff pass1234
+		outbound eu env_proxy
+		outbound us shadowsocks us.example.com:8388 2022-blake3-aes-128-gcm {env.SS_KEY}
+		policy {
+			auth outbound eu "inCIDR(client.ip, '10.0.0.0/8')"
+			target deny "'staff' in user.groups && target.network == 'udp' && target.port != 443"
+		}
+		rewrite intranet.example:80 10.0.0.5:8080
+		rewrite *.local-svc unix//run/local-svc.sock
+		rewrite :25 sinkhole
+		revalidate_interval 5m
+		local_sites
+		ldap {
+			url ldaps://ldap.example.com
+			bind_dn cn=trojan,ou=services,dc=example,dc=com
+			bind_password {env.LDAP_PASSWORD}
+			base_dn ou=people,dc=example,dc=com
+			user_filter (uid=%s)
+			filter (memberOf=cn=vpn,ou=groups,dc=example,dc=com)
+			group cn=staff,ou=groups,dc=example,dc=com staff
+			cache_ttl 5m
+		}
+		sharing {
+			mmdb /var/lib/GeoIP/GeoLite2-City.mmdb /var/lib/GeoIP/GeoLite2-ASN.mmdb
+			window 24h
+			max_ips 10
+			max_asns 3
+			max_countries 2
+			max_speed 1000
+			action webhook https://hooks.example.com/trojan
+		}
+		scanning {
+			window 1m
+			max_connections 600
+			max_hosts 200
+			max_ports 30
+			max_failures 100
+			action throttle 10m
+			throttle_rate 2
+		}
+		egress {
+			retention 720h
+			flush_interval 1m
+		}
 	}
 */
 func parseCaddyfile(d *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
@@ -31,7 +97,11 @@ func parseCaddyfile(d *caddyfile.Dispenser, _ interface{}) (interface{}, error)
 				if app.UpstreamRaw != nil {
 					return nil, d.Err("only one upstream is allowed")
 				}
-				app.UpstreamRaw = caddyconfig.JSONModuleObject(new(CaddyUpstream), "upstream", "caddy", nil)
+				u, err := parseCaddyUpstream(d)
+				if err != nil {
+					return nil, err
+				}
+				app.UpstreamRaw = caddyconfig.JSONModuleObject(u, "upstream", "caddy", nil)
 			case "memory":
 				if app.UpstreamRaw != nil {
 					return nil, d.Err("only one upstream is allowed")
@@ -47,6 +117,15 @@ func parseCaddyfile(d *caddyfile.Dispenser, _ interface{}) (interface{}, error)
 					return nil, d.Err("only one proxy is allowed")
 				}
 				app.ProxyRaw = caddyconfig.JSONModuleObject(new(NoProxy), "proxy", "no_proxy", nil)
+			case "shadowsocks":
+				if app.ProxyRaw != nil {
+					return nil, d.Err("only one proxy is allowed")
+				}
+				p, err := parseShadowsocks(d, d.RemainingArgs())
+				if err != nil {
+					return nil, err
+				}
+				app.ProxyRaw = caddyconfig.JSONModuleObject(p, "proxy", "shadowsocks", nil)
 			case "users":
 				args := d.RemainingArgs()
 				if len(args) < 1 {
@@ -58,6 +137,120 @@ func parseCaddyfile(d *caddyfile.Dispenser, _ interface{}) (interface{}, error)
 					}
 					app.Users = append(app.Users, v)
 				}
+			case "reseller":
+				r, err := parseReseller(d)
+				if err != nil {
+					return nil, err
+				}
+				app.Resellers = append(app.Resellers, r)
+			case "pool":
+				p, err := parsePool(d)
+				if err != nil {
+					return nil, err
+				}
+				app.Pools = append(app.Pools, p)
+			case "group":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return nil, d.ArgErr()
+				}
+				if app.Groups == nil {
+					app.Groups = make(map[string][]string)
+				}
+				app.Groups[args[0]] = append(app.Groups[args[0]], args[1:]...)
+			case "outbound":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return nil, d.ArgErr()
+				}
+				if args[1] != "shadowsocks" && len(args) != 2 {
+					return nil, d.ArgErr()
+				}
+				if app.OutboundsRaw == nil {
+					app.OutboundsRaw = make(map[string]json.RawMessage)
+				}
+				if _, ok := app.OutboundsRaw[args[0]]; ok {
+					return nil, d.Errf("duplicate outbound: %v", args[0])
+				}
+				switch args[1] {
+				case "no_proxy":
+					app.OutboundsRaw[args[0]] = caddyconfig.JSONModuleObject(new(NoProxy), "proxy", "no_proxy", nil)
+				case "env_proxy":
+					app.OutboundsRaw[args[0]] = caddyconfig.JSONModuleObject(new(EnvProxy), "proxy", "env_proxy", nil)
+				case "shadowsocks":
+					p, err := parseShadowsocks(d, args[2:])
+					if err != nil {
+						return nil, err
+					}
+					app.OutboundsRaw[args[0]] = caddyconfig.JSONModuleObject(p, "proxy", "shadowsocks", nil)
+				default:
+					return nil, d.Errf("unknown outbound proxy: %v", args[1])
+				}
+			case "revalidate_interval":
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return nil, d.Errf("parse revalidate_interval error: %v", err)
+				}
+				app.RevalidateInterval = caddy.Duration(dur)
+			case "local_sites":
+				if d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				app.LocalSites = true
+			case "rewrite":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return nil, d.ArgErr()
+				}
+				app.Rewrites = append(app.Rewrites, RewriteRule{Match: args[0], To: args[1]})
+			case "policy":
+				if app.Policy != nil {
+					return nil, d.Err("only one policy is allowed")
+				}
+				p, err := parsePolicy(d)
+				if err != nil {
+					return nil, err
+				}
+				app.Policy = p
+			case "ldap":
+				if app.LDAP != nil {
+					return nil, d.Err("only one ldap is allowed")
+				}
+				l, err := parseLDAP(d)
+				if err != nil {
+					return nil, err
+				}
+				app.LDAP = l
+			case "sharing":
+				if app.Sharing != nil {
+					return nil, d.Err("only one sharing is allowed")
+				}
+				sh, err := parseSharing(d)
+				if err != nil {
+					return nil, err
+				}
+				app.Sharing = sh
+			case "scanning":
+				if app.Scanning != nil {
+					return nil, d.Err("only one scanning is allowed")
+				}
+				sc, err := parseScanning(d)
+				if err != nil {
+					return nil, err
+				}
+				app.Scanning = sc
+			case "egress":
+				if app.Egress != nil {
+					return nil, d.Err("only one egress is allowed")
+				}
+				e, err := parseEgress(d)
+				if err != nil {
+					return nil, err
+				}
+				app.Egress = e
 			}
 
 		}
@@ -68,3 +261,391 @@ func parseCaddyfile(d *caddyfile.Dispenser, _ interface{}) (interface{}, error)
 		Value: caddyconfig.JSON(app, nil),
 	}, nil
 }
+
+// parseShadowsocks is ...
+//
+//	shadowsocks <server> <method> <password>
+func parseShadowsocks(d *caddyfile.Dispenser, args []string) (*ShadowsocksProxy, error) {
+	if len(args) != 3 {
+		return nil, d.ArgErr()
+	}
+	p := &ShadowsocksProxy{Server: args[0], Method: args[1], Password: args[2]}
+	if _, _, err := net.SplitHostPort(p.Server); err != nil {
+		return nil, d.Errf("parse shadowsocks server error: %v", err)
+	}
+	return p, nil
+}
+
+// parseCaddyUpstream is ...
+func parseCaddyUpstream(d *caddyfile.Dispenser) (*CaddyUpstream, error) {
+	u := &CaddyUpstream{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "encryption_key":
+			k := EncryptionKey{}
+			if !d.Args(&k.ID, &k.Key) {
+				return nil, d.ArgErr()
+			}
+			if u.Encryption == nil {
+				u.Encryption = &Encryption{}
+			}
+			u.Encryption.Keys = append(u.Encryption.Keys, k)
+		case "allow_plaintext":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if u.Encryption == nil {
+				u.Encryption = &Encryption{}
+			}
+			u.Encryption.AllowPlaintext = true
+		default:
+			return nil, d.Errf("unknown caddy upstream option: %v", d.Val())
+		}
+	}
+	return u, nil
+}
+
+// parseLDAP is ...
+func parseLDAP(d *caddyfile.Dispenser) (*LDAP, error) {
+	l := &LDAP{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "url":
+			if !d.Args(&l.URL) {
+				return nil, d.ArgErr()
+			}
+		case "start_tls":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			l.StartTLS = true
+		case "bind_dn":
+			if !d.Args(&l.BindDN) {
+				return nil, d.ArgErr()
+			}
+		case "bind_password":
+			if !d.Args(&l.BindPassword) {
+				return nil, d.ArgErr()
+			}
+		case "base_dn":
+			if !d.Args(&l.BaseDN) {
+				return nil, d.ArgErr()
+			}
+		case "user_filter":
+			if !d.Args(&l.UserFilter) {
+				return nil, d.ArgErr()
+			}
+		case "filter":
+			if !d.Args(&l.Filter) {
+				return nil, d.ArgErr()
+			}
+		case "group":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			if l.Groups == nil {
+				l.Groups = make(map[string]string)
+			}
+			l.Groups[args[0]] = args[1]
+		case "cache_ttl", "timeout":
+			name := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse %v error: %v", name, err)
+			}
+			if name == "cache_ttl" {
+				l.CacheTTL = caddy.Duration(dur)
+			} else {
+				l.Timeout = caddy.Duration(dur)
+			}
+		default:
+			return nil, d.Errf("unknown ldap option: %v", d.Val())
+		}
+	}
+	return l, nil
+}
+
+// parseSharing is ...
+func parseSharing(d *caddyfile.Dispenser) (*Sharing, error) {
+	sh := &Sharing{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch v := d.Val(); v {
+		case "mmdb":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return nil, d.ArgErr()
+			}
+			sh.MMDB = append(sh.MMDB, args...)
+		case "window":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse window error: %v", err)
+			}
+			sh.Window = caddy.Duration(dur)
+		case "max_ips", "max_asns", "max_countries":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse %v error: %v", v, err)
+			}
+			switch v {
+			case "max_ips":
+				sh.MaxIPs = n
+			case "max_asns":
+				sh.MaxASNs = n
+			default:
+				sh.MaxCountries = n
+			}
+		case "max_speed":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			f, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return nil, d.Errf("parse max_speed error: %v", err)
+			}
+			sh.MaxSpeed = f
+		case "action":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, d.ArgErr()
+			}
+			sh.Action = args[0]
+			switch {
+			case args[0] == SharingActionWebhook && len(args) == 2:
+				sh.Webhook = args[1]
+			case args[0] == SharingActionDisable && len(args) == 2:
+				dur, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return nil, d.Errf("parse disable duration error: %v", err)
+				}
+				sh.DisableFor = caddy.Duration(dur)
+			case len(args) == 2:
+				return nil, d.ArgErr()
+			}
+		default:
+			return nil, d.Errf("unknown sharing option: %v", v)
+		}
+	}
+	return sh, nil
+}
+
+// parseScanning is ...
+func parseScanning(d *caddyfile.Dispenser) (*Scanning, error) {
+	sc := &Scanning{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch v := d.Val(); v {
+		case "window":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse window error: %v", err)
+			}
+			sc.Window = caddy.Duration(dur)
+		case "max_connections", "max_hosts", "max_ports", "max_failures":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse %v error: %v", v, err)
+			}
+			switch v {
+			case "max_connections":
+				sc.MaxConnections = n
+			case "max_hosts":
+				sc.MaxHosts = n
+			case "max_ports":
+				sc.MaxPorts = n
+			default:
+				sc.MaxFailures = n
+			}
+		case "action":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, d.ArgErr()
+			}
+			sc.Action = args[0]
+			if len(args) == 2 {
+				if args[0] == ScanActionLog {
+					return nil, d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return nil, d.Errf("parse %v duration error: %v", args[0], err)
+				}
+				sc.Duration = caddy.Duration(dur)
+			}
+		case "throttle_rate":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			f, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return nil, d.Errf("parse throttle_rate error: %v", err)
+			}
+			sc.ThrottleRate = f
+		default:
+			return nil, d.Errf("unknown scanning option: %v", v)
+		}
+	}
+	return sc, nil
+}
+
+// parseEgress is ...
+func parseEgress(d *caddyfile.Dispenser) (*Egress, error) {
+	e := &Egress{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch v := d.Val(); v {
+		case "retention", "flush_interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse %v error: %v", v, err)
+			}
+			if v == "retention" {
+				e.Retention = caddy.Duration(dur)
+			} else {
+				e.FlushInterval = caddy.Duration(dur)
+			}
+		default:
+			return nil, d.Errf("unknown egress option: %v", v)
+		}
+	}
+	return e, nil
+}
+
+// parseReseller is ...
+func parseReseller(d *caddyfile.Dispenser) (*Reseller, error) {
+	r := &Reseller{}
+	if !d.Args(&r.Name) {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "token":
+			if !d.Args(&r.Token) {
+				return nil, d.ArgErr()
+			}
+		case "quota":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse quota error: %v", err)
+			}
+			r.Quota = int64(n)
+		case "max_users":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse max_users error: %v", err)
+			}
+			r.MaxUsers = n
+		case "users":
+			args := d.RemainingArgs()
+			if len(args) < 1 {
+				return nil, d.ArgErr()
+			}
+			r.Users = append(r.Users, args...)
+		default:
+			return nil, d.Errf("unknown reseller option: %v", d.Val())
+		}
+	}
+	return r, nil
+}
+
+// parsePool is ...
+func parsePool(d *caddyfile.Dispenser) (*Pool, error) {
+	p := &Pool{}
+	if !d.Args(&p.Name) {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "quota":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return nil, d.Errf("parse quota error: %v", err)
+			}
+			p.Quota = int64(n)
+		case "member":
+			args := d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, d.ArgErr()
+			}
+			m := PoolMember{Password: args[0]}
+			if len(args) == 2 {
+				n, err := humanize.ParseBytes(args[1])
+				if err != nil {
+					return nil, d.Errf("parse member quota error: %v", err)
+				}
+				m.Quota = int64(n)
+			}
+			p.Members = append(p.Members, m)
+		default:
+			return nil, d.Errf("unknown pool option: %v", d.Val())
+		}
+	}
+	return p, nil
+}
+
+// parsePolicy is ...
+//
+//	policy {
+//		auth|target allow|deny <expression>
+//		auth|target outbound <name> <expression>
+//	}
+func parsePolicy(d *caddyfile.Dispenser) (*Policy, error) {
+	p := &Policy{}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		stage := d.Val()
+		if stage != "auth" && stage != "target" {
+			return nil, d.Errf("unknown policy stage: %v", stage)
+		}
+		args := d.RemainingArgs()
+		if len(args) < 2 {
+			return nil, d.ArgErr()
+		}
+		rule := PolicyRule{Action: args[0]}
+		switch rule.Action {
+		case PolicyAllow, PolicyDeny:
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			rule.Match = args[1]
+		case PolicyOutbound:
+			if len(args) != 3 {
+				return nil, d.ArgErr()
+			}
+			rule.Outbound, rule.Match = args[1], args[2]
+		default:
+			return nil, d.Errf("unknown policy action: %v", rule.Action)
+		}
+		if stage == "auth" {
+			p.Auth = append(p.Auth, rule)
+		} else {
+			p.Target = append(p.Target, rule)
+		}
+	}
+	return p, nil
+}
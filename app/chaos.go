@@ -0,0 +1,438 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func init() {
+	caddy.RegisterModule(ChaosProxy{})
+}
+
+// ErrChaosDial is returned when a dial failure is injected.
+var ErrChaosDial = errors.New("chaos: injected dial failure")
+
+// ChaosProxy wraps another proxy and injects faults into the connections
+// it makes, it is meant for resilience testing only.
+type ChaosProxy struct {
+	// ProxyRaw is the wrapped proxy
+	ProxyRaw json.RawMessage `json:"outbound,omitempty" caddy:"namespace=trojan.proxies inline_key=proxy"`
+	// Rules is a list of faults, the first matched rule is applied.
+	Rules []ChaosRule `json:"rules,omitempty"`
+
+	px Proxy
+}
+
+// ChaosRule is ...
+type ChaosRule struct {
+	// Users are passwords of users this rule applies to, empty for all.
+	Users []string `json:"users,omitempty"`
+	// Destinations this rule applies to, empty for all. Supported forms
+	// are example.com, *.example.com, 10.0.0.1, 10.0.0.0/8, each with
+	// an optional port, or only a port as :53.
+	Destinations []string `json:"destinations,omitempty"`
+	// Probability of applying the rule to a connection, default is 1.
+	Probability float64 `json:"probability,omitempty"`
+
+	// DialFailure makes dialing fail.
+	DialFailure bool `json:"dial_failure,omitempty"`
+	// Latency is added before dialing and to every UDP packet.
+	Latency caddy.Duration `json:"latency,omitempty"`
+	// Jitter is a random extra latency up to this value.
+	Jitter caddy.Duration `json:"jitter,omitempty"`
+	// Bandwidth caps each direction of a connection in bytes per second.
+	Bandwidth int64 `json:"bandwidth,omitempty"`
+	// ResetAfter resets a TCP connection after this many bytes.
+	ResetAfter int64 `json:"reset_after,omitempty"`
+	// PacketLoss is the probability of dropping a UDP packet.
+	PacketLoss float64 `json:"packet_loss,omitempty"`
+
+	users map[string]struct{}
+	dests []destMatcher
+}
+
+// CaddyModule is ...
+func (ChaosProxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.proxies.chaos",
+		New: func() caddy.Module { return new(ChaosProxy) },
+	}
+}
+
+// Provision is ...
+func (p *ChaosProxy) Provision(ctx caddy.Context) error {
+	if p.ProxyRaw == nil {
+		p.px = &NoProxy{}
+	} else {
+		mod, err := ctx.LoadModule(p, "ProxyRaw")
+		if err != nil {
+			return err
+		}
+		p.px = mod.(Proxy)
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Probability == 0 {
+			rule.Probability = 1
+		}
+		if rule.Probability < 0 || rule.Probability > 1 {
+			return fmt.Errorf("chaos rule %d: probability out of range: %v", i, rule.Probability)
+		}
+		if rule.PacketLoss < 0 || rule.PacketLoss > 1 {
+			return fmt.Errorf("chaos rule %d: packet_loss out of range: %v", i, rule.PacketLoss)
+		}
+		if len(rule.Users) > 0 {
+			rule.users = make(map[string]struct{}, len(rule.Users))
+			for _, v := range rule.Users {
+				b := [trojan.HeaderLen]byte{}
+				trojan.GenKey(v, b[:])
+				rule.users[string(b[:])] = struct{}{}
+			}
+		}
+		for _, v := range rule.Destinations {
+			m, err := parseDestMatcher(v)
+			if err != nil {
+				return fmt.Errorf("chaos rule %d: %w", i, err)
+			}
+			rule.dests = append(rule.dests, m)
+		}
+	}
+	return nil
+}
+
+// Handle is ...
+func (p *ChaosProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
+}
+
+// Close is ...
+func (p *ChaosProxy) Close() error {
+	return p.px.Close()
+}
+
+// Dial is ...
+func (p *ChaosProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is ...
+func (p *ChaosProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	rule := p.match(trojan.UserFromContext(ctx), addr)
+	if rule == nil {
+		return trojan.DialContext(ctx, p.px, network, addr)
+	}
+	if err := rule.sleep(ctx); err != nil {
+		return nil, err
+	}
+	if rule.DialFailure {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrChaosDial}
+	}
+	conn, err := trojan.DialContext(ctx, p.px, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if rule.Bandwidth == 0 && rule.ResetAfter == 0 {
+		return conn, nil
+	}
+	return &chaosConn{Conn: conn, rule: rule, start: time.Now()}, nil
+}
+
+// ListenPacket is ...
+func (p *ChaosProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return p.ListenPacketContext(context.Background(), network, addr)
+}
+
+// ListenPacketContext is ...
+func (p *ChaosProxy) ListenPacketContext(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	user := trojan.UserFromContext(ctx)
+	if !p.matchUser(user) {
+		return trojan.ListenPacketContext(ctx, p.px, network, addr)
+	}
+	pc, err := trojan.ListenPacketContext(ctx, p.px, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &chaosPacketConn{PacketConn: pc, proxy: p, user: user}, nil
+}
+
+// ListenPing is not affected by chaos rules.
+func (p *ChaosProxy) ListenPing(ctx context.Context) (net.PacketConn, error) {
+	return trojan.ListenPing(ctx, p.px)
+}
+
+// match returns the rule to apply to a connection, or nil. A matched
+// rule which is not applied by its probability falls through to later
+// rules.
+func (p *ChaosProxy) match(user, addr string) *ChaosRule {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(user, addr) {
+			continue
+		}
+		if rule.Probability < 1 && rand.Float64() >= rule.Probability {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// matchUser reports whether any rule may apply to user
+func (p *ChaosProxy) matchUser(user string) bool {
+	for i := range p.Rules {
+		if p.Rules[i].users == nil {
+			return true
+		}
+		if _, ok := p.Rules[i].users[user]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matches is ...
+func (rule *ChaosRule) matches(user, addr string) bool {
+	if rule.users != nil {
+		if _, ok := rule.users[user]; !ok {
+			return false
+		}
+	}
+	if len(rule.dests) == 0 {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	for _, m := range rule.dests {
+		if m.Match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep waits for the configured latency
+func (rule *ChaosRule) sleep(ctx context.Context) error {
+	d := time.Duration(rule.Latency)
+	if rule.Jitter > 0 {
+		d += rand.N(time.Duration(rule.Jitter))
+	}
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chaosConn is ...
+type chaosConn struct {
+	net.Conn
+	rule  *ChaosRule
+	start time.Time
+
+	mu     sync.Mutex
+	total  int64
+	nr, nw int64
+	reset  sync.Once
+}
+
+// Read is ...
+func (c *chaosConn) Read(b []byte) (int, error) {
+	if err := c.check("read"); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	c.account(&c.nr, n)
+	return n, err
+}
+
+// Write is ...
+func (c *chaosConn) Write(b []byte) (int, error) {
+	if err := c.check("write"); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	c.account(&c.nw, n)
+	return n, err
+}
+
+// CloseWrite is ...
+func (c *chaosConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("not supported")
+}
+
+// check resets the connection if the byte budget is spent, op is the
+// operation reported in the error
+func (c *chaosConn) check(op string) error {
+	if c.rule.ResetAfter == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	total := c.total
+	c.mu.Unlock()
+	if total < c.rule.ResetAfter {
+		return nil
+	}
+	c.reset.Do(func() {
+		if sl, ok := c.Conn.(interface {
+			SetLinger(int) error
+		}); ok {
+			sl.SetLinger(0)
+		}
+		c.Conn.Close()
+	})
+	return &net.OpError{Op: op, Net: "tcp", Err: syscall.ECONNRESET}
+}
+
+// account counts n bytes and sleeps to keep under the bandwidth cap
+func (c *chaosConn) account(dir *int64, n int) {
+	if n <= 0 {
+		return
+	}
+	c.mu.Lock()
+	c.total += int64(n)
+	*dir += int64(n)
+	sent := *dir
+	c.mu.Unlock()
+
+	if c.rule.Bandwidth == 0 {
+		return
+	}
+	due := c.start.Add(time.Duration(sent * int64(time.Second) / c.rule.Bandwidth))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// chaosPacketConn is ...
+type chaosPacketConn struct {
+	net.PacketConn
+	proxy *ChaosProxy
+	user  string
+}
+
+// WriteTo is ...
+func (c *chaosPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	rule := c.proxy.match(c.user, addr.String())
+	if rule == nil {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	if rule.PacketLoss > 0 && rand.Float64() < rule.PacketLoss {
+		return len(b), nil
+	}
+	if err := rule.sleep(context.Background()); err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// ReadFrom is ...
+func (c *chaosPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		rule := c.proxy.match(c.user, addr.String())
+		if rule != nil && rule.PacketLoss > 0 && rand.Float64() < rule.PacketLoss {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+// destMatcher matches a destination by domain, IP or port
+type destMatcher struct {
+	Domain string
+	Suffix bool
+	Prefix *net.IPNet
+	Port   string
+}
+
+// parseDestMatcher is ...
+func parseDestMatcher(s string) (destMatcher, error) {
+	m := destMatcher{}
+	host := s
+	if h, port, err := net.SplitHostPort(s); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return m, fmt.Errorf("invalid port: %v", s)
+		}
+		host, m.Port = h, port
+	}
+	switch {
+	case host == "":
+		if m.Port == "" {
+			return m, fmt.Errorf("invalid destination: %v", s)
+		}
+	case strings.Contains(host, "/"):
+		_, prefix, err := net.ParseCIDR(host)
+		if err != nil {
+			return m, fmt.Errorf("invalid destination: %v", s)
+		}
+		m.Prefix = prefix
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		m.Prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(host, "*."):
+		m.Domain, m.Suffix = strings.ToLower(host[1:]), true
+	default:
+		m.Domain = strings.ToLower(host)
+	}
+	return m, nil
+}
+
+// Match is ...
+func (m *destMatcher) Match(host, port string) bool {
+	if m.Port != "" && m.Port != port {
+		return false
+	}
+	switch {
+	case m.Prefix != nil:
+		ip := net.ParseIP(host)
+		return ip != nil && m.Prefix.Contains(ip)
+	case m.Suffix:
+		return strings.HasSuffix(strings.ToLower(host), m.Domain)
+	case m.Domain != "":
+		return strings.EqualFold(host, m.Domain)
+	}
+	return true
+}
+
+var (
+	_ Proxy                        = (*ChaosProxy)(nil)
+	_ caddy.Provisioner            = (*ChaosProxy)(nil)
+	_ trojan.ContextDialer         = (*ChaosProxy)(nil)
+	_ trojan.ContextPacketListener = (*ChaosProxy)(nil)
+	_ trojan.Pinger                = (*ChaosProxy)(nil)
+)
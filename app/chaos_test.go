@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func TestDestMatcher(t *testing.T) {
+	for _, v := range []struct {
+		Rule string
+		Addr string
+		OK   bool
+	}{
+		{"example.com", "example.com:80", true},
+		{"example.com", "www.example.com:80", false},
+		{"*.example.com", "www.example.com:80", true},
+		{"*.example.com:443", "www.example.com:80", false},
+		{"10.0.0.0/8", "10.1.2.3:53", true},
+		{"10.0.0.1", "10.0.0.2:53", false},
+		{":53", "1.1.1.1:53", true},
+	} {
+		m, err := parseDestMatcher(v.Rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, port, _ := net.SplitHostPort(v.Addr)
+		if m.Match(host, port) != v.OK {
+			t.Errorf("match %v %v error", v.Rule, v.Addr)
+		}
+	}
+}
+
+func TestChaosProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	p := &ChaosProxy{Rules: []ChaosRule{
+		{Users: []string{"broken"}, DialFailure: true},
+		{ResetAfter: 8},
+	}}
+	if err := p.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("broken", key[:])
+	ctx := trojan.WithUser(context.Background(), string(key[:]))
+	if _, err := p.DialContext(ctx, "tcp", ln.Addr().String()); !errors.Is(err, ErrChaosDial) {
+		t.Fatalf("dial failure error: %v", err)
+	}
+
+	c, err := p.DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b := make([]byte, 16)
+	if _, err := c.Write(b[:8]); err != nil {
+		t.Fatal(err)
+	}
+	oe := (*net.OpError)(nil)
+	if _, err := c.Write(b[:8]); !errors.As(err, &oe) || oe.Op != "write" || !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("reset after error: %v", err)
+	}
+	if _, err := c.Read(b); !errors.As(err, &oe) || oe.Op != "read" {
+		t.Fatalf("read after reset error: %v", err)
+	}
+}
+
+func TestChaosProxyMatch(t *testing.T) {
+	p := &ChaosProxy{Rules: []ChaosRule{
+		{Destinations: []string{":53"}, Probability: 1e-9, DialFailure: true},
+		{Destinations: []string{":53"}, Latency: caddy.Duration(time.Millisecond)},
+	}}
+	if err := p.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	// a matched rule which is not applied falls through to the next rule
+	if rule := p.match("", "1.1.1.1:53"); rule != &p.Rules[1] {
+		t.Fatalf("match error: %+v", rule)
+	}
+	if rule := p.match("", "1.1.1.1:80"); rule != nil {
+		t.Fatalf("match error: %+v", rule)
+	}
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNodeDraining is the reason of sessions terminated at the deadline of
+// draining.
+var ErrNodeDraining = errors.New("node is draining")
+
+const (
+	// DrainFallback serves new trojan handshakes as fallback traffic
+	DrainFallback = "fallback"
+	// DrainReject closes new trojan handshakes
+	DrainReject = "reject"
+)
+
+// Drain is the maintenance state of a node which stops accepting new
+// sessions while live sessions finish.
+type Drain struct {
+	// Mode is fallback or reject.
+	Mode string
+	// Since is ...
+	Since time.Time
+	// Deadline is when live sessions are closed, zero for never.
+	Deadline time.Time
+}
+
+// drain is the drain state of Sessions
+type drain struct {
+	Drain
+	timer *time.Timer
+}
+
+// Drain stops accepting new sessions with mode and terminates live
+// sessions after d, 0 waits for them to finish. An existing drain is
+// replaced.
+func (ss *Sessions) Drain(mode string, d time.Duration) (Drain, error) {
+	switch mode {
+	case "":
+		mode = DrainFallback
+	case DrainFallback, DrainReject:
+	default:
+		return Drain{}, fmt.Errorf("unknown drain mode: %v", mode)
+	}
+	if d < 0 {
+		return Drain{}, errors.New("negative drain deadline")
+	}
+
+	ss.reg.mu.Lock()
+	defer ss.reg.mu.Unlock()
+	if ss.reg.drain != nil && ss.reg.drain.timer != nil {
+		ss.reg.drain.timer.Stop()
+	}
+	dr := &drain{Drain: Drain{Mode: mode, Since: time.Now()}}
+	if ss.reg.drain != nil {
+		dr.Since = ss.reg.drain.Since
+	}
+	if d > 0 {
+		dr.Deadline = time.Now().Add(d)
+		dr.timer = time.AfterFunc(d, ss.closeAll)
+	}
+	ss.reg.drain = dr
+	ss.logger.Info(fmt.Sprintf("drain node with mode %v, live sessions: %v", mode, len(ss.reg.m)))
+	return dr.Drain, nil
+}
+
+// closeAll terminates all live sessions at the deadline of draining
+func (ss *Sessions) closeAll() {
+	ss.Range(func(s *Session) bool {
+		ss.Terminate(s, ErrNodeDraining)
+		return true
+	})
+}
+
+// Resume accepts new sessions again and returns whether the node was
+// draining.
+func (ss *Sessions) Resume() bool {
+	ss.reg.mu.Lock()
+	defer ss.reg.mu.Unlock()
+	if ss.reg.drain == nil {
+		return false
+	}
+	if ss.reg.drain.timer != nil {
+		ss.reg.drain.timer.Stop()
+	}
+	ss.reg.drain = nil
+	ss.logger.Info("resume node")
+	return true
+}
+
+// Draining returns the drain state and whether the node is draining.
+func (ss *Sessions) Draining() (Drain, bool) {
+	if ss == nil {
+		return Drain{}, false
+	}
+	ss.reg.mu.Lock()
+	defer ss.reg.mu.Unlock()
+	if ss.reg.drain == nil {
+		return Drain{}, false
+	}
+	return ss.reg.drain.Drain, true
+}
+
+// DrainMode returns the mode of draining or empty if new sessions are
+// accepted.
+func (ss *Sessions) DrainMode() string {
+	dr, _ := ss.Draining()
+	return dr.Mode
+}
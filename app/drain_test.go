@@ -0,0 +1,109 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSessionsDrain(t *testing.T) {
+	u, keys := newTestMemoryUpstream(t, 1)
+	ss := NewSessions(u, nil, zap.NewNop())
+	if ss.DrainMode() != "" || ss.Resume() {
+		t.Fatal("new sessions are draining")
+	}
+	if _, err := ss.Drain("pause", 0); err == nil {
+		t.Fatal("drain with unknown mode error")
+	}
+
+	sessions := []*Session{
+		NewSession(string(keys[0]), TransportTLS, "1.2.3.4:5", ""),
+		NewSession(string(keys[0]), TransportTLS, "1.2.3.4:6", ""),
+	}
+	closed := make(chan *Session, len(sessions))
+	for _, s := range sessions {
+		ss.Add(s, closerFunc(func() { closed <- s }))
+	}
+
+	// live sessions are kept without a deadline
+	dr, err := ss.Drain("", 0)
+	if err != nil || dr.Mode != DrainFallback || !dr.Deadline.IsZero() || ss.DrainMode() != DrainFallback {
+		t.Fatalf("drain error: %+v %v", dr, err)
+	}
+
+	// a new drain keeps the start and replaces the deadline
+	dr2, err := ss.Drain(DrainReject, 20*time.Millisecond)
+	if err != nil || dr2.Mode != DrainReject || !dr2.Since.Equal(dr.Since) || dr2.Deadline.IsZero() {
+		t.Fatalf("drain again error: %+v %v", dr2, err)
+	}
+	for range sessions {
+		select {
+		case s := <-closed:
+			if !errors.Is(s.reason, ErrNodeDraining) {
+				t.Errorf("session %v reason error: %v", s.RemoteAddr, s.reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("sessions are not closed at the deadline")
+		}
+	}
+
+	// resuming cancels the deadline
+	s := NewSession(string(keys[0]), TransportTLS, "1.2.3.4:7", "")
+	ss.Add(s, closerFunc(func() { closed <- s }))
+	if _, err := ss.Drain(DrainReject, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !ss.Resume() || ss.DrainMode() != "" {
+		t.Fatal("resume error")
+	}
+	select {
+	case <-closed:
+		t.Fatal("session is closed after resuming")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+func TestSessionsShare(t *testing.T) {
+	t.Cleanup(func() { liveSessions.reg = nil })
+	u, keys := newTestMemoryUpstream(t, 1)
+	old := NewSessions(u, nil, zap.NewNop())
+	old.share()
+	closed := make(chan struct{}, 2)
+	s := NewSession(string(keys[0]), TransportTLS, "1.2.3.4:5", "")
+	old.Add(s, closerFunc(func() { closed <- struct{}{} }))
+	if _, err := old.Drain(DrainReject, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sessions of a reloaded app take over live sessions and draining
+	ss := NewSessions(u, nil, zap.NewNop())
+	ss.share()
+	if ss.Len() != 1 || ss.DrainMode() != DrainReject {
+		t.Fatalf("share error: %v %v", ss.Len(), ss.DrainMode())
+	}
+
+	// resuming stops the deadline set before the reload
+	if !ss.Resume() || old.DrainMode() != "" {
+		t.Fatal("resume error")
+	}
+	select {
+	case <-closed:
+		t.Fatal("session is closed after resuming")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// sessions are removed by the app which accepted them
+	old.Remove(s)
+	if ss.Len() != 0 {
+		t.Fatalf("remove error: %v", ss.Len())
+	}
+}
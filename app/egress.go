@@ -0,0 +1,547 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// ErrEgressDisabled is returned by querying an app without egress records.
+var ErrEgressDisabled = errors.New("egress records are not enabled")
+
+// ErrEgressQuery is the error of invalid queries of egress records.
+var ErrEgressQuery = errors.New("invalid egress query")
+
+// EgressPrefix is the storage prefix of egress records, which are stored
+// in chunks under a directory of every UTC hour.
+const EgressPrefix = "trojan/egress/"
+
+const (
+	// egressHourFormat is the name of the directory of an hour
+	egressHourFormat = "2006010215"
+	// egressMaxHours is the max number of hours of a query
+	egressMaxHours = 48
+	// egressMaxPending is the max number of records of closed sockets
+	// kept while storage fails, the oldest are dropped
+	egressMaxPending = 1 << 16
+)
+
+// Egress records outbound sockets of users with their local and remote
+// addresses, so that the user owning an egress address at a time can be
+// found for abuse reports.
+type Egress struct {
+	// Retention is how long records are kept in storage, default is 720h.
+	Retention caddy.Duration `json:"retention,omitempty"`
+	// FlushInterval is the interval of writing records to storage,
+	// default is 1m.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	storage certmagic.Storage
+	logger  *zap.Logger
+
+	idx    *egressIndex
+	purged time.Time
+
+	loop loop
+}
+
+// egressIndex is the set of records of open sockets and of closed sockets
+// not written yet
+type egressIndex struct {
+	mu     sync.Mutex
+	live   map[*EgressRecord]struct{}
+	closed []*EgressRecord
+
+	// flushing serializes writes of the apps sharing the index
+	flushing sync.Mutex
+}
+
+// newEgressIndex is ...
+func newEgressIndex() *egressIndex {
+	return &egressIndex{live: make(map[*EgressRecord]struct{})}
+}
+
+// liveEgress is the index shared by the apps of reloaded configs, as
+// sockets outlive the app which opened them and are closed and written
+// by the app of the last config
+var liveEgress struct {
+	sync.Mutex
+	idx *egressIndex
+}
+
+// EgressRecord is an outbound socket of a session.
+type EgressRecord struct {
+	Network string `json:"network"`
+	// Local is the egress address of the socket.
+	Local string `json:"local"`
+	// Remote is empty for UDP sockets, which send to any address.
+	Remote string    `json:"remote,omitempty"`
+	Start  time.Time `json:"start"`
+	// End is nil if the socket was open when the record was written.
+	End *time.Time `json:"end,omitempty"`
+	// Key is hex(SHA224(password)) of the user
+	Key       string `json:"key"`
+	Client    string `json:"client"`
+	Transport string `json:"transport"`
+	// SessionStart is the start of the session owning the socket.
+	SessionStart time.Time `json:"session_start"`
+
+	// written is the last hour the open socket is written to
+	written time.Time
+}
+
+// id identifies a record written more than once
+func (rec *EgressRecord) id() string {
+	return rec.Network + rec.Local + rec.Remote + strconv.FormatInt(rec.Start.UnixNano(), 10) + rec.Key
+}
+
+// EgressQuery selects records of sockets open at a time.
+type EgressQuery struct {
+	// Local is IP:port, IP or :port of the egress address.
+	Local string
+	// Remote is IP:port, IP or :port of the remote address, empty for any.
+	Remote string
+	// At is the time of the report.
+	At time.Time
+	// Slack extends At to [At-Slack, At+Slack] for inaccurate clocks.
+	Slack time.Duration
+}
+
+// addrMatcher is a parsed address of a query
+type addrMatcher struct {
+	ip   netip.Addr
+	port uint16
+}
+
+// parseAddrMatcher is ...
+func parseAddrMatcher(s string) (addrMatcher, error) {
+	m := addrMatcher{}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, ""
+	}
+	if host != "" {
+		if m.ip, err = netip.ParseAddr(host); err != nil {
+			return m, fmt.Errorf("%w: invalid address: %v", ErrEgressQuery, s)
+		}
+		m.ip = m.ip.Unmap()
+	}
+	if port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return m, fmt.Errorf("%w: invalid port: %v", ErrEgressQuery, s)
+		}
+		m.port = uint16(n)
+	}
+	return m, nil
+}
+
+// Match returns whether addr of a record matches, an unspecified IP of a
+// socket bound to all addresses matches any IP.
+func (m addrMatcher) Match(addr string) bool {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return false
+	}
+	if m.ip.IsValid() && !ap.Addr().IsUnspecified() && ap.Addr().Unmap() != m.ip {
+		return false
+	}
+	return m.port == 0 || ap.Port() == m.port
+}
+
+// Provision is ...
+func (e *Egress) Provision(ctx caddy.Context, lg *zap.Logger) error {
+	if e.Retention == 0 {
+		e.Retention = caddy.Duration(30 * 24 * time.Hour)
+	}
+	if e.FlushInterval == 0 {
+		e.FlushInterval = caddy.Duration(time.Minute)
+	}
+	if e.Retention < 0 || e.FlushInterval < 0 {
+		return errors.New("negative egress retention or flush_interval")
+	}
+	e.storage = ctx.Storage()
+	e.logger = lg
+	e.share()
+	return nil
+}
+
+// share makes e use the index of the process, so that sockets opened by
+// the app of the last config are written by e.
+func (e *Egress) share() {
+	liveEgress.Lock()
+	defer liveEgress.Unlock()
+	if liveEgress.idx == nil {
+		liveEgress.idx = newEgressIndex()
+	}
+	e.idx = liveEgress.idx
+}
+
+// Open records a new socket of s and returns its record.
+func (e *Egress) Open(s *Session, network string, local, remote net.Addr) *EgressRecord {
+	rec := &EgressRecord{
+		Network:      network,
+		Local:        local.String(),
+		Start:        time.Now(),
+		Key:          s.Key,
+		Client:       s.RemoteAddr,
+		Transport:    s.Transport,
+		SessionStart: s.Start,
+	}
+	if remote != nil {
+		rec.Remote = remote.String()
+	}
+	e.idx.mu.Lock()
+	e.idx.live[rec] = struct{}{}
+	e.idx.mu.Unlock()
+	return rec
+}
+
+// Close records the end of the socket of rec.
+func (e *Egress) Close(rec *EgressRecord) {
+	e.idx.mu.Lock()
+	defer e.idx.mu.Unlock()
+	if _, ok := e.idx.live[rec]; !ok {
+		return
+	}
+	delete(e.idx.live, rec)
+	end := time.Now()
+	rec.End = &end
+	e.idx.closed = append(e.idx.closed, rec)
+}
+
+// Start writes records periodically.
+func (e *Egress) Start() {
+	e.loop.Start(time.Duration(e.FlushInterval), e.flush)
+}
+
+// Stop writes records of closed sockets and sockets still open.
+func (e *Egress) Stop() {
+	e.loop.Stop()
+	e.flush()
+}
+
+// flush writes records of closed sockets to a new chunk of every hour
+// they overlap, and records of open sockets to hours they are not written
+// to yet, so that they survive a crash. Expired hours are removed.
+func (e *Egress) flush() {
+	e.idx.flushing.Lock()
+	defer e.idx.flushing.Unlock()
+
+	now := time.Now()
+	hour := now.UTC().Truncate(time.Hour)
+	hours := make(map[string][]EgressRecord)
+	add := func(rec EgressRecord, from, to time.Time) {
+		for h := from.UTC().Truncate(time.Hour); !h.After(to); h = h.Add(time.Hour) {
+			hours[h.Format(egressHourFormat)] = append(hours[h.Format(egressHourFormat)], rec)
+		}
+	}
+
+	e.idx.mu.Lock()
+	n := len(e.idx.closed)
+	for _, rec := range e.idx.closed {
+		add(*rec, rec.Start, *rec.End)
+	}
+	live := make([]*EgressRecord, 0, len(e.idx.live))
+	for rec := range e.idx.live {
+		if rec.written.Equal(hour) {
+			continue
+		}
+		from := rec.Start
+		if !rec.written.IsZero() {
+			from = rec.written.Add(time.Hour)
+		}
+		add(*rec, from, now)
+		live = append(live, rec)
+	}
+	e.idx.mu.Unlock()
+
+	ok := true
+	for h, records := range hours {
+		if err := e.store(h, records); err != nil {
+			e.logger.Error(fmt.Sprintf("store egress records of %v error: %v", h, err))
+			ok = false
+		}
+	}
+
+	// records are kept to be written again if storage fails
+	e.idx.mu.Lock()
+	if ok {
+		e.idx.closed = e.idx.closed[n:]
+		for _, rec := range live {
+			rec.written = hour
+		}
+	} else if len(e.idx.closed) > egressMaxPending {
+		dropped := len(e.idx.closed) - egressMaxPending
+		e.idx.closed = e.idx.closed[dropped:]
+		e.logger.Error(fmt.Sprintf("drop %v egress records of closed sockets", dropped))
+	}
+	e.idx.mu.Unlock()
+
+	if now.Sub(e.purged) >= time.Hour {
+		e.purged = now
+		if err := e.purge(now); err != nil {
+			e.logger.Error(fmt.Sprintf("purge egress records error: %v", err))
+		}
+	}
+}
+
+// store writes records to a new chunk of hour
+func (e *Egress) store(hour string, records []EgressRecord) error {
+	buf := bytes.Buffer{}
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(records); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + hex.EncodeToString(b)
+	return e.storage.Store(context.Background(), EgressPrefix+hour+"/"+name, buf.Bytes())
+}
+
+// purge removes hours older than the retention
+func (e *Egress) purge(now time.Time) error {
+	ctx := context.Background()
+	dirs, err := e.storage.List(ctx, EgressPrefix, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, dir := range dirs {
+		h, err := time.Parse(egressHourFormat, path.Base(dir))
+		if err != nil || !h.Add(time.Hour).Before(now.Add(-time.Duration(e.Retention))) {
+			continue
+		}
+		keys, err := e.storage.List(ctx, dir, false)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, key := range keys {
+			if err := e.storage.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+		if err := e.storage.Delete(ctx, dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads all records of hour
+func (e *Egress) load(ctx context.Context, hour string) ([]EgressRecord, error) {
+	keys, err := e.storage.List(ctx, EgressPrefix+hour, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	list := []EgressRecord{}
+	for _, key := range keys {
+		b, err := e.storage.Load(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("read %v error: %w", key, err)
+		}
+		records := []EgressRecord{}
+		err = json.NewDecoder(zr).Decode(&records)
+		zr.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode %v error: %w", key, err)
+		}
+		list = append(list, records...)
+	}
+	return list, nil
+}
+
+// Query returns records of sockets matching q sorted by start time.
+func (e *Egress) Query(ctx context.Context, q EgressQuery) ([]EgressRecord, error) {
+	if e == nil {
+		return nil, ErrEgressDisabled
+	}
+	local, err := parseAddrMatcher(q.Local)
+	if err != nil {
+		return nil, err
+	}
+	remote := addrMatcher{}
+	if q.Remote != "" {
+		if remote, err = parseAddrMatcher(q.Remote); err != nil {
+			return nil, err
+		}
+	}
+	from, to := q.At.Add(-q.Slack), q.At.Add(q.Slack)
+	if q.Slack < 0 || to.Sub(from) > egressMaxHours*time.Hour {
+		return nil, fmt.Errorf("%w: slack %v is negative or longer than %vh", ErrEgressQuery, q.Slack, egressMaxHours/2)
+	}
+
+	// records in memory are found before records in storage, which may
+	// be written again when open sockets are closed
+	list := []EgressRecord{}
+	e.idx.mu.Lock()
+	for rec := range e.idx.live {
+		list = append(list, *rec)
+	}
+	for _, rec := range e.idx.closed {
+		list = append(list, *rec)
+	}
+	e.idx.mu.Unlock()
+	for h := from.UTC().Truncate(time.Hour); !h.After(to); h = h.Add(time.Hour) {
+		records, err := e.load(ctx, h.Format(egressHourFormat))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, records...)
+	}
+
+	seen := make(map[string]int)
+	result := []EgressRecord{}
+	for _, rec := range list {
+		if rec.Start.After(to) || (rec.End != nil && rec.End.Before(from)) {
+			continue
+		}
+		if !local.Match(rec.Local) || (rec.Remote != "" && q.Remote != "" && !remote.Match(rec.Remote)) {
+			continue
+		}
+		if i, ok := seen[rec.id()]; ok {
+			if result[i].End == nil {
+				result[i].End = rec.End
+			}
+			continue
+		}
+		seen[rec.id()] = len(result)
+		result = append(result, rec)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result, nil
+}
+
+// egressProxy records outbound sockets of sessions.
+type egressProxy struct {
+	Proxy
+	egress *Egress
+}
+
+// Handle is ...
+func (p *egressProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
+}
+
+// Dial is ...
+func (p *egressProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is ...
+func (p *egressProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := trojan.DialContext(ctx, p.Proxy, network, addr)
+	s := SessionFromContext(ctx)
+	if err != nil || s == nil {
+		return c, err
+	}
+	rec := p.egress.Open(s, network, c.LocalAddr(), c.RemoteAddr())
+	return &egressConn{Conn: c, egress: p.egress, rec: rec}, nil
+}
+
+// ListenPacket is ...
+func (p *egressProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return p.ListenPacketContext(context.Background(), network, addr)
+}
+
+// ListenPacketContext is ...
+func (p *egressProxy) ListenPacketContext(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	pc, err := trojan.ListenPacketContext(ctx, p.Proxy, network, addr)
+	s := SessionFromContext(ctx)
+	if err != nil || s == nil {
+		return pc, err
+	}
+	rec := p.egress.Open(s, network, pc.LocalAddr(), nil)
+	return &egressPacketConn{PacketConn: pc, egress: p.egress, rec: rec}, nil
+}
+
+// ListenPing is ...
+func (p *egressProxy) ListenPing(ctx context.Context) (net.PacketConn, error) {
+	pc, err := trojan.ListenPing(ctx, p.Proxy)
+	s := SessionFromContext(ctx)
+	if err != nil || s == nil {
+		return pc, err
+	}
+	// echo requests are sent from any address of the host without port
+	local := pc.LocalAddr()
+	if _, err := netip.ParseAddrPort(local.String()); err != nil {
+		local = &net.UDPAddr{IP: net.IPv6unspecified}
+	}
+	rec := p.egress.Open(s, "icmp", local, nil)
+	return &egressPacketConn{PacketConn: pc, egress: p.egress, rec: rec}, nil
+}
+
+// egressConn records the end of the socket when it is closed.
+type egressConn struct {
+	net.Conn
+	egress *Egress
+	rec    *EgressRecord
+}
+
+// Close is ...
+func (c *egressConn) Close() error {
+	c.egress.Close(c.rec)
+	return c.Conn.Close()
+}
+
+// CloseWrite is ...
+func (c *egressConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("not supported")
+}
+
+// egressPacketConn is ...
+type egressPacketConn struct {
+	net.PacketConn
+	egress *Egress
+	rec    *EgressRecord
+}
+
+// Close is ...
+func (c *egressPacketConn) Close() error {
+	c.egress.Close(c.rec)
+	return c.PacketConn.Close()
+}
+
+var (
+	_ Proxy                        = (*egressProxy)(nil)
+	_ trojan.ContextDialer         = (*egressProxy)(nil)
+	_ trojan.ContextPacketListener = (*egressProxy)(nil)
+	_ trojan.Pinger                = (*egressProxy)(nil)
+)
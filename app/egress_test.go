@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestEgress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	e := &Egress{
+		Retention: caddy.Duration(24 * time.Hour),
+		storage:   storage,
+		logger:    zap.NewNop(),
+		idx:       newEgressIndex(),
+	}
+	p := &egressProxy{Proxy: &NoProxy{}, egress: e}
+	s := NewSession("key", TransportWebSocket, "1.2.3.4:5", "example.com")
+	ctx := context.Background()
+
+	c, err := p.DialContext(s.Context(ctx), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := c.LocalAddr().String()
+	_, tcpPort, _ := net.SplitHostPort(local)
+	pc, err := p.ListenPacketContext(s.Context(ctx), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+
+	// open sockets are found in memory
+	list, err := e.Query(ctx, EgressQuery{Local: local, At: time.Now()})
+	if err != nil || len(list) != 1 || list[0].Key != "key" || list[0].Remote != ln.Addr().String() || list[0].End != nil {
+		t.Fatalf("query open socket error: %+v %v", list, err)
+	}
+
+	// open sockets are written once every hour
+	e.flush()
+	keys, _ := storage.List(ctx, EgressPrefix+time.Now().UTC().Format(egressHourFormat), false)
+	e.flush()
+	if keys2, _ := storage.List(ctx, EgressPrefix+time.Now().UTC().Format(egressHourFormat), false); len(keys) != 1 || len(keys2) != len(keys) {
+		t.Fatalf("flush of open sockets error: %v %v", keys, keys2)
+	}
+
+	c.Close()
+	pc.Close()
+	e.flush()
+	if len(e.idx.closed) != 0 || len(e.idx.live) != 0 {
+		t.Fatal("flush error")
+	}
+
+	list, err = e.Query(ctx, EgressQuery{Local: local, Remote: ln.Addr().String(), At: time.Now(), Slack: time.Second})
+	if err != nil || len(list) != 1 || list[0].End == nil || list[0].Client != "1.2.3.4:5" || list[0].Transport != TransportWebSocket {
+		t.Fatalf("query closed socket error: %+v %v", list, err)
+	}
+	// udp sockets bound to all addresses match any IP
+	if list, err := e.Query(ctx, EgressQuery{Local: "192.0.2.1:" + port, Remote: "198.51.100.1:53", At: time.Now(), Slack: time.Second}); err != nil || len(list) != 1 || list[0].Network != "udp" {
+		t.Fatalf("query udp socket error: %+v %v", list, err)
+	}
+	for _, q := range []EgressQuery{
+		{Local: local, At: time.Now().Add(-time.Hour)},
+		{Local: local, Remote: "127.0.0.1:1", At: time.Now(), Slack: time.Second},
+		{Local: net.JoinHostPort("127.0.0.2", tcpPort), At: time.Now(), Slack: time.Second},
+	} {
+		if list, err := e.Query(ctx, q); err != nil || len(list) != 0 {
+			t.Fatalf("query %+v error: %+v %v", q, list, err)
+		}
+	}
+	if _, err := e.Query(ctx, EgressQuery{Local: "localhost:80"}); !errors.Is(err, ErrEgressQuery) {
+		t.Fatalf("query with invalid address error: %v", err)
+	}
+	if _, err := (*Egress)(nil).Query(ctx, EgressQuery{Local: local}); !errors.Is(err, ErrEgressDisabled) {
+		t.Fatalf("query without egress error: %v", err)
+	}
+
+	// hours older than the retention are removed
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(egressHourFormat)
+	if err := e.store(old, []EgressRecord{{Network: "tcp", Local: local}}); err != nil {
+		t.Fatal(err)
+	}
+	e.purged = time.Time{}
+	e.flush()
+	if keys, _ := storage.List(ctx, EgressPrefix, false); len(keys) != 1 {
+		t.Fatalf("purge error: %v", keys)
+	}
+
+	// sockets open when stopped are written without end
+	c, err = p.DialContext(s.Context(ctx), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e.Stop()
+	e.idx.live = make(map[*EgressRecord]struct{})
+	list, err = e.Query(ctx, EgressQuery{Local: c.LocalAddr().String(), At: time.Now()})
+	if err != nil || len(list) != 1 || list[0].End != nil {
+		t.Fatalf("query of stopped egress error: %+v %v", list, err)
+	}
+
+	// records of closed sockets are dropped over the limit if storage fails
+	e.storage = failStorage{storage}
+	for range egressMaxPending + 1 {
+		e.Close(e.Open(s, "tcp", c.LocalAddr(), c.RemoteAddr()))
+	}
+	e.flush()
+	if len(e.idx.closed) != egressMaxPending {
+		t.Fatalf("pending records error: %v", len(e.idx.closed))
+	}
+}
+
+func TestEgressPing(t *testing.T) {
+	e := &Egress{
+		storage: &certmagic.FileStorage{Path: t.TempDir()},
+		logger:  zap.NewNop(),
+		idx:     newEgressIndex(),
+	}
+	p := &egressProxy{Proxy: &pingProxy{}, egress: e}
+	s := NewSession("key", TransportTLS, "1.2.3.4:5", "")
+	ctx := context.Background()
+
+	pc, err := p.ListenPing(s.Context(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	list, err := e.Query(ctx, EgressQuery{Local: "192.0.2.1", At: time.Now()})
+	if err != nil || len(list) != 1 || list[0].Network != "icmp" {
+		t.Fatalf("query ping socket error: %+v %v", list, err)
+	}
+}
+
+func TestEgressShare(t *testing.T) {
+	t.Cleanup(func() { liveEgress.idx = nil })
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	old := &Egress{storage: storage, logger: zap.NewNop()}
+	old.share()
+	s := NewSession("key", TransportTLS, "1.2.3.4:5", "")
+	local := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	rec := old.Open(s, "tcp", local, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443})
+	old.Stop()
+
+	// sockets opened before a reload are closed and written by the new app
+	e := &Egress{storage: storage, logger: zap.NewNop()}
+	e.share()
+	old.Close(rec)
+	e.flush()
+	if len(e.idx.closed) != 0 || len(e.idx.live) != 0 {
+		t.Fatal("flush error")
+	}
+	e.idx.mu.Lock()
+	e.idx.live = make(map[*EgressRecord]struct{})
+	e.idx.mu.Unlock()
+	list, err := e.Query(context.Background(), EgressQuery{Local: local.String(), At: time.Now(), Slack: time.Second})
+	if err != nil || len(list) != 1 || list[0].End == nil {
+		t.Fatalf("query of socket opened before reload error: %+v %v", list, err)
+	}
+}
+
+// failStorage fails to store
+type failStorage struct {
+	certmagic.Storage
+}
+
+// Store is ...
+func (failStorage) Store(context.Context, string, []byte) error {
+	return errors.New("store error")
+}
+
+// pingProxy returns a packet conn without local address like ICMP echo
+// sockets
+type pingProxy struct {
+	NoProxy
+}
+
+// ListenPing is ...
+func (*pingProxy) ListenPing(ctx context.Context) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return pingConn{pc}, nil
+}
+
+// pingConn is ...
+type pingConn struct {
+	net.PacketConn
+}
+
+// LocalAddr is ...
+func (pingConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
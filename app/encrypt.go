@@ -0,0 +1,176 @@
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ErrEncryptionDisabled is returned by rewrapping an upstream without
+// encryption.
+var ErrEncryptionDisabled = errors.New("encryption of user records is not enabled")
+
+// ErrPlaintextRecord is returned by opening a record which is not
+// encrypted without AllowPlaintext.
+var ErrPlaintextRecord = errors.New("user record is not encrypted")
+
+// Rewrapper is an Upstream which encrypts user records.
+type Rewrapper interface {
+	// Rewrap encrypts all records with the primary key.
+	Rewrap(context.Context) (RewrapResult, error)
+}
+
+// RewrapResult is the result of rewrapping user records.
+type RewrapResult struct {
+	// Rewrapped is the number of records written again.
+	Rewrapped int `json:"rewrapped"`
+	// Plaintext is the number of records still not encrypted, which are
+	// only read with AllowPlaintext.
+	Plaintext int `json:"plaintext"`
+}
+
+// EncryptionKey is a key encrypting keys of user records.
+type EncryptionKey struct {
+	// ID is stored along with records to find the key for decryption.
+	ID string `json:"id"`
+	// Key is the base64 encoded 32 byte key, which supports {env.*} and
+	// {file.*} placeholders.
+	Key string `json:"key"`
+}
+
+// Encryption encrypts user records with a random data key per record,
+// which is wrapped with the first key. Other keys only decrypt records
+// written before a key rotation until they are rewrapped.
+type Encryption struct {
+	// Keys are ...
+	Keys []EncryptionKey `json:"keys"`
+	// AllowPlaintext reads records written before encryption is enabled,
+	// which are encrypted when written again. It is only for migration,
+	// as anyone writing the storage can add plain records.
+	AllowPlaintext bool `json:"allow_plaintext,omitempty"`
+
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// sealedRecord is an encrypted user record in the storage.
+type sealedRecord struct {
+	// KeyID is the ID of the key wrapping DataKey.
+	KeyID string `json:"kid"`
+	// DataKey is the nonce and the wrapped data key.
+	DataKey []byte `json:"dek"`
+	// Data is the nonce and the encrypted record.
+	Data []byte `json:"data"`
+}
+
+// Provision is ...
+func (e *Encryption) Provision() error {
+	if len(e.Keys) == 0 {
+		return errors.New("no encryption key")
+	}
+	repl := caddy.NewReplacer()
+	e.keys = make(map[string]cipher.AEAD)
+	for _, v := range e.Keys {
+		if v.ID == "" {
+			return errors.New("empty encryption key id")
+		}
+		if _, ok := e.keys[v.ID]; ok {
+			return fmt.Errorf("duplicate encryption key id: %v", v.ID)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(repl.ReplaceKnown(v.Key, "")))
+		if err != nil {
+			return fmt.Errorf("decode encryption key %v error: %w", v.ID, err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("encryption key %v is not 32 bytes", v.ID)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		e.keys[v.ID] = aead
+	}
+	e.primary = e.Keys[0].ID
+	return nil
+}
+
+// newAEAD returns AES-256-GCM of key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal appends a random nonce and the sealed b to dst
+func seal(aead cipher.AEAD, dst, b, ad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(append(dst, nonce...), nonce, b, ad)
+}
+
+// open opens b sealed by seal
+func open(aead cipher.AEAD, b, ad []byte) ([]byte, error) {
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], ad)
+}
+
+// Seal encrypts the record of name, which is authenticated so a record
+// can not be moved to another user.
+func (e *Encryption) Seal(name string, b []byte) ([]byte, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&sealedRecord{
+		KeyID:   e.primary,
+		DataKey: seal(e.keys[e.primary], nil, dek, []byte(e.primary)),
+		Data:    seal(aead, nil, b, []byte(name)),
+	})
+}
+
+// Open decrypts the record of name, records written without encryption
+// are returned as is with AllowPlaintext and are ErrPlaintextRecord
+// otherwise. It also reports whether the record is not sealed with the
+// primary key.
+func (e *Encryption) Open(name string, b []byte) ([]byte, bool, error) {
+	r := sealedRecord{}
+	if err := json.Unmarshal(b, &r); err != nil || r.KeyID == "" {
+		if !e.AllowPlaintext {
+			return nil, false, ErrPlaintextRecord
+		}
+		return b, true, nil
+	}
+	kek, ok := e.keys[r.KeyID]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown encryption key: %v", r.KeyID)
+	}
+	dek, err := open(kek, r.DataKey, []byte(r.KeyID))
+	if err != nil {
+		return nil, false, fmt.Errorf("unwrap data key error: %w", err)
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := open(aead, r.Data, []byte(name))
+	if err != nil {
+		return nil, false, fmt.Errorf("decrypt record error: %w", err)
+	}
+	return data, r.KeyID != e.primary, nil
+}
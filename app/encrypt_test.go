@@ -0,0 +1,105 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func newTestEncryption(t *testing.T, ids ...string) *Encryption {
+	e := &Encryption{}
+	for _, id := range ids {
+		key := make([]byte, 32)
+		rand.Read(key)
+		t.Setenv("TROJAN_KEY_"+id, base64.StdEncoding.EncodeToString(key))
+		e.Keys = append(e.Keys, EncryptionKey{ID: id, Key: "{env.TROJAN_KEY_" + id + "}"})
+	}
+	if err := e.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryption(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u := &CaddyUpstream{Prefix: "trojan/", Storage: storage, Logger: zap.NewNop()}
+	ctx := context.Background()
+
+	b := [trojan.HeaderLen]byte{}
+	trojan.GenKey("pass0", b[:])
+	key0 := string(b[:])
+	trojan.GenKey("pass1", b[:])
+	key1 := string(b[:])
+
+	// records written before encryption is enabled
+	u.Add("pass0")
+	u.Consume(key0, 1, 2)
+
+	old := newTestEncryption(t, "old")
+	u.Encryption = old
+
+	// plain records are only read for migration
+	if _, _, err := u.load(u.Prefix + key0); !errors.Is(err, ErrPlaintextRecord) {
+		t.Fatalf("load plain record error: %v", err)
+	}
+	if res, err := u.Rewrap(ctx); err != nil || res != (RewrapResult{Plaintext: 1}) {
+		t.Fatalf("rewrap of plain records error: %+v %v", res, err)
+	}
+	old.AllowPlaintext = true
+	u.Add("pass1")
+	u.Consume(key0, 1, 2)
+	for _, k := range []string{key0, key1} {
+		bb, err := storage.Load(ctx, u.Prefix+k)
+		if err != nil || bytes.Contains(bb, []byte(`"up"`)) {
+			t.Fatalf("record is not encrypted: %s %v", bb, err)
+		}
+	}
+
+	// records can not be moved to another user
+	bb, _ := storage.Load(ctx, u.Prefix+key0)
+	if _, _, err := old.Open(u.Prefix+key1, bb); err == nil {
+		t.Fatal("open moved record error")
+	}
+
+	// rotate keys
+	u.Encryption = newTestEncryption(t, "new")
+	u.Encryption.Keys = append(u.Encryption.Keys, old.Keys...)
+	if err := u.Encryption.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := u.Rewrap(ctx); err != nil || res != (RewrapResult{Rewrapped: 2}) {
+		t.Fatalf("rewrap error: %+v %v", res, err)
+	}
+	if res, err := u.Rewrap(ctx); err != nil || res != (RewrapResult{}) {
+		t.Fatalf("rewrap again error: %+v %v", res, err)
+	}
+
+	// the old key is retired
+	u.Encryption.Keys = u.Encryption.Keys[:1]
+	if err := u.Encryption.Provision(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	u.Range(func(k string, up, down int64) {
+		n++
+		if k == key0 && (up != 2 || down != 4) {
+			t.Errorf("traffic error: %v %v", up, down)
+		}
+	})
+	if n != 2 {
+		t.Fatalf("range error: %v", n)
+	}
+
+	u.Encryption = nil
+	if _, err := u.Rewrap(ctx); err != ErrEncryptionDisabled {
+		t.Fatalf("rewrap without encryption error: %v", err)
+	}
+}
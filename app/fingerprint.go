@@ -0,0 +1,383 @@
+package app
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// fingerprintConnTTL is how long the fingerprint of a connection is
+	// kept after it is used last
+	fingerprintConnTTL = time.Hour
+	// fingerprintMaxConns is the max number of connections whose
+	// fingerprints are kept
+	fingerprintMaxConns = 1 << 16
+	// fingerprintMaxPerUser is the max number of fingerprints kept per user
+	fingerprintMaxPerUser = 64
+	// fingerprintMaxLabels is the max number of JA4 labels of the metric,
+	// sessions of other fingerprints are counted as fingerprintOther
+	fingerprintMaxLabels = 64
+	// fingerprintOther is the label of fingerprints over the limit
+	fingerprintOther = "other"
+)
+
+// Fingerprint is the fingerprint of a TLS ClientHello.
+type Fingerprint struct {
+	// JA3 is the MD5 hash of JA3Raw.
+	JA3    string `json:"ja3"`
+	JA3Raw string `json:"ja3_raw"`
+	JA4    string `json:"ja4"`
+	// ServerName is the SNI.
+	ServerName string   `json:"server_name,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+}
+
+// isGREASE returns whether v is a GREASE value of RFC 8701
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns values which are not GREASE
+func withoutGREASE[T ~uint16 | ~uint8](list []T) []uint16 {
+	values := make([]uint16, 0, len(list))
+	for _, v := range list {
+		if !isGREASE(uint16(v)) {
+			values = append(values, uint16(v))
+		}
+	}
+	return values
+}
+
+// joinUint16 joins values formatted by format with sep
+func joinUint16(values []uint16, format, sep string) string {
+	list := make([]string, len(values))
+	for i, v := range values {
+		list[i] = fmt.Sprintf(format, v)
+	}
+	return strings.Join(list, sep)
+}
+
+// NewFingerprint returns the JA3 and JA4 fingerprint of hello.
+func NewFingerprint(hello *tls.ClientHelloInfo) Fingerprint {
+	ciphers := withoutGREASE(hello.CipherSuites)
+	exts := withoutGREASE(helloExtensions(hello))
+	curves := withoutGREASE(hello.SupportedCurves)
+	points := withoutGREASE(hello.SupportedPoints)
+	sigs := withoutGREASE(hello.SignatureSchemes)
+	versions := withoutGREASE(hello.SupportedVersions)
+
+	// the legacy version of TLS 1.3 is TLS 1.2, and supported versions
+	// are derived from the legacy version without the extension
+	maxVersion := uint16(0)
+	if len(versions) > 0 {
+		maxVersion = slices.Max(versions)
+	}
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(min(maxVersion, tls.VersionTLS12))),
+		joinUint16(ciphers, "%d", "-"),
+		joinUint16(exts, "%d", "-"),
+		joinUint16(curves, "%d", "-"),
+		joinUint16(points, "%d", "-"),
+	}, ",")
+	sum := md5.Sum([]byte(ja3))
+
+	return Fingerprint{
+		JA3:        hex.EncodeToString(sum[:]),
+		JA3Raw:     ja3,
+		JA4:        ja4(hello, maxVersion, ciphers, exts, sigs),
+		ServerName: hello.ServerName,
+		ALPN:       hello.SupportedProtos,
+	}
+}
+
+// ja4 returns the JA4 fingerprint of hello
+func ja4(hello *tls.ClientHelloInfo, version uint16, ciphers, exts, sigs []uint16) string {
+	b := strings.Builder{}
+	if hello.Conn != nil && hello.Conn.LocalAddr().Network() == "udp" {
+		b.WriteByte('q')
+	} else {
+		b.WriteByte('t')
+	}
+	switch version {
+	case tls.VersionTLS13:
+		b.WriteString("13")
+	case tls.VersionTLS12:
+		b.WriteString("12")
+	case tls.VersionTLS11:
+		b.WriteString("11")
+	case tls.VersionTLS10:
+		b.WriteString("10")
+	case 0x0300: // SSL 3.0
+		b.WriteString("s3")
+	default:
+		b.WriteString("00")
+	}
+	// crypto/tls only sets the server name of a valid SNI extension
+	if hello.ServerName != "" {
+		b.WriteByte('d')
+	} else {
+		b.WriteByte('i')
+	}
+	fmt.Fprintf(&b, "%02d%02d", min(len(ciphers), 99), min(len(exts), 99))
+	b.WriteString(ja4ALPN(hello.SupportedProtos))
+
+	hash := func(s string) string {
+		if s == "" {
+			return "000000000000"
+		}
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:6])
+	}
+
+	ciphers = slices.Clone(ciphers)
+	slices.Sort(ciphers)
+	b.WriteString("_" + hash(joinUint16(ciphers, "%04x", ",")))
+
+	// the server name and alpn extensions are not hashed
+	sorted := make([]uint16, 0, len(exts))
+	for _, v := range exts {
+		if v != 0x0000 && v != 0x0010 {
+			sorted = append(sorted, v)
+		}
+	}
+	slices.Sort(sorted)
+	s := joinUint16(sorted, "%04x", ",")
+	if s != "" && len(sigs) > 0 {
+		s += "_" + joinUint16(sigs, "%04x", ",")
+	}
+	b.WriteString("_" + hash(s))
+	return b.String()
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN
+func ja4ALPN(protos []string) string {
+	if len(protos) == 0 || protos[0] == "" {
+		return "00"
+	}
+	alnum := func(c byte) bool {
+		return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	}
+	p := protos[0]
+	first, last := p[0], p[len(p)-1]
+	if !alnum(first) || !alnum(last) {
+		s := hex.EncodeToString([]byte(p))
+		return s[:1] + s[len(s)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+// FingerprintStat is a fingerprint seen in sessions of a user.
+type FingerprintStat struct {
+	Fingerprint
+	Sessions int64     `json:"sessions"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+}
+
+// FingerprintSummary is a fingerprint aggregated over all users.
+type FingerprintSummary struct {
+	JA3      string `json:"ja3"`
+	JA4      string `json:"ja4"`
+	Sessions int64  `json:"sessions"`
+	Users    int    `json:"users"`
+}
+
+// fingerprintConn is the fingerprint of a connection
+type fingerprintConn struct {
+	fp   Fingerprint
+	used time.Time
+}
+
+// Fingerprints records ClientHello fingerprints of connections and binds
+// them to trojan sessions of the same connection by the client address.
+type Fingerprints struct {
+	mu      sync.Mutex
+	conns   map[string]*fingerprintConn
+	users   map[string]map[string]*FingerprintStat
+	labels  map[string]struct{}
+	counter *prometheus.CounterVec
+}
+
+// NewFingerprints returns Fingerprints whose sessions are counted in reg
+// if not nil.
+func NewFingerprints(reg *prometheus.Registry) (*Fingerprints, error) {
+	fs := &Fingerprints{
+		conns:  make(map[string]*fingerprintConn),
+		users:  make(map[string]map[string]*FingerprintStat),
+		labels: make(map[string]struct{}),
+		counter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "caddy",
+			Subsystem: "trojan",
+			Name:      "tls_fingerprint_sessions_total",
+			Help:      "Counter of trojan sessions by the JA4 fingerprint of the TLS ClientHello.",
+		}, []string{"ja4"}),
+	}
+	if reg == nil {
+		return fs, nil
+	}
+	if err := reg.Register(fs.counter); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		fs.counter = are.ExistingCollector.(*prometheus.CounterVec)
+	}
+
+	// labels of a reloaded app count towards the same limit
+	ch := make(chan prometheus.Metric)
+	go func() {
+		fs.counter.Collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err == nil && len(pb.GetLabel()) == 1 {
+			fs.labels[pb.GetLabel()[0].GetValue()] = struct{}{}
+		}
+	}
+	return fs, nil
+}
+
+// Capture records the fingerprint of the connection of hello, nothing is
+// recorded if fingerprints are not supported.
+func (fs *Fingerprints) Capture(hello *tls.ClientHelloInfo) {
+	if fs == nil || hello.Conn == nil || !FingerprintSupported {
+		return
+	}
+	fp := NewFingerprint(hello)
+	addr := hello.Conn.RemoteAddr().String()
+	now := time.Now()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.conns[addr]; !ok && len(fs.conns) >= fingerprintMaxConns {
+		for k, v := range fs.conns {
+			if now.Sub(v.used) > fingerprintConnTTL {
+				delete(fs.conns, k)
+			}
+		}
+		for k := range fs.conns {
+			if len(fs.conns) < fingerprintMaxConns {
+				break
+			}
+			delete(fs.conns, k)
+		}
+	}
+	fs.conns[addr] = &fingerprintConn{fp: fp, used: now}
+}
+
+// attach sets the fingerprint of the connection of s and records it for
+// the user of s
+func (fs *Fingerprints) attach(s *Session) {
+	if fs == nil {
+		return
+	}
+	now := time.Now()
+
+	fs.mu.Lock()
+	c, ok := fs.conns[s.RemoteAddr]
+	if !ok {
+		fs.mu.Unlock()
+		return
+	}
+	c.used = now
+	fp := c.fp
+	s.Fingerprint = &fp
+
+	stats, ok := fs.users[s.Key]
+	if !ok {
+		stats = make(map[string]*FingerprintStat)
+		fs.users[s.Key] = stats
+	}
+	id := fp.JA4 + "|" + fp.JA3
+	st, ok := stats[id]
+	if !ok {
+		if len(stats) >= fingerprintMaxPerUser {
+			oldest := ""
+			for k, v := range stats {
+				if oldest == "" || v.Last.Before(stats[oldest].Last) {
+					oldest = k
+				}
+			}
+			delete(stats, oldest)
+		}
+		st = &FingerprintStat{First: now}
+		stats[id] = st
+	}
+	st.Fingerprint = fp
+	st.Sessions++
+	st.Last = now
+
+	label := fp.JA4
+	if _, ok := fs.labels[label]; !ok {
+		if len(fs.labels) < fingerprintMaxLabels {
+			fs.labels[label] = struct{}{}
+		} else {
+			label = fingerprintOther
+		}
+	}
+	fs.mu.Unlock()
+
+	fs.counter.WithLabelValues(label).Inc()
+}
+
+// User returns fingerprints of the user of key by the time they were
+// seen last.
+func (fs *Fingerprints) User(key string) []FingerprintStat {
+	if fs == nil {
+		return nil
+	}
+	fs.mu.Lock()
+	list := make([]FingerprintStat, 0, len(fs.users[key]))
+	for _, v := range fs.users[key] {
+		list = append(list, *v)
+	}
+	fs.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Last.After(list[j].Last) })
+	return list
+}
+
+// Summary returns fingerprints of all users by the number of sessions.
+func (fs *Fingerprints) Summary() []FingerprintSummary {
+	if fs == nil {
+		return nil
+	}
+	m := make(map[string]*FingerprintSummary)
+	fs.mu.Lock()
+	for _, stats := range fs.users {
+		for id, v := range stats {
+			sum, ok := m[id]
+			if !ok {
+				sum = &FingerprintSummary{JA3: v.JA3, JA4: v.JA4}
+				m[id] = sum
+			}
+			sum.Sessions += v.Sessions
+			sum.Users++
+		}
+	}
+	fs.mu.Unlock()
+
+	list := make([]FingerprintSummary, 0, len(m))
+	for _, v := range m {
+		list = append(list, *v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Sessions != list[j].Sessions {
+			return list[i].Sessions > list[j].Sessions
+		}
+		return list[i].JA4 < list[j].JA4
+	})
+	return list
+}
@@ -0,0 +1,15 @@
+//go:build !go1.24
+
+package app
+
+import "crypto/tls"
+
+// FingerprintSupported is false, the extensions of a ClientHello are not
+// available before Go 1.24 and fingerprints without them are not JA3 and
+// JA4 fingerprints
+const FingerprintSupported = false
+
+// helloExtensions returns nil
+func helloExtensions(hello *tls.ClientHelloInfo) []uint16 {
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package app
+
+import "crypto/tls"
+
+// FingerprintSupported is whether fingerprints of a ClientHello can be
+// built, which needs its extensions
+const FingerprintSupported = true
+
+// helloExtensions returns the extensions of hello in the order they are
+// sent, they are only available since Go 1.24
+func helloExtensions(hello *tls.ClientHelloInfo) []uint16 {
+	return hello.Extensions
+}
@@ -0,0 +1,61 @@
+//go:build go1.24
+
+package app
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"testing"
+)
+
+func TestNewFingerprint(t *testing.T) {
+	// the ClientHello of Chrome in the JA4 specification with GREASE values
+	hello := &tls.ClientHelloInfo{
+		CipherSuites: []uint16{
+			0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		Extensions: []uint16{
+			0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005,
+			0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015, 0x2a2a,
+		},
+		SupportedCurves:   []tls.CurveID{0x3a3a, tls.X25519, tls.CurveP256, tls.CurveP384},
+		SupportedPoints:   []uint8{0},
+		SupportedVersions: []uint16{0x4a4a, tls.VersionTLS13, tls.VersionTLS12},
+		SignatureSchemes: []tls.SignatureScheme{
+			0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+		},
+		SupportedProtos: []string{"h2", "http/1.1"},
+		ServerName:      "example.com",
+	}
+	fp := NewFingerprint(hello)
+	if fp.JA4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Errorf("ja4 error: %v", fp.JA4)
+	}
+	// the flag of the SNI follows the server name
+	hello.ServerName = ""
+	if s := NewFingerprint(hello).JA4; s[:4] != "t13i" {
+		t.Errorf("ja4 without server name error: %v", s)
+	}
+	ja3 := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	sum := md5.Sum([]byte(ja3))
+	if fp.JA3Raw != ja3 || fp.JA3 != hex.EncodeToString(sum[:]) {
+		t.Errorf("ja3 error: %v %v", fp.JA3Raw, fp.JA3)
+	}
+
+	for _, v := range []struct {
+		protos []string
+		alpn   string
+	}{
+		{nil, "00"},
+		{[]string{"http/1.1"}, "h1"},
+		{[]string{"h"}, "hh"},
+		{[]string{"\xabq"}, "a1"},
+	} {
+		if s := ja4ALPN(v.protos); s != v.alpn {
+			t.Errorf("alpn of %q error: %v", v.protos, s)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+//go:build go1.24
+
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestFingerprints(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	fs, err := NewFingerprints(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, keys := newTestMemoryUpstream(t, 1)
+	ss := NewSessions(u, nil, zap.NewNop())
+	ss.fps = fs
+
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			fs.Capture(hello)
+			return nil, nil
+		},
+	}
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	c, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{"http/1.1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// sessions of the connection share its fingerprint
+	for range 2 {
+		s := NewSession(string(keys[0]), TransportHTTP2, c.LocalAddr().String(), "example.com")
+		ss.Add(s, nil)
+		if s.Fingerprint == nil || s.Fingerprint.JA4[:4] != "t13d" || s.Fingerprint.ServerName != "example.com" {
+			t.Fatalf("fingerprint error: %+v", s.Fingerprint)
+		}
+	}
+	s := NewSession(string(keys[0]), TransportTLS, (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}).String(), "")
+	if ss.Add(s, nil); s.Fingerprint != nil {
+		t.Fatal("fingerprint of unknown connection")
+	}
+
+	stats := fs.User(string(keys[0]))
+	if len(stats) != 1 || stats[0].Sessions != 2 || len(stats[0].ALPN) != 1 {
+		t.Fatalf("user fingerprints error: %+v", stats)
+	}
+	sum := fs.Summary()
+	if len(sum) != 1 || sum[0].Sessions != 2 || sum[0].Users != 1 || sum[0].JA4 != stats[0].JA4 {
+		t.Fatalf("summary error: %+v", sum)
+	}
+	if n := testutil.ToFloat64(fs.counter.WithLabelValues(stats[0].JA4)); n != 2 {
+		t.Fatalf("metrics error: %v", n)
+	}
+
+	// fingerprints of a reloaded app are counted in the same metric
+	fs2, err := NewFingerprints(reg)
+	if err != nil || fs2.counter != fs.counter || len(fs2.labels) != 1 {
+		t.Fatalf("register again error: %v %v", fs2.labels, err)
+	}
+
+	// labels over the limit are counted as other
+	ss.fps = fs2
+	for i := range fingerprintMaxLabels {
+		addr := (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: i + 1}).String()
+		fs2.conns[addr] = &fingerprintConn{fp: Fingerprint{JA4: fmt.Sprintf("t13d%08d", i)}}
+		ss.Add(NewSession(string(keys[0]), TransportTLS, addr, ""), nil)
+	}
+	if n := testutil.ToFloat64(fs.counter.WithLabelValues(fingerprintOther)); n != 1 {
+		t.Fatalf("metrics of other fingerprints error: %v", n)
+	}
+	if n := testutil.CollectAndCount(fs.counter); n != fingerprintMaxLabels+1 {
+		t.Fatalf("number of labels error: %v", n)
+	}
+}
@@ -0,0 +1,425 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// ErrLDAPCredentials is returned for a wrong user name or password.
+var ErrLDAPCredentials = errors.New("invalid ldap credentials")
+
+const (
+	// ldapMaxFailures is the number of failed binds of a user from a
+	// client IP in ldapFailWindow, after which the user is rejected from
+	// the IP without a bind until the window ends
+	ldapMaxFailures = 5
+	// ldapFailWindow is ...
+	ldapFailWindow = time.Minute
+)
+
+// LDAP authenticates user:password credentials of CONNECT, forward proxy
+// and WebSocket requests with a bind to an LDAP server. Keys of LDAP users
+// identify them in sessions and traffic, they are not accepted as trojan
+// passwords.
+type LDAP struct {
+	// URL is ldap://host:389 or ldaps://host:636.
+	URL string `json:"url"`
+	// StartTLS upgrades ldap:// connections with StartTLS.
+	StartTLS bool `json:"start_tls,omitempty"`
+	// BindDN and BindPassword are the account searching users, users
+	// are searched anonymously if empty. BindPassword supports {env.*}
+	// and {file.*} placeholders.
+	BindDN       string `json:"bind_dn,omitempty"`
+	BindPassword string `json:"bind_password,omitempty"`
+	// BaseDN is where users are searched.
+	BaseDN string `json:"base_dn"`
+	// UserFilter finds the entry of a user, %s is the escaped user name,
+	// default is (uid=%s).
+	UserFilter string `json:"user_filter,omitempty"`
+	// Filter is combined with UserFilter to require group membership,
+	// such as (memberOf=cn=vpn,ou=groups,dc=example,dc=com).
+	Filter string `json:"filter,omitempty"`
+	// Groups maps DNs of memberOf of a user to trojan groups seen by the
+	// policy as user.groups.
+	Groups map[string]string `json:"groups,omitempty"`
+	// CacheTTL is how long a successful bind is cached and a user is
+	// valid before it is searched again, default is 5m.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+	// Timeout is the timeout of an LDAP operation, default is 10s.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	secret []byte
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	creds map[string]ldapCred
+	users map[string]*ldapUser
+	// fails is keyed by the user and the client IP, so that others can
+	// not lock a user out
+	fails map[string]*ldapFail
+}
+
+// ldapFail counts failed binds of a user from a client IP
+type ldapFail struct {
+	count int
+	since time.Time
+}
+
+// ldapCred is a cached successful bind
+type ldapCred struct {
+	key     string
+	expires time.Time
+}
+
+// ldapUser is an authenticated user of LDAP
+type ldapUser struct {
+	Name    string
+	DN      string
+	Groups  []string
+	Checked time.Time
+	Up      int64
+	Down    int64
+}
+
+// Provision is ...
+func (l *LDAP) Provision(lg *zap.Logger) error {
+	if l.URL == "" || l.BaseDN == "" {
+		return errors.New("ldap url and base_dn are required")
+	}
+	if l.UserFilter == "" {
+		l.UserFilter = "(uid=%s)"
+	}
+	if strings.Count(l.UserFilter, "%s") != 1 {
+		return fmt.Errorf("ldap user_filter must have one %%s: %v", l.UserFilter)
+	}
+	if l.CacheTTL == 0 {
+		l.CacheTTL = caddy.Duration(5 * time.Minute)
+	}
+	if l.Timeout == 0 {
+		l.Timeout = caddy.Duration(10 * time.Second)
+	}
+	l.BindPassword = caddy.NewReplacer().ReplaceKnown(l.BindPassword, "")
+
+	// keys of ldap users can not be derived from user names, so they can
+	// not be presented as trojan passwords
+	l.secret = make([]byte, 32)
+	if _, err := rand.Read(l.secret); err != nil {
+		return err
+	}
+	l.logger = lg
+	l.creds = make(map[string]ldapCred)
+	l.users = make(map[string]*ldapUser)
+	l.fails = make(map[string]*ldapFail)
+	return nil
+}
+
+// mac returns the hex HMAC of s
+func (l *LDAP) mac(s string) string {
+	h := hmac.New(sha256.New, l.secret)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dial connects to the server and binds the search account
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	timeout := time.Duration(l.Timeout)
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if l.StartTLS {
+		host := strings.TrimPrefix(l.URL, "ldap://")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("bind %v error: %w", l.BindDN, err)
+		}
+	}
+	return conn, nil
+}
+
+// search returns the entry of user
+func (l *LDAP) search(conn *ldap.Conn, user string) (*ldap.Entry, error) {
+	filter := fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(user))
+	if l.Filter != "" {
+		filter = "(&" + filter + l.Filter + ")"
+	}
+	req := ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(time.Duration(l.Timeout).Seconds()), false, filter, []string{"memberOf"}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrLDAPCredentials
+	}
+	return res.Entries[0], nil
+}
+
+// groups maps memberOf of entry to trojan groups
+func (l *LDAP) groups(entry *ldap.Entry) []string {
+	groups := []string{}
+	for _, dn := range entry.GetAttributeValues("memberOf") {
+		for k, v := range l.Groups {
+			if strings.EqualFold(k, dn) {
+				groups = append(groups, v)
+			}
+		}
+	}
+	return groups
+}
+
+// Authenticate binds as user with password and returns the trojan key of
+// the user, successful binds are cached for CacheTTL. Failed binds are
+// limited per user and IP of the client address.
+func (l *LDAP) Authenticate(ctx context.Context, user, password, client string) (string, error) {
+	// an empty password is an unauthenticated bind which always succeeds
+	if user == "" || password == "" {
+		return "", ErrLDAPCredentials
+	}
+	id := l.mac(user + "\x00" + password)
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	fk := user + "\x00" + client
+
+	l.mu.Lock()
+	if c, ok := l.creds[id]; ok && time.Now().Before(c.expires) {
+		if _, ok := l.users[c.key]; ok {
+			l.mu.Unlock()
+			return c.key, nil
+		}
+	}
+	if f, ok := l.fails[fk]; ok && f.count >= ldapMaxFailures && time.Since(f.since) < ldapFailWindow {
+		l.mu.Unlock()
+		return "", ErrLDAPCredentials
+	}
+	l.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	entry, err := l.search(conn, user)
+	if err != nil {
+		if errors.Is(err, ErrLDAPCredentials) {
+			l.fail(fk, user, client)
+		}
+		return "", err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			l.fail(fk, user, client)
+			return "", ErrLDAPCredentials
+		}
+		return "", err
+	}
+
+	key := l.mac("ldap:" + user)[:trojan.HeaderLen]
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, c := range l.creds {
+		if now.After(c.expires) {
+			delete(l.creds, k)
+		}
+	}
+	l.creds[id] = ldapCred{key: key, expires: now.Add(time.Duration(l.CacheTTL))}
+	delete(l.fails, fk)
+	u, ok := l.users[key]
+	if !ok {
+		u = &ldapUser{Name: user}
+		l.users[key] = u
+	}
+	u.DN = entry.DN
+	u.Groups = l.groups(entry)
+	u.Checked = now
+	return key, nil
+}
+
+// fail counts a failed bind of user from client, whose key is fk
+func (l *LDAP) fail(fk, user, client string) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, f := range l.fails {
+		if now.Sub(f.since) >= ldapFailWindow {
+			delete(l.fails, k)
+		}
+	}
+	f, ok := l.fails[fk]
+	if !ok {
+		f = &ldapFail{since: now}
+		l.fails[fk] = f
+	}
+	f.count++
+	if f.count == ldapMaxFailures {
+		l.logger.Info(fmt.Sprintf("reject ldap user %v from %v for %v after %v failed binds", user, client, ldapFailWindow, f.count))
+	}
+}
+
+// Owns returns whether key is of an LDAP user, which is accepted only
+// with user:password and never as a trojan password.
+func (l *LDAP) Owns(key string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.users[key]
+	return ok
+}
+
+// Validate returns whether key is of a user authenticated before, whose
+// entry is searched again after CacheTTL. Users are kept valid if the
+// server is unavailable.
+func (l *LDAP) Validate(key string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	u, ok := l.users[key]
+	if !ok {
+		l.mu.Unlock()
+		return false
+	}
+	if time.Since(u.Checked) < time.Duration(l.CacheTTL) {
+		l.mu.Unlock()
+		return true
+	}
+	name := u.Name
+	l.mu.Unlock()
+
+	entry, err := func() (*ldap.Entry, error) {
+		conn, err := l.dial()
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return l.search(conn, name)
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case errors.Is(err, ErrLDAPCredentials):
+		l.logger.Info(fmt.Sprintf("ldap user %v is removed", name))
+		delete(l.users, key)
+		for k, c := range l.creds {
+			if c.key == key {
+				delete(l.creds, k)
+			}
+		}
+		return false
+	case err != nil:
+		l.logger.Error(fmt.Sprintf("search ldap user %v error: %v", name, err))
+	default:
+		u.DN = entry.DN
+		u.Groups = l.groups(entry)
+		u.Checked = time.Now()
+	}
+	return true
+}
+
+// UserGroups returns trojan groups of the user of key.
+func (l *LDAP) UserGroups(key string) []string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if u, ok := l.users[key]; ok {
+		return u.Groups
+	}
+	return nil
+}
+
+// consume counts traffic of an ldap user and reports whether key is of one
+func (l *LDAP) consume(key string, nr, nw int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u, ok := l.users[key]
+	if ok {
+		u.Up += nr
+		u.Down += nw
+	}
+	return ok
+}
+
+// ldapUpstream accepts users authenticated by LDAP, whose traffic is
+// counted in memory.
+type ldapUpstream struct {
+	Upstream
+	ldap *LDAP
+}
+
+// Range is ...
+func (u *ldapUpstream) Range(fn func(string, int64, int64)) {
+	u.Upstream.Range(fn)
+
+	type User struct {
+		Key      string
+		Up, Down int64
+	}
+	users := []User{}
+	u.ldap.mu.Lock()
+	for k, v := range u.ldap.users {
+		users = append(users, User{Key: k, Up: v.Up, Down: v.Down})
+	}
+	u.ldap.mu.Unlock()
+	for _, v := range users {
+		fn(v.Key, v.Up, v.Down)
+	}
+}
+
+// Validate is ...
+func (u *ldapUpstream) Validate(k string) bool {
+	return u.Upstream.Validate(k) || u.ldap.Validate(k)
+}
+
+// Limited is ...
+func (u *ldapUpstream) Limited(k string) bool {
+	return limited(u.Upstream, k)
+}
+
+// Consume is ...
+func (u *ldapUpstream) Consume(k string, nr, nw int64) error {
+	if u.ldap.consume(k, nr, nw) {
+		return nil
+	}
+	return u.Upstream.Consume(k, nr, nw)
+}
+
+var _ Upstream = (*ldapUpstream)(nil)
@@ -0,0 +1,281 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// ldapEntry is an entry of testLDAPServer
+type ldapEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+// testLDAPServer is an in-process LDAP server supporting simple binds and
+// searches with and, or, not, equality and presence filters.
+type testLDAPServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	dns   map[string]*ldapEntry
+	binds atomic.Int32
+}
+
+func newTestLDAPServer(t *testing.T, entries map[string]*ldapEntry) *testLDAPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testLDAPServer{ln: ln, dns: entries}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testLDAPServer) URL() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ber.Tag(0): // bind
+			dn, pass := op.Children[1].Data.String(), op.Children[2].Data.String()
+			s.binds.Add(1)
+			code := int64(49)
+			s.mu.Lock()
+			if e, ok := s.dns[dn]; (ok && e.password == pass) || (dn == "" && pass == "") {
+				code = 0
+			}
+			s.mu.Unlock()
+			conn.Write(ldapResult(id, 1, code).Bytes())
+		case ber.Tag(3): // search
+			base := op.Children[0].Data.String()
+			s.mu.Lock()
+			for dn, e := range s.dns {
+				if !strings.HasSuffix(dn, base) || !ldapMatch(op.Children[6], e.attrs) {
+					continue
+				}
+				res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(4), nil, "")
+				res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				attrs := ber.NewSequence("")
+				for k, vals := range e.attrs {
+					attr := ber.NewSequence("")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range vals {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					attr.AppendChild(set)
+					attrs.AppendChild(attr)
+				}
+				res.AppendChild(attrs)
+				conn.Write(ldapMessage(id, res).Bytes())
+			}
+			s.mu.Unlock()
+			conn.Write(ldapResult(id, 5, 0).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.NewSequence("")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapResult(id int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapMessage(id, op)
+}
+
+func ldapMatch(f *ber.Packet, attrs map[string][]string) bool {
+	values := func(name string) []string {
+		for k, v := range attrs {
+			if strings.EqualFold(k, name) {
+				return v
+			}
+		}
+		return nil
+	}
+	switch f.Tag {
+	case 0: // and
+		for _, c := range f.Children {
+			if !ldapMatch(c, attrs) {
+				return false
+			}
+		}
+		return true
+	case 1: // or
+		for _, c := range f.Children {
+			if ldapMatch(c, attrs) {
+				return true
+			}
+		}
+		return false
+	case 2: // not
+		return !ldapMatch(f.Children[0], attrs)
+	case 3: // equality
+		for _, v := range values(f.Children[0].Data.String()) {
+			if strings.EqualFold(v, f.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	case 7: // present
+		return len(values(f.Data.String())) > 0
+	}
+	return false
+}
+
+func TestLDAP(t *testing.T) {
+	const vpn = "cn=vpn,ou=groups,dc=example,dc=com"
+	const staff = "cn=staff,ou=groups,dc=example,dc=com"
+	srv := newTestLDAPServer(t, map[string]*ldapEntry{
+		"cn=trojan,ou=services,dc=example,dc=com": {password: "service"},
+		"uid=alice,ou=people,dc=example,dc=com": {password: "alice-pass", attrs: map[string][]string{
+			"uid": {"alice"}, "memberOf": {vpn, staff},
+		}},
+		"uid=bob,ou=people,dc=example,dc=com": {password: "bob-pass", attrs: map[string][]string{
+			"uid": {"bob"}, "memberOf": {staff},
+		}},
+		"uid=carol,ou=people,dc=example,dc=com": {password: "carol-pass", attrs: map[string][]string{
+			"uid": {"carol"}, "memberOf": {vpn},
+		}},
+	})
+
+	l := &LDAP{
+		URL:          srv.URL(),
+		BindDN:       "cn=trojan,ou=services,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		Filter:       "(memberOf=" + vpn + ")",
+		Groups:       map[string]string{strings.ToUpper(staff): "staff"},
+		CacheTTL:     caddy.Duration(time.Hour),
+	}
+	if err := l.Provision(zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	u, keys := newTestMemoryUpstream(t, 1)
+	up := &ldapUpstream{Upstream: u, ldap: l}
+	ctx := context.Background()
+
+	key, err := l.Authenticate(ctx, "alice", "alice-pass", "1.2.3.4:5")
+	if err != nil || len(key) != trojan.HeaderLen {
+		t.Fatalf("authenticate error: %v %v", key, err)
+	}
+	if groups := l.UserGroups(key); len(groups) != 1 || groups[0] != "staff" {
+		t.Errorf("groups error: %v", groups)
+	}
+	b := [trojan.HeaderLen]byte{}
+	trojan.GenKey("alice", b[:])
+	if key == string(b[:]) {
+		t.Error("key is derived from the user name")
+	}
+
+	// successful binds are cached
+	binds := srv.binds.Load()
+	if k, err := l.Authenticate(ctx, "alice", "alice-pass", "1.2.3.4:5"); err != nil || k != key || srv.binds.Load() != binds {
+		t.Fatalf("cache error: %v %v", err, srv.binds.Load()-binds)
+	}
+
+	for _, v := range []struct{ user, pass string }{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"bob", "bob-pass"},
+		{"*", "alice-pass"},
+		{"nobody", "pass"},
+	} {
+		if _, err := l.Authenticate(ctx, v.user, v.pass, "1.2.3.4:5"); !errors.Is(err, ErrLDAPCredentials) {
+			t.Errorf("authenticate %v:%v error: %v", v.user, v.pass, err)
+		}
+	}
+
+	// ldap users are valid users of the upstream with traffic in memory
+	if !up.Validate(key) || !up.Validate(string(keys[0])) || up.Validate(string(b[:])) {
+		t.Fatal("validate error")
+	}
+	// but their keys are not trojan passwords
+	if !l.Owns(key) || l.Owns(string(keys[0])) || (*LDAP)(nil).Owns(key) {
+		t.Fatal("owns error")
+	}
+	up.Consume(key, 1, 2)
+	n := 0
+	up.Range(func(k string, nr, nw int64) {
+		n++
+		if k == key && (nr != 1 || nw != 2) {
+			t.Errorf("traffic error: %v %v", nr, nw)
+		}
+	})
+	if n != 2 {
+		t.Fatalf("range error: %v", n)
+	}
+
+	// users leaving the group are invalid after the cache expires
+	srv.mu.Lock()
+	srv.dns["uid=alice,ou=people,dc=example,dc=com"].attrs["memberOf"] = []string{staff}
+	srv.mu.Unlock()
+	if !up.Validate(key) {
+		t.Fatal("validate cached user error")
+	}
+	l.CacheTTL = caddy.Duration(0)
+	if up.Validate(key) {
+		t.Fatal("validate removed user error")
+	}
+	if _, err := l.Authenticate(ctx, "alice", "alice-pass", "1.2.3.4:5"); !errors.Is(err, ErrLDAPCredentials) {
+		t.Fatalf("authenticate removed user error: %v", err)
+	}
+
+	// users with too many failed binds are rejected without a bind
+	for i := 0; i < ldapMaxFailures; i++ {
+		if _, err := l.Authenticate(ctx, "carol", "wrong", "1.2.3.4:5"); !errors.Is(err, ErrLDAPCredentials) {
+			t.Fatalf("authenticate wrong password error: %v", err)
+		}
+	}
+	binds = srv.binds.Load()
+	if _, err := l.Authenticate(ctx, "carol", "carol-pass", "1.2.3.4:6"); !errors.Is(err, ErrLDAPCredentials) || srv.binds.Load() != binds {
+		t.Fatalf("authenticate limited user error: %v %v", err, srv.binds.Load()-binds)
+	}
+	// other clients are not locked out
+	if _, err := l.Authenticate(ctx, "carol", "carol-pass", "5.6.7.8:5"); err != nil {
+		t.Fatalf("authenticate from other ip error: %v", err)
+	}
+	l.mu.Lock()
+	l.fails["carol\x001.2.3.4"].since = time.Now().Add(-ldapFailWindow)
+	l.mu.Unlock()
+	if _, err := l.Authenticate(ctx, "carol", "carol-pass", "1.2.3.4:5"); err != nil {
+		t.Fatalf("authenticate after the window error: %v", err)
+	}
+}
@@ -0,0 +1,362 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// localSite is a site of this caddy instance which is served in-process.
+type localSite struct {
+	// Name is ...
+	Name string
+	// Hosts are host names of the site, *.example.com matches one label.
+	Hosts []string
+	// Ports are ...
+	Ports []int
+	// Handler is ...
+	Handler http.Handler
+	// TLS is the config to terminate TLS, nil for plain HTTP.
+	TLS *tls.Config
+	// HTTP2 is ...
+	HTTP2 bool
+
+	once sync.Once
+	ln   *localListener
+	srv  *http.Server
+}
+
+// Match returns whether host and port are of s.
+func (s *localSite) Match(host string, port int) bool {
+	if !slices.Contains(s.Ports, port) {
+		return false
+	}
+	for _, v := range s.Hosts {
+		if v == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(v, "*."); ok {
+			if label, ok := strings.CutSuffix(host, "."+suffix); ok && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serve starts the http server of s on first use
+func (s *localSite) serve(lg *zap.Logger) {
+	s.once.Do(func() {
+		s.ln = newLocalListener()
+		s.srv = &http.Server{
+			Handler:  s.Handler,
+			ErrorLog: zap.NewStdLog(lg),
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, caddyhttp.ConnCtxKey, c)
+			},
+		}
+		if s.HTTP2 {
+			http2.ConfigureServer(s.srv, nil)
+		}
+		if s.TLS != nil {
+			go s.srv.Serve(tls.NewListener(s.ln, s.TLS))
+		} else {
+			go s.srv.Serve(s.ln)
+		}
+	})
+}
+
+// Dial returns an in-memory connection to the site, remote is the address
+// of the client seen by the site.
+func (s *localSite) Dial(ctx context.Context, port int, remote net.Addr, lg *zap.Logger) (net.Conn, error) {
+	s.serve(lg)
+	if s.ln == nil {
+		return nil, net.ErrClosed
+	}
+	c, peer := net.Pipe()
+	conn := &localConn{
+		Conn:   peer,
+		local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		remote: remote,
+	}
+	if err := s.ln.push(ctx, conn); err != nil {
+		c.Close()
+		peer.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close is ...
+func (s *localSite) Close() error {
+	s.once.Do(func() {})
+	if s.srv == nil {
+		return nil
+	}
+	s.ln.Close()
+	return s.srv.Close()
+}
+
+// localConn is the server side of an in-memory connection
+type localConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+// LocalAddr is ...
+func (c *localConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr is ...
+func (c *localConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// localListener accepts in-memory connections
+type localListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// newLocalListener is ...
+func newLocalListener() *localListener {
+	return &localListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// push passes c to Accept, or returns the error of ctx if it is done
+// before c is accepted
+func (l *localListener) push(ctx context.Context, c net.Conn) error {
+	select {
+	case <-l.closed:
+		return net.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case l.conns <- c:
+		return nil
+	}
+}
+
+// Accept is ...
+func (l *localListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, os.ErrClosed
+	case c := <-l.conns:
+		return c, nil
+	}
+}
+
+// Close is ...
+func (l *localListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr is ...
+func (l *localListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// LocalSites finds sites of the caddy http app matching tunnel targets.
+type LocalSites struct {
+	ctx    caddy.Context
+	logger *zap.Logger
+
+	once  sync.Once
+	sites []*localSite
+}
+
+// NewLocalSites returns LocalSites of the http app of ctx, sites are
+// loaded on first use as the http app is provisioned after the trojan app.
+func NewLocalSites(ctx caddy.Context, lg *zap.Logger) *LocalSites {
+	return &LocalSites{ctx: ctx, logger: lg}
+}
+
+// load collects sites with host matchers of the http app
+func (ls *LocalSites) load() {
+	mod, err := ls.ctx.AppIfConfigured("http")
+	if err != nil {
+		return
+	}
+	httpApp := mod.(*caddyhttp.App)
+	httpPort := httpApp.HTTPPort
+	if httpPort == 0 {
+		httpPort = caddyhttp.DefaultHTTPPort
+	}
+
+	names := make([]string, 0, len(httpApp.Servers))
+	for name := range httpApp.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		srv := httpApp.Servers[name]
+		hosts := []string{}
+		for _, route := range srv.Routes {
+			for _, set := range route.MatcherSets {
+				for _, m := range set {
+					if hm, ok := m.(*caddyhttp.MatchHost); ok {
+						for _, v := range *hm {
+							if !strings.Contains(v, "{") {
+								hosts = append(hosts, strings.ToLower(v))
+							}
+						}
+					}
+				}
+			}
+		}
+		if len(hosts) == 0 {
+			continue
+		}
+
+		plain := &localSite{Name: name, Hosts: hosts, Handler: srv}
+		secure := &localSite{Name: name, Hosts: hosts, Handler: srv, HTTP2: slices.Contains(srv.Protocols, "h2")}
+		for _, v := range srv.Listen {
+			addr, err := caddy.ParseNetworkAddress(v)
+			if err != nil || addr.IsUnixNetwork() || addr.IsFdNetwork() {
+				continue
+			}
+			for port := addr.StartPort; port <= addr.EndPort; port++ {
+				if len(srv.TLSConnPolicies) > 0 && int(port) != httpPort {
+					secure.Ports = append(secure.Ports, int(port))
+				} else {
+					plain.Ports = append(plain.Ports, int(port))
+				}
+			}
+		}
+		if len(plain.Ports) > 0 {
+			ls.sites = append(ls.sites, plain)
+		}
+		if len(secure.Ports) > 0 {
+			secure.TLS = srv.TLSConnPolicies.TLSConfig(ls.ctx)
+			ls.sites = append(ls.sites, secure)
+		}
+	}
+	for _, s := range ls.sites {
+		ls.logger.Info(fmt.Sprintf("serve local site %v of %v on ports %v in-process", s.Name, s.Hosts, s.Ports))
+	}
+}
+
+// Match returns the site of a tcp target or nil.
+func (ls *LocalSites) Match(network, addr string) (*localSite, int) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, 0
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, 0
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	ls.once.Do(ls.load)
+	for _, s := range ls.sites {
+		if s.Match(host, port) {
+			return s, port
+		}
+	}
+	return nil, 0
+}
+
+// Close is ...
+func (ls *LocalSites) Close() error {
+	ls.once.Do(func() {})
+	for _, s := range ls.sites {
+		s.Close()
+	}
+	return nil
+}
+
+// localProxy serves targets of local sites in-process.
+type localProxy struct {
+	Proxy
+	sites  *LocalSites
+	policy *Policy
+}
+
+// Handle is ...
+func (p *localProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
+}
+
+// Close is ...
+func (p *localProxy) Close() error {
+	p.sites.Close()
+	return p.Proxy.Close()
+}
+
+// Dial is ...
+func (p *localProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is ...
+func (p *localProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	site, port := p.sites.Match(network, addr)
+	if site == nil {
+		return trojan.DialContext(ctx, p.Proxy, network, addr)
+	}
+	s := SessionFromContext(ctx)
+	if action, _ := p.policy.Route(s, network, addr); action == PolicyDeny {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrPolicyDenied}
+	}
+	remote := net.Addr(&net.TCPAddr{IP: net.IPv4zero})
+	if s != nil {
+		if ap, err := netip.ParseAddrPort(s.RemoteAddr); err == nil {
+			remote = net.TCPAddrFromAddrPort(ap)
+		}
+	}
+	return site.Dial(ctx, port, remote, p.sites.logger)
+}
+
+// ListenPacket is ...
+func (p *localProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return p.ListenPacketContext(context.Background(), network, addr)
+}
+
+// ListenPacketContext is ...
+func (p *localProxy) ListenPacketContext(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	return trojan.ListenPacketContext(ctx, p.Proxy, network, addr)
+}
+
+// ListenPing is ...
+func (p *localProxy) ListenPing(ctx context.Context) (net.PacketConn, error) {
+	return trojan.ListenPing(ctx, p.Proxy)
+}
+
+var (
+	_ Proxy                        = (*localProxy)(nil)
+	_ trojan.ContextDialer         = (*localProxy)(nil)
+	_ trojan.ContextPacketListener = (*localProxy)(nil)
+	_ trojan.Pinger                = (*localProxy)(nil)
+	_ net.Listener                 = (*localListener)(nil)
+)
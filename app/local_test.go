@@ -0,0 +1,202 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	_ "github.com/caddyserver/caddy/v2/modules/filestorage"
+	"go.uber.org/zap"
+)
+
+func TestLocalSites(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v %v %v", r.Host, r.RemoteAddr, r.TLS != nil, r.ProtoMajor)
+	})
+	// the certificate of httptest is for example.com
+	ts := httptest.NewTLSServer(handler)
+	defer ts.Close()
+
+	ls := &LocalSites{logger: zap.NewNop()}
+	ls.once.Do(func() {})
+	ls.sites = []*localSite{
+		{Name: "dash", Hosts: []string{"dash.internal", "*.svc.internal"}, Ports: []int{80}, Handler: handler},
+		{Name: "site", Hosts: []string{"example.com"}, Ports: []int{443}, Handler: handler, HTTP2: true,
+			TLS: &tls.Config{Certificates: ts.TLS.Certificates, NextProtos: []string{"h2", "http/1.1"}}},
+	}
+
+	p := &Policy{Target: []PolicyRule{{Match: "target.host == 'dash.internal' && client.ip == '5.6.7.8'", Action: PolicyDeny}}}
+	if err := p.Provision(nil, func(key string) map[string]any { return map[string]any{"key": key} }, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	px := &localProxy{Proxy: &NoProxy{}, sites: ls, policy: p}
+	defer px.Close()
+
+	for _, v := range []struct {
+		network, addr string
+		ok            bool
+	}{
+		{"tcp", "dash.internal:80", true},
+		{"tcp4", "DASH.internal.:80", true},
+		{"tcp", "a.svc.internal:80", true},
+		{"tcp", "a.b.svc.internal:80", false},
+		{"tcp", "dash.internal:8080", false},
+		{"udp", "dash.internal:80", false},
+		{"tcp", "example.com:443", true},
+		{"tcp", "example.com:80", false},
+	} {
+		if s, _ := ls.Match(v.network, v.addr); (s != nil) != v.ok {
+			t.Errorf("match %v %v error", v.network, v.addr)
+		}
+	}
+
+	client := func(remote string) *http.Client {
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return px.DialContext(NewSession("key", TransportTLS, remote, "").Context(ctx), network, addr)
+			},
+			TLSClientConfig:   &tls.Config{RootCAs: ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+			ForceAttemptHTTP2: true,
+		}
+		return &http.Client{Transport: tr}
+	}
+
+	for _, v := range []struct {
+		url, body string
+	}{
+		{"http://a.svc.internal/", "a.svc.internal 1.2.3.4:5 false 1"},
+		{"https://example.com/", "example.com 1.2.3.4:5 true 2"},
+	} {
+		resp, err := client("1.2.3.4:5").Get(v.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != v.body {
+			t.Errorf("get %v error: %q", v.url, b)
+		}
+	}
+
+	if _, err := client("5.6.7.8:9").Get("http://dash.internal/"); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("policy error: %v", err)
+	}
+}
+
+func TestLocalSitesLoad(t *testing.T) {
+	// caddy only loads modules of json.RawMessage of encoding/json
+	if reflect.TypeOf(json.RawMessage{}).PkgPath() != "encoding/json" {
+		t.Skip("json.RawMessage is not of encoding/json")
+	}
+
+	storage, _ := json.Marshal(map[string]string{"module": "file_system", "root": t.TempDir()})
+	cfg := &caddy.Config{
+		Admin:      &caddy.AdminConfig{Disabled: true},
+		StorageRaw: storage,
+		AppsRaw: caddy.ModuleMap{"http": json.RawMessage(`{
+			"http_port": 8081,
+			"servers": {
+				"dash": {
+					"listen": [":8080"],
+					"automatic_https": {"disable": true},
+					"routes": [{
+						"match": [{"host": ["dash.internal", "{env.HOST}"]}],
+						"handle": [{"handler": "static_response", "body": "{http.request.host} {http.request.remote}"}]
+					}]
+				},
+				"site": {
+					"listen": [":8081", ":8443-8444"],
+					"protocols": ["h1", "h2"],
+					"automatic_https": {"disable": true},
+					"tls_connection_policies": [{}],
+					"routes": [{
+						"match": [{"host": ["example.com"]}],
+						"handle": [{"handler": "static_response", "body": "site"}]
+					}]
+				},
+				"any": {
+					"listen": [":9000"],
+					"routes": [{"handle": [{"handler": "static_response", "body": "any"}]}]
+				}
+			}
+		}`)},
+	}
+	ctx, err := caddy.ProvisionContext(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := NewLocalSites(ctx, zap.NewNop())
+	px := &localProxy{Proxy: &NoProxy{}, sites: ls}
+	defer px.Close()
+
+	for _, v := range []struct {
+		addr   string
+		name   string
+		secure bool
+	}{
+		{"dash.internal:8080", "dash", false},
+		{"example.com:8081", "site", false},
+		{"example.com:8444", "site", true},
+		{"dash.internal:8443", "", false},
+		{"other.internal:9000", "", false},
+	} {
+		s, _ := ls.Match("tcp", v.addr)
+		if v.name == "" {
+			if s != nil {
+				t.Errorf("match %v error: %v", v.addr, s.Name)
+			}
+			continue
+		}
+		if s == nil || s.Name != v.name || (s.TLS != nil) != v.secure || s.HTTP2 != v.secure {
+			t.Errorf("match %v error: %+v", v.addr, s)
+		}
+	}
+	if len(ls.sites) != 3 {
+		t.Fatalf("sites error: %v", len(ls.sites))
+	}
+
+	// requests are served by the caddy server of the site
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return px.DialContext(NewSession("key", TransportTLS, "1.2.3.4:5", "").Context(ctx), network, addr)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get("http://dash.internal:8080/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "dash.internal 1.2.3.4:5" {
+		t.Fatalf("response error: %q", b)
+	}
+}
+
+func TestLocalListenerPush(t *testing.T) {
+	l := newLocalListener()
+	defer l.Close()
+	c, peer := net.Pipe()
+	defer c.Close()
+	defer peer.Close()
+
+	// a connection which is not accepted is given up with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.push(ctx, c); !errors.Is(err, context.Canceled) {
+		t.Fatalf("push error: %v", err)
+	}
+	l.Close()
+	if err := l.push(context.Background(), c); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("push to closed listener error: %v", err)
+	}
+}
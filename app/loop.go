@@ -0,0 +1,40 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// loop runs a function periodically in a goroutine until it is stopped
+type loop struct {
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Start is ...
+func (l *loop) Start(d time.Duration, fn func()) {
+	l.done = make(chan struct{})
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for the running function to return.
+func (l *loop) Stop() {
+	if l.done == nil {
+		return
+	}
+	close(l.done)
+	l.wg.Wait()
+}
@@ -0,0 +1,408 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func init() {
+	caddy.RegisterModule(MASQUEProxy{})
+}
+
+// ErrMASQUEUDP is returned when a UDP association is made through a
+// proxy which does not support HTTP Datagrams.
+var ErrMASQUEUDP = errors.New("masque: udp is not supported")
+
+// MASQUEProxy dials TCP targets with HTTP/3 or HTTP/2 CONNECT requests
+// and UDP targets with CONNECT-UDP requests of RFC 9298 to a proxy. All
+// requests share one connection to the proxy.
+type MASQUEProxy struct {
+	// Server is the address of the proxy.
+	Server string `json:"server"`
+	// ServerName is the TLS server name, default is the host of Server.
+	ServerName string `json:"server_name,omitempty"`
+	// CAFile is a PEM file of certificates the proxy is verified with,
+	// default is the system pool.
+	CAFile string `json:"ca_file,omitempty"`
+	// Username is ..., placeholders such as {env.MASQUE_USER} are supported.
+	Username string `json:"username,omitempty"`
+	// Password is ..., placeholders such as {env.MASQUE_PASSWORD} are supported.
+	Password string `json:"password,omitempty"`
+	// Template is the URI template of CONNECT-UDP requests, default is
+	// https://<server>/.well-known/masque/udp/{target_host}/{target_port}/
+	Template string `json:"template,omitempty"`
+	// HTTP2 uses HTTP/2 instead of HTTP/3, UDP is not supported.
+	HTTP2 bool `json:"http2,omitempty"`
+	// DialTimeout is the timeout of connecting to the proxy, default is 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	auth string
+	tls  *tls.Config
+	h2   *http2.Transport
+	slot *masqueSlot
+}
+
+// masqueSlot holds the HTTP/3 connection to the proxy
+type masqueSlot struct {
+	mu   sync.Mutex
+	conn *masqueConn
+}
+
+// masqueConn is an HTTP/3 connection to the proxy
+type masqueConn struct {
+	quic.Connection
+	cc *http3.ClientConn
+}
+
+// CaddyModule is ...
+func (MASQUEProxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.proxies.masque",
+		New: func() caddy.Module { return new(MASQUEProxy) },
+	}
+}
+
+// Provision is ...
+func (p *MASQUEProxy) Provision(ctx caddy.Context) error {
+	if p.Server == "" {
+		return errors.New("masque: server is empty")
+	}
+	host, _, err := net.SplitHostPort(p.Server)
+	if err != nil {
+		return fmt.Errorf("masque: server error: %w", err)
+	}
+	if p.ServerName == "" {
+		p.ServerName = host
+	}
+	if p.Template == "" {
+		p.Template = "https://" + p.Server + "/.well-known/masque/udp/{target_host}/{target_port}/"
+	}
+	if _, err := url.Parse(p.Template); err != nil {
+		return fmt.Errorf("masque: template error: %w", err)
+	}
+	if p.DialTimeout == 0 {
+		p.DialTimeout = caddy.Duration(10 * time.Second)
+	}
+
+	p.slot = &masqueSlot{}
+	p.tls = &tls.Config{ServerName: p.ServerName}
+	if p.CAFile != "" {
+		b, err := os.ReadFile(p.CAFile)
+		if err != nil {
+			return fmt.Errorf("masque: read ca file error: %w", err)
+		}
+		p.tls.RootCAs = x509.NewCertPool()
+		if !p.tls.RootCAs.AppendCertsFromPEM(b) {
+			return fmt.Errorf("masque: no certificate in %v", p.CAFile)
+		}
+	}
+
+	repl := caddy.NewReplacer()
+	if user := repl.ReplaceKnown(p.Username, ""); user != "" {
+		p.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+repl.ReplaceKnown(p.Password, "")))
+	}
+
+	if p.HTTP2 {
+		p.h2 = &http2.Transport{
+			TLSClientConfig: p.tls,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				d := &tls.Dialer{NetDialer: &net.Dialer{Timeout: time.Duration(p.DialTimeout)}, Config: cfg}
+				return d.DialContext(ctx, network, addr)
+			},
+			ReadIdleTimeout: 30 * time.Second,
+		}
+	}
+	return nil
+}
+
+// Handle is ...
+func (p *MASQUEProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
+}
+
+// Close closes the connection to the proxy.
+func (p *MASQUEProxy) Close() error {
+	if p.h2 != nil {
+		p.h2.CloseIdleConnections()
+	}
+	s := p.slot
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+		s.conn = nil
+	}
+	return nil
+}
+
+// Dial is ...
+func (p *MASQUEProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext sends a CONNECT request of addr.
+func (p *MASQUEProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("masque: network %v is not supported", network)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: p.Server},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if p.auth != "" {
+		req.Header.Set("Proxy-Authorization", p.auth)
+	}
+	if p.HTTP2 {
+		return p.dialHTTP2(ctx, req)
+	}
+
+	str, c, err := p.request(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	return &masqueStreamConn{RequestStream: str, local: c.LocalAddr(), remote: c.RemoteAddr()}, nil
+}
+
+// ListenPacket is ...
+func (p *MASQUEProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return p.ListenPacketContext(context.Background(), network, addr)
+}
+
+// ListenPacketContext returns a packet conn which sends a CONNECT-UDP
+// request for every target.
+func (p *MASQUEProxy) ListenPacketContext(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	if p.HTTP2 {
+		return nil, ErrMASQUEUDP
+	}
+	return newMASQUEPacketConn(ctx, p), nil
+}
+
+// connect returns the connection to the proxy and connects to the proxy
+// if there is none.
+func (p *MASQUEProxy) connect(ctx context.Context) (*masqueConn, error) {
+	s := p.slot
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && s.conn.Context().Err() == nil {
+		return s.conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.DialTimeout))
+	defer cancel()
+	tlsConfig := p.tls.Clone()
+	tlsConfig.NextProtos = []string{http3.NextProtoH3}
+	conn, err := quic.DialAddr(ctx, p.Server, tlsConfig, &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: 15 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("masque: connect %v error: %w", p.Server, err)
+	}
+	tr := &http3.Transport{EnableDatagrams: true}
+	s.conn = &masqueConn{Connection: conn, cc: tr.NewClientConn(conn)}
+	return s.conn, nil
+}
+
+// drop closes c and removes it from p
+func (p *MASQUEProxy) drop(c *masqueConn) {
+	p.slot.mu.Lock()
+	if p.slot.conn == c {
+		p.slot.conn = nil
+	}
+	p.slot.mu.Unlock()
+	c.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+}
+
+// request sends req on a new request stream, a broken connection is
+// replaced and the request is sent again once. Datagram support of the
+// proxy is required if datagram is true.
+func (p *MASQUEProxy) request(ctx context.Context, req *http.Request, datagram bool) (http3.RequestStream, *masqueConn, error) {
+	for retry := 0; ; retry++ {
+		c, err := p.connect(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		str, err := c.cc.OpenRequestStream(ctx)
+		if err != nil {
+			if ctx.Err() != nil || retry > 0 {
+				return nil, nil, fmt.Errorf("masque: open stream error: %w", err)
+			}
+			p.drop(c)
+			continue
+		}
+
+		if datagram {
+			select {
+			case <-c.cc.ReceivedSettings():
+			case <-ctx.Done():
+				str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+				str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+				return nil, nil, ctx.Err()
+			}
+			if s := c.cc.Settings(); !s.EnableDatagrams || !s.EnableExtendedConnect {
+				str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+				str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+				return nil, nil, ErrMASQUEUDP
+			}
+		}
+
+		resp, err := func() (*http.Response, error) {
+			if err := str.SendRequestHeader(req); err != nil {
+				return nil, err
+			}
+			return str.ReadResponse()
+		}()
+		if err == nil && resp.StatusCode/100 == 2 {
+			return str, c, nil
+		}
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		if err != nil {
+			return nil, nil, fmt.Errorf("masque: request %v error: %w", req.Host, err)
+		}
+		return nil, nil, fmt.Errorf("masque: request %v error: %v", req.Host, resp.Status)
+	}
+}
+
+// dialHTTP2 sends req as an HTTP/2 CONNECT request
+func (p *MASQUEProxy) dialHTTP2(ctx context.Context, req *http.Request) (net.Conn, error) {
+	pr, pw := io.Pipe()
+	req = req.WithContext(context.WithoutCancel(ctx))
+	req.Body = pr
+
+	type Result struct {
+		Resp *http.Response
+		Err  error
+	}
+	ch := make(chan Result, 1)
+	go func() {
+		resp, err := p.h2.RoundTrip(req)
+		ch <- Result{Resp: resp, Err: err}
+	}()
+
+	r := Result{}
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		pw.CloseWithError(ctx.Err())
+		go func() {
+			if r := <-ch; r.Resp != nil {
+				r.Resp.Body.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	if r.Err != nil {
+		pw.Close()
+		return nil, fmt.Errorf("masque: request %v error: %w", req.Host, r.Err)
+	}
+	if r.Resp.StatusCode/100 != 2 {
+		pw.Close()
+		r.Resp.Body.Close()
+		return nil, fmt.Errorf("masque: request %v error: %v", req.Host, r.Resp.Status)
+	}
+	return newMASQUEH2Conn(pw, r.Resp.Body), nil
+}
+
+// masqueStreamConn is the request stream of a CONNECT request
+type masqueStreamConn struct {
+	http3.RequestStream
+	local  net.Addr
+	remote net.Addr
+}
+
+// CloseWrite is ...
+func (c *masqueStreamConn) CloseWrite() error {
+	return c.RequestStream.Close()
+}
+
+// Close is ...
+func (c *masqueStreamConn) Close() error {
+	c.RequestStream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return c.RequestStream.Close()
+}
+
+// LocalAddr is ...
+func (c *masqueStreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr is ...
+func (c *masqueStreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// masqueH2Conn is the tunnel of an HTTP/2 CONNECT request. Reads go
+// through a pipe fed by the response body, which adds read deadlines.
+type masqueH2Conn struct {
+	net.Conn
+	w    io.WriteCloser
+	body io.ReadCloser
+}
+
+// newMASQUEH2Conn is ...
+func newMASQUEH2Conn(w io.WriteCloser, body io.ReadCloser) *masqueH2Conn {
+	c, peer := net.Pipe()
+	go func() {
+		io.Copy(peer, body)
+		peer.Close()
+	}()
+	return &masqueH2Conn{Conn: c, w: w, body: body}
+}
+
+// Write is ...
+func (c *masqueH2Conn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// CloseWrite is ...
+func (c *masqueH2Conn) CloseWrite() error {
+	return c.w.Close()
+}
+
+// Close is ...
+func (c *masqueH2Conn) Close() error {
+	c.Conn.Close()
+	c.w.Close()
+	return c.body.Close()
+}
+
+// SetDeadline is ...
+func (c *masqueH2Conn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is not supported by request bodies and is ignored.
+func (c *masqueH2Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+var (
+	_ Proxy                        = (*MASQUEProxy)(nil)
+	_ caddy.Provisioner            = (*MASQUEProxy)(nil)
+	_ trojan.ContextDialer         = (*MASQUEProxy)(nil)
+	_ trojan.ContextPacketListener = (*MASQUEProxy)(nil)
+)
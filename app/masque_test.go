@@ -0,0 +1,252 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/imgk/caddy-trojan/socks"
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// masqueHandler is an HTTP/3 and HTTP/2 stand-in of a MASQUE proxy
+func masqueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("trojan:secret")) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	if r.Proto == "connect-udp" {
+		// /.well-known/masque/udp/{target_host}/{target_port}/
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 5 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rc, err := net.Dial("udp", net.JoinHostPort(parts[3], parts[4]))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rc.Close()
+		w.Header().Set(http3.CapsuleProtocolHeader, "?1")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		str := w.(http3.HTTPStreamer).HTTPStream()
+		defer str.Close()
+		go func() {
+			for {
+				b, err := str.ReceiveDatagram(r.Context())
+				if err != nil {
+					return
+				}
+				if len(b) > 0 && b[0] == 0 {
+					rc.Write(b[1:])
+				}
+			}
+		}()
+		go func() {
+			b := make([]byte, 1500)
+			for {
+				n, err := rc.Read(b)
+				if err != nil {
+					return
+				}
+				str.SendDatagram(append([]byte{0}, b[:n]...))
+			}
+		}()
+		io.Copy(io.Discard, str)
+		return
+	}
+
+	rc, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer rc.Close()
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	rd, wr := io.Reader(r.Body), io.Writer(&flushWriter{w})
+	if hs, ok := w.(http3.HTTPStreamer); ok {
+		str := hs.HTTPStream()
+		defer str.Close()
+		rd, wr = str, str
+	}
+	go func() {
+		io.Copy(rc, rd)
+		rc.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(wr, rc)
+}
+
+// flushWriter flushes every write
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.ResponseWriter.(http.Flusher).Flush()
+	return n, err
+}
+
+// echoUDP echoes packets of pc
+func echoUDP(pc net.PacketConn) {
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		pc.WriteTo(b[:n], addr)
+	}
+}
+
+// newMASQUEServer starts HTTP/2 and HTTP/3 stand-ins on the same port, it
+// returns the address and the CA file.
+func newMASQUEServer(t *testing.T) (string, string) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(masqueHandler))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	pc, err := net.ListenPacket("udp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{
+		Handler:         http.HandlerFunc(masqueHandler),
+		TLSConfig:       http3.ConfigureTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}),
+		EnableDatagrams: true,
+	}
+	go srv.Serve(pc)
+	t.Cleanup(func() {
+		srv.Close()
+		pc.Close()
+	})
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return ts.Listener.Addr().String(), caFile
+}
+
+func newTestMASQUEProxy(t *testing.T, p *MASQUEProxy) *MASQUEProxy {
+	if err := p.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestMASQUEProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	n, _ := strconv.Atoi(port)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go echoUDP(pc)
+
+	server, caFile := newMASQUEServer(t)
+	for _, h2 := range []bool{false, true} {
+		p := newTestMASQUEProxy(t, &MASQUEProxy{Server: server, CAFile: caFile, Username: "trojan", Password: "secret", HTTP2: h2})
+
+		for i := 0; i < 2; i++ {
+			c, err := p.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("http2 %v: dial error: %v", h2, err)
+			}
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+				t.Fatalf("http2 %v: echo error: %q %v", h2, b, err)
+			}
+			c.Close()
+		}
+
+		payload := string(bytes.Repeat([]byte("ping"), 0x4000))
+		w := &bytes.Buffer{}
+		if _, _, err := p.Handle(context.Background(), trojanRequest(host, uint16(n), payload), w); err != nil || w.String() != payload {
+			t.Fatalf("http2 %v: handle error: %v %v", h2, w.Len(), err)
+		}
+
+		if h2 {
+			if _, err := p.ListenPacket("udp", ""); !errors.Is(err, ErrMASQUEUDP) {
+				t.Fatalf("http2 udp error: %v", err)
+			}
+			continue
+		}
+
+		// udp targets share the connection of tcp targets
+		conn := p.slot.conn
+		addr := pc.LocalAddr().(*net.UDPAddr)
+		req := []byte{socks.AddrTypeIPv4, 127, 0, 0, 1, byte(addr.Port >> 8), byte(addr.Port), 0, 4, '\r', '\n', 'p', 'i', 'n', 'g'}
+		r, rw := io.Pipe()
+		resp, ww := io.Pipe()
+		go func() {
+			trojan.HandleUDP(r, ww, 100*time.Millisecond, p)
+			ww.Close()
+		}()
+		for i := 0; i < 2; i++ {
+			go rw.Write(req)
+			b := make([]byte, len(req))
+			if _, err := io.ReadFull(resp, b); err != nil || !bytes.Equal(b, req) {
+				t.Fatalf("handle udp error: %v %v", b, err)
+			}
+		}
+		rw.Close()
+		io.Copy(io.Discard, resp)
+		if p.slot.conn != conn {
+			t.Fatal("connection is not reused")
+		}
+
+		// a closed connection is replaced
+		conn.CloseWithError(0, "")
+		c, err := p.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("reconnect error: %v", err)
+		}
+		c.Close()
+	}
+
+	p := newTestMASQUEProxy(t, &MASQUEProxy{Server: server, CAFile: caFile, Username: "trojan", Password: "wrong"})
+	if _, err := p.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatal("proxy auth error")
+	}
+}
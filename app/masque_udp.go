@@ -0,0 +1,270 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// masqueLinger is the time flows of a closed packet conn keep accepting
+// datagrams. quic-go stops receiving datagrams of a connection once a
+// datagram of an unknown stream arrives, so that streams are released
+// after datagrams in flight.
+const masqueLinger = time.Second
+
+// masquePacket is ...
+type masquePacket struct {
+	b    []byte
+	addr *net.UDPAddr
+}
+
+// masqueFlow is the CONNECT-UDP request of a target
+type masqueFlow struct {
+	ready chan struct{}
+	str   http3.RequestStream
+	err   error
+	addr  *net.UDPAddr
+}
+
+// masquePacketConn sends packets of each target through its own
+// CONNECT-UDP request, requests share the connection to the proxy
+type masquePacketConn struct {
+	p      *MASQUEProxy
+	ctx    context.Context
+	cancel context.CancelFunc
+	in     chan masquePacket
+
+	mu       sync.Mutex
+	flows    map[string]*masqueFlow
+	deadline time.Time
+	wake     chan struct{}
+}
+
+// newMASQUEPacketConn is ...
+func newMASQUEPacketConn(ctx context.Context, p *MASQUEProxy) *masquePacketConn {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	return &masquePacketConn{
+		p:      p,
+		ctx:    ctx,
+		cancel: cancel,
+		in:     make(chan masquePacket, 64),
+		flows:  make(map[string]*masqueFlow),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// ReadFrom is ...
+func (c *masquePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		timer := (*time.Timer)(nil)
+		timeout := (<-chan time.Time)(nil)
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case pkt := <-c.in:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, pkt.b), pkt.addr, nil
+		case <-c.ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-c.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// WriteTo is ...
+func (c *masquePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	f, err := c.flow(addr)
+	if err != nil {
+		return 0, err
+	}
+	// the context id of UDP payloads is 0
+	if err := f.str.SendDatagram(append([]byte{0}, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flow returns the flow of addr and sends a CONNECT-UDP request if
+// there is none
+func (c *masquePacketConn) flow(addr net.Addr) (*masqueFlow, error) {
+	key := addr.String()
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	f, ok := c.flows[key]
+	if !ok {
+		f = &masqueFlow{ready: make(chan struct{})}
+		c.flows[key] = f
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-f.ready
+		return f, f.err
+	}
+
+	f.addr, f.str, f.err = c.connect(addr)
+	close(f.ready)
+	if f.err != nil {
+		c.remove(key, f)
+		return nil, f.err
+	}
+	go c.receive(key, f)
+	return f, nil
+}
+
+// connect sends the CONNECT-UDP request of addr
+func (c *masquePacketConn) connect(addr net.Addr) (*net.UDPAddr, http3.RequestStream, error) {
+	raddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		ua, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return nil, nil, err
+		}
+		raddr = ua
+	}
+
+	host := raddr.IP.String()
+	if raddr.IP.To4() == nil {
+		host = strings.ReplaceAll(host, ":", "%3A")
+	}
+	u, err := url.Parse(strings.NewReplacer(
+		"{target_host}", host,
+		"{target_port}", strconv.Itoa(raddr.Port),
+	).Replace(c.p.Template))
+	if err != nil {
+		return nil, nil, fmt.Errorf("masque: template error: %w", err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  "connect-udp",
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{http3.CapsuleProtocolHeader: []string{"?1"}},
+	}
+	if c.p.auth != "" {
+		req.Header.Set("Proxy-Authorization", c.p.auth)
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, time.Duration(c.p.DialTimeout))
+	defer cancel()
+	str, _, err := c.p.request(ctx, req, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raddr, str, nil
+}
+
+// receive delivers datagrams of f until the request is closed
+func (c *masquePacketConn) receive(key string, f *masqueFlow) {
+	defer c.remove(key, f)
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	go func() {
+		// capsules are not used
+		io.Copy(io.Discard, f.str)
+		cancel()
+	}()
+
+	for {
+		b, err := f.str.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if len(b) == 0 || b[0] != 0 {
+			continue
+		}
+		select {
+		case c.in <- masquePacket{b: b[1:], addr: f.addr}:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// remove closes f and removes it from c
+func (c *masquePacketConn) remove(key string, f *masqueFlow) {
+	c.mu.Lock()
+	if c.flows[key] == f {
+		delete(c.flows, key)
+	}
+	c.mu.Unlock()
+	if f.str != nil {
+		f.str.Close()
+		time.AfterFunc(masqueLinger, func() {
+			f.str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		})
+	}
+}
+
+// Close closes all flows, which are removed by their receive goroutines.
+func (c *masquePacketConn) Close() error {
+	c.mu.Lock()
+	c.cancel()
+	c.mu.Unlock()
+	return nil
+}
+
+// LocalAddr is ...
+func (c *masquePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+// SetDeadline is ...
+func (c *masquePacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline is ...
+func (c *masquePacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline is not supported by datagrams and is ignored.
+func (c *masquePacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+var _ net.PacketConn = (*masquePacketConn)(nil)
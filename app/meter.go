@@ -0,0 +1,149 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+// MeterThreshold is the number of bytes a Meter of a user limited by a
+// quota accumulates before charging them to the upstream.
+const MeterThreshold = 1 << 20
+
+// quotaUpstream is an Upstream which cuts off users at a quota.
+type quotaUpstream interface {
+	// Limited reports whether the user of key is limited by a quota.
+	Limited(key string) bool
+}
+
+// limited is ...
+func limited(up Upstream, key string) bool {
+	q, ok := up.(quotaUpstream)
+	return ok && q.Limited(key)
+}
+
+// Meter charges the traffic of a session to the upstream. Sessions of
+// users limited by a quota are charged every MeterThreshold bytes, so that
+// they are cut off once the quota is used up, other sessions are charged
+// when they are closed.
+type Meter struct {
+	up        Upstream
+	key       string
+	threshold int64
+
+	mu     sync.Mutex
+	nr, nw int64
+	err    error
+}
+
+// NewMeter is ...
+func NewMeter(up Upstream, key string) *Meter {
+	m := &Meter{up: up, key: key, threshold: math.MaxInt64}
+	if limited(up, key) {
+		m.threshold = MeterThreshold
+	}
+	return m
+}
+
+// Reader counts bytes read from r as upload.
+func (m *Meter) Reader(r io.Reader) io.Reader {
+	return &meterReader{Reader: r, m: m}
+}
+
+// Writer counts bytes written to w as download.
+func (m *Meter) Writer(w io.Writer) io.Writer {
+	return &meterWriter{Writer: w, m: m}
+}
+
+// add counts a read or a write, it returns ErrQuotaExceeded once the
+// upstream reports the user exhausted.
+func (m *Meter) add(nr, nw int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	m.nr += nr
+	m.nw += nw
+	if m.nr+m.nw < m.threshold {
+		return nil
+	}
+	return m.flush()
+}
+
+// flush is ...
+func (m *Meter) flush() error {
+	nr, nw := m.nr, m.nw
+	m.nr, m.nw = 0, 0
+	if nr == 0 && nw == 0 {
+		return nil
+	}
+	if err := m.up.Consume(m.key, nr, nw); errors.Is(err, ErrQuotaExceeded) {
+		m.err = err
+	}
+	return m.err
+}
+
+// Err returns ErrQuotaExceeded if the session has been cut off.
+func (m *Meter) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close charges the remaining bytes.
+func (m *Meter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flush()
+	return nil
+}
+
+// meterReader is ...
+type meterReader struct {
+	io.Reader
+	m *Meter
+}
+
+// Read is ...
+func (r *meterReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if er := r.m.add(int64(n), 0); er != nil {
+		return n, er
+	}
+	return n, err
+}
+
+// meterWriter is ...
+type meterWriter struct {
+	io.Writer
+	m *Meter
+}
+
+// Write is ...
+func (w *meterWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	if ew := w.m.add(0, int64(n)); ew != nil {
+		return n, ew
+	}
+	return n, err
+}
+
+// CloseWrite is ...
+func (w *meterWriter) CloseWrite() error {
+	if cw, ok := w.Writer.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("not supported")
+}
+
+var (
+	_ quotaUpstream = (*poolUpstream)(nil)
+	_ quotaUpstream = (*resellerUpstream)(nil)
+	_ quotaUpstream = (*ldapUpstream)(nil)
+	_ quotaUpstream = (*banUpstream)(nil)
+)
@@ -0,0 +1,315 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+const (
+	// PolicyAllow is ...
+	PolicyAllow = "allow"
+	// PolicyDeny is ...
+	PolicyDeny = "deny"
+	// PolicyOutbound allows the connection through a named outbound.
+	PolicyOutbound = "outbound"
+)
+
+// policyCostLimit is the runtime cost limit of an expression
+const policyCostLimit = 10000
+
+// ErrPolicyDenied is ...
+var ErrPolicyDenied = errors.New("denied by policy")
+
+// Policy is a list of CEL rules evaluated when a user is authenticated
+// and when a target is dialed, the first matched rule decides.
+// Connections matching no rule are allowed. A deny rule which fails to
+// evaluate, for example over the cost limit, is taken as matched, other
+// rules failing to evaluate are skipped.
+//
+// Expressions see the following variables:
+//
+//	user       map: key, groups, pool, reseller
+//	client     map: ip, port
+//	sni        string
+//	transport  string: tls, websocket, h2, h3
+//	target     map: network, host, ip, port (empty at authentication)
+//	now        timestamp
+//
+// and the function inCIDR(ip, cidr).
+type Policy struct {
+	// Auth is evaluated once a user is authenticated, outbound selects
+	// the outbound of both TCP and UDP of the session.
+	Auth []PolicyRule `json:"auth,omitempty"`
+	// Target is evaluated for every TCP target and UDP packet,
+	// outbound is supported for TCP only.
+	Target []PolicyRule `json:"target,omitempty"`
+
+	attrs  func(string) map[string]any
+	logger *zap.Logger
+}
+
+// PolicyRule is ...
+type PolicyRule struct {
+	// Match is a CEL expression returning bool
+	Match string `json:"match"`
+	// Action is one of allow, deny and outbound
+	Action string `json:"action"`
+	// Outbound is the name of the outbound for action outbound
+	Outbound string `json:"outbound,omitempty"`
+
+	prg cel.Program
+}
+
+// newPolicyEnv is ...
+func newPolicyEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("user", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("client", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("sni", cel.StringType),
+		cel.Variable("transport", cel.StringType),
+		cel.Variable("target", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("now", cel.TimestampType),
+		cel.Function("inCIDR",
+			cel.Overload("inCIDR_string_string",
+				[]*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(func(lhs, rhs ref.Val) ref.Val {
+					ip, err := netip.ParseAddr(string(lhs.(types.String)))
+					if err != nil {
+						return types.False
+					}
+					prefix, err := netip.ParsePrefix(string(rhs.(types.String)))
+					if err != nil {
+						return types.NewErr("invalid cidr: %v", rhs)
+					}
+					return types.Bool(prefix.Contains(ip.Unmap()))
+				}),
+			),
+		),
+	)
+}
+
+// Provision compiles all expressions.
+func (p *Policy) Provision(outbounds map[string]Proxy, attrs func(string) map[string]any, lg *zap.Logger) error {
+	env, err := newPolicyEnv()
+	if err != nil {
+		return err
+	}
+	p.attrs = attrs
+	p.logger = lg
+
+	compile := func(stage string, rules []PolicyRule) error {
+		for i := range rules {
+			rule := &rules[i]
+			switch rule.Action {
+			case PolicyAllow, PolicyDeny:
+			case PolicyOutbound:
+				if _, ok := outbounds[rule.Outbound]; !ok {
+					return fmt.Errorf("policy %s rule %d: unknown outbound: %q", stage, i, rule.Outbound)
+				}
+			default:
+				return fmt.Errorf("policy %s rule %d: unknown action: %q", stage, i, rule.Action)
+			}
+
+			ast, iss := env.Compile(rule.Match)
+			if iss.Err() != nil {
+				return fmt.Errorf("policy %s rule %d: compile %q error:\n%w", stage, i, rule.Match, iss.Err())
+			}
+			if ast.OutputType() != cel.BoolType {
+				return fmt.Errorf("policy %s rule %d: %q returns %v, not bool", stage, i, rule.Match, ast.OutputType())
+			}
+			rule.prg, err = env.Program(ast, cel.CostLimit(policyCostLimit))
+			if err != nil {
+				return fmt.Errorf("policy %s rule %d: %w", stage, i, err)
+			}
+		}
+		return nil
+	}
+	if err := compile("auth", p.Auth); err != nil {
+		return err
+	}
+	return compile("target", p.Target)
+}
+
+// activation is ...
+func (p *Policy) activation(s *Session, network, addr string) map[string]any {
+	client := map[string]any{"ip": "", "port": 0}
+	if ap, err := netip.ParseAddrPort(s.RemoteAddr); err == nil {
+		client["ip"] = ap.Addr().Unmap().String()
+		client["port"] = int(ap.Port())
+	}
+
+	target := map[string]any{"network": network, "host": "", "ip": "", "port": 0}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		target["host"] = host
+		if ip, err := netip.ParseAddr(host); err == nil {
+			target["ip"] = ip.Unmap().String()
+		}
+		target["port"], _ = strconv.Atoi(port)
+	}
+
+	return map[string]any{
+		"user":      p.attrs(s.Key),
+		"client":    client,
+		"sni":       s.ServerName,
+		"transport": s.Transport,
+		"target":    target,
+		"now":       time.Now().UTC(),
+	}
+}
+
+// eval returns the first matched rule or nil, deny rules fail closed
+func (p *Policy) eval(rules []PolicyRule, vars map[string]any) *PolicyRule {
+	for i := range rules {
+		out, _, err := rules[i].prg.Eval(vars)
+		if err != nil {
+			p.logger.Error(fmt.Sprintf("evaluate policy %q error: %v", rules[i].Match, err))
+			if rules[i].Action == PolicyDeny {
+				return &rules[i]
+			}
+			continue
+		}
+		if out == types.True {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Authorize evaluates the auth rules and records the chosen outbound in s.
+func (p *Policy) Authorize(s *Session) bool {
+	if p == nil || len(p.Auth) == 0 {
+		return true
+	}
+	rule := p.eval(p.Auth, p.activation(s, "", ""))
+	if rule == nil {
+		return true
+	}
+	switch rule.Action {
+	case PolicyDeny:
+		return false
+	case PolicyOutbound:
+		s.Outbound = rule.Outbound
+	}
+	return true
+}
+
+// Route evaluates the target rules and returns the action and the outbound.
+func (p *Policy) Route(s *Session, network, addr string) (string, string) {
+	if p == nil || len(p.Target) == 0 || s == nil {
+		return PolicyAllow, ""
+	}
+	rule := p.eval(p.Target, p.activation(s, network, addr))
+	if rule == nil {
+		return PolicyAllow, ""
+	}
+	return rule.Action, rule.Outbound
+}
+
+// policyProxy routes connections to named outbounds by the policy.
+type policyProxy struct {
+	Proxy
+	policy    *Policy
+	outbounds map[string]Proxy
+}
+
+// Handle is ...
+func (p *policyProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
+}
+
+// Close is ...
+func (p *policyProxy) Close() error {
+	for _, v := range p.outbounds {
+		v.Close()
+	}
+	return p.Proxy.Close()
+}
+
+// outbound returns the outbound chosen for the session
+func (p *policyProxy) outbound(s *Session) Proxy {
+	if s != nil && s.Outbound != "" {
+		if px, ok := p.outbounds[s.Outbound]; ok {
+			return px
+		}
+	}
+	return p.Proxy
+}
+
+// Dial is ...
+func (p *policyProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is ...
+func (p *policyProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s := SessionFromContext(ctx)
+	px := p.outbound(s)
+	switch action, name := p.policy.Route(s, network, addr); action {
+	case PolicyDeny:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrPolicyDenied}
+	case PolicyOutbound:
+		px = p.outbounds[name]
+	}
+	return trojan.DialContext(ctx, px, network, addr)
+}
+
+// ListenPacket is ...
+func (p *policyProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return p.ListenPacketContext(context.Background(), network, addr)
+}
+
+// ListenPacketContext is ...
+func (p *policyProxy) ListenPacketContext(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	s := SessionFromContext(ctx)
+	pc, err := trojan.ListenPacketContext(ctx, p.outbound(s), network, addr)
+	if err != nil || s == nil || len(p.policy.Target) == 0 {
+		return pc, err
+	}
+	return &policyPacketConn{PacketConn: pc, network: "udp", session: s, policy: p.policy}, nil
+}
+
+// ListenPing is ...
+func (p *policyProxy) ListenPing(ctx context.Context) (net.PacketConn, error) {
+	s := SessionFromContext(ctx)
+	pc, err := trojan.ListenPing(ctx, p.outbound(s))
+	if err != nil || s == nil || len(p.policy.Target) == 0 {
+		return pc, err
+	}
+	return &policyPacketConn{PacketConn: pc, network: "icmp", session: s, policy: p.policy}, nil
+}
+
+// policyPacketConn drops packets to targets denied by the policy.
+type policyPacketConn struct {
+	net.PacketConn
+	network string
+	session *Session
+	policy  *Policy
+}
+
+// WriteTo is ...
+func (c *policyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if action, _ := c.policy.Route(c.session, c.network, addr.String()); action == PolicyDeny {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+var (
+	_ Proxy                        = (*policyProxy)(nil)
+	_ trojan.ContextDialer         = (*policyProxy)(nil)
+	_ trojan.ContextPacketListener = (*policyProxy)(nil)
+	_ trojan.Pinger                = (*policyProxy)(nil)
+)
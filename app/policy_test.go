@@ -0,0 +1,100 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPolicy(t *testing.T) {
+	p := &Policy{
+		Auth: []PolicyRule{
+			{Match: "sni == 'blocked.example.com'", Action: PolicyDeny},
+			{Match: "inCIDR(client.ip, '10.0.0.0/8')", Action: PolicyOutbound, Outbound: "eu"},
+		},
+		Target: []PolicyRule{
+			{Match: "'staff' in user.groups && target.network == 'udp' && target.port != 443", Action: PolicyDeny},
+			{Match: "target.host.endsWith('.eu') && now.getHours('UTC') >= 0", Action: PolicyOutbound, Outbound: "eu"},
+		},
+	}
+	attrs := func(key string) map[string]any {
+		groups := []string{}
+		if key == "staff-user" {
+			groups = append(groups, "staff")
+		}
+		return map[string]any{"key": key, "groups": groups}
+	}
+	if err := p.Provision(map[string]Proxy{"eu": &NoProxy{}}, attrs, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Authorize(&Session{Key: "k", RemoteAddr: "1.2.3.4:5", ServerName: "blocked.example.com"}) {
+		t.Error("auth deny error")
+	}
+	s := &Session{Key: "staff-user", RemoteAddr: "10.1.2.3:5"}
+	if !p.Authorize(s) || s.Outbound != "eu" {
+		t.Errorf("auth outbound error: %v", s.Outbound)
+	}
+
+	for _, v := range []struct {
+		Network string
+		Addr    string
+		Action  string
+	}{
+		{"udp", "1.1.1.1:53", PolicyDeny},
+		{"udp", "1.1.1.1:443", PolicyAllow},
+		{"tcp", "1.1.1.1:53", PolicyAllow},
+		{"tcp", "www.example.eu:443", PolicyOutbound},
+	} {
+		if action, _ := p.Route(s, v.Network, v.Addr); action != v.Action {
+			t.Errorf("route %v %v error: %v", v.Network, v.Addr, action)
+		}
+	}
+	if action, _ := p.Route(&Session{Key: "other"}, "udp", "1.1.1.1:53"); action != PolicyAllow {
+		t.Errorf("route other user error: %v", action)
+	}
+}
+
+func TestPolicyCompileError(t *testing.T) {
+	for _, v := range []struct {
+		Rule PolicyRule
+		Err  string
+	}{
+		{PolicyRule{Match: "target.port +", Action: PolicyDeny}, "compile"},
+		{PolicyRule{Match: "target.port", Action: PolicyDeny}, "not bool"},
+		{PolicyRule{Match: "unknown == 1", Action: PolicyDeny}, "undeclared reference"},
+		{PolicyRule{Match: "true", Action: "drop"}, "unknown action"},
+		{PolicyRule{Match: "true", Action: PolicyOutbound, Outbound: "us"}, "unknown outbound"},
+	} {
+		p := &Policy{Target: []PolicyRule{v.Rule}}
+		err := p.Provision(map[string]Proxy{}, nil, zap.NewNop())
+		if err == nil || !strings.Contains(err.Error(), v.Err) {
+			t.Errorf("compile %q error: %v", v.Rule.Match, err)
+		}
+	}
+}
+
+func TestPolicyEvalError(t *testing.T) {
+	p := &Policy{
+		Target: []PolicyRule{
+			{Match: "inCIDR(target.ip, 'bad')", Action: PolicyOutbound, Outbound: "eu"},
+			{Match: "inCIDR(target.ip, 'bad')", Action: PolicyDeny},
+		},
+		Auth: []PolicyRule{
+			{Match: "[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].exists(x, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].exists(y, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].exists(z, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].exists(w, x + y + z + w < 0))))", Action: PolicyDeny},
+		},
+	}
+	attrs := func(key string) map[string]any { return map[string]any{"key": key} }
+	if err := p.Provision(map[string]Proxy{"eu": &NoProxy{}}, attrs, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	// the failing outbound rule is skipped and the failing deny rule denies
+	if action, _ := p.Route(&Session{Key: "k"}, "tcp", "1.1.1.1:53"); action != PolicyDeny {
+		t.Errorf("route error: %v", action)
+	}
+	// the deny rule over the cost limit denies
+	if p.Authorize(&Session{Key: "k"}) {
+		t.Error("auth cost limit error")
+	}
+}
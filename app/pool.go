@@ -0,0 +1,272 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// PoolPrefix is the storage prefix of quota pool records.
+const PoolPrefix = "trojan_pools/"
+
+// ErrQuotaExceeded is returned by Consume when a quota is used up.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Pool is a traffic quota shared by a group of users.
+type Pool struct {
+	// Name is ...
+	Name string `json:"name"`
+	// Quota is the shared traffic (up + down) in bytes, 0 is unlimited.
+	Quota int64 `json:"quota,omitempty"`
+	// Members is ...
+	Members []PoolMember `json:"members,omitempty"`
+
+	ps    *pools
+	mu    sync.Mutex
+	usage int64
+	used  map[string]*poolMember
+}
+
+// PoolMember is ...
+type PoolMember struct {
+	// Password is ...
+	Password string `json:"password"`
+	// Quota is the sub-cap of this user in bytes, 0 is only limited by the pool.
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// poolMember is ...
+type poolMember struct {
+	quota int64
+	usage int64
+}
+
+// poolRecord is the persisted state of a pool
+type poolRecord struct {
+	Usage   int64            `json:"usage"`
+	Members map[string]int64 `json:"members"`
+}
+
+// PoolMemberUsage is ...
+type PoolMemberUsage struct {
+	Key   string `json:"key"`
+	Usage int64  `json:"usage"`
+	Quota int64  `json:"quota,omitempty"`
+}
+
+// Usage returns the shared usage of the pool.
+func (p *Pool) Usage() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.usage
+}
+
+// Range calls fn for the usage of every member.
+func (p *Pool) Range(fn func(PoolMemberUsage)) {
+	p.mu.Lock()
+	list := make([]PoolMemberUsage, 0, len(p.used))
+	for k, v := range p.used {
+		list = append(list, PoolMemberUsage{Key: k, Usage: v.usage, Quota: v.quota})
+	}
+	p.mu.Unlock()
+
+	for _, v := range list {
+		fn(v)
+	}
+}
+
+// Reset clears the usage of the pool and its members, and saves the pool.
+func (p *Pool) Reset() error {
+	p.mu.Lock()
+	p.usage = 0
+	for _, v := range p.used {
+		v.usage = 0
+	}
+	p.mu.Unlock()
+	if p.ps == nil {
+		return nil
+	}
+	return p.ps.save(p)
+}
+
+// exhausted is ...
+func (p *Pool) exhausted(m *poolMember) bool {
+	return (p.Quota > 0 && p.usage >= p.Quota) || (m.quota > 0 && m.usage >= m.quota)
+}
+
+// Exhausted reports whether the user of key may not use the pool any more.
+func (p *Pool) Exhausted(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.used[key]
+	return ok && p.exhausted(m)
+}
+
+// Debit charges n bytes to both the user and the pool in one step,
+// and reports whether either of them is exhausted afterwards.
+func (p *Pool) Debit(key string, n int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, ok := p.used[key]
+	if !ok {
+		return false
+	}
+	m.usage += n
+	p.usage += n
+	return p.exhausted(m)
+}
+
+// pools is ...
+type pools struct {
+	list    []*Pool
+	members map[string]*Pool
+	storage certmagic.Storage
+	logger  *zap.Logger
+
+	loop loop
+}
+
+// newPools is ...
+func newPools(ctx caddy.Context, list []*Pool, up Upstream, lg *zap.Logger) (*pools, error) {
+	ps := &pools{
+		list:    list,
+		members: make(map[string]*Pool),
+		storage: ctx.Storage(),
+		logger:  lg,
+	}
+
+	names := make(map[string]struct{}, len(list))
+	for _, p := range list {
+		if p.Name == "" {
+			return nil, errors.New("pool name is empty")
+		}
+		if _, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate pool: %v", p.Name)
+		}
+		names[p.Name] = struct{}{}
+
+		p.ps = ps
+		p.used = make(map[string]*poolMember, len(p.Members))
+		list := make([]string, 0, len(p.Members))
+		for _, v := range p.Members {
+			if v.Password == "" {
+				return nil, fmt.Errorf("pool %v: empty password", p.Name)
+			}
+			b := [trojan.HeaderLen]byte{}
+			trojan.GenKey(v.Password, b[:])
+			key := string(b[:])
+			if prev, ok := ps.members[key]; ok {
+				return nil, fmt.Errorf("pool %v: user %v is a member of %v", p.Name, key, prev.Name)
+			}
+			list = append(list, v.Password)
+			ps.members[key] = p
+			p.used[key] = &poolMember{quota: v.Quota}
+		}
+		addAll(up, list)
+
+		if err := ps.load(p); err != nil {
+			return nil, fmt.Errorf("pool %v: %w", p.Name, err)
+		}
+	}
+
+	return ps, nil
+}
+
+// load is ...
+func (ps *pools) load(p *Pool) error {
+	b, err := ps.storage.Load(context.Background(), PoolPrefix+p.Name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	record := poolRecord{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return err
+	}
+	p.usage = record.Usage
+	for k, v := range record.Members {
+		if m, ok := p.used[k]; ok {
+			m.usage = v
+		}
+	}
+	return nil
+}
+
+// save is ...
+func (ps *pools) save(p *Pool) error {
+	p.mu.Lock()
+	record := poolRecord{Usage: p.usage, Members: make(map[string]int64, len(p.used))}
+	for k, v := range p.used {
+		record.Members[k] = v.usage
+	}
+	p.mu.Unlock()
+
+	b, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	return ps.storage.Store(context.Background(), PoolPrefix+p.Name, b)
+}
+
+// saveAll is ...
+func (ps *pools) saveAll() {
+	for _, p := range ps.list {
+		if err := ps.save(p); err != nil {
+			ps.logger.Error(fmt.Sprintf("save pool %v error: %v", p.Name, err))
+		}
+	}
+}
+
+// Start saves pools periodically.
+func (ps *pools) Start() {
+	ps.loop.Start(time.Minute, ps.saveAll)
+}
+
+// Stop is ...
+func (ps *pools) Stop() {
+	ps.loop.Stop()
+	ps.saveAll()
+}
+
+// poolUpstream debits traffic from quota pools and rejects exhausted users.
+type poolUpstream struct {
+	Upstream
+	ps *pools
+}
+
+// Validate is ...
+func (u *poolUpstream) Validate(k string) bool {
+	if !u.Upstream.Validate(k) {
+		return false
+	}
+	if p := u.ps.members[k]; p != nil && p.Exhausted(k) {
+		return false
+	}
+	return true
+}
+
+// Limited is ...
+func (u *poolUpstream) Limited(k string) bool {
+	return u.ps.members[k] != nil || limited(u.Upstream, k)
+}
+
+// Consume is ...
+func (u *poolUpstream) Consume(k string, nr, nw int64) error {
+	err := u.Upstream.Consume(k, nr, nw)
+	if p := u.ps.members[k]; p != nil && p.Debit(k, nr+nw) {
+		return ErrQuotaExceeded
+	}
+	return err
+}
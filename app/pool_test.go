@@ -0,0 +1,89 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func copyChunks(w io.Writer, r io.Reader) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, make([]byte, 32*1024))
+}
+
+func TestPoolMeter(t *testing.T) {
+	u, keys := newTestMemoryUpstream(t, 3)
+
+	p := &Pool{Name: "team", Quota: 3 * MeterThreshold}
+	p.used = map[string]*poolMember{
+		string(keys[0]): {quota: MeterThreshold},
+		string(keys[1]): {},
+	}
+	ps := &pools{list: []*Pool{p}, members: map[string]*Pool{
+		string(keys[0]): p,
+		string(keys[1]): p,
+	}, storage: &certmagic.FileStorage{Path: t.TempDir()}}
+	p.ps = ps
+	up := &poolUpstream{Upstream: u, ps: ps}
+
+	// the sub-cap of the first user cuts it off after 1 MiB
+	meter := NewMeter(up, string(keys[0]))
+	n, err := copyChunks(meter.Writer(io.Discard), bytes.NewReader(make([]byte, 4*MeterThreshold)))
+	if !errors.Is(err, ErrQuotaExceeded) || n != MeterThreshold {
+		t.Fatalf("sub-cap error: %v %v", n, err)
+	}
+	meter.Close()
+	if up.Validate(string(keys[0])) {
+		t.Fatal("validate exhausted user error")
+	}
+
+	// the second user is cut off when the pool is exhausted
+	meter = NewMeter(up, string(keys[1]))
+	n, err = copyChunks(io.Discard, meter.Reader(bytes.NewReader(make([]byte, 4*MeterThreshold))))
+	if !errors.Is(err, ErrQuotaExceeded) || n != 2*MeterThreshold {
+		t.Fatalf("pool quota error: %v %v", n, err)
+	}
+	meter.Close()
+	if up.Validate(string(keys[1])) || p.Usage() != 3*MeterThreshold {
+		t.Fatalf("pool usage error: %v", p.Usage())
+	}
+
+	if err := p.Reset(); err != nil || !up.Validate(string(keys[1])) {
+		t.Fatalf("reset error: %v", err)
+	}
+	// the reset is saved
+	p.usage = MeterThreshold
+	if err := ps.load(p); err != nil || p.Usage() != 0 {
+		t.Fatalf("load reset pool error: %v %v", p.Usage(), err)
+	}
+
+	// users out of pools are charged when sessions are closed
+	traffic := func(k string) (n int64) {
+		u.Range(func(key string, nr, nw int64) {
+			if key == k {
+				n = nr + nw
+			}
+		})
+		return
+	}
+	meter = NewMeter(&banUpstream{Upstream: up, bs: NewBans()}, string(keys[2]))
+	if _, err := copyChunks(meter.Writer(io.Discard), bytes.NewReader(make([]byte, 2*MeterThreshold))); err != nil || traffic(string(keys[2])) != 0 {
+		t.Fatalf("charge unlimited user error: %v", err)
+	}
+	meter.Close()
+	if n := traffic(string(keys[2])); n != 2*MeterThreshold {
+		t.Fatalf("charge closed session error: %v", n)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("pass0", key[:])
+	u.Range(func(k string, nr, nw int64) {
+		if k == string(key[:]) && nw != MeterThreshold {
+			t.Errorf("user traffic error: %v", nw)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -20,7 +21,9 @@ func init() {
 // Proxy is ...
 type Proxy interface {
 	// Handle is ...
-	Handle(r io.Reader, w io.Writer) (int64, int64, error)
+	Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error)
+	// Dialer is ...
+	trojan.Dialer
 	// Closer is ...
 	io.Closer
 }
@@ -37,8 +40,8 @@ func (NoProxy) CaddyModule() caddy.ModuleInfo {
 }
 
 // Handle is ...
-func (*NoProxy) Handle(r io.Reader, w io.Writer) (int64, int64, error) {
-	return trojan.Handle(r, w)
+func (p *NoProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
 }
 
 // Close is ...
@@ -46,6 +49,26 @@ func (*NoProxy) Close() error {
 	return nil
 }
 
+// Dial is ...
+func (*NoProxy) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial(network, addr)
+}
+
+// DialContext is ...
+func (*NoProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+// ListenPacket is ...
+func (*NoProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return net.ListenPacket(network, addr)
+}
+
+// ListenPing is ...
+func (*NoProxy) ListenPing(ctx context.Context) (net.PacketConn, error) {
+	return trojan.ListenICMP()
+}
+
 // EnvProxy is ...
 type EnvProxy struct {
 	proxy.Dialer `json:"-,omitempty"`
@@ -66,8 +89,8 @@ func (p *EnvProxy) Provision(ctx caddy.Context) error {
 }
 
 // Handle is ...
-func (p *EnvProxy) Handle(r io.Reader, w io.Writer) (int64, int64, error) {
-	return trojan.HandleWithDialer(r, w, p)
+func (p *EnvProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
 }
 
 // Close is ...
@@ -75,13 +98,24 @@ func (*EnvProxy) Close() error {
 	return nil
 }
 
+// DialContext is ...
+func (p *EnvProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if cd, ok := p.Dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return trojan.DialContext(ctx, p.Dialer, network, addr)
+}
+
 // ListenPacket is ...
 func (*EnvProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
 	return nil, errors.New("proxy from environment does not support UDP")
 }
 
 var (
-	_ Proxy             = (*NoProxy)(nil)
-	_ caddy.Provisioner = (*EnvProxy)(nil)
-	_ Proxy             = (*EnvProxy)(nil)
+	_ Proxy                = (*NoProxy)(nil)
+	_ trojan.ContextDialer = (*NoProxy)(nil)
+	_ trojan.Pinger        = (*NoProxy)(nil)
+	_ caddy.Provisioner    = (*EnvProxy)(nil)
+	_ Proxy                = (*EnvProxy)(nil)
+	_ trojan.ContextDialer = (*EnvProxy)(nil)
 )
@@ -0,0 +1,366 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// ResellerPrefix is the storage prefix of reseller records, it must not be
+// under the prefix of CaddyUpstream.
+const ResellerPrefix = "trojan_resellers/"
+
+var (
+	// ErrUserExists is ...
+	ErrUserExists = errors.New("user already exists")
+	// ErrUserNotOwned is ...
+	ErrUserNotOwned = errors.New("user is not owned by this reseller")
+	// ErrUserLimit is ...
+	ErrUserLimit = errors.New("user count limit is reached")
+)
+
+// Reseller owns a set of users and manages them with a scoped admin token.
+type Reseller struct {
+	// Name is ...
+	Name string `json:"name"`
+	// Token is the bearer token of the reseller admin API,
+	// placeholders such as {env.TOKEN} are supported.
+	Token string `json:"token"`
+	// Quota is the aggregate traffic (up + down) in bytes of all users,
+	// users of the reseller are rejected once it is exceeded, 0 is unlimited.
+	Quota int64 `json:"quota,omitempty"`
+	// MaxUsers is the maximum number of users, 0 is unlimited.
+	MaxUsers int `json:"max_users,omitempty"`
+	// Users are passwords of users owned by the reseller.
+	Users []string `json:"users,omitempty"`
+
+	up    Upstream
+	rs    *resellers
+	usage atomic.Int64
+
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// resellerRecord is the persisted state of a reseller
+type resellerRecord struct {
+	Keys  []string `json:"keys"`
+	Usage int64    `json:"usage"`
+}
+
+// Usage returns the aggregate traffic of the reseller.
+func (r *Reseller) Usage() int64 {
+	return r.usage.Load()
+}
+
+// Exhausted reports whether the quota is used up.
+func (r *Reseller) Exhausted() bool {
+	return r.Quota > 0 && r.usage.Load() >= r.Quota
+}
+
+// Count returns the number of users.
+func (r *Reseller) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.keys)
+}
+
+// Owns is ...
+func (r *Reseller) Owns(key string) bool {
+	r.mu.Lock()
+	_, ok := r.keys[key]
+	r.mu.Unlock()
+	return ok
+}
+
+// Add creates a user owned by the reseller.
+func (r *Reseller) Add(s string) error {
+	b := [trojan.HeaderLen]byte{}
+	trojan.GenKey(s, b[:])
+	key := string(b[:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// an owned user lost by the upstream is added again
+	_, owned := r.keys[key]
+	if r.up.Validate(key) {
+		if owned {
+			return nil
+		}
+		return ErrUserExists
+	}
+	if !owned && r.MaxUsers > 0 && len(r.keys) >= r.MaxUsers {
+		return ErrUserLimit
+	}
+	if err := r.up.Add(s); err != nil {
+		return err
+	}
+	r.keys[key] = struct{}{}
+	r.rs.setOwner(key, r)
+	return nil
+}
+
+// Delete removes a user owned by the reseller.
+func (r *Reseller) Delete(s string) error {
+	b := [trojan.HeaderLen]byte{}
+	trojan.GenKey(s, b[:])
+	key := string(b[:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.keys[key]; !ok {
+		return ErrUserNotOwned
+	}
+	if err := r.up.Delete(s); err != nil {
+		return err
+	}
+	delete(r.keys, key)
+	r.rs.setOwner(key, nil)
+	return nil
+}
+
+// disown removes key from the users of the reseller
+func (r *Reseller) disown(key string) {
+	r.mu.Lock()
+	delete(r.keys, key)
+	r.mu.Unlock()
+	r.rs.setOwner(key, nil)
+}
+
+// Range calls fn for every user owned by the reseller.
+func (r *Reseller) Range(fn func(string, int64, int64)) {
+	r.up.Range(func(k string, up, down int64) {
+		if r.Owns(k) {
+			fn(k, up, down)
+		}
+	})
+}
+
+// resellers tracks the owner of each user and their aggregate usage.
+type resellers struct {
+	list    []*Reseller
+	storage certmagic.Storage
+	logger  *zap.Logger
+
+	mu     sync.RWMutex
+	owners map[string]*Reseller
+
+	loop loop
+}
+
+// newResellers is ...
+func newResellers(storage certmagic.Storage, list []*Reseller, up Upstream, lg *zap.Logger) (*resellers, error) {
+	rs := &resellers{
+		list:    list,
+		storage: storage,
+		logger:  lg,
+		owners:  make(map[string]*Reseller),
+	}
+
+	repl := caddy.NewReplacer()
+	names := make(map[string]struct{}, len(list))
+	for _, r := range list {
+		if r.Name == "" {
+			return nil, errors.New("reseller name is empty")
+		}
+		if _, ok := names[r.Name]; ok {
+			return nil, fmt.Errorf("duplicate reseller: %v", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		r.Token = repl.ReplaceKnown(r.Token, "")
+		if r.Token == "" {
+			return nil, fmt.Errorf("reseller %v: token is empty", r.Name)
+		}
+		r.up = up
+		r.rs = rs
+		r.keys = make(map[string]struct{})
+
+		if err := rs.load(r); err != nil {
+			return nil, fmt.Errorf("reseller %v: %w", r.Name, err)
+		}
+		if err := addAll(up, r.Users); err != nil {
+			return nil, fmt.Errorf("reseller %v: add users error: %w", r.Name, err)
+		}
+		for _, v := range r.Users {
+			b := [trojan.HeaderLen]byte{}
+			trojan.GenKey(v, b[:])
+			r.keys[string(b[:])] = struct{}{}
+		}
+		// keys of users the upstream does not know, such as users of the
+		// memory upstream after a restart, are dropped
+		lost := 0
+		for k := range r.keys {
+			if !up.Validate(k) {
+				delete(r.keys, k)
+				lost++
+			}
+		}
+		if lost > 0 {
+			lg.Info(fmt.Sprintf("drop %v users of reseller %v unknown to the upstream", lost, r.Name))
+		}
+		for k := range r.keys {
+			if prev, ok := rs.owners[k]; ok && prev != r {
+				return nil, fmt.Errorf("reseller %v: user %v is owned by %v", r.Name, k, prev.Name)
+			}
+			rs.owners[k] = r
+		}
+	}
+
+	return rs, nil
+}
+
+// load restores the users and the usage of a reseller from storage
+func (rs *resellers) load(r *Reseller) error {
+	b, err := rs.storage.Load(context.Background(), ResellerPrefix+r.Name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	record := resellerRecord{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return err
+	}
+	for _, k := range record.Keys {
+		r.keys[k] = struct{}{}
+	}
+	r.usage.Store(record.Usage)
+	return nil
+}
+
+// save persists the users and the usage of a reseller
+func (rs *resellers) save(r *Reseller) error {
+	record := resellerRecord{Usage: r.Usage()}
+	r.mu.Lock()
+	for k := range r.keys {
+		record.Keys = append(record.Keys, k)
+	}
+	r.mu.Unlock()
+
+	b, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	return rs.storage.Store(context.Background(), ResellerPrefix+r.Name, b)
+}
+
+// saveAll is ...
+func (rs *resellers) saveAll() {
+	for _, r := range rs.list {
+		if err := rs.save(r); err != nil {
+			rs.logger.Error(fmt.Sprintf("save reseller %v error: %v", r.Name, err))
+		}
+	}
+}
+
+// Start saves resellers periodically.
+func (rs *resellers) Start() {
+	rs.loop.Start(time.Minute, rs.saveAll)
+}
+
+// Stop is ...
+func (rs *resellers) Stop() {
+	rs.loop.Stop()
+	rs.saveAll()
+}
+
+// ByToken returns the reseller of the admin token or nil.
+func (rs *resellers) ByToken(token string) *Reseller {
+	for _, r := range rs.list {
+		if subtle.ConstantTimeCompare([]byte(r.Token), []byte(token)) == 1 {
+			return r
+		}
+	}
+	return nil
+}
+
+// owner is ...
+func (rs *resellers) owner(key string) *Reseller {
+	rs.mu.RLock()
+	r := rs.owners[key]
+	rs.mu.RUnlock()
+	return r
+}
+
+// setOwner is ...
+func (rs *resellers) setOwner(key string, r *Reseller) {
+	rs.mu.Lock()
+	if r == nil {
+		delete(rs.owners, key)
+	} else {
+		rs.owners[key] = r
+	}
+	rs.mu.Unlock()
+}
+
+// resellerUpstream enforces reseller quotas and accounts their usage.
+type resellerUpstream struct {
+	Upstream
+	rs *resellers
+}
+
+// Validate is ...
+func (u *resellerUpstream) Validate(k string) bool {
+	if !u.Upstream.Validate(k) {
+		return false
+	}
+	if r := u.rs.owner(k); r != nil && r.Exhausted() {
+		return false
+	}
+	return true
+}
+
+// Delete is ...
+func (u *resellerUpstream) Delete(s string) error {
+	if err := u.Upstream.Delete(s); err != nil {
+		return err
+	}
+	// users deleted by the admin are not counted for their resellers
+	b := [trojan.HeaderLen]byte{}
+	trojan.GenKey(s, b[:])
+	if r := u.rs.owner(string(b[:])); r != nil {
+		r.disown(string(b[:]))
+	}
+	return nil
+}
+
+// Limited is ...
+func (u *resellerUpstream) Limited(k string) bool {
+	if r := u.rs.owner(k); r != nil && r.Quota > 0 {
+		return true
+	}
+	return limited(u.Upstream, k)
+}
+
+// AddAll is ...
+func (u *resellerUpstream) AddAll(list []string) error {
+	return addAll(u.Upstream, list)
+}
+
+// Consume is ...
+func (u *resellerUpstream) Consume(k string, nr, nw int64) error {
+	err := u.Upstream.Consume(k, nr, nw)
+	if r := u.rs.owner(k); r != nil {
+		r.usage.Add(nr + nw)
+		if r.Exhausted() {
+			return ErrQuotaExceeded
+		}
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func TestResellerDeletedByAdmin(t *testing.T) {
+	u, _ := newTestMemoryUpstream(t, 0)
+	rs := &resellers{logger: zap.NewNop(), owners: make(map[string]*Reseller)}
+	r := &Reseller{Name: "acme", MaxUsers: 1, up: u, rs: rs, keys: make(map[string]struct{})}
+	rs.list = []*Reseller{r}
+	up := &banUpstream{Upstream: &resellerUpstream{Upstream: u, rs: rs}, bs: NewBans()}
+
+	if err := r.Add("pass0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("pass1"); !errors.Is(err, ErrUserLimit) {
+		t.Fatalf("user limit error: %v", err)
+	}
+
+	// a user deleted by the admin is neither owned nor counted
+	if err := up.Delete("pass0"); err != nil {
+		t.Fatal(err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("pass0", key[:])
+	if r.Count() != 0 || r.Owns(string(key[:])) || rs.owner(string(key[:])) != nil {
+		t.Fatalf("ownership error: %v", r.Count())
+	}
+	if err := r.Add("pass1"); err != nil {
+		t.Fatalf("add after admin delete error: %v", err)
+	}
+}
+
+func TestResellerLostUsers(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	u, _ := newTestMemoryUpstream(t, 0)
+	rs := &resellers{storage: storage, logger: zap.NewNop(), owners: make(map[string]*Reseller)}
+	r := &Reseller{Name: "acme", MaxUsers: 1, up: u, rs: rs, keys: make(map[string]struct{})}
+	rs.list = []*Reseller{r}
+	if err := r.Add("pass0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.save(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// an owned user lost by the upstream is added again
+	u.Delete("pass0")
+	if err := r.Add("pass0"); err != nil || r.Count() != 1 {
+		t.Fatalf("add lost user error: %v", err)
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("pass0", key[:])
+	if !u.Validate(string(key[:])) {
+		t.Fatal("lost user is not added")
+	}
+
+	// keys unknown to the upstream after a restart are dropped
+	u, _ = newTestMemoryUpstream(t, 0)
+	rs, err := newResellers(storage, []*Reseller{{Name: "acme", Token: "token", MaxUsers: 1}}, u, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rs.list[0]; r.Count() != 0 || r.Add("pass1") != nil {
+		t.Fatalf("restart error: %v", r.Count())
+	}
+}
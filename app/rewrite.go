@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// RewriteRule rewrites the target of trojan requests before dialing.
+type RewriteRule struct {
+	// Match is a domain, *.suffix, IP or CIDR with an optional port, or :port
+	Match string `json:"match"`
+	// To is one of host:port, host which keeps the port, :port which keeps
+	// the host, unix//path/to/socket and sinkhole. Unix sockets and
+	// sinkhole are not dialed through the proxy, so target rules of the
+	// policy, scanning and egress records do not apply to them.
+	To string `json:"to"`
+
+	m       destMatcher
+	network string
+	host    string
+	port    string
+}
+
+// parse is ...
+func (rule *RewriteRule) parse() (err error) {
+	rule.m, err = parseDestMatcher(rule.Match)
+	if err != nil {
+		return err
+	}
+
+	switch to := rule.To; {
+	case to == trojan.NetworkSinkhole:
+		rule.network = trojan.NetworkSinkhole
+	case strings.HasPrefix(to, "unix/"):
+		rule.network, rule.host = "unix", strings.TrimPrefix(to, "unix/")
+		if rule.host == "" {
+			return fmt.Errorf("invalid unix socket: %v", to)
+		}
+	case to == "":
+		return fmt.Errorf("rewrite %v: empty target", rule.Match)
+	default:
+		rule.network = "tcp"
+		host, port, err := net.SplitHostPort(to)
+		if err != nil {
+			// no port
+			host, port = to, ""
+		}
+		if port != "" {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return fmt.Errorf("invalid port: %v", to)
+			}
+		}
+		rule.host, rule.port = host, port
+	}
+	return nil
+}
+
+// target returns the network and the address of the rewritten target
+func (rule *RewriteRule) target(host, port string) (string, string) {
+	switch rule.network {
+	case trojan.NetworkSinkhole:
+		return rule.network, ""
+	case "unix":
+		return rule.network, rule.host
+	}
+	if rule.host != "" {
+		host = rule.host
+	}
+	if rule.port != "" {
+		port = rule.port
+	}
+	return rule.network, net.JoinHostPort(host, port)
+}
+
+// Rewriter applies rewrite rules in order, the first matched rule wins.
+type Rewriter struct {
+	rules  []RewriteRule
+	logger *zap.Logger
+}
+
+// NewRewriter is ...
+func NewRewriter(rules []RewriteRule, lg *zap.Logger) (*Rewriter, error) {
+	for i := range rules {
+		if err := rules[i].parse(); err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: %w", i, err)
+		}
+	}
+	return &Rewriter{rules: rules, logger: lg}, nil
+}
+
+// Rewrite implements trojan.Rewriter.
+func (rw *Rewriter) Rewrite(ctx context.Context, network, addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return network, addr
+	}
+	for i := range rw.rules {
+		rule := &rw.rules[i]
+		if !rule.m.Match(host, port) {
+			continue
+		}
+		nn, na := rule.target(host, port)
+		to := na
+		switch nn {
+		case trojan.NetworkSinkhole:
+			to = nn
+		case "unix":
+			to = "unix/" + na
+		}
+		from := ""
+		if s := SessionFromContext(ctx); s != nil {
+			from = s.RemoteAddr
+		}
+		rw.logger.Info(fmt.Sprintf("rewrite %v -> %v from %v", addr, to, from))
+		return nn, na
+	}
+	return network, addr
+}
+
+// rewriteProxy passes the rewriter to trojan requests, it is the outermost
+// proxy so rewritten TCP targets are checked by the inner proxies.
+type rewriteProxy struct {
+	Proxy
+	rw *Rewriter
+}
+
+// Handle is ...
+func (p *rewriteProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return p.Proxy.Handle(trojan.WithRewriter(ctx, p.rw), r, w)
+}
+
+// Dial is ...
+func (p *rewriteProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext rewrites targets of standard CONNECT requests.
+func (p *rewriteProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	network, addr = p.rw.Rewrite(ctx, network, addr)
+	return trojan.DialTarget(ctx, p.Proxy, network, addr)
+}
+
+// ListenPacketContext is ...
+func (p *rewriteProxy) ListenPacketContext(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	return trojan.ListenPacketContext(ctx, p.Proxy, network, addr)
+}
+
+var (
+	_ Proxy                        = (*rewriteProxy)(nil)
+	_ trojan.ContextDialer         = (*rewriteProxy)(nil)
+	_ trojan.ContextPacketListener = (*rewriteProxy)(nil)
+	_ trojan.Rewriter              = (*Rewriter)(nil)
+)
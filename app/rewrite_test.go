@@ -0,0 +1,130 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func TestRewriter(t *testing.T) {
+	rw, err := NewRewriter([]RewriteRule{
+		{Match: "intranet.example:80", To: "10.0.0.5:8080"},
+		{Match: "*.local-svc", To: "unix//run/local-svc.sock"},
+		{Match: "10.1.0.0/16", To: "10.2.0.1"},
+		{Match: "example.com", To: ":8443"},
+		{Match: ":25", To: "sinkhole"},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		Addr    string
+		Network string
+		Target  string
+	}{
+		{"intranet.example:80", "tcp", "10.0.0.5:8080"},
+		{"intranet.example:443", "tcp", "intranet.example:443"},
+		{"api.local-svc:80", "unix", "/run/local-svc.sock"},
+		{"10.1.2.3:22", "tcp", "10.2.0.1:22"},
+		{"example.com:443", "tcp", "example.com:8443"},
+		{"1.2.3.4:25", trojan.NetworkSinkhole, ""},
+		{"1.2.3.4:26", "tcp", "1.2.3.4:26"},
+	} {
+		network, target := rw.Rewrite(context.Background(), "tcp", v.Addr)
+		if network != v.Network || target != v.Target {
+			t.Errorf("rewrite %v error: %v %v", v.Addr, network, target)
+		}
+	}
+
+	for _, rule := range []RewriteRule{
+		{Match: "a.example", To: ""},
+		{Match: "a.example", To: "unix/"},
+		{Match: "a.example", To: "b.example:http"},
+		{Match: "a.example:port", To: "b.example"},
+	} {
+		if _, err := NewRewriter([]RewriteRule{rule}, zap.NewNop()); err == nil {
+			t.Errorf("parse %v -> %v error", rule.Match, rule.To)
+		}
+	}
+}
+
+// echo serves ln by echoing every connection
+func echo(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+	}
+}
+
+// trojanRequest returns a CONNECT request to host:port followed by payload
+func trojanRequest(host string, port uint16, payload string) io.Reader {
+	b := []byte{trojan.CmdConnect, 3, byte(len(host))}
+	b = append(b, host...)
+	b = append(b, byte(port>>8), byte(port), '\r', '\n')
+	return io.MultiReader(bytes.NewReader(b), bytes.NewReader([]byte(payload)))
+}
+
+func TestRewriteProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	sock := filepath.Join(t.TempDir(), "echo.sock")
+	ul, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	go echo(ul)
+
+	rw, err := NewRewriter([]RewriteRule{
+		{Match: "intranet.example:80", To: ln.Addr().String()},
+		{Match: "*.local-svc", To: "unix/" + sock},
+		{Match: ":25", To: "sinkhole"},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &rewriteProxy{Proxy: &NoProxy{}, rw: rw}
+
+	for _, v := range []struct {
+		Host  string
+		Port  uint16
+		Reply string
+	}{
+		{"intranet.example", 80, "ping"},
+		{"api.local-svc", 80, "ping"},
+		{"mail.example", 25, ""},
+	} {
+		w := &bytes.Buffer{}
+		if _, _, err := p.Handle(context.Background(), trojanRequest(v.Host, v.Port, "ping"), w); err != nil {
+			t.Errorf("handle %v error: %v", v.Host, err)
+		}
+		if w.String() != v.Reply {
+			t.Errorf("handle %v reply: %q", v.Host, w.String())
+		}
+	}
+
+	c, err := p.DialContext(context.Background(), "tcp", "intranet.example:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
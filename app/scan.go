@@ -0,0 +1,546 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// ErrScanBlocked is the error of dials of users blocked for scanning.
+var ErrScanBlocked = errors.New("blocked for scanning")
+
+// ScanningKey is the storage key of the penalties of scanning, which are
+// kept across reloads and restarts like bans.
+const ScanningKey = "trojan_scanning"
+
+const (
+	// ScanActionLog logs users crossing the thresholds
+	ScanActionLog = "log"
+	// ScanActionThrottle limits the rate of new connections of users
+	ScanActionThrottle = "throttle"
+	// ScanActionBlock denies new connections of users
+	ScanActionBlock = "block"
+)
+
+const (
+	// ScanReasonConnections is ...
+	ScanReasonConnections = "connections"
+	// ScanReasonHosts is ...
+	ScanReasonHosts = "hosts"
+	// ScanReasonPorts is ...
+	ScanReasonPorts = "ports"
+	// ScanReasonFailures is ...
+	ScanReasonFailures = "failures"
+)
+
+const (
+	// scanMaxDials is the max number of connections kept per user
+	scanMaxDials = 4096
+	// scanMaxEvents is the number of recent events kept
+	scanMaxEvents = 256
+	// scanMaxDestinations is the max number of destinations tracked per
+	// UDP and ICMP socket
+	scanMaxDestinations = 1024
+)
+
+// Scanning detects port scans and connection floods through the outbound,
+// from the rate of new connections, distinct destination hosts and ports
+// and failed dials of a user within a sliding window.
+type Scanning struct {
+	// Window is the sliding window of counting, default is 1m.
+	Window caddy.Duration `json:"window,omitempty"`
+	// MaxConnections is the max number of new connections of a user
+	// within Window, 0 is unlimited. Every new destination of UDP and
+	// ICMP sockets is counted as a connection.
+	MaxConnections int `json:"max_connections,omitempty"`
+	// MaxHosts is the max number of distinct destination IPs and domains.
+	MaxHosts int `json:"max_hosts,omitempty"`
+	// MaxPorts is the max number of distinct destination ports.
+	MaxPorts int `json:"max_ports,omitempty"`
+	// MaxFailures is the max number of failed dials.
+	MaxFailures int `json:"max_failures,omitempty"`
+	// Action is log, throttle or block, default is throttle. Events are
+	// always logged.
+	Action string `json:"action,omitempty"`
+	// Duration is the duration of throttling and blocking, default is 10m.
+	Duration caddy.Duration `json:"duration,omitempty"`
+	// ThrottleRate is the number of new connections per second allowed
+	// while a user is throttled, default is 1.
+	ThrottleRate float64 `json:"throttle_rate,omitempty"`
+
+	storage certmagic.Storage
+	logger  *zap.Logger
+	// saving serializes saves
+	saving sync.Mutex
+
+	mu     sync.Mutex
+	users  map[string]*scanUser
+	events []ScanEvent
+	// swept is the last time idle users are removed
+	swept time.Time
+}
+
+// ScanEvent is a user crossing the thresholds with the counts within the
+// window.
+type ScanEvent struct {
+	// Key is only kept in memory, ID is reported instead.
+	Key     string    `json:"-"`
+	ID      string    `json:"id"`
+	Action  string    `json:"action"`
+	Reasons []string  `json:"reasons"`
+	Time    time.Time `json:"time"`
+	// Until is the end of throttling or blocking, nil for action log.
+	Until       *time.Time `json:"until,omitempty"`
+	Connections int        `json:"connections"`
+	Hosts       int        `json:"hosts"`
+	Ports       int        `json:"ports"`
+	Failures    int        `json:"failures"`
+}
+
+// scanDial is a new connection of a user
+type scanDial struct {
+	time   time.Time
+	host   string
+	port   string
+	failed bool
+}
+
+// scanRecord is a penalty in storage
+type scanRecord struct {
+	Key   string    `json:"key"`
+	Event ScanEvent `json:"event"`
+}
+
+// scanUser is ...
+type scanUser struct {
+	dials []scanDial
+	// hosts, ports and failures are counted over dials as they are added
+	// and removed
+	hosts    map[string]int
+	ports    map[string]int
+	failures int
+	// last is the last event of the user
+	last    *ScanEvent
+	limiter *rate.Limiter
+}
+
+// newScanUser is ...
+func newScanUser() *scanUser {
+	return &scanUser{hosts: make(map[string]int), ports: make(map[string]int)}
+}
+
+// count adds n to the counts of d
+func (u *scanUser) count(d scanDial, n int) {
+	u.hosts[d.host] += n
+	if u.hosts[d.host] == 0 {
+		delete(u.hosts, d.host)
+	}
+	// destinations of ping have no port
+	if d.port != "" {
+		u.ports[d.port] += n
+		if u.ports[d.port] == 0 {
+			delete(u.ports, d.port)
+		}
+	}
+	if d.failed {
+		u.failures += n
+	}
+}
+
+// drop removes the first n dials
+func (u *scanUser) drop(n int) {
+	for _, d := range u.dials[:n] {
+		u.count(d, -1)
+	}
+	u.dials = u.dials[n:]
+}
+
+// penalty returns the throttling or blocking of u in effect or nil
+func (u *scanUser) penalty(now time.Time) *ScanEvent {
+	if u.last == nil || u.last.Until == nil || !now.Before(*u.last.Until) {
+		return nil
+	}
+	return u.last
+}
+
+// Provision loads penalties in effect from storage if not nil.
+func (sc *Scanning) Provision(storage certmagic.Storage, lg *zap.Logger) error {
+	if sc.Window == 0 {
+		sc.Window = caddy.Duration(time.Minute)
+	}
+	if sc.Duration == 0 {
+		sc.Duration = caddy.Duration(10 * time.Minute)
+	}
+	if sc.ThrottleRate == 0 {
+		sc.ThrottleRate = 1
+	}
+	switch sc.Action {
+	case "":
+		sc.Action = ScanActionThrottle
+	case ScanActionLog, ScanActionThrottle, ScanActionBlock:
+	default:
+		return fmt.Errorf("unknown scanning action: %v", sc.Action)
+	}
+	if sc.ThrottleRate < 0 {
+		return fmt.Errorf("invalid scanning throttle_rate: %v", sc.ThrottleRate)
+	}
+	sc.storage = storage
+	sc.logger = lg
+	sc.users = make(map[string]*scanUser)
+	return sc.load()
+}
+
+// load restores penalties in effect from storage
+func (sc *Scanning) load() error {
+	if sc.storage == nil {
+		return nil
+	}
+	b, err := sc.storage.Load(context.Background(), ScanningKey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	records := []scanRecord{}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("load scanning penalties error: %w", err)
+	}
+	now := time.Now()
+	for _, v := range records {
+		ev := v.Event
+		ev.Key = v.Key
+		u := newScanUser()
+		u.last = &ev
+		if u.penalty(now) == nil {
+			continue
+		}
+		if ev.Action == ScanActionThrottle {
+			u.limiter = rate.NewLimiter(rate.Limit(sc.ThrottleRate), 1)
+		}
+		sc.users[v.Key] = u
+	}
+	return nil
+}
+
+// save stores penalties in effect
+func (sc *Scanning) save() {
+	if sc.storage == nil {
+		return
+	}
+	sc.saving.Lock()
+	defer sc.saving.Unlock()
+
+	records := []scanRecord{}
+	for _, v := range sc.Penalties() {
+		records = append(records, scanRecord{Key: v.Key, Event: v})
+	}
+	b, err := json.Marshal(records)
+	if err == nil {
+		err = sc.storage.Store(context.Background(), ScanningKey, b)
+	}
+	if err != nil {
+		sc.logger.Error(fmt.Sprintf("save scanning penalties error: %v", err))
+	}
+}
+
+// Allow returns an error if the user of key is blocked, and waits for the
+// rate limit if it is throttled.
+func (sc *Scanning) Allow(ctx context.Context, key string) error {
+	sc.mu.Lock()
+	u, ok := sc.users[key]
+	if !ok {
+		sc.mu.Unlock()
+		return nil
+	}
+	p := u.penalty(time.Now())
+	lim := u.limiter
+	sc.mu.Unlock()
+
+	switch {
+	case p == nil:
+		return nil
+	case p.Action == ScanActionBlock:
+		return ErrScanBlocked
+	}
+	return lim.Wait(ctx)
+}
+
+// allowPacket is Allow for a packet to a new destination, which is
+// dropped instead of waiting.
+func (sc *Scanning) allowPacket(key string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	u, ok := sc.users[key]
+	if !ok {
+		return true
+	}
+	p := u.penalty(time.Now())
+	switch {
+	case p == nil:
+		return true
+	case p.Action == ScanActionBlock:
+		return false
+	}
+	return u.limiter.Allow()
+}
+
+// Record records a new connection of the user of key to addr, and acts if
+// the user crosses the thresholds.
+func (sc *Scanning) Record(key, addr string, failed bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	now := time.Now()
+
+	start := now.Add(-time.Duration(sc.Window))
+
+	sc.mu.Lock()
+	if now.Sub(sc.swept) > time.Duration(sc.Window) {
+		sc.sweep(now)
+	}
+	u, ok := sc.users[key]
+	if !ok {
+		u = newScanUser()
+		sc.users[key] = u
+	}
+	u.drop(sort.Search(len(u.dials), func(i int) bool { return u.dials[i].time.After(start) }))
+	d := scanDial{time: now, host: host, port: port, failed: failed}
+	u.dials = append(u.dials, d)
+	u.count(d, 1)
+	if len(u.dials) > scanMaxDials {
+		u.drop(len(u.dials) - scanMaxDials)
+	}
+
+	// a user is throttled or blocked once until the penalty is over,
+	// and logged once every window
+	if u.penalty(now) != nil || (u.last != nil && u.last.Until == nil && u.last.Time.After(start)) {
+		sc.mu.Unlock()
+		return
+	}
+
+	reasons := []string{}
+	if sc.MaxConnections > 0 && len(u.dials) > sc.MaxConnections {
+		reasons = append(reasons, ScanReasonConnections)
+	}
+	if sc.MaxHosts > 0 && len(u.hosts) > sc.MaxHosts {
+		reasons = append(reasons, ScanReasonHosts)
+	}
+	if sc.MaxPorts > 0 && len(u.ports) > sc.MaxPorts {
+		reasons = append(reasons, ScanReasonPorts)
+	}
+	if sc.MaxFailures > 0 && u.failures > sc.MaxFailures {
+		reasons = append(reasons, ScanReasonFailures)
+	}
+	if len(reasons) == 0 {
+		sc.mu.Unlock()
+		return
+	}
+
+	ev := &ScanEvent{
+		Key:         key,
+		ID:          KeyID(key),
+		Action:      sc.Action,
+		Reasons:     reasons,
+		Time:        now,
+		Connections: len(u.dials),
+		Hosts:       len(u.hosts),
+		Ports:       len(u.ports),
+		Failures:    u.failures,
+	}
+	if sc.Action != ScanActionLog {
+		until := now.Add(time.Duration(sc.Duration))
+		ev.Until = &until
+	}
+	if sc.Action == ScanActionThrottle {
+		u.limiter = rate.NewLimiter(rate.Limit(sc.ThrottleRate), 1)
+	}
+	u.last = ev
+	sc.events = append(sc.events, *ev)
+	if len(sc.events) > scanMaxEvents {
+		sc.events = slices.Delete(sc.events, 0, len(sc.events)-scanMaxEvents)
+	}
+	sc.mu.Unlock()
+
+	sc.logger.Warn(fmt.Sprintf("user %v is suspected of scanning: %v, connections: %v, hosts: %v, ports: %v, failures: %v, action: %v",
+		ev.ID, reasons, ev.Connections, ev.Hosts, ev.Ports, ev.Failures, ev.Action))
+	if ev.Until != nil {
+		sc.save()
+	}
+}
+
+// Penalties lists users throttled or blocked by the time of events.
+func (sc *Scanning) Penalties() []ScanEvent {
+	if sc == nil {
+		return nil
+	}
+	now := time.Now()
+	sc.mu.Lock()
+	list := []ScanEvent{}
+	for _, u := range sc.users {
+		if p := u.penalty(now); p != nil {
+			list = append(list, *p)
+		}
+	}
+	sc.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list
+}
+
+// sweep removes users without penalty and connections within the window,
+// it is called at most once every window by Record
+func (sc *Scanning) sweep(now time.Time) {
+	start := now.Add(-time.Duration(sc.Window))
+	for k, u := range sc.users {
+		if u.penalty(now) != nil {
+			continue
+		}
+		if len(u.dials) == 0 || u.dials[len(u.dials)-1].time.Before(start) {
+			delete(sc.users, k)
+		}
+	}
+	sc.swept = now
+}
+
+// Events lists recent events, the latest is the last.
+func (sc *Scanning) Events() []ScanEvent {
+	if sc == nil {
+		return nil
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return slices.Clone(sc.events)
+}
+
+// Clear lifts the throttling or blocking of the user of key and forgets
+// its connections, and returns whether the user was penalized.
+func (sc *Scanning) Clear(key string) bool {
+	if sc == nil {
+		return false
+	}
+	sc.mu.Lock()
+	u, ok := sc.users[key]
+	delete(sc.users, key)
+	penalized := ok && u.penalty(time.Now()) != nil
+	sc.mu.Unlock()
+	if penalized {
+		sc.save()
+	}
+	return penalized
+}
+
+// scanProxy records new connections of users to detect scanning.
+type scanProxy struct {
+	Proxy
+	sc *Scanning
+}
+
+// Handle is ...
+func (p *scanProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
+}
+
+// Dial is ...
+func (p *scanProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is ...
+func (p *scanProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s := SessionFromContext(ctx)
+	if s == nil {
+		return trojan.DialContext(ctx, p.Proxy, network, addr)
+	}
+	if err := p.sc.Allow(ctx, s.Key); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	c, err := trojan.DialContext(ctx, p.Proxy, network, addr)
+	// dials given up by the client are not failures
+	p.sc.Record(s.Key, addr, err != nil && ctx.Err() == nil)
+	return c, err
+}
+
+// ListenPacket is ...
+func (p *scanProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return p.ListenPacketContext(context.Background(), network, addr)
+}
+
+// ListenPacketContext is ...
+func (p *scanProxy) ListenPacketContext(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	pc, err := trojan.ListenPacketContext(ctx, p.Proxy, network, addr)
+	return p.wrap(ctx, pc, err)
+}
+
+// ListenPing is ...
+func (p *scanProxy) ListenPing(ctx context.Context) (net.PacketConn, error) {
+	pc, err := trojan.ListenPing(ctx, p.Proxy)
+	return p.wrap(ctx, pc, err)
+}
+
+// wrap is ...
+func (p *scanProxy) wrap(ctx context.Context, pc net.PacketConn, err error) (net.PacketConn, error) {
+	s := SessionFromContext(ctx)
+	if err != nil || s == nil {
+		return pc, err
+	}
+	return &scanPacketConn{PacketConn: pc, key: s.Key, sc: p.sc, seen: make(map[string]struct{})}, nil
+}
+
+// scanPacketConn records new destinations of packets as connections, and
+// drops packets to new destinations of users blocked or throttled.
+type scanPacketConn struct {
+	net.PacketConn
+	key string
+	sc  *Scanning
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// WriteTo is ...
+func (c *scanPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst := addr.String()
+	c.mu.Lock()
+	_, ok := c.seen[dst]
+	c.mu.Unlock()
+	if ok {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	if !c.sc.allowPacket(c.key) {
+		return len(b), nil
+	}
+
+	// the set starts over when full, so a destination is recorded again
+	// at most once every scanMaxDestinations new destinations
+	c.mu.Lock()
+	if len(c.seen) >= scanMaxDestinations {
+		clear(c.seen)
+	}
+	c.seen[dst] = struct{}{}
+	c.mu.Unlock()
+	c.sc.Record(c.key, dst, false)
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+var (
+	_ Proxy                        = (*scanProxy)(nil)
+	_ trojan.ContextDialer         = (*scanProxy)(nil)
+	_ trojan.ContextPacketListener = (*scanProxy)(nil)
+	_ trojan.Pinger                = (*scanProxy)(nil)
+)
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestScanProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	// a port without listener
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	sc := &Scanning{MaxFailures: 2, Action: ScanActionBlock}
+	if err := sc.Provision(nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	p := &scanProxy{Proxy: &NoProxy{}, sc: sc}
+	s := NewSession("key", TransportTLS, "1.2.3.4:1", "")
+	ctx := s.Context(context.Background())
+
+	c, err := p.DialContext(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	for range 3 {
+		if _, err := p.DialContext(ctx, "tcp", closed.Addr().String()); err == nil || errors.Is(err, ErrScanBlocked) {
+			t.Fatalf("dial closed port error: %v", err)
+		}
+	}
+	if _, err := p.DialContext(ctx, "tcp", ln.Addr().String()); !errors.Is(err, ErrScanBlocked) {
+		t.Fatalf("dial of blocked user error: %v", err)
+	}
+	// dials without sessions and of other users are not blocked
+	if c, err := p.DialContext(context.Background(), "tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	} else {
+		c.Close()
+	}
+
+	list := sc.Penalties()
+	if len(list) != 1 || list[0].Key != "key" || list[0].ID != KeyID("key") || list[0].Failures != 3 || list[0].Connections != 4 || list[0].Until == nil {
+		t.Fatalf("penalties error: %+v", list)
+	}
+	if events := sc.Events(); len(events) != 1 || events[0].Reasons[0] != ScanReasonFailures {
+		t.Fatalf("events error: %+v", events)
+	}
+
+	if !sc.Clear("key") || sc.Clear("key") {
+		t.Fatal("clear error")
+	}
+	if c, err := p.DialContext(ctx, "tcp", ln.Addr().String()); err != nil {
+		t.Fatalf("dial of cleared user error: %v", err)
+	} else {
+		c.Close()
+	}
+}
+
+func TestScanningThrottle(t *testing.T) {
+	sc := &Scanning{MaxPorts: 10, MaxHosts: 3, ThrottleRate: 0.001}
+	if err := sc.Provision(nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 4 {
+		sc.Record("key", fmt.Sprintf("10.0.0.%d:22", i), false)
+	}
+	list := sc.Penalties()
+	if len(list) != 1 || list[0].Action != ScanActionThrottle || list[0].Hosts != 4 || list[0].Ports != 1 {
+		t.Fatalf("penalties error: %+v", list)
+	}
+
+	// one connection is allowed by the burst, the next waits too long
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sc.Allow(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Allow(ctx, "key"); err == nil {
+		t.Fatal("throttle error")
+	}
+	if err := sc.Allow(ctx, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// packets to new destinations are dropped, known destinations pass
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	seen := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	sp := &scanPacketConn{PacketConn: pc, key: "key", sc: sc, seen: map[string]struct{}{seen.String(): {}}}
+	if _, err := sp.WriteTo([]byte("a"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.WriteTo([]byte("a"), seen); err != nil {
+		t.Fatal(err)
+	}
+	if len(sp.seen) != 1 {
+		t.Fatalf("destinations error: %v", sp.seen)
+	}
+}
+
+func TestScanningSweep(t *testing.T) {
+	sc := &Scanning{Window: caddy.Duration(time.Minute), MaxFailures: 1, Action: ScanActionBlock}
+	if err := sc.Provision(nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	sc.Record("idle", "10.0.0.1:22", false)
+	sc.Record("blocked", "10.0.0.1:22", true)
+	sc.Record("blocked", "10.0.0.1:22", true)
+
+	// users idle for a window are removed by the next record, penalized
+	// users are kept
+	for _, u := range sc.users {
+		for i := range u.dials {
+			u.dials[i].time = u.dials[i].time.Add(-time.Hour)
+		}
+	}
+	sc.swept = sc.swept.Add(-time.Hour)
+	sc.Record("other", "10.0.0.1:22", false)
+	if _, ok := sc.users["idle"]; ok || len(sc.users) != 2 {
+		t.Fatalf("sweep error: %v", sc.users)
+	}
+}
+
+func TestScanningStorage(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	sc := &Scanning{MaxHosts: 2, Action: ScanActionBlock}
+	if err := sc.Provision(storage, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		sc.Record("key", fmt.Sprintf("10.0.0.%d:22", i), false)
+	}
+
+	// counts of dials out of the window are removed
+	u := sc.users["key"]
+	for i := range u.dials[:2] {
+		u.dials[i].time = u.dials[i].time.Add(-time.Hour)
+	}
+	sc.Record("key", "10.0.0.2:23", false)
+	if len(u.dials) != 2 || len(u.hosts) != 1 || len(u.ports) != 2 {
+		t.Fatalf("counts error: %v %v %v", u.dials, u.hosts, u.ports)
+	}
+
+	// penalties are kept across reloads
+	sc2 := &Scanning{Action: ScanActionLog}
+	if err := sc2.Provision(storage, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if list := sc2.Penalties(); len(list) != 1 || list[0].Key != "key" || list[0].Action != ScanActionBlock {
+		t.Fatalf("penalties of reloaded scanning error: %+v", list)
+	}
+	if err := sc2.Allow(context.Background(), "key"); !errors.Is(err, ErrScanBlocked) {
+		t.Fatalf("allow of reloaded scanning error: %v", err)
+	}
+	if !sc2.Clear("key") {
+		t.Fatal("clear error")
+	}
+	sc3 := &Scanning{}
+	if err := sc3.Provision(storage, zap.NewNop()); err != nil || len(sc3.Penalties()) != 0 {
+		t.Fatalf("penalties of cleared scanning error: %v %v", sc3.Penalties(), err)
+	}
+}
@@ -0,0 +1,246 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// ErrUserInvalid is the reason of sessions terminated by revalidation.
+var ErrUserInvalid = errors.New("user is no longer valid")
+
+const (
+	// TransportTLS is trojan over TLS handled by the listener wrapper
+	TransportTLS = "tls"
+	// TransportWebSocket is trojan over websocket
+	TransportWebSocket = "websocket"
+	// TransportHTTP2 is CONNECT over http2
+	TransportHTTP2 = "h2"
+	// TransportHTTP3 is CONNECT over http3
+	TransportHTTP3 = "h3"
+)
+
+// Session is the metadata of an authenticated trojan connection.
+type Session struct {
+	// Key is hex(SHA224(password)) of the user
+	Key string
+	// Transport is ...
+	Transport string
+	// RemoteAddr is the address of the client
+	RemoteAddr string
+	// ServerName is the TLS SNI sent by the client
+	ServerName string
+	// Start is ...
+	Start time.Time
+	// Outbound is the named outbound chosen at authentication, empty for the default.
+	Outbound string
+	// Fingerprint is the TLS ClientHello fingerprint of the connection,
+	// nil if it is not recorded.
+	Fingerprint *Fingerprint
+
+	once   sync.Once
+	closer io.Closer
+	reason error
+}
+
+// NewSession is ...
+func NewSession(key, transport, remoteAddr, serverName string) *Session {
+	return &Session{
+		Key:        key,
+		Transport:  transport,
+		RemoteAddr: remoteAddr,
+		ServerName: serverName,
+		Start:      time.Now(),
+	}
+}
+
+// KeyID returns a short ID of the user of key for logs and reports, which
+// does not reveal the key as the key is the credential of the user.
+func KeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// sessionKey is ...
+type sessionKey struct{}
+
+// WithSession is ...
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+// SessionFromContext returns the session of ctx or nil.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// HTTPTransport returns the transport of a CONNECT request of protoMajor.
+func HTTPTransport(protoMajor int) string {
+	if protoMajor == 3 {
+		return TransportHTTP3
+	}
+	return TransportHTTP2
+}
+
+// Context returns a copy of ctx carrying the session and its user.
+func (s *Session) Context(ctx context.Context) context.Context {
+	return WithSession(trojan.WithUser(ctx, s.Key), s)
+}
+
+// Terminate closes the connection of the session, it is safe to call
+// more than once.
+func (s *Session) Terminate(reason error) {
+	s.once.Do(func() {
+		s.reason = reason
+		if s.closer != nil {
+			s.closer.Close()
+		}
+	})
+}
+
+// sessionRegistry is the set of live sessions and the drain state
+type sessionRegistry struct {
+	mu    sync.Mutex
+	m     map[*Session]struct{}
+	drain *drain
+}
+
+// liveSessions is the registry shared by the apps of reloaded configs, as
+// sessions outlive the app which accepted them
+var liveSessions struct {
+	sync.Mutex
+	reg *sessionRegistry
+}
+
+// Sessions tracks live sessions and revalidates them periodically.
+type Sessions struct {
+	up     Upstream
+	policy *Policy
+	logger *zap.Logger
+
+	reg *sessionRegistry
+
+	// observe is called for every added session
+	observe func(*Session)
+	// fps binds fingerprints of connections to sessions
+	fps *Fingerprints
+
+	loop loop
+}
+
+// NewSessions is ...
+func NewSessions(up Upstream, policy *Policy, lg *zap.Logger) *Sessions {
+	return &Sessions{
+		up:     up,
+		policy: policy,
+		logger: lg,
+		reg:    &sessionRegistry{m: make(map[*Session]struct{})},
+	}
+}
+
+// share makes ss use the registry of the process, so that sessions and
+// draining of the app of the last config are taken over.
+func (ss *Sessions) share() {
+	liveSessions.Lock()
+	defer liveSessions.Unlock()
+	if liveSessions.reg == nil {
+		liveSessions.reg = ss.reg
+	}
+	ss.reg = liveSessions.reg
+}
+
+// Add tracks s until Remove is called, c is closed to terminate s.
+func (ss *Sessions) Add(s *Session, c io.Closer) {
+	if ss == nil {
+		return
+	}
+	s.closer = c
+	ss.fps.attach(s)
+	ss.reg.mu.Lock()
+	ss.reg.m[s] = struct{}{}
+	ss.reg.mu.Unlock()
+	if ss.observe != nil {
+		ss.observe(s)
+	}
+}
+
+// Remove is ...
+func (ss *Sessions) Remove(s *Session) {
+	if ss == nil {
+		return
+	}
+	ss.reg.mu.Lock()
+	delete(ss.reg.m, s)
+	ss.reg.mu.Unlock()
+}
+
+// Len is ...
+func (ss *Sessions) Len() int {
+	ss.reg.mu.Lock()
+	defer ss.reg.mu.Unlock()
+	return len(ss.reg.m)
+}
+
+// Range calls fn for every live session until fn returns false.
+func (ss *Sessions) Range(fn func(*Session) bool) {
+	ss.reg.mu.Lock()
+	list := make([]*Session, 0, len(ss.reg.m))
+	for s := range ss.reg.m {
+		list = append(list, s)
+	}
+	ss.reg.mu.Unlock()
+
+	for _, s := range list {
+		if !fn(s) {
+			return
+		}
+	}
+}
+
+// Terminate terminates s and logs the reason.
+func (ss *Sessions) Terminate(s *Session, reason error) {
+	ss.logger.Info(fmt.Sprintf("terminate %v session of %v from %v: %v", s.Transport, KeyID(s.Key), s.RemoteAddr, reason))
+	s.Terminate(reason)
+}
+
+// Revalidate validates the users of live sessions with the upstream and
+// the auth rules of the policy again, and terminates invalid sessions.
+// Every user is validated once.
+func (ss *Sessions) Revalidate() {
+	valid := make(map[string]bool)
+	ss.Range(func(s *Session) bool {
+		ok, found := valid[s.Key]
+		if !found {
+			ok = ss.up.Validate(s.Key)
+			valid[s.Key] = ok
+		}
+		if !ok {
+			ss.Terminate(s, ErrUserInvalid)
+			return true
+		}
+		if !ss.policy.Authorize(NewSession(s.Key, s.Transport, s.RemoteAddr, s.ServerName)) {
+			ss.Terminate(s, ErrPolicyDenied)
+		}
+		return true
+	})
+}
+
+// Start revalidates sessions every d.
+func (ss *Sessions) Start(d time.Duration) {
+	ss.loop.Start(d, ss.Revalidate)
+}
+
+// Stop is ...
+func (ss *Sessions) Stop() {
+	ss.loop.Stop()
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSessionsRevalidate(t *testing.T) {
+	u, keys := newTestMemoryUpstream(t, 2)
+	p := &Policy{Auth: []PolicyRule{{Match: "sni == 'blocked.example.com'", Action: PolicyDeny}}}
+	if err := p.Provision(nil, func(key string) map[string]any { return map[string]any{"key": key} }, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	ss := NewSessions(u, p, zap.NewNop())
+
+	conns := make([]net.Conn, 3)
+	sessions := []*Session{
+		NewSession(string(keys[0]), TransportTLS, "1.2.3.4:5", "ok.example.com"),
+		NewSession(string(keys[1]), TransportTLS, "1.2.3.4:6", "ok.example.com"),
+		NewSession(string(keys[1]), TransportTLS, "1.2.3.4:7", "ok.example.com"),
+	}
+	for i, s := range sessions {
+		c, peer := net.Pipe()
+		defer peer.Close()
+		conns[i] = peer
+		ss.Add(s, c)
+	}
+
+	ss.Revalidate()
+	if ss.Len() != 3 || sessions[0].reason != nil {
+		t.Fatalf("revalidate valid sessions error: %v", sessions[0].reason)
+	}
+
+	u.Delete("pass0")
+	// blocked after authentication
+	sessions[2].ServerName = "blocked.example.com"
+	ss.Revalidate()
+	for i, err := range []error{ErrUserInvalid, nil, ErrPolicyDenied} {
+		if !errors.Is(sessions[i].reason, err) {
+			t.Errorf("session %d reason error: %v", i, sessions[i].reason)
+		}
+		// reads of the peer end once the session is closed
+		conns[i].SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, er := conns[i].Read(make([]byte, 1)); errors.Is(er, io.EOF) != (err != nil) {
+			t.Errorf("session %d close error: %v", i, er)
+		}
+	}
+
+	for _, s := range sessions {
+		ss.Remove(s)
+	}
+	if ss.Len() != 0 {
+		t.Fatalf("remove error: %v", ss.Len())
+	}
+}
@@ -0,0 +1,448 @@
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/imgk/caddy-trojan/socks"
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func init() {
+	caddy.RegisterModule(ShadowsocksProxy{})
+}
+
+// ErrShadowsocksBadHeader is returned when a response header of a
+// Shadowsocks 2022 server is invalid.
+var ErrShadowsocksBadHeader = errors.New("shadowsocks: bad header")
+
+// ShadowsocksProxy dials targets through a Shadowsocks server.
+type ShadowsocksProxy struct {
+	// Server is the address of the Shadowsocks server.
+	Server string `json:"server"`
+	// Method is one of aes-128-gcm, aes-256-gcm, chacha20-ietf-poly1305,
+	// 2022-blake3-aes-128-gcm, 2022-blake3-aes-256-gcm and
+	// 2022-blake3-chacha20-poly1305.
+	Method string `json:"method"`
+	// Password is ..., 2022 methods take a base64 key of the key size.
+	// Placeholders such as {env.SS_PASSWORD} are supported.
+	Password string `json:"password"`
+	// DialTimeout is the timeout of connecting to the server, default is 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	cipher *ssCipher
+}
+
+// CaddyModule is ...
+func (ShadowsocksProxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.proxies.shadowsocks",
+		New: func() caddy.Module { return new(ShadowsocksProxy) },
+	}
+}
+
+// Provision is ...
+func (p *ShadowsocksProxy) Provision(ctx caddy.Context) error {
+	if p.Server == "" {
+		return errors.New("shadowsocks: server is empty")
+	}
+	if _, _, err := net.SplitHostPort(p.Server); err != nil {
+		return fmt.Errorf("shadowsocks: server error: %w", err)
+	}
+	if p.DialTimeout == 0 {
+		p.DialTimeout = caddy.Duration(10 * time.Second)
+	}
+
+	c, err := newSSCipher(p.Method, caddy.NewReplacer().ReplaceKnown(p.Password, ""))
+	if err != nil {
+		return err
+	}
+	p.cipher = c
+	return nil
+}
+
+// Handle is ...
+func (p *ShadowsocksProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
+}
+
+// Close is ...
+func (*ShadowsocksProxy) Close() error {
+	return nil
+}
+
+// Dial is ...
+func (p *ShadowsocksProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the server and sends the request header.
+func (p *ShadowsocksProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("shadowsocks: network %v is not supported", network)
+	}
+	target, err := socks.ResolveHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: target %v error: %w", addr, err)
+	}
+
+	conn, err := (&net.Dialer{Timeout: time.Duration(p.DialTimeout)}).DialContext(ctx, "tcp", p.Server)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: connect %v error: %w", p.Server, err)
+	}
+	c, err := newSSConn(conn, p.cipher, target)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("shadowsocks: request %v error: %w", addr, err)
+	}
+	return c, nil
+}
+
+// ListenPacket is ...
+func (p *ShadowsocksProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	server, err := net.ResolveUDPAddr("udp", p.Server)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: resolve %v error: %w", p.Server, err)
+	}
+	conn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	codec, err := newSSUDPCodec(p.cipher, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ssPacketConn{PacketConn: conn, server: server, codec: codec}, nil
+}
+
+// ssCipher is the key and the AEAD construction of a method
+type ssCipher struct {
+	key    []byte
+	is2022 bool
+	aead   func(key []byte) (cipher.AEAD, error)
+	// block encrypts the separate headers of 2022 AES UDP packets
+	block cipher.Block
+}
+
+// newSSCipher is ...
+func newSSCipher(method, password string) (*ssCipher, error) {
+	c := &ssCipher{}
+	size := 0
+	switch method {
+	case "aes-128-gcm", "2022-blake3-aes-128-gcm":
+		c.aead, size = newGCM, 16
+	case "aes-256-gcm", "2022-blake3-aes-256-gcm":
+		c.aead, size = newGCM, 32
+	case "chacha20-ietf-poly1305", "2022-blake3-chacha20-poly1305":
+		c.aead, size = chacha20poly1305.New, chacha20poly1305.KeySize
+	default:
+		return nil, fmt.Errorf("shadowsocks: unknown method: %v", method)
+	}
+	if password == "" {
+		return nil, errors.New("shadowsocks: password is empty")
+	}
+
+	c.is2022 = method[:5] == "2022-"
+	if !c.is2022 {
+		c.key = evpBytesToKey(password, size)
+		return c, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks: decode key error: %w", err)
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("shadowsocks: key size of %v is %v, got %v", method, size, len(key))
+	}
+	c.key = key
+	if method != "2022-blake3-chacha20-poly1305" {
+		c.block, _ = aes.NewCipher(key)
+	}
+	return c, nil
+}
+
+// newGCM is ...
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// evpBytesToKey derives a key from password as OpenSSL EVP_BytesToKey with MD5
+func evpBytesToKey(password string, size int) []byte {
+	key, prev := []byte{}, []byte{}
+	h := md5.New()
+	for len(key) < size {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-h.Size():]
+	}
+	return key[:size]
+}
+
+// SaltSize is the size of salts, which is the key size
+func (c *ssCipher) SaltSize() int {
+	return len(c.key)
+}
+
+// Session returns the AEAD of the session of salt
+func (c *ssCipher) Session(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if c.is2022 {
+		blake3.DeriveKey("shadowsocks 2022 session subkey", append(append([]byte{}, c.key...), salt...), subkey)
+	} else if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.aead(subkey)
+}
+
+// MaxPayload is the maximum payload size of a chunk
+func (c *ssCipher) MaxPayload() int {
+	if c.is2022 {
+		return 0xffff
+	}
+	return 0x3fff
+}
+
+// ssTimeWindow is the maximum clock difference of 2022 headers
+const ssTimeWindow = 30
+
+// checkTimestamp is ...
+func checkTimestamp(ts uint64) error {
+	if d := time.Now().Unix() - int64(ts); d > ssTimeWindow || d < -ssTimeWindow {
+		return fmt.Errorf("%w: timestamp %v is out of window", ErrShadowsocksBadHeader, ts)
+	}
+	return nil
+}
+
+// increment increments a little endian nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// ssWriter seals chunks of [length][payload]
+type ssWriter struct {
+	io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	max   int
+	buf   []byte
+}
+
+// newSSWriter is ...
+func newSSWriter(w io.Writer, aead cipher.AEAD, max int) *ssWriter {
+	return &ssWriter{Writer: w, aead: aead, nonce: make([]byte, aead.NonceSize()), max: max}
+}
+
+// Seal appends a sealed message to dst
+func (w *ssWriter) Seal(dst, b []byte) []byte {
+	dst = w.aead.Seal(dst, w.nonce, b, nil)
+	increment(w.nonce)
+	return dst
+}
+
+// Write is ...
+func (w *ssWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > w.max {
+			chunk = chunk[:w.max]
+		}
+		w.buf = w.Seal(w.buf[:0], []byte{byte(len(chunk) >> 8), byte(len(chunk))})
+		w.buf = w.Seal(w.buf, chunk)
+		if _, err := w.Writer.Write(w.buf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// ssReader opens chunks of [length][payload]
+type ssReader struct {
+	io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	left  []byte
+}
+
+// newSSReader is ...
+func newSSReader(r io.Reader, aead cipher.AEAD) *ssReader {
+	return &ssReader{Reader: r, aead: aead, nonce: make([]byte, aead.NonceSize()), buf: make([]byte, 0xffff+aead.Overhead())}
+}
+
+// Open reads and opens a sealed message of n bytes
+func (r *ssReader) Open(n int) ([]byte, error) {
+	b := r.buf[:n+r.aead.Overhead()]
+	if _, err := io.ReadFull(r.Reader, b); err != nil {
+		return nil, err
+	}
+	b, err := r.aead.Open(b[:0], r.nonce, b, nil)
+	if err != nil {
+		return nil, err
+	}
+	increment(r.nonce)
+	return b, nil
+}
+
+// Read is ...
+func (r *ssReader) Read(b []byte) (int, error) {
+	for len(r.left) == 0 {
+		size, err := r.Open(2)
+		if err != nil {
+			return 0, err
+		}
+		r.left, err = r.Open(int(binary.BigEndian.Uint16(size)))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.left)
+	r.left = r.left[n:]
+	return n, nil
+}
+
+// ssConn is a TCP connection to a Shadowsocks server
+type ssConn struct {
+	net.Conn
+	cipher *ssCipher
+	salt   []byte
+	w      *ssWriter
+	r      *ssReader
+}
+
+// newSSConn writes the request header of target to conn
+func newSSConn(conn net.Conn, c *ssCipher, target *socks.Addr) (*ssConn, error) {
+	salt := make([]byte, c.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.Session(salt)
+	if err != nil {
+		return nil, err
+	}
+	w := newSSWriter(conn, aead, c.MaxPayload())
+
+	b := append([]byte{}, salt...)
+	if !c.is2022 {
+		b = w.Seal(b, []byte{0, byte(target.Len())})
+		b = w.Seal(b, target.Bytes())
+	} else {
+		// there is no initial payload, so the padding is required
+		pad, err := rand.Int(rand.Reader, big.NewInt(900))
+		if err != nil {
+			return nil, err
+		}
+		vh := target.AppendTo(make([]byte, 0, target.Len()+2+900))
+		vh = binary.BigEndian.AppendUint16(vh, uint16(pad.Int64()+1))
+		vh = vh[:len(vh)+int(pad.Int64()+1)]
+
+		fh := []byte{0}
+		fh = binary.BigEndian.AppendUint64(fh, uint64(time.Now().Unix()))
+		fh = binary.BigEndian.AppendUint16(fh, uint16(len(vh)))
+		b = w.Seal(b, fh)
+		b = w.Seal(b, vh)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	return &ssConn{Conn: conn, cipher: c, salt: salt, w: w}, nil
+}
+
+// readHeader reads the salt and the 2022 response header
+func (c *ssConn) readHeader() error {
+	salt := make([]byte, c.cipher.SaltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.cipher.Session(salt)
+	if err != nil {
+		return err
+	}
+	r := newSSReader(c.Conn, aead)
+	if c.cipher.is2022 {
+		// [type][timestamp][request salt][length]
+		fh, err := r.Open(1 + 8 + len(c.salt) + 2)
+		if err != nil {
+			return err
+		}
+		if fh[0] != 1 {
+			return fmt.Errorf("%w: type %v", ErrShadowsocksBadHeader, fh[0])
+		}
+		if err := checkTimestamp(binary.BigEndian.Uint64(fh[1:])); err != nil {
+			return err
+		}
+		if string(fh[9:9+len(c.salt)]) != string(c.salt) {
+			return fmt.Errorf("%w: request salt mismatch", ErrShadowsocksBadHeader)
+		}
+		if r.left, err = r.Open(int(binary.BigEndian.Uint16(fh[9+len(c.salt):]))); err != nil {
+			return err
+		}
+	}
+	c.r = r
+	return nil
+}
+
+// Read is ...
+func (c *ssConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(b)
+}
+
+// Write is ...
+func (c *ssConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// CloseWrite is ...
+func (c *ssConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+var (
+	_ Proxy                = (*ShadowsocksProxy)(nil)
+	_ caddy.Provisioner    = (*ShadowsocksProxy)(nil)
+	_ trojan.ContextDialer = (*ShadowsocksProxy)(nil)
+)
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/socks"
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// ssServe serves Shadowsocks TCP connections of ln
+func ssServe(ln net.Listener, c *ssCipher) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			ssServeConn(conn, c)
+			conn.Close()
+		}()
+	}
+}
+
+func ssServeConn(conn net.Conn, c *ssCipher) error {
+	salt := make([]byte, c.SaltSize())
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.Session(salt)
+	if err != nil {
+		return err
+	}
+	r := newSSReader(conn, aead)
+
+	addr := (*socks.Addr)(nil)
+	if !c.is2022 {
+		if addr, err = socks.ReadAddrBuffer(r, make([]byte, socks.MaxAddrLen)); err != nil {
+			return err
+		}
+	} else {
+		fh, err := r.Open(1 + 8 + 2)
+		if err != nil {
+			return err
+		}
+		if fh[0] != 0 {
+			return ErrShadowsocksBadHeader
+		}
+		if err := checkTimestamp(binary.BigEndian.Uint64(fh[1:])); err != nil {
+			return err
+		}
+		vh, err := r.Open(int(binary.BigEndian.Uint16(fh[9:])))
+		if err != nil {
+			return err
+		}
+		if addr, err = socks.ParseAddr(append([]byte{}, vh...)); err != nil {
+			return err
+		}
+		if n := addr.Len() + 2 + int(binary.BigEndian.Uint16(vh[addr.Len():])); len(vh) > n {
+			r.left = vh[n:]
+		}
+	}
+
+	rc, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	rsalt := make([]byte, c.SaltSize())
+	rand.Read(rsalt)
+	raead, err := c.Session(rsalt)
+	if err != nil {
+		return err
+	}
+	w := newSSWriter(conn, raead, c.MaxPayload())
+	b := append([]byte{}, rsalt...)
+	if c.is2022 {
+		// an empty first chunk
+		fh := binary.BigEndian.AppendUint64([]byte{1}, uint64(time.Now().Unix()))
+		fh = append(append(fh, salt...), 0, 0)
+		b = w.Seal(b, fh)
+		b = w.Seal(b, nil)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+
+	go func() {
+		io.Copy(rc, r)
+		rc.(*net.TCPConn).CloseWrite()
+	}()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// ssServeUDP echoes Shadowsocks UDP packets of pc back to their senders
+func ssServeUDP(pc net.PacketConn, c *ssCipher) {
+	codec, err := newSSUDPCodec(c, true)
+	if err != nil {
+		return
+	}
+	b := make([]byte, 64*1024)
+	for {
+		n, raddr, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		addr, payload, err := codec.Open(b[:n])
+		if err != nil {
+			continue
+		}
+		pkt, err := codec.Seal(nil, addr, payload)
+		if err != nil {
+			continue
+		}
+		pc.WriteTo(pkt, raddr)
+	}
+}
+
+func TestShadowsocksProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	n, _ := strconv.Atoi(port)
+
+	for _, method := range []string{
+		"aes-128-gcm",
+		"aes-256-gcm",
+		"chacha20-ietf-poly1305",
+		"2022-blake3-aes-128-gcm",
+		"2022-blake3-aes-256-gcm",
+		"2022-blake3-chacha20-poly1305",
+	} {
+		password := "secret"
+		if method[:5] == "2022-" {
+			key := make([]byte, 32)
+			if method == "2022-blake3-aes-128-gcm" {
+				key = key[:16]
+			}
+			rand.Read(key)
+			password = base64.StdEncoding.EncodeToString(key)
+		}
+		c, err := newSSCipher(method, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sl, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sl.Close()
+		go ssServe(sl, c)
+		pc, err := net.ListenPacket("udp", sl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		go ssServeUDP(pc, c)
+
+		p := &ShadowsocksProxy{Server: sl.Addr().String(), Method: method, Password: password}
+		if err := p.Provision(caddy.Context{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// tcp
+		payload := string(bytes.Repeat([]byte("ping"), 0x5000))
+		w := &bytes.Buffer{}
+		if _, _, err := p.Handle(context.Background(), trojanRequest(host, uint16(n), payload), w); err != nil || w.String() != payload {
+			t.Fatalf("%v: handle error: %v %v", method, w.Len(), err)
+		}
+
+		// udp
+		req := []byte{socks.AddrTypeIPv4, 127, 0, 0, 1, 0, 53, 0, 4, '\r', '\n', 'p', 'i', 'n', 'g'}
+		r, rw := io.Pipe()
+		resp, ww := io.Pipe()
+		go func() {
+			trojan.HandleUDP(r, ww, 100*time.Millisecond, p)
+			ww.Close()
+		}()
+		go rw.Write(req)
+		b := make([]byte, len(req))
+		if _, err := io.ReadFull(resp, b); err != nil || !bytes.Equal(b, req) {
+			t.Fatalf("%v: handle udp error: %v %v", method, b, err)
+		}
+		rw.Close()
+		io.Copy(io.Discard, resp)
+	}
+
+	for method, password := range map[string]string{
+		"rc4-md5":                 "secret",
+		"aes-128-gcm":             "",
+		"2022-blake3-aes-128-gcm": "secret",
+		"2022-blake3-aes-256-gcm": base64.StdEncoding.EncodeToString(make([]byte, 16)),
+	} {
+		p := &ShadowsocksProxy{Server: "127.0.0.1:8388", Method: method, Password: password}
+		if err := p.Provision(caddy.Context{}); err == nil {
+			t.Errorf("%v: provision error", method)
+		}
+	}
+}
+
+func TestShadowsocksBadHeader(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	c, err := newSSCipher("2022-blake3-aes-128-gcm", base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a response to another request is rejected
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+	target, _ := socks.ResolveHostPort("example.com:80")
+	sc, err := newSSConn(conn, c, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		salt := make([]byte, c.SaltSize())
+		aead, _ := c.Session(salt)
+		w := newSSWriter(io.Discard, aead, c.MaxPayload())
+		fh := binary.BigEndian.AppendUint64([]byte{1}, uint64(time.Now().Unix()))
+		fh = append(append(fh, make([]byte, c.SaltSize())...), 0, 0)
+		peer.Write(w.Seal(salt, fh))
+	}()
+	if _, err := sc.Read(make([]byte, 1)); !errors.Is(err, ErrShadowsocksBadHeader) {
+		t.Fatalf("request salt error: %v", err)
+	}
+}
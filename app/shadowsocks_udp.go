@@ -0,0 +1,250 @@
+package app
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/imgk/memory-go"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/imgk/caddy-trojan/socks"
+)
+
+// ssPacketConn relays UDP packets through a Shadowsocks server
+type ssPacketConn struct {
+	net.PacketConn
+	server net.Addr
+	codec  *ssUDPCodec
+}
+
+// ReadFrom returns packets from the server, invalid packets are dropped.
+func (c *ssPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	ptr, buf := memory.Alloc[byte](64 * 1024)
+	defer memory.Free(ptr)
+
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		addr, payload, err := c.codec.Open(buf[:n])
+		if err != nil {
+			continue
+		}
+		raddr, err := socks.ResolveUDPAddr(addr)
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), raddr, nil
+	}
+}
+
+// WriteTo is ...
+func (c *ssPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target, err := socks.ResolveAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	pkt, err := c.codec.Seal(nil, target, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(pkt, c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ssUDPCodec seals and opens Shadowsocks UDP packets of one side of
+// an association
+type ssUDPCodec struct {
+	cipher *ssCipher
+	server bool
+
+	// 2022 session of this side
+	session [8]byte
+	packet  uint64
+	aead    cipher.AEAD
+	xaead   cipher.AEAD
+
+	// 2022 session of the other side
+	mu       sync.Mutex
+	peer     [8]byte
+	peerKey  [8]byte
+	peerAEAD cipher.AEAD
+}
+
+// newSSUDPCodec is ...
+func newSSUDPCodec(c *ssCipher, server bool) (*ssUDPCodec, error) {
+	codec := &ssUDPCodec{cipher: c, server: server}
+	if !c.is2022 {
+		return codec, nil
+	}
+	if _, err := rand.Read(codec.session[:]); err != nil {
+		return nil, err
+	}
+	if c.block == nil {
+		aead, err := chacha20poly1305.NewX(c.key)
+		if err != nil {
+			return nil, err
+		}
+		codec.xaead = aead
+		return codec, nil
+	}
+	aead, err := c.Session(codec.session[:])
+	if err != nil {
+		return nil, err
+	}
+	codec.aead = aead
+	return codec, nil
+}
+
+// Seal appends a packet of payload to addr to dst.
+func (c *ssUDPCodec) Seal(dst []byte, addr *socks.Addr, payload []byte) ([]byte, error) {
+	if !c.cipher.is2022 {
+		// [salt][addr payload]
+		salt := make([]byte, c.cipher.SaltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		aead, err := c.cipher.Session(salt)
+		if err != nil {
+			return nil, err
+		}
+		b := append(addr.AppendTo(make([]byte, 0, addr.Len()+len(payload))), payload...)
+		return aead.Seal(append(dst, salt...), make([]byte, aead.NonceSize()), b, nil), nil
+	}
+
+	// [session id][packet id][type][timestamp]([client session id])[padding length][addr][payload]
+	b := make([]byte, 0, 16+1+8+8+2+addr.Len()+len(payload))
+	b = append(b, c.session[:]...)
+	b = binary.BigEndian.AppendUint64(b, atomic.AddUint64(&c.packet, 1)-1)
+	if c.server {
+		b = append(b, 1)
+		b = binary.BigEndian.AppendUint64(b, uint64(time.Now().Unix()))
+		c.mu.Lock()
+		b = append(b, c.peer[:]...)
+		c.mu.Unlock()
+	} else {
+		b = append(b, 0)
+		b = binary.BigEndian.AppendUint64(b, uint64(time.Now().Unix()))
+	}
+	b = append(b, 0, 0)
+	b = addr.AppendTo(b)
+	b = append(b, payload...)
+
+	if c.xaead != nil {
+		nonce := make([]byte, c.xaead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return c.xaead.Seal(append(dst, nonce...), nonce, b, nil), nil
+	}
+
+	header := make([]byte, 16)
+	c.cipher.block.Encrypt(header, b[:16])
+	return c.aead.Seal(append(dst, header...), b[4:16], b[16:], nil), nil
+}
+
+// Open returns the address and the payload of a packet, b is reused.
+func (c *ssUDPCodec) Open(b []byte) (*socks.Addr, []byte, error) {
+	if !c.cipher.is2022 {
+		if len(b) < c.cipher.SaltSize() {
+			return nil, nil, errors.New("shadowsocks: short packet")
+		}
+		aead, err := c.cipher.Session(b[:c.cipher.SaltSize()])
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err = aead.Open(b[c.cipher.SaltSize():c.cipher.SaltSize()], make([]byte, aead.NonceSize()), b[c.cipher.SaltSize():], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		addr, err := socks.ParseAddr(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		return addr, b[addr.Len():], nil
+	}
+
+	header, body := []byte(nil), []byte(nil)
+	if c.xaead != nil {
+		ns := c.xaead.NonceSize()
+		if len(b) < ns+16 {
+			return nil, nil, errors.New("shadowsocks: short packet")
+		}
+		pt, err := c.xaead.Open(b[ns:ns], b[:ns], b[ns:], nil)
+		if err != nil || len(pt) < 16 {
+			return nil, nil, fmt.Errorf("shadowsocks: open packet error: %w", err)
+		}
+		header, body = pt[:16], pt[16:]
+	} else {
+		if len(b) < 16 {
+			return nil, nil, errors.New("shadowsocks: short packet")
+		}
+		header = b[:16]
+		c.cipher.block.Decrypt(header, header)
+		aead, err := c.peerSession(header[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		if body, err = aead.Open(b[16:16], header[4:16], b[16:], nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// servers receive type 0 and clients receive type 1
+	typ, n := byte(0), 1+8+2
+	if !c.server {
+		typ, n = 1, 1+8+8+2
+	}
+	if len(body) < n {
+		return nil, nil, ErrShadowsocksBadHeader
+	}
+	if body[0] != typ {
+		return nil, nil, fmt.Errorf("%w: type %v", ErrShadowsocksBadHeader, body[0])
+	}
+	if err := checkTimestamp(binary.BigEndian.Uint64(body[1:])); err != nil {
+		return nil, nil, err
+	}
+	if !c.server && string(body[9:17]) != string(c.session[:]) {
+		return nil, nil, fmt.Errorf("%w: client session id mismatch", ErrShadowsocksBadHeader)
+	}
+	n += int(binary.BigEndian.Uint16(body[n-2:]))
+	if len(body) < n {
+		return nil, nil, ErrShadowsocksBadHeader
+	}
+	addr, err := socks.ParseAddr(body[n:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.server {
+		c.mu.Lock()
+		copy(c.peer[:], header[:8])
+		c.mu.Unlock()
+	}
+	return addr, body[n+addr.Len():], nil
+}
+
+// peerSession returns the AEAD of the 2022 session of the other side
+func (c *ssUDPCodec) peerSession(session []byte) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peerAEAD != nil && string(c.peerKey[:]) == string(session) {
+		return c.peerAEAD, nil
+	}
+	aead, err := c.cipher.Session(session)
+	if err != nil {
+		return nil, err
+	}
+	copy(c.peerKey[:], session)
+	c.peerAEAD = aead
+	return aead, nil
+}
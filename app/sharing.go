@@ -0,0 +1,413 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+// ErrCredentialSharing is the reason of bans of the disable action.
+var ErrCredentialSharing = errors.New("credential sharing")
+
+const (
+	// SharingActionLog logs flagged users
+	SharingActionLog = "log"
+	// SharingActionWebhook posts flags to the webhook
+	SharingActionWebhook = "webhook"
+	// SharingActionDisable bans flagged users
+	SharingActionDisable = "disable"
+)
+
+const (
+	// SharingReasonIPs is ...
+	SharingReasonIPs = "ips"
+	// SharingReasonASNs is ...
+	SharingReasonASNs = "asns"
+	// SharingReasonCountries is ...
+	SharingReasonCountries = "countries"
+	// SharingReasonTravel is ...
+	SharingReasonTravel = "impossible_travel"
+)
+
+const (
+	// sharingMaxObservations is the max number of connections kept per user
+	sharingMaxObservations = 1024
+	// sharingMinDistance is the distance in km below which locations are
+	// considered the same because of the accuracy of geolocation
+	sharingMinDistance = 200
+	// sharingSweepInterval is the interval of removing inactive users
+	sharingSweepInterval = 10 * time.Minute
+)
+
+// Sharing flags users whose passwords are likely shared, from distinct
+// client IPs, ASNs and countries within a sliding window and from
+// impossible travel between connections.
+type Sharing struct {
+	// MMDB are paths of MaxMind databases such as GeoLite2-City and
+	// GeoLite2-ASN, whose records are merged.
+	MMDB []string `json:"mmdb,omitempty"`
+	// Window is the sliding window of counting, default is 24h.
+	Window caddy.Duration `json:"window,omitempty"`
+	// MaxIPs is the max number of distinct client IPs of a user within
+	// Window, 0 is unlimited.
+	MaxIPs int `json:"max_ips,omitempty"`
+	// MaxASNs is ...
+	MaxASNs int `json:"max_asns,omitempty"`
+	// MaxCountries is ...
+	MaxCountries int `json:"max_countries,omitempty"`
+	// MaxSpeed is the max speed in km/h between locations of consecutive
+	// connections of a user, 0 disables detecting impossible travel.
+	MaxSpeed float64 `json:"max_speed,omitempty"`
+	// Action is log, webhook or disable, default is log. Flags are always
+	// logged.
+	Action string `json:"action,omitempty"`
+	// Webhook is the URL receiving flags of the webhook action.
+	Webhook string `json:"webhook,omitempty"`
+	// DisableFor is the duration of bans of the disable action, 0 bans
+	// permanently.
+	DisableFor caddy.Duration `json:"disable_for,omitempty"`
+
+	dbs    []*maxminddb.Reader
+	ban    func(key, reason string, d time.Duration) Ban
+	logger *zap.Logger
+	client *http.Client
+
+	mu    sync.Mutex
+	users map[string][]SharingObservation
+	flags map[string]*SharingFlag
+	loop  loop
+}
+
+// SharingObservation is a connection of a user.
+type SharingObservation struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	ASN       uint      `json:"asn,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Latitude  float64   `json:"latitude,omitempty"`
+	Longitude float64   `json:"longitude,omitempty"`
+
+	located bool
+}
+
+// SharingTravel is an impossible travel between two connections.
+type SharingTravel struct {
+	From SharingObservation `json:"from"`
+	To   SharingObservation `json:"to"`
+	// Distance is in km
+	Distance float64 `json:"distance"`
+	// Speed is in km/h
+	Speed float64 `json:"speed"`
+}
+
+// SharingFlag is a user suspected of sharing its password with evidence.
+type SharingFlag struct {
+	// Key is only kept in memory, ID is reported instead.
+	Key     string    `json:"-"`
+	ID      string    `json:"id"`
+	Reasons []string  `json:"reasons"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	// IPs, ASNs and Countries are distinct values within the window when
+	// the user was flagged last.
+	IPs       []string       `json:"ips,omitempty"`
+	ASNs      []uint         `json:"asns,omitempty"`
+	Countries []string       `json:"countries,omitempty"`
+	Travel    *SharingTravel `json:"travel,omitempty"`
+}
+
+// geoRecord is the union of fields of city, country and asn databases
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// Provision is ...
+func (sh *Sharing) Provision(ban func(string, string, time.Duration) Ban, lg *zap.Logger) error {
+	if sh.Window == 0 {
+		sh.Window = caddy.Duration(24 * time.Hour)
+	}
+	switch sh.Action {
+	case "":
+		sh.Action = SharingActionLog
+	case SharingActionLog, SharingActionDisable:
+	case SharingActionWebhook:
+		if sh.Webhook == "" {
+			return errors.New("sharing webhook action without webhook url")
+		}
+	default:
+		return fmt.Errorf("unknown sharing action: %v", sh.Action)
+	}
+	if (sh.MaxASNs > 0 || sh.MaxCountries > 0 || sh.MaxSpeed > 0) && len(sh.MMDB) == 0 {
+		return errors.New("sharing asns, countries and travel need mmdb")
+	}
+	for _, v := range sh.MMDB {
+		db, err := maxminddb.Open(v)
+		if err != nil {
+			sh.Close()
+			return fmt.Errorf("open mmdb %v error: %w", v, err)
+		}
+		sh.dbs = append(sh.dbs, db)
+	}
+	sh.ban = ban
+	sh.logger = lg
+	sh.client = &http.Client{Timeout: 10 * time.Second}
+	sh.users = make(map[string][]SharingObservation)
+	sh.flags = make(map[string]*SharingFlag)
+	return nil
+}
+
+// Start removes users without connections within the window periodically.
+func (sh *Sharing) Start() {
+	sh.loop.Start(sharingSweepInterval, func() { sh.sweep(time.Now()) })
+}
+
+// sweep removes connections and flags of users which have no connection
+// within the window
+func (sh *Sharing) sweep(now time.Time) {
+	start := now.Add(-time.Duration(sh.Window))
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for k, list := range sh.users {
+		if len(list) == 0 || !list[len(list)-1].Time.After(start) {
+			delete(sh.users, k)
+		}
+	}
+	for k, v := range sh.flags {
+		if !v.Last.After(start) {
+			if _, ok := sh.users[k]; !ok {
+				delete(sh.flags, k)
+			}
+		}
+	}
+}
+
+// Close is ...
+func (sh *Sharing) Close() error {
+	sh.loop.Stop()
+	for _, db := range sh.dbs {
+		db.Close()
+	}
+	sh.dbs = nil
+	return nil
+}
+
+// lookup returns the observation of a connection from ip
+func (sh *Sharing) lookup(ip netip.Addr, now time.Time) SharingObservation {
+	o := SharingObservation{Time: now, IP: ip.String()}
+	rec := geoRecord{}
+	for _, db := range sh.dbs {
+		if err := db.Lookup(net.IP(ip.AsSlice()), &rec); err != nil {
+			sh.logger.Debug(fmt.Sprintf("lookup %v error: %v", ip, err))
+		}
+	}
+	o.ASN = rec.ASN
+	o.Country = rec.Country.ISOCode
+	if rec.Location.Latitude != nil && rec.Location.Longitude != nil {
+		o.Latitude, o.Longitude, o.located = *rec.Location.Latitude, *rec.Location.Longitude, true
+	}
+	return o
+}
+
+// Observe records a new session and flags its user if needed.
+func (sh *Sharing) Observe(s *Session) {
+	if sh == nil {
+		return
+	}
+	ap, err := netip.ParseAddrPort(s.RemoteAddr)
+	if err != nil {
+		return
+	}
+	o := sh.lookup(ap.Addr().Unmap(), time.Now())
+
+	sh.mu.Lock()
+	list := sh.users[s.Key]
+	start := o.Time.Add(-time.Duration(sh.Window))
+	i := sort.Search(len(list), func(i int) bool { return list[i].Time.After(start) })
+	list = append(list[i:], o)
+	if len(list) > sharingMaxObservations {
+		list = list[len(list)-sharingMaxObservations:]
+	}
+	sh.users[s.Key] = list
+
+	ips, asns, countries := []string{}, []uint{}, []string{}
+	for _, v := range list {
+		if !slices.Contains(ips, v.IP) {
+			ips = append(ips, v.IP)
+		}
+		if v.ASN != 0 && !slices.Contains(asns, v.ASN) {
+			asns = append(asns, v.ASN)
+		}
+		if v.Country != "" && !slices.Contains(countries, v.Country) {
+			countries = append(countries, v.Country)
+		}
+	}
+
+	reasons := []string{}
+	if sh.MaxIPs > 0 && len(ips) > sh.MaxIPs {
+		reasons = append(reasons, SharingReasonIPs)
+	}
+	if sh.MaxASNs > 0 && len(asns) > sh.MaxASNs {
+		reasons = append(reasons, SharingReasonASNs)
+	}
+	if sh.MaxCountries > 0 && len(countries) > sh.MaxCountries {
+		reasons = append(reasons, SharingReasonCountries)
+	}
+	travel := sh.travel(list)
+	if travel != nil {
+		reasons = append(reasons, SharingReasonTravel)
+	}
+	if len(reasons) == 0 {
+		sh.mu.Unlock()
+		return
+	}
+
+	flag, ok := sh.flags[s.Key]
+	if !ok {
+		flag = &SharingFlag{Key: s.Key, ID: KeyID(s.Key), First: o.Time}
+		sh.flags[s.Key] = flag
+	}
+	added := false
+	for _, v := range reasons {
+		if !slices.Contains(flag.Reasons, v) {
+			flag.Reasons = append(flag.Reasons, v)
+			added = true
+		}
+	}
+	flag.Last = o.Time
+	flag.IPs, flag.ASNs, flag.Countries = ips, asns, countries
+	if travel != nil {
+		flag.Travel = travel
+	}
+	f := *flag
+	sh.mu.Unlock()
+
+	// act once for every new reason
+	if added {
+		sh.act(f)
+	}
+}
+
+// travel returns the impossible travel of the last connection in list
+func (sh *Sharing) travel(list []SharingObservation) *SharingTravel {
+	if sh.MaxSpeed <= 0 || len(list) < 2 {
+		return nil
+	}
+	to := list[len(list)-1]
+	if !to.located {
+		return nil
+	}
+	for i := len(list) - 2; i >= 0; i-- {
+		from := list[i]
+		if !from.located {
+			continue
+		}
+		d := distance(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+		if d < sharingMinDistance {
+			return nil
+		}
+		hours := math.Max(to.Time.Sub(from.Time).Hours(), time.Minute.Hours())
+		if speed := d / hours; speed > sh.MaxSpeed {
+			return &SharingTravel{From: from, To: to, Distance: math.Round(d), Speed: math.Round(speed)}
+		}
+		return nil
+	}
+	return nil
+}
+
+// distance returns the great-circle distance in km
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const radius = 6371
+	rad := math.Pi / 180
+	dlat, dlon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * radius * math.Asin(math.Sqrt(a))
+}
+
+// act runs the action of a flag
+func (sh *Sharing) act(f SharingFlag) {
+	sh.logger.Warn(fmt.Sprintf("user %v is suspected of credential sharing: %v, ips: %v, asns: %v, countries: %v",
+		f.ID, f.Reasons, len(f.IPs), f.ASNs, f.Countries))
+
+	switch sh.Action {
+	case SharingActionWebhook:
+		go func() {
+			if err := sh.post(f); err != nil {
+				sh.logger.Error(fmt.Sprintf("post sharing webhook error: %v", err))
+			}
+		}()
+	case SharingActionDisable:
+		sh.ban(f.Key, ErrCredentialSharing.Error(), time.Duration(sh.DisableFor))
+	}
+}
+
+// post sends f to the webhook
+func (sh *Sharing) post(f SharingFlag) error {
+	b, err := json.Marshal(map[string]any{"event": "credential_sharing", "flag": f})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, sh.Webhook, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook status: %v", resp.Status)
+	}
+	return nil
+}
+
+// Flags lists flagged users by the time they were flagged first.
+func (sh *Sharing) Flags() []SharingFlag {
+	if sh == nil {
+		return nil
+	}
+	sh.mu.Lock()
+	list := make([]SharingFlag, 0, len(sh.flags))
+	for _, v := range sh.flags {
+		list = append(list, *v)
+	}
+	sh.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].First.Before(list[j].First) })
+	return list
+}
+
+// Clear removes the flag and connections of the user of key, such as
+// after its password is changed.
+func (sh *Sharing) Clear(key string) bool {
+	if sh == nil {
+		return false
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	_, ok := sh.flags[key]
+	delete(sh.flags, key)
+	delete(sh.users, key)
+	return ok
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeMMDB writes an IPv4 MaxMind DB of networks to a temporary file
+func writeMMDB(t *testing.T, networks map[string]map[string]any) string {
+	type node struct {
+		child [2]*node
+		data  [2]int // index of data + 1
+		id    int
+	}
+
+	root := &node{}
+	records := []map[string]any{}
+	for prefix, rec := range networks {
+		p := netip.MustParsePrefix(prefix)
+		records = append(records, rec)
+		ip := p.Addr().As4()
+		n := root
+		for i := 0; i < p.Bits(); i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if i == p.Bits()-1 {
+				n.data[bit] = len(records)
+				break
+			}
+			if n.child[bit] == nil {
+				n.child[bit] = &node{}
+			}
+			n = n.child[bit]
+		}
+	}
+	nodes := []*node{root}
+	for i := 0; i < len(nodes); i++ {
+		nodes[i].id = i
+		for _, c := range nodes[i].child {
+			if c != nil {
+				nodes = append(nodes, c)
+			}
+		}
+	}
+
+	data, offsets := &bytes.Buffer{}, []int{}
+	for _, rec := range records {
+		offsets = append(offsets, data.Len())
+		mmdbEncode(data, rec)
+	}
+
+	b := &bytes.Buffer{}
+	for _, n := range nodes {
+		for bit := range 2 {
+			v := len(nodes)
+			switch {
+			case n.child[bit] != nil:
+				v = n.child[bit].id
+			case n.data[bit] != 0:
+				v = len(nodes) + 16 + offsets[n.data[bit]-1]
+			}
+			b.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	b.Write(make([]byte, 16))
+	b.Write(data.Bytes())
+	b.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbEncode(b, map[string]any{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint32(time.Now().Unix()),
+	})
+
+	name := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(name, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// mmdbEncode encodes v in the data format of MaxMind DB
+func mmdbEncode(b *bytes.Buffer, v any) {
+	putUint := func(typ byte, n uint64) {
+		bb := binary.BigEndian.AppendUint64(nil, n)
+		for len(bb) > 0 && bb[0] == 0 {
+			bb = bb[1:]
+		}
+		b.WriteByte(typ<<5 | byte(len(bb)))
+		b.Write(bb)
+	}
+	switch v := v.(type) {
+	case string:
+		b.WriteByte(2<<5 | byte(len(v)))
+		b.WriteString(v)
+	case float64:
+		b.WriteByte(3<<5 | 8)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		putUint(5, uint64(v))
+	case uint32:
+		putUint(6, uint64(v))
+	case map[string]any:
+		b.WriteByte(7<<5 | byte(len(v)))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			mmdbEncode(b, k)
+			mmdbEncode(b, v[k])
+		}
+	}
+}
+
+func TestSharing(t *testing.T) {
+	city := func(country string, lat, lon float64) map[string]any {
+		return map[string]any{
+			"country":  map[string]any{"iso_code": country},
+			"location": map[string]any{"latitude": lat, "longitude": lon},
+		}
+	}
+	asn := func(n uint32) map[string]any {
+		return map[string]any{"autonomous_system_number": n}
+	}
+	sh := &Sharing{
+		MMDB: []string{
+			writeMMDB(t, map[string]map[string]any{
+				"1.0.0.0/8": city("US", 40.71, -74.01),
+				"2.0.0.0/8": city("US", 40.71, -74.01),
+				"3.0.0.0/8": city("JP", 35.68, 139.69),
+			}),
+			writeMMDB(t, map[string]map[string]any{
+				"1.0.0.0/8": asn(100),
+				"2.0.0.0/8": asn(200),
+				"3.0.0.0/8": asn(300),
+			}),
+		},
+		MaxIPs:       2,
+		MaxASNs:      2,
+		MaxCountries: 1,
+		MaxSpeed:     1000,
+		Action:       SharingActionDisable,
+	}
+	bans := []string{}
+	ban := func(key, reason string, d time.Duration) Ban {
+		bans = append(bans, key)
+		return Ban{}
+	}
+	if err := sh.Provision(ban, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	defer sh.Close()
+
+	for _, v := range []struct {
+		key, addr string
+		bans      int
+	}{
+		{"alice", "1.1.1.1:1", 0},
+		{"alice", "[::ffff:1.1.1.2]:1", 0},
+		{"bob", "1.1.1.1:1", 0},
+		{"alice", "2.2.2.2:1", 1},
+		{"alice", "2.2.2.2:2", 1},
+		{"alice", "3.3.3.3:1", 2},
+	} {
+		sh.Observe(NewSession(v.key, TransportTLS, v.addr, ""))
+		if len(bans) != v.bans {
+			t.Fatalf("observe %v from %v error: %v", v.key, v.addr, bans)
+		}
+	}
+
+	flags := sh.Flags()
+	if len(flags) != 1 || flags[0].Key != "alice" {
+		t.Fatalf("flags error: %v", flags)
+	}
+	f := flags[0]
+	slices.Sort(f.Reasons)
+	if !slices.Equal(f.Reasons, []string{SharingReasonASNs, SharingReasonCountries, SharingReasonTravel, SharingReasonIPs}) {
+		t.Errorf("reasons error: %v", f.Reasons)
+	}
+	if len(f.IPs) != 4 || !slices.Equal(f.ASNs, []uint{100, 200, 300}) || !slices.Equal(f.Countries, []string{"US", "JP"}) {
+		t.Errorf("evidence error: %v %v %v", f.IPs, f.ASNs, f.Countries)
+	}
+	if f.Travel == nil || f.Travel.From.IP != "2.2.2.2" || f.Travel.To.Country != "JP" || f.Travel.Distance < 10000 {
+		t.Errorf("travel error: %+v", f.Travel)
+	}
+
+	// users without connections within the window are removed
+	sh.sweep(time.Now())
+	if len(sh.users) != 2 || len(sh.flags) != 1 {
+		t.Fatalf("sweep of active users error: %v %v", sh.users, sh.flags)
+	}
+	sh.Observe(NewSession("carol", TransportTLS, "1.1.1.1:1", ""))
+	sh.sweep(time.Now().Add(time.Duration(sh.Window)))
+	if len(sh.users) != 0 || len(sh.flags) != 0 {
+		t.Fatalf("sweep error: %v %v", sh.users, sh.flags)
+	}
+
+	sh.Observe(NewSession("alice", TransportTLS, "1.1.1.1:1", ""))
+	sh.flags["alice"] = &SharingFlag{Key: "alice"}
+	if !sh.Clear("alice") || sh.Clear("alice") || len(sh.Flags()) != 0 {
+		t.Fatal("clear error")
+	}
+}
+
+func TestSharingWebhook(t *testing.T) {
+	ch := make(chan SharingFlag, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := struct {
+			Event string      `json:"event"`
+			Flag  SharingFlag `json:"flag"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&event)
+		if event.Event == "credential_sharing" {
+			ch <- event.Flag
+		}
+	}))
+	defer srv.Close()
+
+	sh := &Sharing{MaxIPs: 1, Action: SharingActionWebhook, Webhook: srv.URL}
+	if err := sh.Provision(nil, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	sh.Observe(NewSession("alice", TransportTLS, "1.1.1.1:1", ""))
+	sh.Observe(NewSession("alice", TransportTLS, "1.1.1.2:1", ""))
+
+	select {
+	case f := <-ch:
+		if f.ID != KeyID("alice") || !slices.Equal(f.Reasons, []string{SharingReasonIPs}) {
+			t.Fatalf("webhook flag error: %+v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook timeout")
+	}
+
+	if err := (&Sharing{MaxCountries: 1}).Provision(nil, zap.NewNop()); err == nil {
+		t.Fatal("countries without mmdb error")
+	}
+}
@@ -0,0 +1,341 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func init() {
+	caddy.RegisterModule(SSHProxy{})
+}
+
+// ErrSSHUDP is returned when a UDP association is made through SSH.
+var ErrSSHUDP = errors.New("ssh: udp is not supported")
+
+// SSHProxy dials targets through direct-tcpip channels of a pool of
+// SSH connections.
+type SSHProxy struct {
+	// Server is the address of the SSH server, default port is 22.
+	Server string `json:"server"`
+	// User is ...
+	User string `json:"user"`
+	// Password is ..., placeholders such as {env.SSH_PASSWORD} are supported.
+	Password string `json:"password,omitempty"`
+	// PrivateKeyFile is the path of a private key in PEM format.
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	// Passphrase is the passphrase of the private key.
+	Passphrase string `json:"passphrase,omitempty"`
+	// KnownHostsFile is the path of a known_hosts file pinning the host key.
+	KnownHostsFile string `json:"known_hosts_file,omitempty"`
+	// HostKey is the pinned host key in authorized_keys format,
+	// one of HostKey and KnownHostsFile is required.
+	HostKey string `json:"host_key,omitempty"`
+	// Connections is the size of the connection pool, default is 2.
+	Connections int `json:"connections,omitempty"`
+	// DialTimeout is the timeout of connecting to the server, default is 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+	// KeepAlive is the interval of keepalive requests, default is 30s,
+	// -1 disables keepalive.
+	KeepAlive caddy.Duration `json:"keep_alive,omitempty"`
+
+	config *ssh.ClientConfig
+	slots  []sshSlot
+	next   uint32
+}
+
+// sshSlot is a pooled SSH connection
+type sshSlot struct {
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// CaddyModule is ...
+func (SSHProxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "trojan.proxies.ssh",
+		New: func() caddy.Module { return new(SSHProxy) },
+	}
+}
+
+// Provision is ...
+func (p *SSHProxy) Provision(ctx caddy.Context) error {
+	if p.Server == "" {
+		return errors.New("ssh: server is empty")
+	}
+	if _, _, err := net.SplitHostPort(p.Server); err != nil {
+		p.Server = net.JoinHostPort(p.Server, "22")
+	}
+	if p.User == "" {
+		return errors.New("ssh: user is empty")
+	}
+	if p.Connections == 0 {
+		p.Connections = 2
+	}
+	if p.DialTimeout == 0 {
+		p.DialTimeout = caddy.Duration(10 * time.Second)
+	}
+	if p.KeepAlive == 0 {
+		p.KeepAlive = caddy.Duration(30 * time.Second)
+	}
+
+	repl := caddy.NewReplacer()
+	auths := []ssh.AuthMethod{}
+	if p.PrivateKeyFile != "" {
+		b, err := os.ReadFile(p.PrivateKeyFile)
+		if err != nil {
+			return fmt.Errorf("ssh: read private key error: %w", err)
+		}
+		signer := ssh.Signer(nil)
+		if pass := repl.ReplaceKnown(p.Passphrase, ""); pass != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(pass))
+		} else {
+			signer, err = ssh.ParsePrivateKey(b)
+		}
+		if err != nil {
+			return fmt.Errorf("ssh: parse private key error: %w", err)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if pass := repl.ReplaceKnown(p.Password, ""); pass != "" {
+		auths = append(auths, ssh.Password(pass))
+	}
+	if len(auths) == 0 {
+		return errors.New("ssh: one of password and private_key_file is required")
+	}
+
+	callback, algos := ssh.HostKeyCallback(nil), []string(nil)
+	switch {
+	case p.HostKey != "" && p.KnownHostsFile != "":
+		return errors.New("ssh: only one of host_key and known_hosts_file is allowed")
+	case p.HostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(p.HostKey))
+		if err != nil {
+			return fmt.Errorf("ssh: parse host key error: %w", err)
+		}
+		callback, algos = ssh.FixedHostKey(key), hostKeyAlgorithms(key.Type())
+	case p.KnownHostsFile != "":
+		cb, err := knownhosts.New(p.KnownHostsFile)
+		if err != nil {
+			return fmt.Errorf("ssh: read known hosts error: %w", err)
+		}
+		callback = cb
+	default:
+		return errors.New("ssh: one of host_key and known_hosts_file is required")
+	}
+
+	p.config = &ssh.ClientConfig{
+		User:              p.User,
+		Auth:              auths,
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: algos,
+		Timeout:           time.Duration(p.DialTimeout),
+	}
+	p.slots = make([]sshSlot, p.Connections)
+	return nil
+}
+
+// hostKeyAlgorithms returns the signature algorithms of a host key type
+func hostKeyAlgorithms(typ string) []string {
+	if typ == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{typ}
+}
+
+// Handle is ...
+func (p *SSHProxy) Handle(ctx context.Context, r io.Reader, w io.Writer) (int64, int64, error) {
+	return trojan.HandleContext(ctx, r, w, p)
+}
+
+// Close closes all pooled connections.
+func (p *SSHProxy) Close() error {
+	for i := range p.slots {
+		s := &p.slots[i]
+		s.mu.Lock()
+		if s.client != nil {
+			s.client.Close()
+			s.client = nil
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Dial is ...
+func (p *SSHProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext opens a direct-tcpip channel, a broken connection is
+// replaced and the channel is opened again once.
+func (p *SSHProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("ssh: network %v is not supported", network)
+	}
+
+	s := &p.slots[int(atomic.AddUint32(&p.next, 1))%len(p.slots)]
+	for retry := 0; ; retry++ {
+		client, err := p.client(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		c, err := client.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return newSSHConn(c), nil
+		}
+		if oe := (*ssh.OpenChannelError)(nil); errors.As(err, &oe) || ctx.Err() != nil || retry > 0 {
+			return nil, fmt.Errorf("ssh: dial %v error: %w", addr, err)
+		}
+		s.drop(client)
+	}
+}
+
+// ListenPacket is ...
+func (p *SSHProxy) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return nil, ErrSSHUDP
+}
+
+// client returns the connection of s and connects to the server if
+// there is none.
+func (p *SSHProxy) client(ctx context.Context, s *sshSlot) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	conn, err := (&net.Dialer{Timeout: time.Duration(p.DialTimeout)}).DialContext(ctx, "tcp", p.Server)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: connect %v error: %w", p.Server, err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(p.DialTimeout)))
+	cc, chans, reqs, err := ssh.NewClientConn(conn, p.Server, p.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh: handshake %v error: %w", p.Server, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.client = ssh.NewClient(cc, chans, reqs)
+	go p.keepAlive(s, s.client)
+	return s.client, nil
+}
+
+// keepAlive sends keepalive requests and removes c from s once it is closed
+func (p *SSHProxy) keepAlive(s *sshSlot, c *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(done)
+	}()
+
+	if p.KeepAlive < 0 {
+		<-done
+		s.drop(c)
+		return
+	}
+
+	d := time.Duration(p.KeepAlive)
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			s.drop(c)
+			return
+		case <-ticker.C:
+			timer := time.AfterFunc(d, func() { c.Close() })
+			_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+			timer.Stop()
+			if err != nil {
+				c.Close()
+			}
+		}
+	}
+}
+
+// drop closes c and removes it from s
+func (s *sshSlot) drop(c *ssh.Client) {
+	s.mu.Lock()
+	if s.client == c {
+		s.client = nil
+	}
+	s.mu.Unlock()
+	c.Close()
+}
+
+// sshConn adds read deadlines to a direct-tcpip channel, which are
+// required by trojan.Relay. Reads go through a pipe fed by the channel.
+type sshConn struct {
+	net.Conn
+	ch net.Conn
+}
+
+// newSSHConn is ...
+func newSSHConn(ch net.Conn) *sshConn {
+	c, peer := net.Pipe()
+	go func() {
+		io.Copy(peer, ch)
+		peer.Close()
+	}()
+	return &sshConn{Conn: c, ch: ch}
+}
+
+// Write is ...
+func (c *sshConn) Write(b []byte) (int, error) {
+	return c.ch.Write(b)
+}
+
+// CloseWrite is ...
+func (c *sshConn) CloseWrite() error {
+	return c.ch.(interface {
+		CloseWrite() error
+	}).CloseWrite()
+}
+
+// Close is ...
+func (c *sshConn) Close() error {
+	c.Conn.Close()
+	return c.ch.Close()
+}
+
+// SetDeadline is ...
+func (c *sshConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is not supported by SSH channels and is ignored.
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// LocalAddr is ...
+func (c *sshConn) LocalAddr() net.Addr {
+	return c.ch.LocalAddr()
+}
+
+// RemoteAddr is ...
+func (c *sshConn) RemoteAddr() net.Addr {
+	return c.ch.RemoteAddr()
+}
+
+var (
+	_ Proxy                = (*SSHProxy)(nil)
+	_ caddy.Provisioner    = (*SSHProxy)(nil)
+	_ trojan.ContextDialer = (*SSHProxy)(nil)
+)
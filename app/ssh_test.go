@@ -0,0 +1,227 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshServer is an in-process SSH server serving direct-tcpip channels
+type sshServer struct {
+	net.Listener
+	HostKey ssh.Signer
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// newSSHServer accepts the password "secret" and the public key of client
+func newSSHServer(t *testing.T, client ssh.PublicKey) *sshServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "trojan" && string(pass) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("password rejected")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if client != nil && string(key.Marshal()) == string(client.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("public key rejected")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &sshServer{Listener: ln, HostKey: signer}
+	t.Cleanup(func() {
+		ln.Close()
+		srv.CloseConns()
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, c)
+			srv.mu.Unlock()
+			go srv.serve(c, config)
+		}
+	}()
+	return srv
+}
+
+// CloseConns closes all accepted connections.
+func (srv *sshServer) CloseConns() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, c := range srv.conns {
+		c.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *sshServer) serve(c net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "direct-tcpip" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		msg := struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}{}
+		if err := ssh.Unmarshal(nc.ExtraData(), &msg); err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		rc, err := net.Dial("tcp", net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port))))
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, creqs, err := nc.Accept()
+		if err != nil {
+			rc.Close()
+			continue
+		}
+		go ssh.DiscardRequests(creqs)
+		go func() {
+			io.Copy(rc, ch)
+			rc.(*net.TCPConn).CloseWrite()
+		}()
+		go func() {
+			io.Copy(ch, rc)
+			ch.Close()
+			rc.Close()
+		}()
+	}
+}
+
+func newTestSSHProxy(t *testing.T, p *SSHProxy) *SSHProxy {
+	if err := p.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestSSHProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go echo(ln)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newSSHServer(t, clientKey)
+
+	// private key and known_hosts files
+	dir := t.TempDir()
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{srv.Addr().String()}, srv.HostKey.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey := string(ssh.MarshalAuthorizedKey(srv.HostKey.PublicKey()))
+	for name, p := range map[string]*SSHProxy{
+		"password":    {Server: srv.Addr().String(), User: "trojan", Password: "secret", HostKey: hostKey, Connections: 1},
+		"private key": {Server: srv.Addr().String(), User: "trojan", PrivateKeyFile: keyFile, KnownHostsFile: knownHosts, Connections: 1},
+	} {
+		p := newTestSSHProxy(t, p)
+		for i := 0; i < 2; i++ {
+			c, err := p.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("%v: dial error: %v", name, err)
+			}
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+				t.Fatalf("%v: echo error: %q %v", name, b, err)
+			}
+			c.Close()
+
+			// connections are replaced once they are broken
+			srv.CloseConns()
+		}
+
+		// trojan requests are relayed through channels
+		host, port, _ := net.SplitHostPort(ln.Addr().String())
+		n, _ := strconv.Atoi(port)
+		w := &bytes.Buffer{}
+		if _, _, err := p.Handle(context.Background(), trojanRequest(host, uint16(n), "ping"), w); err != nil || w.String() != "ping" {
+			t.Fatalf("%v: handle error: %q %v", name, w.String(), err)
+		}
+	}
+
+	// the host key is pinned
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(other)
+	p := newTestSSHProxy(t, &SSHProxy{Server: srv.Addr().String(), User: "trojan", Password: "secret", HostKey: string(ssh.MarshalAuthorizedKey(otherKey))})
+	if _, err := p.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatal("host key pinning error")
+	}
+
+	p = newTestSSHProxy(t, &SSHProxy{Server: srv.Addr().String(), User: "trojan", Password: "wrong", HostKey: hostKey})
+	if _, err := p.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Fatal("password auth error")
+	}
+	if _, err := p.ListenPacket("udp", ""); !errors.Is(err, ErrSSHUDP) {
+		t.Fatalf("udp error: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// shardCount is the number of shards of memoryTable, must be a power of 2
+const shardCount = 64
+
+// memoryEntry is the traffic counter of a single user
+type memoryEntry struct {
+	up   atomic.Int64
+	down atomic.Int64
+}
+
+// memoryShard is a copy-on-write map, readers never take a lock
+// and writers copy the map under mu before publishing it
+type memoryShard struct {
+	mu sync.Mutex
+	mm atomic.Pointer[map[string]*memoryEntry]
+
+	// avoid false sharing between neighbouring shards
+	_ [48]byte
+}
+
+// memoryTable is a sharded in-memory user table
+type memoryTable struct {
+	shards [shardCount]memoryShard
+}
+
+// newMemoryTable is ...
+func newMemoryTable() *memoryTable {
+	t := &memoryTable{}
+	for i := range t.shards {
+		mm := make(map[string]*memoryEntry)
+		t.shards[i].mm.Store(&mm)
+	}
+	return t
+}
+
+// index picks the shard from the first two hex digits of the key,
+// which are uniformly distributed as keys are hex(SHA224(password))
+func (t *memoryTable) index(k string) uint {
+	if len(k) < 2 {
+		return 0
+	}
+	hex := func(c byte) uint { return uint(c&0x0f) + 9*uint(c>>6) }
+	return (hex(k[0])<<2 | hex(k[1])>>2) & (shardCount - 1)
+}
+
+// shard is ...
+func (t *memoryTable) shard(k string) *memoryShard {
+	return &t.shards[t.index(k)]
+}
+
+// Load returns the entry of k or nil, it does not allocate
+// so k can safely point into a reused header buffer.
+func (t *memoryTable) Load(k string) *memoryEntry {
+	return (*t.shard(k).mm.Load())[k]
+}
+
+// Store adds k if it does not exist.
+func (t *memoryTable) Store(k string) *memoryEntry {
+	s := t.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := *s.mm.Load()
+	if v, ok := old[k]; ok {
+		return v
+	}
+	mm := make(map[string]*memoryEntry, len(old)+1)
+	for kk, vv := range old {
+		mm[kk] = vv
+	}
+	v := &memoryEntry{}
+	mm[k] = v
+	s.mm.Store(&mm)
+	return v
+}
+
+// StoreBatch calls fn with a store func adding keys like Store, every
+// shard is copied once and the keys are published when fn returns. It is
+// for loading many users, which would copy a shard per key with Store.
+func (t *memoryTable) StoreBatch(fn func(store func(string) *memoryEntry)) {
+	for i := range t.shards {
+		t.shards[i].mu.Lock()
+		defer t.shards[i].mu.Unlock()
+	}
+
+	mms := [shardCount]map[string]*memoryEntry{}
+	fn(func(k string) *memoryEntry {
+		i := t.index(k)
+		if mms[i] == nil {
+			mms[i] = maps.Clone(*t.shards[i].mm.Load())
+		}
+		if v, ok := mms[i][k]; ok {
+			return v
+		}
+		v := &memoryEntry{}
+		mms[i][k] = v
+		return v
+	})
+	for i, mm := range mms {
+		if mm != nil {
+			t.shards[i].mm.Store(&mm)
+		}
+	}
+}
+
+// Delete is ...
+func (t *memoryTable) Delete(k string) {
+	s := t.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := *s.mm.Load()
+	if _, ok := old[k]; !ok {
+		return
+	}
+	mm := make(map[string]*memoryEntry, len(old))
+	for kk, vv := range old {
+		if kk != k {
+			mm[kk] = vv
+		}
+	}
+	s.mm.Store(&mm)
+}
+
+// Range calls fn for every entry of a consistent snapshot of each shard.
+func (t *memoryTable) Range(fn func(string, *memoryEntry)) {
+	for i := range t.shards {
+		for k, v := range *t.shards[i].mm.Load() {
+			fn(k, v)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/certmagic"
@@ -31,7 +33,7 @@ type Upstream interface {
 	// Validate is ...
 	Validate(string) bool
 	// Consume is ...
-	// Consume(string, int64, int64) error
+	Consume(string, int64, int64) error
 }
 
 // TaskType is ...
@@ -53,16 +55,28 @@ type Task struct {
 	}
 }
 
+// memoryFlushInterval is how often traffic is forwarded to the persistent
+// upstream of MemoryUpstream
+const memoryFlushInterval = 10 * time.Second
+
 // MemoryUpstream is ...
 type MemoryUpstream struct {
 	// UpstreamRaw is ...
 	UpstreamRaw json.RawMessage `json:"persist" caddy:"namespace=trojan.upstreams inline_key=upstream"`
 
-	ch chan Task
-	up Upstream
+	ch    chan Task
+	done  chan struct{}
+	up    Upstream
+	batch *memoryBatch
+
+	tb *memoryTable
+}
 
-	mu sync.RWMutex
-	mm map[string]Traffic
+// memoryBatch accumulates traffic for the persistent upstream until the
+// next flush, so that the data path never waits for it
+type memoryBatch struct {
+	mu      sync.Mutex
+	traffic map[string]Traffic
 }
 
 // CaddyModule is ...
@@ -75,7 +89,7 @@ func (MemoryUpstream) CaddyModule() caddy.ModuleInfo {
 
 // Provision is ...
 func (u *MemoryUpstream) Provision(ctx caddy.Context) error {
-	u.mm = make(map[string]Traffic)
+	u.tb = newMemoryTable()
 
 	if u.UpstreamRaw == nil {
 		return nil
@@ -87,38 +101,106 @@ func (u *MemoryUpstream) Provision(ctx caddy.Context) error {
 	}
 	up := mod.(Upstream)
 
-	up.Range(func(k string, nr, nw int64) {
-		u.AddKey(k)
-		u.Consume(k, nr, nw)
+	u.tb.StoreBatch(func(store func(string) *memoryEntry) {
+		up.Range(func(k string, nr, nw int64) {
+			v := store(k)
+			v.up.Add(nr)
+			v.down.Add(nw)
+		})
 	})
 
 	u.up = up
 	u.ch = make(chan Task, 16)
+	u.done = make(chan struct{})
+	u.batch = &memoryBatch{traffic: make(map[string]Traffic)}
+	go u.run()
 
-	go func(up Upstream, ch chan Task) {
-		for {
-			t, ok := <-ch
-			if !ok {
-				break
-			}
-			switch t.Type {
-			case TaskAdd:
-				up.Add(t.Value.Password)
-			case TaskDelete:
-				up.Delete(t.Value.Password)
-			case TaskConsume:
-				// up.Consume(t.Value.Key, t.Value.Up, t.Value.Down)
-			default:
+	return nil
+}
+
+// run applies tasks to the persistent upstream and flushes traffic until
+// Cleanup
+func (u *MemoryUpstream) run() {
+	ticker := time.NewTicker(memoryFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-u.ch:
+			u.apply(t)
+		case <-ticker.C:
+			u.flush()
+		case <-u.done:
+			for {
+				select {
+				case t := <-u.ch:
+					u.apply(t)
+				default:
+					u.flush()
+					return
+				}
 			}
 		}
-	}(u.up, u.ch)
+	}
+}
 
-	return nil
+// apply is ...
+func (u *MemoryUpstream) apply(t Task) {
+	switch t.Type {
+	case TaskAdd:
+		u.up.Add(t.Value.Password)
+	case TaskDelete:
+		u.up.Delete(t.Value.Password)
+	case TaskConsume:
+		u.up.Consume(t.Value.Key, t.Value.Up, t.Value.Down)
+	default:
+	}
+}
+
+// flush forwards accumulated traffic to the persistent upstream
+func (u *MemoryUpstream) flush() {
+	u.batch.mu.Lock()
+	traffic := u.batch.traffic
+	u.batch.traffic = make(map[string]Traffic)
+	u.batch.mu.Unlock()
+	for k, v := range traffic {
+		u.up.Consume(k, v.Up, v.Down)
+	}
+}
+
+// send passes t to the persistent upstream, tasks after Cleanup are
+// applied in a new goroutine
+func (u *MemoryUpstream) send(t Task) {
+	select {
+	case <-u.done:
+		go u.apply(t)
+		return
+	default:
+	}
+	select {
+	case u.ch <- t:
+	case <-u.done:
+		go u.apply(t)
+	}
+}
+
+// Rewrap rewraps records of the persistent upstream.
+func (u *MemoryUpstream) Rewrap(ctx context.Context) (RewrapResult, error) {
+	if r, ok := u.up.(Rewrapper); ok {
+		return r.Rewrap(ctx)
+	}
+	return RewrapResult{}, ErrEncryptionDisabled
 }
 
 // Cleanup is ...
 func (u *MemoryUpstream) Cleanup() error {
-	close(u.ch)
+	if u.done == nil {
+		return nil
+	}
+	select {
+	case <-u.done:
+	default:
+		close(u.done)
+	}
 	return nil
 }
 
@@ -135,28 +217,60 @@ func (u *MemoryUpstream) Add(s string) error {
 
 	t := Task{Type: TaskAdd}
 	t.Value.Password = s
-	u.ch <- t
+	u.send(t)
+	return nil
+}
+
+// AddAll adds users of passwords like Add, their keys are stored in bulk.
+func (u *MemoryUpstream) AddAll(list []string) error {
+	u.tb.StoreBatch(func(store func(string) *memoryEntry) {
+		b := [trojan.HeaderLen]byte{}
+		for _, s := range list {
+			trojan.GenKey(s, b[:])
+			store(string(b[:]))
+		}
+	})
+
+	if u.up == nil {
+		return nil
+	}
+
+	for _, s := range list {
+		t := Task{Type: TaskAdd}
+		t.Value.Password = s
+		u.send(t)
+	}
+	return nil
+}
+
+// bulkAdder is an Upstream adding many users at once
+type bulkAdder interface {
+	AddAll([]string) error
+}
+
+// addAll adds users of passwords to up, in bulk if up is a bulkAdder.
+func addAll(up Upstream, list []string) error {
+	if b, ok := up.(bulkAdder); ok {
+		return b.AddAll(list)
+	}
+	for _, s := range list {
+		if err := up.Add(s); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // AddKey is ...
 func (u *MemoryUpstream) AddKey(key string) {
-	u.mu.Lock()
-	u.mm[key] = Traffic{
-		Up:   0,
-		Down: 0,
-	}
-	u.mu.Unlock()
+	u.tb.Store(key)
 }
 
 // Delete is ...
 func (u *MemoryUpstream) Delete(s string) error {
 	b := [trojan.HeaderLen]byte{}
 	trojan.GenKey(s, b[:])
-	key := utils.ByteSliceToString(b[:])
-	u.mu.Lock()
-	delete(u.mm, key)
-	u.mu.Unlock()
+	u.tb.Delete(utils.ByteSliceToString(b[:]))
 
 	if u.up == nil {
 		return nil
@@ -164,56 +278,65 @@ func (u *MemoryUpstream) Delete(s string) error {
 
 	t := Task{Type: TaskDelete}
 	t.Value.Password = s
-	u.ch <- t
+	u.send(t)
 	return nil
 }
 
 // Range is ...
 func (u *MemoryUpstream) Range(fn func(string, int64, int64)) {
-	u.mu.RLock()
-	for k, v := range u.mm {
-		fn(k, v.Up, v.Down)
-	}
-	u.mu.RUnlock()
+	u.tb.Range(func(k string, v *memoryEntry) {
+		fn(k, v.up.Load(), v.down.Load())
+	})
 }
 
 // Validate is ...
 func (u *MemoryUpstream) Validate(k string) bool {
-	u.mu.RLock()
-	_, ok := u.mm[k]
-	u.mu.RUnlock()
-	return ok
+	return u.tb.Load(k) != nil
 }
 
-// Consume is ...
+// Consume counts traffic of a known user and forwards the traffic of
+// every user to the persistent upstream, which may know users that are
+// not in memory. Traffic is forwarded in batches every
+// memoryFlushInterval.
 func (u *MemoryUpstream) Consume(k string, nr, nw int64) error {
-	u.mu.Lock()
-	traffic := u.mm[k]
-	traffic.Up += nr
-	traffic.Down += nw
-	u.mm[k] = traffic
-	u.mu.Unlock()
+	if v := u.tb.Load(k); v != nil {
+		v.up.Add(nr)
+		v.down.Add(nw)
+	}
 
 	if u.up == nil {
 		return nil
 	}
 
-	t := Task{Type: TaskConsume}
-	t.Value.Key = k
-	t.Value.Up = nr
-	t.Value.Down = nw
-	u.ch <- t
+	select {
+	case <-u.done:
+		t := Task{Type: TaskConsume}
+		t.Value.Key = k
+		t.Value.Up = nr
+		t.Value.Down = nw
+		go u.apply(t)
+		return nil
+	default:
+	}
+	u.batch.mu.Lock()
+	traffic := u.batch.traffic[k]
+	traffic.Up += nr
+	traffic.Down += nw
+	u.batch.traffic[k] = traffic
+	u.batch.mu.Unlock()
 	return nil
 }
 
 // CaddyUpstream is ...
 type CaddyUpstream struct {
 	// Prefix is ...
-	Prefix string `json:"-,omitempty"`
+	Prefix string `json:"-"`
 	// Storage is ...
-	Storage certmagic.Storage `json:"-,omitempty"`
+	Storage certmagic.Storage `json:"-"`
 	// Logger is ...
-	Logger *zap.Logger `json:"-,omitempty"`
+	Logger *zap.Logger `json:"-"`
+	// Encryption encrypts user records in the storage if not nil.
+	Encryption *Encryption `json:"encryption,omitempty"`
 }
 
 // CaddyModule is ...
@@ -229,9 +352,47 @@ func (u *CaddyUpstream) Provision(ctx caddy.Context) error {
 	u.Prefix = "trojan/"
 	u.Storage = ctx.Storage()
 	u.Logger = ctx.Logger(u)
+	if u.Encryption != nil {
+		return u.Encryption.Provision()
+	}
 	return nil
 }
 
+// load reads the record of key
+func (u *CaddyUpstream) load(key string) (Traffic, bool, error) {
+	traffic := Traffic{}
+	b, err := u.Storage.Load(context.Background(), key)
+	if err != nil {
+		return traffic, false, err
+	}
+	stale := false
+	if u.Encryption != nil {
+		b, stale, err = u.Encryption.Open(key, b)
+		if err != nil {
+			return traffic, false, err
+		}
+	}
+	if err := json.Unmarshal(b, &traffic); err != nil {
+		return traffic, false, err
+	}
+	return traffic, stale, nil
+}
+
+// store writes the record of key
+func (u *CaddyUpstream) store(key string, traffic Traffic) error {
+	b, err := json.Marshal(&traffic)
+	if err != nil {
+		return err
+	}
+	if u.Encryption != nil {
+		b, err = u.Encryption.Seal(key, b)
+		if err != nil {
+			return err
+		}
+	}
+	return u.Storage.Store(context.Background(), key, b)
+}
+
 // Add is ...
 func (u *CaddyUpstream) Add(s string) error {
 	b := [trojan.HeaderLen]byte{}
@@ -244,11 +405,7 @@ func (u *CaddyUpstream) Add(s string) error {
 		Up:   0,
 		Down: 0,
 	}
-	bb, err := json.Marshal(&traffic)
-	if err != nil {
-		return err
-	}
-	return u.Storage.Store(context.Background(), key, bb)
+	return u.store(key, traffic)
 }
 
 // Delete is ...
@@ -269,17 +426,12 @@ func (u *CaddyUpstream) Range(fn func(k string, up, down int64)) {
 		return
 	}
 
-	traffic := Traffic{}
 	for _, k := range prekeys {
-		b, err := u.Storage.Load(context.Background(), k)
+		traffic, _, err := u.load(k)
 		if err != nil {
 			u.Logger.Error(fmt.Sprintf("load user error: %v", err))
 			continue
 		}
-		if err := json.Unmarshal(b, &traffic); err != nil {
-			u.Logger.Error(fmt.Sprintf("load user error: %v", err))
-			continue
-		}
 		fn(strings.TrimPrefix(k, u.Prefix), traffic.Up, traffic.Down)
 	}
 
@@ -299,30 +451,63 @@ func (u *CaddyUpstream) Consume(k string, nr, nw int64) error {
 	u.Storage.Lock(context.Background(), key)
 	defer u.Storage.Unlock(context.Background(), key)
 
-	b, err := u.Storage.Load(context.Background(), key)
+	traffic, _, err := u.load(key)
 	if err != nil {
 		return err
 	}
 
-	traffic := Traffic{}
-	if err := json.Unmarshal(b, &traffic); err != nil {
-		return err
-	}
-
 	traffic.Up += nr
 	traffic.Down += nw
 
-	b, err = json.Marshal(&traffic)
+	return u.store(key, traffic)
+}
+
+// Rewrap writes records which are not encrypted with the first key again,
+// and counts plain records which are not read without AllowPlaintext.
+func (u *CaddyUpstream) Rewrap(ctx context.Context) (RewrapResult, error) {
+	res := RewrapResult{}
+	if u.Encryption == nil {
+		return res, ErrEncryptionDisabled
+	}
+	prekeys, err := u.Storage.List(ctx, u.Prefix, false)
 	if err != nil {
-		return err
+		return res, err
 	}
 
-	return u.Storage.Store(context.Background(), key, b)
+	for _, key := range prekeys {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		ok, err := func() (bool, error) {
+			u.Storage.Lock(ctx, key)
+			defer u.Storage.Unlock(ctx, key)
+
+			traffic, stale, err := u.load(key)
+			if err != nil || !stale {
+				return false, err
+			}
+			return true, u.store(key, traffic)
+		}()
+		if errors.Is(err, ErrPlaintextRecord) {
+			res.Plaintext++
+			continue
+		}
+		if err != nil {
+			return res, fmt.Errorf("rewrap %v error: %w", strings.TrimPrefix(key, u.Prefix), err)
+		}
+		if ok {
+			res.Rewrapped++
+		}
+	}
+	return res, nil
 }
 
 var (
 	_ Upstream           = (*CaddyUpstream)(nil)
+	_ Rewrapper          = (*CaddyUpstream)(nil)
+	_ Rewrapper          = (*MemoryUpstream)(nil)
 	_ Upstream           = (*MemoryUpstream)(nil)
+	_ bulkAdder          = (*MemoryUpstream)(nil)
 	_ caddy.CleanerUpper = (*MemoryUpstream)(nil)
 	_ caddy.Provisioner  = (*MemoryUpstream)(nil)
 )
@@ -0,0 +1,217 @@
+package app
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+func newTestMemoryUpstream(tb testing.TB, n int) (*MemoryUpstream, [][]byte) {
+	u := &MemoryUpstream{}
+	if err := u.Provision(caddy.Context{}); err != nil {
+		tb.Fatal(err)
+	}
+	keys := make([][]byte, n)
+	for i := range keys {
+		pass := "pass" + strconv.Itoa(i)
+		u.Add(pass)
+		keys[i] = make([]byte, trojan.HeaderLen)
+		trojan.GenKey(pass, keys[i])
+	}
+	return u, keys
+}
+
+func TestMemoryUpstream(t *testing.T) {
+	u, keys := newTestMemoryUpstream(t, 100)
+
+	for _, k := range keys {
+		if !u.Validate(string(k)) {
+			t.Fatalf("validate error: %s", k)
+		}
+	}
+	if u.Validate("not a user") {
+		t.Fatal("validate unknown user error")
+	}
+
+	u.Consume(string(keys[0]), 1, 2)
+	u.Consume(string(keys[0]), 3, 4)
+	// adding an existing user keeps the counters
+	u.Add("pass0")
+	u.Range(func(k string, up, down int64) {
+		if k == string(keys[0]) && (up != 4 || down != 6) {
+			t.Errorf("traffic error: %v %v", up, down)
+		}
+	})
+
+	u.Delete("pass0")
+	if u.Validate(string(keys[0])) {
+		t.Fatal("delete error")
+	}
+	n := 0
+	u.Range(func(string, int64, int64) { n++ })
+	if n != len(keys)-1 {
+		t.Fatalf("range error: %v", n)
+	}
+
+	// traffic of users not in memory is forwarded to the persistent upstream
+	// in batches
+	persist, _ := newTestMemoryUpstream(t, 0)
+	persist.AddKey(string(keys[0]))
+	u.up, u.ch, u.done = persist, make(chan Task, 1), make(chan struct{})
+	u.batch = &memoryBatch{traffic: make(map[string]Traffic)}
+	u.Consume(string(keys[0]), 5, 6)
+	u.Consume(string(keys[0]), 1, 1)
+	u.flush()
+	persist.Range(func(k string, up, down int64) {
+		if up != 6 || down != 7 {
+			t.Errorf("forward error: %v %v", up, down)
+		}
+	})
+
+	// tasks after cleanup do not panic and still reach the persistent upstream
+	go u.run()
+	u.Cleanup()
+	u.Cleanup()
+	u.Consume(string(keys[0]), 1, 1)
+	u.Add("pass-after-cleanup")
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("pass-after-cleanup", key[:])
+	deadline := time.Now().Add(5 * time.Second)
+	for !persist.Validate(string(key[:])) {
+		if time.Now().After(deadline) {
+			t.Fatal("add after cleanup is lost")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryUpstreamAddAll(t *testing.T) {
+	u, keys := newTestMemoryUpstream(t, 1)
+	v := u.tb.Load(string(keys[0]))
+	list := make([]string, 1000)
+	for i := range list {
+		list[i] = "pass" + strconv.Itoa(i)
+	}
+	if err := u.AddAll(list); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range list {
+		b := [trojan.HeaderLen]byte{}
+		trojan.GenKey(s, b[:])
+		if !u.Validate(string(b[:])) {
+			t.Fatalf("validate error: %s", b[:])
+		}
+	}
+	// existing entries are kept
+	if u.tb.Load(string(keys[0])) != v {
+		t.Fatal("entry of existing user is replaced")
+	}
+	n := 0
+	u.Range(func(string, int64, int64) { n++ })
+	if n != len(list) {
+		t.Fatalf("range error: %v", n)
+	}
+}
+
+func TestMemoryUpstreamValidateAllocs(t *testing.T) {
+	u, keys := newTestMemoryUpstream(t, 100)
+
+	b := make([]byte, trojan.HeaderLen)
+	copy(b, keys[42])
+	allocs := testing.AllocsPerRun(1000, func() {
+		if !u.Validate(utils.ByteSliceToString(b)) {
+			t.Fatal("validate error")
+		}
+		u.Consume(utils.ByteSliceToString(b), 1, 1)
+	})
+	if allocs != 0 {
+		t.Fatalf("validate allocates: %v", allocs)
+	}
+}
+
+// lockedUpstream is the previous single RWMutex design, kept as a baseline
+type lockedUpstream struct {
+	mu sync.RWMutex
+	mm map[string]Traffic
+}
+
+func (u *lockedUpstream) Validate(k string) bool {
+	u.mu.RLock()
+	_, ok := u.mm[k]
+	u.mu.RUnlock()
+	return ok
+}
+
+func (u *lockedUpstream) Consume(k string, nr, nw int64) error {
+	u.mu.Lock()
+	traffic := u.mm[k]
+	traffic.Up += nr
+	traffic.Down += nw
+	u.mm[k] = traffic
+	u.mu.Unlock()
+	return nil
+}
+
+type benchUpstream interface {
+	Validate(string) bool
+	Consume(string, int64, int64) error
+}
+
+const benchUsers = 10000
+
+func benchTables(b *testing.B) (map[string]benchUpstream, [][]byte) {
+	u, keys := newTestMemoryUpstream(b, benchUsers)
+	l := &lockedUpstream{mm: make(map[string]Traffic)}
+	for _, k := range keys {
+		l.mm[string(k)] = Traffic{}
+	}
+	return map[string]benchUpstream{"Locked": l, "Sharded": u}, keys
+}
+
+func runParallel(b *testing.B, fn func(u benchUpstream, k string)) {
+	tables, keys := benchTables(b)
+	for _, name := range []string{"Locked", "Sharded"} {
+		u := tables[name]
+		b.Run(name, func(b *testing.B) {
+			var seq atomic.Uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := seq.Add(7919)
+				buf := make([]byte, trojan.HeaderLen)
+				for pb.Next() {
+					copy(buf, keys[i%benchUsers])
+					fn(u, utils.ByteSliceToString(buf))
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkValidateParallel(b *testing.B) {
+	runParallel(b, func(u benchUpstream, k string) {
+		u.Validate(k)
+	})
+}
+
+func BenchmarkConsumeParallel(b *testing.B) {
+	runParallel(b, func(u benchUpstream, k string) {
+		u.Consume(k, 1024, 4096)
+	})
+}
+
+func BenchmarkMixedParallel(b *testing.B) {
+	runParallel(b, func(u benchUpstream, k string) {
+		if u.Validate(k) {
+			u.Consume(k, 1024, 4096)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+// Package command registers caddy subcommands of the trojan app.
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+
+	"github.com/imgk/caddy-trojan/admin/client"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "trojan-egress",
+		Usage: "--addr <ip:port> [--at <time>] [--remote <ip:port>] [--slack <duration>] [--address <admin>]",
+		Short: "Finds the trojan user owning an egress address at a time",
+		Long: `
+Queries the egress records of the trojan app for outbound sockets which
+were open on the egress address at the time, such as the address and time
+of an abuse report. The time is in RFC 3339 format and defaults to now,
+and slack extends it to a range for inaccurate clocks of the reporter.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().String("addr", "", "Egress address as IP:port, IP or :port")
+			cmd.Flags().String("at", "", "Time of the report in RFC 3339 format")
+			cmd.Flags().String("remote", "", "Remote address as IP:port, IP or :port")
+			cmd.Flags().String("slack", "", "Duration before and after the time")
+			cmd.Flags().String("address", "localhost:2019", "Address of the administration endpoint")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdEgress)
+		},
+	})
+}
+
+// cmdEgress is ...
+func cmdEgress(fl caddycmd.Flags) (int, error) {
+	q := client.EgressQuery{Addr: fl.String("addr"), Remote: fl.String("remote")}
+	if q.Addr == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--addr is required")
+	}
+	if v := fl.String("at"); v != "" {
+		at, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("parse --at error: %w", err)
+		}
+		q.At = at
+	}
+	if v := fl.String("slack"); v != "" {
+		d, err := caddy.ParseDuration(v)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("parse --slack error: %w", err)
+		}
+		q.Slack = d
+	}
+
+	base := fl.String("address")
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	list, err := client.New(base).Egress(context.Background(), q)
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	if len(list) == 0 {
+		fmt.Println("no socket found")
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tCLIENT\tTRANSPORT\tNETWORK\tLOCAL\tREMOTE\tSTART\tEND")
+	for _, v := range list {
+		end := "open"
+		if v.End != nil {
+			end = v.End.Format(time.RFC3339)
+		}
+		remote := v.Remote
+		if remote == "" {
+			remote = "*"
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			v.Key, v.Client, v.Transport, v.Network, v.Local, remote, v.Start.Format(time.RFC3339), end)
+	}
+	return caddy.ExitCodeSuccess, tw.Flush()
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
+	"github.com/imgk/caddy-trojan/utils"
+)
+
+// ProxyStatusName is the proxy identifier of Proxy-Status header.
+const ProxyStatusName = "caddy-trojan"
+
+// ProxyAuthKey returns the trojan key of the Proxy-Authorization header,
+// which is either hex(SHA224(password)) or Basic base64(user:password).
+func ProxyAuthKey(r *http.Request) (string, bool) {
+	return basicAuthKey(r.Header.Get("Proxy-Authorization"))
+}
+
+// basicAuthKey returns the trojan key of the credentials of a Basic
+// authorization header
+func basicAuthKey(h string) (string, bool) {
+	auth, ok := strings.CutPrefix(h, "Basic ")
+	if !ok {
+		return "", false
+	}
+	// base64 credentials of 42 bytes are 56 characters too
+	if isKey(auth) {
+		return auth, true
+	}
+	b, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", false
+	}
+	_, pass, found := strings.Cut(utils.ByteSliceToString(b), ":")
+	if !found {
+		pass = string(b)
+	}
+	if pass == "" {
+		return "", false
+	}
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey(pass, key[:])
+	return string(key[:]), true
+}
+
+// isKey returns whether s is hex(SHA224(password)) in lowercase
+func isKey(s string) bool {
+	if len(s) != trojan.HeaderLen {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// proxyAuth returns the key of the valid user of the Proxy-Authorization
+// header, which is a trojan user or, if LDAP is configured, an LDAP user
+// of user:password.
+func (m *Handler) proxyAuth(r *http.Request) (string, bool) {
+	if key, ok := ProxyAuthKey(r); ok && m.validKey(key) {
+		return key, true
+	}
+	if m.LDAP == nil {
+		return "", false
+	}
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", false
+	}
+	user, pass, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return "", false
+	}
+	return m.ldapAuth(r, user, pass)
+}
+
+// validKey returns whether key is of a valid trojan user, keys of LDAP
+// users are not accepted without user:password
+func (m *Handler) validKey(key string) bool {
+	return m.Upstream.Validate(key) && !m.LDAP.Owns(key)
+}
+
+// ldapAuth returns the key of the LDAP user of user and pass
+func (m *Handler) ldapAuth(r *http.Request, user, pass string) (string, bool) {
+	key, err := m.LDAP.Authenticate(r.Context(), user, pass, r.RemoteAddr)
+	if err != nil {
+		if !errors.Is(err, app.ErrLDAPCredentials) {
+			m.Logger.Error(fmt.Sprintf("ldap authenticate %v from %v error: %v", user, r.RemoteAddr, err))
+		}
+		return "", false
+	}
+	// bans apply to ldap users
+	return key, m.Upstream.Validate(key)
+}
+
+// serveConnect handles a standard CONNECT request over http2/http3
+func (m *Handler) serveConnect(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	key, ok := m.proxyAuth(r)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+	sess := app.NewSession(key, app.HTTPTransport(r.ProtoMajor), r.RemoteAddr, serverName(r))
+	if !m.Policy.Authorize(sess) {
+		return next.ServeHTTP(w, r)
+	}
+	if handled, err := m.drain(w, r, next); handled {
+		return err
+	}
+
+	target := r.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		WriteProxyStatus(w, http.StatusBadRequest, "http_request_error", "invalid authority")
+		return nil
+	}
+	if m.Verbose {
+		m.Logger.Info(fmt.Sprintf("handle connect http%d from %v to %v", r.ProtoMajor, r.RemoteAddr, target))
+	}
+
+	ctx, cancel := context.WithTimeout(sess.Context(r.Context()), time.Duration(m.DialTimeout))
+	rc, err := trojan.DialContext(ctx, m.Proxy, "tcp", target)
+	cancel()
+	if err != nil {
+		code, perr := ProxyStatusError(err)
+		m.Logger.Error(fmt.Sprintf("dial %v error: %v", target, err))
+		// errors of the outbound are logged only, the error type tells
+		// the client what failed
+		WriteProxyStatus(w, code, perr, "")
+		return nil
+	}
+	defer rc.Close()
+
+	rd, wr, done := m.connectStream(w, r)
+	defer done()
+	m.Sessions.Add(sess, rd)
+	defer m.Sessions.Remove(sess)
+
+	meter := app.NewMeter(m.Upstream, key)
+	defer meter.Close()
+	_, _, err = trojan.Relay(meter.Reader(rd), meter.Writer(wr), rc)
+	if err != nil {
+		m.Logger.Error(fmt.Sprintf("handle connect http%d error: %v", r.ProtoMajor, err))
+	}
+	return nil
+}
+
+// ProxyStatusError maps a dial error to the response status code and
+// the RFC 9209 proxy error type.
+func ProxyStatusError(err error) (int, string) {
+	if errors.Is(err, app.ErrPolicyDenied) {
+		return http.StatusForbidden, "http_request_denied"
+	}
+	if dnsErr := (*net.DNSError)(nil); errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return http.StatusGatewayTimeout, "dns_timeout"
+		}
+		return http.StatusBadGateway, "dns_error"
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return http.StatusGatewayTimeout, "connection_timeout"
+	}
+	if ne := net.Error(nil); errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout, "connection_timeout"
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return http.StatusBadGateway, "connection_terminated"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return http.StatusBadGateway, "destination_ip_unroutable"
+	}
+	return http.StatusBadGateway, "destination_unavailable"
+}
+
+// WriteProxyStatus writes an error response with the Proxy-Status header,
+// details are omitted if empty.
+func WriteProxyStatus(w http.ResponseWriter, code int, perr, details string) {
+	status := fmt.Sprintf("%s; error=%s", ProxyStatusName, perr)
+	if details != "" {
+		status += "; details=" + quoteString(details)
+	}
+	w.Header().Set("Proxy-Status", status)
+	w.WriteHeader(code)
+}
+
+// quoteString encodes s as a structured field string (RFC 8941)
+func quoteString(s string) string {
+	b := strings.Builder{}
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
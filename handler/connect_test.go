@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func TestServeConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	// a port without listener
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	u := &app.MemoryUpstream{}
+	if err := u.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	u.Add("secret")
+	m := &Handler{
+		Connect:         true,
+		ConnectStandard: true,
+		DialTimeout:     caddy.Duration(10 * time.Second),
+		FlushLatency:    caddy.Duration(DefaultFlushLatency),
+		Upstream:        u,
+		Proxy:           &app.NoProxy{},
+		Logger:          zap.NewNop(),
+		Sessions:        app.NewSessions(u, nil, zap.NewNop()),
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	connect := func(pass, target string, body io.Reader) *http.Response {
+		req, _ := http.NewRequest(http.MethodConnect, srv.URL, body)
+		req.Host = target
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+pass)))
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	pr, pw := io.Pipe()
+	resp := connect("secret", ln.Addr().String(), pr)
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("connect status: %v %v", resp.StatusCode, resp.Proto)
+	}
+	pw.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, b); err != nil || string(b) != "hello" {
+		t.Fatalf("relay error: %q %v", b, err)
+	}
+	pw.Close()
+	resp.Body.Close()
+
+	for _, v := range []struct {
+		pass, target string
+		code         int
+		status       string
+	}{
+		{"wrong", ln.Addr().String(), http.StatusNotFound, ""},
+		{"secret", "127.0.0.1", http.StatusBadRequest, `caddy-trojan; error=http_request_error; details="invalid authority"`},
+		// errors of the outbound are not sent to the client
+		{"secret", closed.Addr().String(), http.StatusBadGateway, "caddy-trojan; error=connection_refused"},
+	} {
+		resp := connect(v.pass, v.target, nil)
+		resp.Body.Close()
+		if resp.StatusCode != v.code || resp.Header.Get("Proxy-Status") != v.status {
+			t.Errorf("connect %v with %v error: %v %q", v.target, v.pass, resp.StatusCode, resp.Header.Get("Proxy-Status"))
+		}
+	}
+}
+
+func TestProxyStatusError(t *testing.T) {
+	for _, v := range []struct {
+		err  error
+		code int
+		perr string
+	}{
+		{fmt.Errorf("dial: %w", app.ErrPolicyDenied), http.StatusForbidden, "http_request_denied"},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, http.StatusBadGateway, "dns_error"},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, http.StatusGatewayTimeout, "dns_timeout"},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, "connection_timeout"},
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, http.StatusGatewayTimeout, "connection_timeout"},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, http.StatusBadGateway, "connection_refused"},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, http.StatusBadGateway, "connection_terminated"},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, http.StatusBadGateway, "destination_ip_unroutable"},
+		{errors.New("other"), http.StatusBadGateway, "destination_unavailable"},
+	} {
+		if code, perr := ProxyStatusError(v.err); code != v.code || perr != v.perr {
+			t.Errorf("proxy status of %v error: %v %v", v.err, code, perr)
+		}
+	}
+}
+
+func TestQuoteString(t *testing.T) {
+	for _, v := range []struct {
+		s, quoted string
+	}{
+		{"", `""`},
+		{"invalid authority", `"invalid authority"`},
+		{`a "b" \c`, `"a \"b\" \\c"`},
+		{"a\r\nb\xff", `"a??b?"`},
+	} {
+		if s := quoteString(v.s); s != v.quoted {
+			t.Errorf("quote %q error: %v", v.s, s)
+		}
+	}
+}
+
+func TestBasicAuthKey(t *testing.T) {
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("password", key[:])
+	// user:password of 42 bytes is 56 characters of base64
+	pass := "user:" + strings.Repeat("p", 37)
+	passKey := [trojan.HeaderLen]byte{}
+	trojan.GenKey(pass[5:], passKey[:])
+
+	for _, v := range []struct {
+		h, key string
+	}{
+		{"Basic " + string(key[:]), string(key[:])},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte(":password")), string(key[:])},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte(pass)), string(passKey[:])},
+		{"Basic " + string(key[:55]) + "!", ""},
+		{"Bearer " + string(key[:]), ""},
+	} {
+		if key, _ := basicAuthKey(v.h); key != v.key {
+			t.Errorf("key of %q error: %v", v.h, key)
+		}
+	}
+}
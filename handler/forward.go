@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+// forwardIdleTimeout is the idle time after which kept-alive connections
+// of forward proxy requests are closed
+const forwardIdleTimeout = 90 * time.Second
+
+// hopHeaders are removed from forwarded requests and responses
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers and headers listed in
+// Connection from h
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// IsForwardRequest returns whether r is an absolute-form proxy request.
+func IsForwardRequest(r *http.Request) bool {
+	return r.Method != http.MethodConnect && r.URL.IsAbs() && r.URL.Host != ""
+}
+
+// serveForward handles an absolute-form proxy request of an
+// authenticated user
+func (m *Handler) serveForward(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	key, ok := m.proxyAuth(r)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+	sess := app.NewSession(key, app.HTTPTransport(r.ProtoMajor), r.RemoteAddr, serverName(r))
+	if !m.Policy.Authorize(sess) {
+		return next.ServeHTTP(w, r)
+	}
+	if handled, err := m.drain(w, r, next); handled {
+		return err
+	}
+	if r.URL.Scheme != "http" {
+		WriteProxyStatus(w, http.StatusBadRequest, "http_request_error", "unsupported scheme "+r.URL.Scheme)
+		return nil
+	}
+	if m.Verbose {
+		m.Logger.Info(fmt.Sprintf("handle forward http%d from %v to %v", r.ProtoMajor, r.RemoteAddr, r.URL.Host))
+	}
+
+	ctx, cancel := context.WithCancel(sess.Context(r.Context()))
+	defer cancel()
+	m.Sessions.Add(sess, closerFunc(cancel))
+	defer m.Sessions.Remove(sess)
+
+	meter := app.NewMeter(m.Upstream, key)
+	defer meter.Close()
+
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	out.Close = false
+	removeHopHeaders(out.Header)
+	if r.Body != nil && r.Body != http.NoBody {
+		out.Body = io.NopCloser(meter.Reader(r.Body))
+	}
+
+	resp, err := m.forward.Transport(sess, m.dialForward).RoundTrip(out)
+	if err != nil {
+		if cerr := meter.Err(); cerr != nil {
+			err = cerr
+		}
+		code, perr := ProxyStatusError(err)
+		m.Logger.Error(fmt.Sprintf("forward %v error: %v", r.URL.Host, err))
+		WriteProxyStatus(w, code, perr, "")
+		return nil
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, vv := range resp.Header {
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	fw := NewFlushWriter(w)
+	fw.Latency = time.Duration(m.FlushLatency)
+	defer fw.Close()
+	if _, err := io.Copy(meter.Writer(fw), resp.Body); err != nil {
+		m.Logger.Error(fmt.Sprintf("handle forward http%d error: %v", r.ProtoMajor, err))
+	}
+	return nil
+}
+
+// dialForward dials the target of a forward proxy request
+func (m *Handler) dialForward(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(m.DialTimeout))
+	defer cancel()
+	return trojan.DialContext(ctx, m.Proxy, network, addr)
+}
+
+// closerFunc is ...
+type closerFunc func()
+
+// Close is ...
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+// forwardPool keeps the connections of forward proxy requests alive.
+// Connections are partitioned by user and client connection, so that a
+// connection dialed for one session is never reused by another one.
+type forwardPool struct {
+	mu    sync.Mutex
+	m     map[string]*forwardTransport
+	swept time.Time
+}
+
+// forwardTransport is ...
+type forwardTransport struct {
+	*http.Transport
+	used time.Time
+}
+
+// Transport returns the transport of sess, transports idle for
+// forwardIdleTimeout are removed.
+func (p *forwardPool) Transport(sess *app.Session, dial func(context.Context, string, string) (net.Conn, error)) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.swept) > forwardIdleTimeout {
+		p.swept = now
+		for k, t := range p.m {
+			if now.Sub(t.used) > forwardIdleTimeout {
+				t.CloseIdleConnections()
+				delete(p.m, k)
+			}
+		}
+	}
+
+	k := sess.Key + "|" + sess.RemoteAddr
+	t, ok := p.m[k]
+	if !ok {
+		if p.m == nil {
+			p.m = make(map[string]*forwardTransport)
+		}
+		t = &forwardTransport{Transport: &http.Transport{
+			DialContext:        dial,
+			DisableCompression: true,
+			IdleConnTimeout:    forwardIdleTimeout,
+		}}
+		p.m[k] = t
+	}
+	t.used = now
+	return t.Transport
+}
+
+// Close closes all idle connections.
+func (p *forwardPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, t := range p.m {
+		t.CloseIdleConnections()
+		delete(p.m, k)
+	}
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/app"
+	"github.com/imgk/caddy-trojan/trojan"
+)
+
+func TestForwardProxy(t *testing.T) {
+	conns := int32(0)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Proxy-Authorization", "Proxy-Connection", "X-Secret"} {
+			if r.Header.Get(name) != "" {
+				t.Errorf("hop-by-hop header %v is forwarded", name)
+			}
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		b, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.URL.Path + string(b)))
+	}))
+	target.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	target.Start()
+	defer target.Close()
+
+	u := &app.MemoryUpstream{}
+	if err := u.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	u.Add("secret")
+	m := &Handler{
+		ForwardProxy: true,
+		DialTimeout:  caddy.Duration(10 * time.Second),
+		FlushLatency: caddy.Duration(DefaultFlushLatency),
+		Upstream:     u,
+		Proxy:        &app.NoProxy{},
+		Logger:       zap.NewNop(),
+		Sessions:     app.NewSessions(u, nil, zap.NewNop()),
+		forward:      &forwardPool{},
+	}
+	defer m.Cleanup()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}))
+	}))
+	defer srv.Close()
+
+	client := func(pass string) *http.Client {
+		proxy, _ := url.Parse(srv.URL)
+		proxy.User = url.UserPassword("trojan", pass)
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+	}
+
+	c := client("secret")
+	down := int64(0)
+	for _, body := range []string{"", "", "-ping"} {
+		req, _ := http.NewRequest(http.MethodPost, target.URL+"/echo", strings.NewReader(body))
+		req.Header.Set("Connection", "X-Secret")
+		req.Header.Set("X-Secret", "1")
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != "/echo"+body {
+			t.Fatalf("forward error: %v %q", resp.StatusCode, b)
+		}
+		if resp.Header.Get("X-Hop") != "" {
+			t.Fatal("hop-by-hop header of response is forwarded")
+		}
+		down += int64(len(b))
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("keep-alive error: %v connections", n)
+	}
+
+	key := [trojan.HeaderLen]byte{}
+	trojan.GenKey("secret", key[:])
+	nr, nw := int64(0), int64(0)
+	u.Range(func(k string, up, down int64) {
+		if k == string(key[:]) {
+			nr, nw = up, down
+		}
+	})
+	if nr != 5 || nw != down {
+		t.Fatalf("traffic error: %v %v", nr, nw)
+	}
+
+	// unauthenticated requests are passed to the next handler
+	resp, err := client("wrong").Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unauthenticated status: %v", resp.StatusCode)
+	}
+
+	// new sessions of a draining node
+	for mode, code := range map[string]int{app.DrainFallback: http.StatusNotFound, app.DrainReject: http.StatusServiceUnavailable} {
+		if _, err := m.Sessions.Drain(mode, 0); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Get(target.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatalf("%v status: %v", mode, resp.StatusCode)
+		}
+	}
+}
@@ -3,10 +3,13 @@ package handler
 import (
 	//"errors"
 
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -36,14 +39,35 @@ type Handler struct {
 	Connect   bool `json:"connect_method,omitempty"`
 	Verbose   bool `json:"verbose,omitempty"`
 
+	// ConnectStandard serves CONNECT as a standard HTTP proxy, the target
+	// is taken from :authority instead of a trojan request in the body.
+	ConnectStandard bool `json:"connect_standard,omitempty"`
+	// DialTimeout is the timeout of dialing the target of a standard
+	// CONNECT request, default is 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+	// FlushLatency is the maximum delay of coalesced writes of CONNECT
+	// responses under bulk load, default is 5ms, -1 flushes every write.
+	FlushLatency caddy.Duration `json:"flush_latency,omitempty"`
+	// ForwardProxy serves absolute-form requests such as
+	// GET http://host/path of users authenticated by Proxy-Authorization.
+	ForwardProxy bool `json:"forward_proxy,omitempty"`
+
 	// Upstream is ...
-	Upstream app.Upstream `json:"-,omitempty"`
+	Upstream app.Upstream `json:"-"`
 	// Proxy is ...
-	Proxy app.Proxy `json:"-,omitempty"`
+	Proxy app.Proxy `json:"-"`
 	// Logger is ...
-	Logger *zap.Logger `json:"-,omitempty"`
+	Logger *zap.Logger `json:"-"`
 	// Upgrader is ...
-	Upgrader websocket.Upgrader `json:"-,omitempty"`
+	Upgrader websocket.Upgrader `json:"-"`
+	// Policy is ...
+	Policy *app.Policy `json:"-"`
+	// Sessions is ...
+	Sessions *app.Sessions `json:"-"`
+	// LDAP is ...
+	LDAP *app.LDAP `json:"-"`
+
+	forward *forwardPool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -68,11 +92,34 @@ func (m *Handler) Provision(ctx caddy.Context) error {
 	app := mod.(*app.App)
 	m.Upstream = app.Upstream()
 	m.Proxy = app.Proxy()
+	m.Policy = app.Policy
+	m.Sessions = app.Sessions()
+	m.LDAP = app.LDAP
+	if m.DialTimeout == 0 {
+		m.DialTimeout = caddy.Duration(10 * time.Second)
+	}
+	if m.FlushLatency == 0 {
+		m.FlushLatency = caddy.Duration(DefaultFlushLatency)
+	}
+	m.forward = &forwardPool{}
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (m *Handler) Cleanup() error {
+	if m.forward != nil {
+		m.forward.Close()
+	}
 	return nil
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// plain http forward proxy
+	if m.ForwardProxy && IsForwardRequest(r) {
+		return m.serveForward(w, r, next)
+	}
+
 	// trojan over http2/http3
 	// use CONNECT method, put trojan header as Proxy-Authorization
 	if m.Connect && r.Method == http.MethodConnect {
@@ -80,28 +127,60 @@ func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		if r.ProtoMajor == 1 {
 			return next.ServeHTTP(w, r)
 		}
+		if m.ConnectStandard {
+			return m.serveConnect(w, r, next)
+		}
 		auth := strings.TrimPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
-		if len(auth) != trojan.HeaderLen {
-			return next.ServeHTTP(w, r)
+		if len(auth) != trojan.HeaderLen || !m.validKey(auth) {
+			key, ok := m.proxyAuth(r)
+			if !ok {
+				return next.ServeHTTP(w, r)
+			}
+			auth = key
 		}
-		if ok := m.Upstream.Validate(auth); !ok {
+		sess := app.NewSession(auth, app.HTTPTransport(r.ProtoMajor), r.RemoteAddr, serverName(r))
+		if ok := m.Policy.Authorize(sess); !ok {
 			return next.ServeHTTP(w, r)
 		}
+		if handled, err := m.drain(w, r, next); handled {
+			return err
+		}
 		if m.Verbose {
 			m.Logger.Info(fmt.Sprintf("handle trojan http%d from %v", r.ProtoMajor, r.RemoteAddr))
 		}
 
-		_, _, err := m.Proxy.Handle(r.Body, NewFlushWriter(w))
-		// nr, nw, err := m.Proxy.Handle(r.Body, NewFlushWriter(w))
+		rd, wr, done := m.connectStream(w, r)
+		defer done()
+		m.Sessions.Add(sess, rd)
+		defer m.Sessions.Remove(sess)
+		meter := app.NewMeter(m.Upstream, auth)
+		defer meter.Close()
+		ctx := sess.Context(r.Context())
+		_, _, err := m.Proxy.Handle(ctx, meter.Reader(rd), meter.Writer(wr))
 		if err != nil {
 			m.Logger.Error(fmt.Sprintf("handle http%d error: %v", r.ProtoMajor, err))
 		}
-		// m.Upstream.Consume(auth, nr, nw)
 		return nil
 	}
 
 	// handle websocket
 	if m.WebSocket && websocket.IsWebSocketUpgrade(r) {
+		// the trojan header is read after the upgrade, so all upgrades
+		// are handled as new sessions
+		if handled, err := m.drain(w, r, next); handled {
+			return err
+		}
+
+		// users of LDAP put user:password in Authorization of the upgrade
+		// request, and the trojan header is of the same password
+		ldapKey, header := "", [trojan.HeaderLen]byte{}
+		if user, pass, ok := r.BasicAuth(); ok && m.LDAP != nil {
+			if ldapKey, ok = m.ldapAuth(r, user, pass); !ok {
+				return next.ServeHTTP(w, r)
+			}
+			trojan.GenKey(pass, header[:])
+		}
+
 		conn, err := m.Upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			return err
@@ -115,24 +194,50 @@ func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 			m.Logger.Error(fmt.Sprintf("read trojan header error: %v", err))
 			return nil
 		}
-		if ok := m.Upstream.Validate(utils.ByteSliceToString(b[:trojan.HeaderLen])); !ok {
+		key := string(b[:trojan.HeaderLen])
+		if ldapKey != "" {
+			if !bytes.Equal(b[:trojan.HeaderLen], header[:]) {
+				return nil
+			}
+			key = ldapKey
+		} else if ok := m.validKey(utils.ByteSliceToString(b[:trojan.HeaderLen])); !ok {
+			return nil
+		}
+		sess := app.NewSession(key, app.TransportWebSocket, r.RemoteAddr, serverName(r))
+		if ok := m.Policy.Authorize(sess); !ok {
 			return nil
 		}
 		if m.Verbose {
 			m.Logger.Info(fmt.Sprintf("handle trojan websocket.Conn from %v", r.RemoteAddr))
 		}
 
-		_, _, err = m.Proxy.Handle(io.Reader(c), io.Writer(c))
-		// nr, nw, err := m.Proxy.Handle(io.Reader(c), io.Writer(c))
+		m.Sessions.Add(sess, c)
+		defer m.Sessions.Remove(sess)
+		meter := app.NewMeter(m.Upstream, sess.Key)
+		defer meter.Close()
+		ctx := sess.Context(r.Context())
+		_, _, err = m.Proxy.Handle(ctx, meter.Reader(c), meter.Writer(c))
 		if err != nil {
 			m.Logger.Error(fmt.Sprintf("handle websocket error: %v", err))
 		}
-		// m.Upstream.Consume(utils.ByteSliceToString(b[:trojan.HeaderLen]), nr, nw)
 		return nil
 	}
 	return next.ServeHTTP(w, r)
 }
 
+// drain handles a new session while the node is draining, and reports
+// whether the request is handled.
+func (m *Handler) drain(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) (bool, error) {
+	switch m.Sessions.DrainMode() {
+	case app.DrainFallback:
+		return true, next.ServeHTTP(w, r)
+	case app.DrainReject:
+		WriteProxyStatus(w, http.StatusServiceUnavailable, "http_request_denied", app.ErrNodeDraining.Error())
+		return true, nil
+	}
+	return false, nil
+}
+
 // UnmarshalCaddyfile unmarshals Caddyfile tokens into h.
 func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if !d.Next() {
@@ -155,6 +260,38 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Err("only one connect_method is not allowed")
 			}
 			h.Connect = true
+			if d.NextArg() {
+				switch d.Val() {
+				case "standard":
+					h.ConnectStandard = true
+				case "trojan":
+				default:
+					return d.Errf("unknown connect_method: %v", d.Val())
+				}
+			}
+		case "dial_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse dial_timeout error: %v", err)
+			}
+			h.DialTimeout = caddy.Duration(dur)
+		case "flush_latency":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parse flush_latency error: %v", err)
+			}
+			h.FlushLatency = caddy.Duration(dur)
+		case "forward_proxy":
+			if h.ForwardProxy {
+				return d.Err("only one forward_proxy is not allowed")
+			}
+			h.ForwardProxy = true
 		case "verbose":
 			if h.Verbose {
 				return d.Err("only one verbose is not allowed")
@@ -168,27 +305,187 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 	_ caddyfile.Unmarshaler       = (*Handler)(nil)
 )
 
-// FlushWriter is ...
+// connectStream sends the response header of an accepted CONNECT request
+// and returns the stream to relay. HTTP/3 streams are taken over and
+// written directly, writes are coalesced by FlushWriter in both cases.
+// Closing the reader terminates the stream.
+func (m *Handler) connectStream(w http.ResponseWriter, r *http.Request) (io.ReadCloser, io.Writer, func()) {
+	w.WriteHeader(http.StatusOK)
+	if str := TakeoverHTTP3(w); str != nil {
+		fw := &FlushWriter{Writer: str, Flusher: str, Latency: time.Duration(m.FlushLatency)}
+		return str, fw, func() {
+			fw.Close()
+			str.Close()
+		}
+	}
+	fw := NewFlushWriter(w)
+	fw.Latency = time.Duration(m.FlushLatency)
+	fw.Flush()
+	return r.Body, fw, func() { fw.Close() }
+}
+
+// serverName returns the TLS SNI of r
+func serverName(r *http.Request) string {
+	if r.TLS != nil {
+		return r.TLS.ServerName
+	}
+	return ""
+}
+
+const (
+	// DefaultFlushLatency is the default latency budget of FlushWriter
+	DefaultFlushLatency = 5 * time.Millisecond
+	// smallWrite is the size of a write considered interactive
+	smallWrite = 1500
+	// maxPending is the size of coalesced writes which triggers a flush
+	maxPending = 32 * 1024
+)
+
+// FlushWriter flushes a http2/http3 response adaptively. Small writes and
+// writes after an idle period are flushed immediately, while writes under
+// bulk load are coalesced into larger DATA frames and flushed within
+// Latency or after maxPending bytes. Close must be called before the
+// handler returns.
 type FlushWriter struct {
 	Writer  io.Writer
 	Flusher http.Flusher
+	// Latency is the maximum delay of a coalesced write
+	Latency time.Duration
+
+	mu     sync.Mutex
+	last   time.Time
+	buf    []byte
+	err    error
+	timer  *time.Timer
+	armed  bool
+	closed bool
 }
 
 // NewFlushWriter is ...
 func NewFlushWriter(w http.ResponseWriter) *FlushWriter {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		// wrappers of caddy only implement Unwrap
+		f = controlFlusher{rc: http.NewResponseController(w)}
+	}
 	return &FlushWriter{
 		Writer:  w,
-		Flusher: w.(http.Flusher),
+		Flusher: f,
+		Latency: DefaultFlushLatency,
 	}
 }
 
+// controlFlusher flushes through http.ResponseController
+type controlFlusher struct {
+	rc *http.ResponseController
+}
+
+// Flush is ...
+func (f controlFlusher) Flush() {
+	f.rc.Flush()
+}
+
 // Write is ...
 func (c *FlushWriter) Write(b []byte) (int, error) {
-	n, err := c.Writer.Write(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	now := time.Now()
+	interactive := len(b) < smallWrite || now.Sub(c.last) > c.Latency || c.Latency <= 0
+	c.last = now
+
+	if interactive {
+		if len(c.buf) == 0 {
+			n, err := c.Writer.Write(b)
+			c.Flusher.Flush()
+			return n, err
+		}
+		c.buf = append(c.buf, b...)
+		return len(b), c.flush()
+	}
+
+	if c.buf == nil {
+		c.buf = make([]byte, 0, maxPending+smallWrite)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= maxPending {
+		return len(b), c.flush()
+	}
+	if !c.armed {
+		c.armed = true
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.Latency, c.delayedFlush)
+		} else {
+			c.timer.Reset(c.Latency)
+		}
+	}
+	return len(b), nil
+}
+
+// Flush is ...
+func (c *FlushWriter) Flush() {
+	c.mu.Lock()
+	c.flush()
+	c.mu.Unlock()
+}
+
+// flush writes coalesced data and flushes the response
+func (c *FlushWriter) flush() error {
+	if c.closed || c.err != nil {
+		return c.err
+	}
+	if len(c.buf) > 0 {
+		_, c.err = c.Writer.Write(c.buf)
+		c.buf = c.buf[:0]
+	}
 	c.Flusher.Flush()
-	return n, err
+	return c.err
+}
+
+// delayedFlush is ...
+func (c *FlushWriter) delayedFlush() {
+	c.mu.Lock()
+	c.armed = false
+	if len(c.buf) > 0 {
+		c.flush()
+	}
+	c.mu.Unlock()
+}
+
+// CloseWrite flushes pending data and closes the write side of Writer
+// if it is supported.
+func (c *FlushWriter) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if cw, ok := c.Writer.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close flushes pending data and stops the timer, the writer must not
+// be used after Close.
+func (c *FlushWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	err := c.flush()
+	c.closed = true
+	return err
 }
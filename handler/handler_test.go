@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// countFlusher counts flushes of a response writer
+type countFlusher struct {
+	http.ResponseWriter
+	n int
+}
+
+func (f *countFlusher) Flush() {
+	f.n++
+}
+
+func TestFlushWriter(t *testing.T) {
+	f := &countFlusher{ResponseWriter: httptest.NewRecorder()}
+	fw := &FlushWriter{Writer: f, Flusher: f, Latency: 50 * time.Millisecond}
+
+	// interactive writes are flushed immediately
+	fw.Write(make([]byte, 100))
+	if f.n != 1 {
+		t.Fatalf("small write flush error: %v", f.n)
+	}
+
+	// bulk writes are coalesced
+	for i := 0; i < 7; i++ {
+		fw.Write(make([]byte, 4096))
+	}
+	if f.n != 1 {
+		t.Fatalf("bulk write flush error: %v", f.n)
+	}
+	for i := 0; i < 8; i++ {
+		fw.Write(make([]byte, 4096))
+	}
+	if f.n != 2 {
+		t.Fatalf("max pending flush error: %v", f.n)
+	}
+
+	// the remaining bulk data is flushed within the latency budget
+	fw.Write(make([]byte, 4096))
+	time.Sleep(100 * time.Millisecond)
+	fw.mu.Lock()
+	n := f.n
+	fw.mu.Unlock()
+	if n != 3 {
+		t.Fatalf("delayed flush error: %v", n)
+	}
+
+	fw.Close()
+}
+
+func newBenchServer(b *testing.B, latency time.Duration, fn func(*FlushWriter, *http.Request)) (*httptest.Server, *http.Client) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fw := NewFlushWriter(w)
+		fw.Latency = latency
+		fw.Flush()
+		defer fw.Close()
+		fn(fw, r)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	b.Cleanup(srv.Close)
+	return srv, srv.Client()
+}
+
+var flushModes = []struct {
+	Name    string
+	Latency time.Duration
+}{
+	{"EveryWrite", -1},
+	{"Adaptive", DefaultFlushLatency},
+}
+
+// BenchmarkFlushWriterThroughput downloads 8 MiB over http2 in 4 KiB writes,
+// the typical size of reads from a remote TCP connection.
+func BenchmarkFlushWriterThroughput(b *testing.B) {
+	const size = 8 << 20
+	for _, mode := range flushModes {
+		b.Run(mode.Name, func(b *testing.B) {
+			srv, client := newBenchServer(b, mode.Latency, func(fw *FlushWriter, r *http.Request) {
+				buf := make([]byte, 4*1024)
+				for n := 0; n < size; n += len(buf) {
+					if _, err := fw.Write(buf); err != nil {
+						return
+					}
+				}
+			})
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n, _ := io.Copy(io.Discard, resp.Body); n != size {
+					b.Fatalf("short read: %v", n)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkFlushWriterLatency measures the round trip of a 64 byte echo
+// over a single http2 stream.
+func BenchmarkFlushWriterLatency(b *testing.B) {
+	for _, mode := range flushModes {
+		b.Run(mode.Name, func(b *testing.B) {
+			srv, client := newBenchServer(b, mode.Latency, func(fw *FlushWriter, r *http.Request) {
+				buf := make([]byte, 64)
+				for {
+					if _, err := io.ReadFull(r.Body, buf); err != nil {
+						return
+					}
+					if _, err := fw.Write(buf); err != nil {
+						return
+					}
+				}
+			})
+			pr, pw := io.Pipe()
+			req, err := http.NewRequest(http.MethodPost, srv.URL, pr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer resp.Body.Close()
+			defer pw.Close()
+
+			buf := make([]byte, 64)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := pw.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(resp.Body, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
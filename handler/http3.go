@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3Stream is the request stream of an HTTP/3 CONNECT request taken
+// over from the response writer. Reads and writes go directly to the
+// DATA frames of the QUIC stream without the buffering and flushing of
+// http.ResponseWriter.
+type HTTP3Stream struct {
+	http3.Stream
+}
+
+// TakeoverHTTP3 flushes the response header and takes over the HTTP/3
+// stream of w, it returns nil if w is not an HTTP/3 response. Wrappers of
+// w must implement Unwrap() http.ResponseWriter.
+func TakeoverHTTP3(w http.ResponseWriter) *HTTP3Stream {
+	for {
+		if hs, ok := w.(http3.HTTPStreamer); ok {
+			return &HTTP3Stream{Stream: hs.HTTPStream()}
+		}
+		u, ok := w.(interface {
+			Unwrap() http.ResponseWriter
+		})
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+// Flush is a no-op, writes of the stream are not buffered.
+func (s *HTTP3Stream) Flush() {}
+
+// CloseWrite sends FIN to the client.
+func (s *HTTP3Stream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close closes both directions of the stream.
+func (s *HTTP3Stream) Close() error {
+	s.Stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return s.Stream.Close()
+}
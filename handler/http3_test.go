@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// wrappedWriter mimics the response writer wrappers of caddy
+type wrappedWriter struct {
+	http.ResponseWriter
+}
+
+func (w *wrappedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// newTLSConfig returns a self-signed certificate for 127.0.0.1
+func newTLSConfig(tb testing.TB) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// opaqueWriter hides the http3 response writer from TakeoverHTTP3
+type opaqueWriter struct {
+	http.ResponseWriter
+}
+
+func (w *opaqueWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// newHTTP3Server serves CONNECT requests over http3 with fn, it returns
+// the address of the server and a client.
+func newHTTP3Server(tb testing.TB, takeover bool, fn func(io.Reader, io.Writer)) (string, *http.Client) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	m := &Handler{FlushLatency: caddy.Duration(DefaultFlushLatency)}
+	srv := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(newTLSConfig(tb)),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !takeover {
+				w = &opaqueWriter{ResponseWriter: w}
+			}
+			w = caddyhttp.NewResponseRecorder(w, nil, nil)
+			rd, wr, done := m.connectStream(w, r)
+			defer done()
+			fn(rd, wr)
+		}),
+	}
+	go srv.Serve(conn)
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	tb.Cleanup(func() {
+		tr.Close()
+		srv.Close()
+		conn.Close()
+	})
+	return conn.LocalAddr().String(), &http.Client{Transport: tr}
+}
+
+// connect sends a CONNECT request with body r
+func connect(tb testing.TB, client *http.Client, addr string, r io.Reader) *http.Response {
+	req, err := http.NewRequest(http.MethodConnect, "https://"+addr, r)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		tb.Fatalf("status code: %v", resp.StatusCode)
+	}
+	return resp
+}
+
+func TestTakeoverHTTP3(t *testing.T) {
+	if TakeoverHTTP3(&wrappedWriter{ResponseWriter: &countFlusher{}}) != nil {
+		t.Fatal("takeover non-http3 writer")
+	}
+
+	addr, client := newHTTP3Server(t, true, func(r io.Reader, w io.Writer) {
+		io.Copy(w, r)
+		w.(interface{ CloseWrite() error }).CloseWrite()
+	})
+	pr, pw := io.Pipe()
+	resp := connect(t, client, addr, pr)
+	defer resp.Body.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		pw.Write([]byte(msg))
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(resp.Body, b); err != nil || string(b) != msg {
+			t.Fatalf("echo error: %q, %v", b, err)
+		}
+	}
+	pw.Close()
+	if b, err := io.ReadAll(resp.Body); err != nil || len(b) != 0 {
+		t.Fatalf("close write error: %q, %v", b, err)
+	}
+}
+
+var http3Modes = []struct {
+	Name     string
+	Takeover bool
+}{
+	{"ResponseWriter", false},
+	{"Takeover", true},
+}
+
+// BenchmarkHTTP3Download downloads 8 MiB over an http3 CONNECT stream in
+// 4 KiB and 32 KiB writes, the sizes of reads from a remote TCP connection.
+func BenchmarkHTTP3Download(b *testing.B) {
+	const size = 8 << 20
+	for _, mode := range http3Modes {
+		for _, n := range []int{4 << 10, 32 << 10} {
+			b.Run(fmt.Sprintf("%s/%dK", mode.Name, n>>10), func(b *testing.B) {
+				addr, client := newHTTP3Server(b, mode.Takeover, func(r io.Reader, w io.Writer) {
+					buf := make([]byte, n)
+					for n := 0; n < size; n += len(buf) {
+						if _, err := w.Write(buf); err != nil {
+							return
+						}
+					}
+				})
+				b.SetBytes(size)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					resp := connect(b, client, addr, nil)
+					if n, _ := io.Copy(io.Discard, resp.Body); n != size {
+						b.Fatalf("short read: %v", n)
+					}
+					resp.Body.Close()
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkHTTP3Upload uploads 8 MiB over an http3 CONNECT stream.
+func BenchmarkHTTP3Upload(b *testing.B) {
+	const size = 8 << 20
+	for _, mode := range http3Modes {
+		b.Run(mode.Name, func(b *testing.B) {
+			addr, client := newHTTP3Server(b, mode.Takeover, func(r io.Reader, w io.Writer) {
+				n, _ := io.Copy(io.Discard, r)
+				w.Write([]byte{byte(n >> 20)})
+			})
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp := connect(b, client, addr, io.LimitReader(zeroReader{}, size))
+				if res, _ := io.ReadAll(resp.Body); len(res) != 1 || res[0] != size>>20 {
+					b.Fatalf("short write: %v", res)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+// zeroReader is ...
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,133 @@
+package listener
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+func init() {
+	caddy.RegisterModule(FingerprintWrapper{})
+}
+
+// errHelloCaptured stops the handshake which reads the ClientHello
+var errHelloCaptured = errors.New("client hello captured")
+
+// FingerprintWrapper records the fingerprint of the TLS ClientHello of
+// every connection for trojan sessions of the connection. It reads the
+// ClientHello before the tls listener wrapper and replays it, so it does
+// not take part in the selection of TLS connection policies.
+type FingerprintWrapper struct {
+	fps *app.Fingerprints
+}
+
+// CaddyModule returns the Caddy module information.
+func (FingerprintWrapper) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.listeners.trojan_fingerprint",
+		New: func() caddy.Module { return new(FingerprintWrapper) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *FingerprintWrapper) Provision(ctx caddy.Context) error {
+	if !app.FingerprintSupported {
+		return errors.New("trojan_fingerprint needs a build with Go 1.24 or later")
+	}
+	mod, err := ctx.App(app.CaddyAppID)
+	if err != nil {
+		return err
+	}
+	m.fps = mod.(*app.App).Fingerprints()
+	return nil
+}
+
+// WrapListener implements caddy.ListenWrapper
+func (m *FingerprintWrapper) WrapListener(l net.Listener) net.Listener {
+	return &fingerprintListener{Listener: l, fps: m.fps}
+}
+
+// UnmarshalCaddyfile unmarshals Caddyfile tokens into h.
+func (*FingerprintWrapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*FingerprintWrapper)(nil)
+	_ caddy.ListenerWrapper = (*FingerprintWrapper)(nil)
+	_ caddyfile.Unmarshaler = (*FingerprintWrapper)(nil)
+)
+
+// fingerprintListener wraps accepted connections with fingerprintConn
+type fingerprintListener struct {
+	net.Listener
+	fps *app.Fingerprints
+}
+
+// Accept is ...
+func (l *fingerprintListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprintConn{Conn: c, fps: l.fps, r: c}, nil
+}
+
+// fingerprintConn reads the ClientHello on the first read, so the accept
+// loop is not blocked by slow clients
+type fingerprintConn struct {
+	net.Conn
+	fps  *app.Fingerprints
+	once sync.Once
+	r    io.Reader
+}
+
+// Read is ...
+func (c *fingerprintConn) Read(b []byte) (int, error) {
+	c.once.Do(c.capture)
+	return c.r.Read(b)
+}
+
+// capture parses the ClientHello with crypto/tls and keeps every byte it
+// reads to be read again by the real handshake
+func (c *fingerprintConn) capture() {
+	buf := &bytes.Buffer{}
+	tls.Server(&helloConn{Conn: c.Conn, r: io.TeeReader(c.Conn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c.fps.Capture(hello)
+			return nil, errHelloCaptured
+		},
+	}).Handshake()
+	c.r = io.MultiReader(buf, c.Conn)
+}
+
+// helloConn reads from r and drops alerts written by the handshake which
+// reads the ClientHello
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+// Read is ...
+func (c *helloConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write is ...
+func (c *helloConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
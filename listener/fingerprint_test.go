@@ -0,0 +1,72 @@
+//go:build go1.24
+
+package listener
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-trojan/app"
+)
+
+func TestFingerprintWrapper(t *testing.T) {
+	up := &app.MemoryUpstream{}
+	if err := up.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	a := app.NewApp(up, &app.NoProxy{}, zap.NewNop())
+	selected := 0
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	ts.Listener = (&FingerprintWrapper{fps: a.Fingerprints()}).WrapListener(ts.Listener)
+	ts.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			selected++
+			return nil, nil
+		},
+	}
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	c, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the replayed ClientHello completes the handshake and selects the
+	// config once
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Write(c)
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "ok" || selected != 1 {
+		t.Fatalf("response error: %q %v", b, selected)
+	}
+
+	// sessions of the connection get the fingerprint
+	s := app.NewSession("key", app.TransportHTTP2, c.LocalAddr().String(), "example.com")
+	a.Sessions().Add(s, nil)
+	defer a.Sessions().Remove(s)
+	if s.Fingerprint == nil || s.Fingerprint.ServerName != "example.com" {
+		t.Fatalf("fingerprint error: %+v", s.Fingerprint)
+	}
+}
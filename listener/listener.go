@@ -1,6 +1,8 @@
 package listener
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -34,6 +36,12 @@ type ListenerWrapper struct {
 	Logger *zap.Logger `json:"logger,omitempty"`
 	// Verbose is ...
 	Verbose bool `json:"verbose,omitempty"`
+	// Policy is ...
+	Policy *app.Policy `json:"-"`
+	// Sessions is ...
+	Sessions *app.Sessions `json:"-"`
+	// LDAP is ...
+	LDAP *app.LDAP `json:"-"`
 }
 
 // CaddyModule returns the Caddy module information.
@@ -58,6 +66,9 @@ func (m *ListenerWrapper) Provision(ctx caddy.Context) error {
 	app := mod.(*app.App)
 	m.Upstream = app.Upstream()
 	m.Proxy = app.Proxy()
+	m.Policy = app.Policy
+	m.Sessions = app.Sessions()
+	m.LDAP = app.LDAP
 	return nil
 }
 
@@ -65,6 +76,9 @@ func (m *ListenerWrapper) Provision(ctx caddy.Context) error {
 func (m *ListenerWrapper) WrapListener(l net.Listener) net.Listener {
 	ln := NewListener(l, m.Upstream, m.Proxy, m.Logger)
 	ln.Verbose = m.Verbose
+	ln.Policy = m.Policy
+	ln.Sessions = m.Sessions
+	ln.LDAP = m.LDAP
 	go ln.loop()
 	return ln
 }
@@ -93,6 +107,12 @@ type Listener struct {
 	Proxy app.Proxy
 	// Logger is ...
 	Logger *zap.Logger
+	// Policy is ...
+	Policy *app.Policy
+	// Sessions is ...
+	Sessions *app.Sessions
+	// LDAP is ...
+	LDAP *app.LDAP
 
 	// return *rawConn
 	conns chan net.Conn
@@ -184,8 +204,26 @@ func (l *Listener) loop() {
 				}
 			}
 
-			// check the net.Conn
-			if ok := up.Validate(utils.ByteSliceToString(b[:trojan.HeaderLen])); !ok {
+			// check the net.Conn, keys of ldap users are not trojan passwords
+			key := utils.ByteSliceToString(b[:trojan.HeaderLen])
+			ok := up.Validate(key) && !l.LDAP.Owns(key)
+			sess := (*app.Session)(nil)
+			if ok {
+				sess = app.NewSession(string(b[:trojan.HeaderLen]), app.TransportTLS, c.RemoteAddr().String(), serverName(c))
+				ok = l.Policy.Authorize(sess)
+			}
+			// new sessions are not accepted while the node is draining
+			if ok {
+				switch l.Sessions.DrainMode() {
+				case app.DrainFallback:
+					ok = false
+				case app.DrainReject:
+					lg.Debug(fmt.Sprintf("reject trojan net.Conn from %v: %v", c.RemoteAddr(), app.ErrNodeDraining))
+					c.Close()
+					return
+				}
+			}
+			if !ok {
 				select {
 				case <-l.closed:
 					c.Close()
@@ -195,15 +233,26 @@ func (l *Listener) loop() {
 				return
 			}
 			defer c.Close()
+			l.Sessions.Add(sess, c)
+			defer l.Sessions.Remove(sess)
 			if l.Verbose {
 				lg.Info(fmt.Sprintf("handle trojan net.Conn from %v", c.RemoteAddr()))
 			}
-			_, _, err := l.Proxy.Handle(io.Reader(c), io.Writer(c))
-			// nr, nw, err := l.Proxy.Handle(io.Reader(c), io.Writer(c))
+			meter := app.NewMeter(up, sess.Key)
+			defer meter.Close()
+			ctx := sess.Context(context.Background())
+			_, _, err := l.Proxy.Handle(ctx, meter.Reader(c), meter.Writer(c))
 			if err != nil {
 				lg.Debug(fmt.Sprintf("handle net.Conn error: %v", err))
 			}
-			// up.Consume(utils.ByteSliceToString(b[:trojan.HeaderLen]), nr, nw)
 		}(conn, l.Logger, l.Upstream)
 	}
 }
+
+// serverName returns the TLS SNI of c
+func serverName(c net.Conn) string {
+	if tc, ok := c.(*tls.Conn); ok {
+		return tc.ConnectionState().ServerName
+	}
+	return ""
+}
@@ -1,8 +1,10 @@
 package trojan
 
 import (
+	_ "github.com/imgk/caddy-trojan/adapter"
 	_ "github.com/imgk/caddy-trojan/admin"
 	_ "github.com/imgk/caddy-trojan/app"
+	_ "github.com/imgk/caddy-trojan/command"
 	_ "github.com/imgk/caddy-trojan/handler"
 	_ "github.com/imgk/caddy-trojan/listener"
 )
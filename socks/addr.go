@@ -253,3 +253,27 @@ func ResolveAddrBuffer(addr net.Addr, b []byte) (*Addr, error) {
 
 	return nil, ErrInvalidAddrType
 }
+
+// ResolveHostPort converts host:port to Addr, domains are not resolved.
+func ResolveHostPort(s string) (*Addr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("port (%v) error: %w", port, err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ResolveAddr(&net.TCPAddr{IP: ip, Port: int(p)})
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, ErrInvalidAddrLen
+	}
+
+	b := make([]byte, 0, 1+1+len(host)+2)
+	b = append(b, AddrTypeDomain, byte(len(host)))
+	b = append(b, host...)
+	b = append(b, byte(p>>8), byte(p))
+	return &Addr{data: b}, nil
+}
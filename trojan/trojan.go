@@ -1,6 +1,7 @@
 package trojan
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -21,6 +22,8 @@ const (
 	CmdConnect = 1
 	// CmdAssociate is ...
 	CmdAssociate = 3
+	// CmdPing is a custom command relaying ICMP echo requests
+	CmdPing = 0x10
 )
 
 // GenKey is ...
@@ -34,6 +37,45 @@ func Handle(r io.Reader, w io.Writer) (int64, int64, error) {
 	return HandleWithDialer(r, w, (*netDialer)(nil))
 }
 
+// userKey is ...
+type userKey struct{}
+
+// WithUser returns a copy of ctx carrying the key of the trojan user.
+func WithUser(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, userKey{}, key)
+}
+
+// UserFromContext returns the key of the trojan user or an empty string.
+func UserFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(userKey{}).(string)
+	return key
+}
+
+// NetworkSinkhole is the network of a rewritten target which discards
+// all data and closes when the client closes.
+const NetworkSinkhole = "sinkhole"
+
+// Rewriter rewrites the target of a trojan request before dialing.
+type Rewriter interface {
+	// Rewrite returns the network and address to dial instead of addr.
+	Rewrite(ctx context.Context, network, addr string) (string, string)
+}
+
+// rewriterKey is ...
+type rewriterKey struct{}
+
+// WithRewriter returns a copy of ctx carrying rw, which is applied to
+// targets of CONNECT requests by HandleContext.
+func WithRewriter(ctx context.Context, rw Rewriter) context.Context {
+	return context.WithValue(ctx, rewriterKey{}, rw)
+}
+
+// RewriterFromContext returns the rewriter of ctx or nil.
+func RewriterFromContext(ctx context.Context) Rewriter {
+	rw, _ := ctx.Value(rewriterKey{}).(Rewriter)
+	return rw
+}
+
 // Dialer is ...
 type Dialer interface {
 	// Dial is ...
@@ -42,18 +84,85 @@ type Dialer interface {
 	ListenPacket(string, string) (net.PacketConn, error)
 }
 
+// ContextDialer is ...
+type ContextDialer interface {
+	// DialContext is ...
+	DialContext(context.Context, string, string) (net.Conn, error)
+}
+
+// ContextPacketListener is ...
+type ContextPacketListener interface {
+	// ListenPacketContext is ...
+	ListenPacketContext(context.Context, string, string) (net.PacketConn, error)
+}
+
+// ListenPacketContext is ...
+func ListenPacketContext(ctx context.Context, d Dialer, network, addr string) (net.PacketConn, error) {
+	if pl, ok := d.(ContextPacketListener); ok {
+		return pl.ListenPacketContext(ctx, network, addr)
+	}
+	return d.ListenPacket(network, addr)
+}
+
+// DialContext dials addr with d, and gives up when ctx is done
+// if d does not support context.
+func DialContext(ctx context.Context, d interface {
+	Dial(string, string) (net.Conn, error)
+}, network, addr string) (net.Conn, error) {
+	if cd, ok := d.(ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+
+	type Result struct {
+		Conn net.Conn
+		Err  error
+	}
+
+	ch := make(chan Result, 1)
+	go func() {
+		c, err := d.Dial(network, addr)
+		ch <- Result{Conn: c, Err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.Conn, r.Err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.Conn != nil {
+				r.Conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
 type netDialer struct{}
 
 func (*netDialer) Dial(network, addr string) (net.Conn, error) {
 	return net.Dial(network, addr)
 }
 
+func (*netDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
 func (*netDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
 	return net.ListenPacket(network, addr)
 }
 
+func (*netDialer) ListenPing(ctx context.Context) (net.PacketConn, error) {
+	return ListenICMP()
+}
+
 // HandleWithDialer is ...
 func HandleWithDialer(r io.Reader, w io.Writer, d Dialer) (int64, int64, error) {
+	return HandleContext(context.Background(), r, w, d)
+}
+
+// HandleContext is ...
+// ctx is passed to d if d is a ContextDialer or a ContextPacketListener
+func HandleContext(ctx context.Context, r io.Reader, w io.Writer, d Dialer) (int64, int64, error) {
 	// where Trojan Request is a SOCKS5-like request:
 	// +-----+------+----------+----------+
 	// | CMD | ATYP | DST.ADDR | DST.PORT |
@@ -84,7 +193,7 @@ func HandleWithDialer(r io.Reader, w io.Writer, d Dialer) (int64, int64, error)
 	if _, err := io.ReadFull(r, b[:1]); err != nil {
 		return 0, 0, fmt.Errorf("read command error: %w", err)
 	}
-	if b[0] != CmdConnect && b[0] != CmdAssociate {
+	if b[0] != CmdConnect && b[0] != CmdAssociate && b[0] != CmdPing {
 		return 0, 0, errors.New("command error")
 	}
 
@@ -101,17 +210,23 @@ func HandleWithDialer(r io.Reader, w io.Writer, d Dialer) (int64, int64, error)
 
 	switch b[0] {
 	case CmdConnect:
-		nr, nw, err := HandleTCP(r, w, addr, d)
+		nr, nw, err := HandleTCPContext(ctx, r, w, addr, d)
 		if err != nil {
 			return nr, nw, fmt.Errorf("handle tcp error: %w", err)
 		}
 		return nr, nw, nil
 	case CmdAssociate:
-		nr, nw, err := HandleUDP(r, w, time.Minute*10, d)
+		nr, nw, err := HandleUDPContext(ctx, r, w, time.Minute*10, d)
 		if err != nil {
 			return nr, nw, fmt.Errorf("handle udp error: %w", err)
 		}
 		return nr, nw, nil
+	case CmdPing:
+		nr, nw, err := HandlePingContext(ctx, r, w, time.Minute, d)
+		if err != nil {
+			return nr, nw, fmt.Errorf("handle ping error: %w", err)
+		}
+		return nr, nw, nil
 	default:
 	}
 	return 0, 0, errors.New("command error")
@@ -0,0 +1,418 @@
+package trojan
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/time/rate"
+
+	"github.com/imgk/caddy-trojan/socks"
+
+	"github.com/imgk/memory-go"
+)
+
+const (
+	// PingRate is the number of echo requests per second of a tunnel,
+	// requests over the rate are dropped
+	PingRate = 10
+	// PingBurst is the burst of PingRate
+	PingBurst = 20
+	// PingMaxSize is the max size of echo data
+	PingMaxSize = 1472
+	// pingMaxPending is the max number of echo requests waiting for replies
+	pingMaxPending = 1024
+)
+
+// ErrPingUnsupported is returned by ListenPing if the dialer is not a Pinger.
+var ErrPingUnsupported = errors.New("ping is not supported")
+
+// Pinger is a Dialer which sends ICMP echo requests.
+type Pinger interface {
+	// ListenPing returns a packet conn of ICMP echo, whose packets are
+	// [Seq(2 byte)][Data] and are sent to and received from *net.UDPAddr
+	// with port 0.
+	ListenPing(context.Context) (net.PacketConn, error)
+}
+
+// ListenPing returns the ICMP echo conn of d.
+func ListenPing(ctx context.Context, d Dialer) (net.PacketConn, error) {
+	if p, ok := d.(Pinger); ok {
+		return p.ListenPing(ctx)
+	}
+	return nil, ErrPingUnsupported
+}
+
+// HandlePingContext relays ICMP echo requests of the client, framed like
+// UDP packets, the port is ignored.
+// Request:
+// [AddrType(1 byte)][Addr(max 256 byte)][Port(2 byte)][Len(2 byte)][0x0d, 0x0a][Seq(2 byte)][Data]
+// Reply:
+// [AddrType(1 byte)][Addr(max 256 byte)][Port(2 byte)][Len(2 byte)][0x0d, 0x0a][Seq(2 byte)][RTT(4 byte, us)][Data]
+func HandlePingContext(ctx context.Context, r io.Reader, w io.Writer, timeout time.Duration, d Dialer) (int64, int64, error) {
+	rc, err := ListenPing(ctx, d)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rc.Close()
+
+	type Result struct {
+		Num int64
+		Err error
+	}
+
+	type Key struct {
+		IP  [16]byte
+		Seq uint16
+	}
+	key := func(ip net.IP, seq []byte) Key {
+		k := Key{Seq: binary.BigEndian.Uint16(seq)}
+		copy(k.IP[:], ip.To16())
+		return k
+	}
+	mu := sync.Mutex{}
+	sent := make(map[Key]time.Time)
+
+	errCh := make(chan Result, 0)
+	// copy echo requests from client to desired destination address
+	go func(rc net.PacketConn, r io.Reader, errCh chan Result) (nr int64, err error) {
+		defer func() {
+			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) {
+				err = nil
+			}
+			errCh <- Result{Num: nr, Err: err}
+		}()
+
+		limiter := rate.NewLimiter(PingRate, PingBurst)
+
+		ptr, b := memory.Alloc[byte](64*1024 + socks.MaxAddrLen)
+		defer memory.Free(ptr)
+
+		for {
+			raddr, er := socks.ReadAddrBuffer(r, b)
+			if er != nil {
+				err = er
+				break
+			}
+
+			l := raddr.Len()
+			if _, er := io.ReadFull(r, b[l:l+4]); er != nil {
+				err = er
+				break
+			}
+
+			n := int(b[l])<<8 | int(b[l+1])
+			nr += int64(l) + 4 + int64(n)
+
+			buf := b[l : l+n]
+			if _, er := io.ReadFull(r, buf); er != nil {
+				err = er
+				break
+			}
+			if n < 2 || n > 2+PingMaxSize || !limiter.Allow() {
+				continue
+			}
+
+			addr, er := socks.ResolveUDPAddr(raddr)
+			if er != nil {
+				continue
+			}
+			addr.Port = 0
+
+			mu.Lock()
+			if len(sent) >= pingMaxPending {
+				clear(sent)
+			}
+			sent[key(addr.IP, buf)] = time.Now()
+			mu.Unlock()
+
+			if _, ew := rc.WriteTo(buf, addr); ew != nil && errors.Is(ew, net.ErrClosed) {
+				err = ew
+				break
+			}
+		}
+		rc.SetReadDeadline(time.Now())
+		return
+	}(rc, r, errCh)
+
+	nr, nw, err := func(rc net.PacketConn, w io.Writer, errCh chan Result, timeout time.Duration) (_, nw int64, err error) {
+		// [Addr][Len][0x0d, 0x0a][Seq][RTT][Data]
+		ptr, b := memory.Alloc[byte](64*1024 + socks.MaxAddrLen + 8)
+		defer memory.Free(ptr)
+
+		const offset = socks.MaxAddrLen + 4
+		for {
+			rc.SetReadDeadline(time.Now().Add(timeout))
+			n, addr, er := rc.ReadFrom(b[offset+4:])
+			if er != nil {
+				err = er
+				break
+			}
+			if n < 2 {
+				continue
+			}
+			copy(b[offset:], b[offset+4:offset+6])
+
+			raddr := addr.(*net.UDPAddr)
+			mu.Lock()
+			k := key(raddr.IP, b[offset:offset+2])
+			start, ok := sent[k]
+			delete(sent, k)
+			mu.Unlock()
+			if !ok {
+				continue
+			}
+			binary.BigEndian.PutUint32(b[offset+2:], uint32(time.Since(start).Microseconds()))
+
+			ra, er := socks.ResolveAddrBuffer(&net.UDPAddr{IP: raddr.IP}, b[:socks.MaxAddrLen])
+			if er != nil {
+				continue
+			}
+			l := copy(b[socks.MaxAddrLen-ra.Len():], ra.Bytes())
+
+			n += 4
+			b[socks.MaxAddrLen] = byte(n >> 8)
+			b[socks.MaxAddrLen+1] = byte(n)
+			b[socks.MaxAddrLen+2] = 0x0d
+			b[socks.MaxAddrLen+3] = 0x0a
+			nw += int64(l) + 4 + int64(n)
+
+			if _, ew := w.Write(b[socks.MaxAddrLen-l : offset+n]); ew != nil {
+				err = ew
+				break
+			}
+		}
+		rc.SetWriteDeadline(time.Now())
+
+		if errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) {
+			r := <-errCh
+			return r.Num, nw, r.Err
+		}
+		r := <-errCh
+		return r.Num, nw, err
+	}(rc, w, errCh, timeout)
+
+	return nr, nw, err
+}
+
+// icmpPacket is ...
+type icmpPacket struct {
+	b    []byte
+	addr *net.UDPAddr
+}
+
+// ICMPConn sends ICMP echo requests with unprivileged ICMP datagram
+// sockets of Linux, the group of the process must be in
+// net.ipv4.ping_group_range.
+type ICMPConn struct {
+	in     chan icmpPacket
+	closed chan struct{}
+
+	mu       sync.Mutex
+	conns    [2]*icmp.PacketConn
+	deadline time.Time
+	wake     chan struct{}
+}
+
+// ListenICMP returns an ICMPConn, the IPv6 socket is opened on first use.
+func ListenICMP() (*ICMPConn, error) {
+	c := &ICMPConn{
+		in:     make(chan icmpPacket, 64),
+		closed: make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+	// fail early if ICMP sockets are not permitted
+	if _, err := c.conn(false); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// conn returns the socket of the address family and opens it if there
+// is none
+func (c *ICMPConn) conn(v6 bool) (*icmp.PacketConn, error) {
+	i, network, address := 0, "udp4", "0.0.0.0"
+	if v6 {
+		i, network, address = 1, "udp6", "::"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	if c.conns[i] != nil {
+		return c.conns[i], nil
+	}
+	pc, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[i] = pc
+	go c.receive(pc, v6)
+	return pc, nil
+}
+
+// receive reads echo replies of pc
+func (c *ICMPConn) receive(pc *icmp.PacketConn, v6 bool) {
+	proto := 1
+	if v6 {
+		proto = 58
+	}
+	b := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		msg, err := icmp.ParseMessage(proto, b[:n])
+		if err != nil || (msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply) {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok {
+			continue
+		}
+		pkt := icmpPacket{b: make([]byte, 2+len(echo.Data)), addr: addr.(*net.UDPAddr)}
+		binary.BigEndian.PutUint16(pkt.b, uint16(echo.Seq))
+		copy(pkt.b[2:], echo.Data)
+		select {
+		case c.in <- pkt:
+		default:
+		}
+	}
+}
+
+// ReadFrom is ...
+func (c *ICMPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		timer := (*time.Timer)(nil)
+		timeout := (<-chan time.Time)(nil)
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case pkt := <-c.in:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, pkt.b), pkt.addr, nil
+		case <-c.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-c.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// WriteTo sends an echo request of [Seq(2 byte)][Data] to addr.
+func (c *ICMPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) < 2 {
+		return 0, errors.New("icmp: short echo request")
+	}
+	ip := net.IP(nil)
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		ip = v.IP
+	case *net.IPAddr:
+		ip = v.IP
+	default:
+		return 0, errors.New("icmp: address type error")
+	}
+
+	v6 := ip.To4() == nil
+	pc, err := c.conn(v6)
+	if err != nil {
+		return 0, err
+	}
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{Seq: int(binary.BigEndian.Uint16(b)), Data: b[2:]},
+	}
+	if v6 {
+		// the checksum is computed by the kernel
+		msg.Type = ipv6.ICMPTypeEchoRequest
+	}
+	bb, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := pc.WriteTo(bb, &net.UDPAddr{IP: ip}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close is ...
+func (c *ICMPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+		close(c.closed)
+	}
+	for _, pc := range c.conns {
+		if pc != nil {
+			pc.Close()
+		}
+	}
+	return nil
+}
+
+// LocalAddr is ...
+func (c *ICMPConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+// SetDeadline is ...
+func (c *ICMPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline is ...
+func (c *ICMPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline is ignored.
+func (c *ICMPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+var _ net.PacketConn = (*ICMPConn)(nil)
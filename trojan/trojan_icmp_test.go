@@ -0,0 +1,77 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/imgk/caddy-trojan/socks"
+)
+
+type udpDialer struct{}
+
+func (udpDialer) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial(network, addr)
+}
+
+func (udpDialer) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return net.ListenPacket(network, addr)
+}
+
+func TestHandlePing(t *testing.T) {
+	if _, _, err := HandlePingContext(context.Background(), nil, nil, time.Second, udpDialer{}); !errors.Is(err, ErrPingUnsupported) {
+		t.Fatalf("unsupported error: %v", err)
+	}
+
+	pc, err := ListenICMP()
+	if err != nil {
+		t.Skipf("icmp is not permitted: %v", err)
+	}
+	pc.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		HandleWithDialer(server, server, (*netDialer)(nil))
+		server.Close()
+	}()
+
+	// [Cmd][Addr][0x0d, 0x0a]
+	addr, _ := socks.ResolveHostPort("127.0.0.1:0")
+	req := append([]byte{CmdPing}, addr.Bytes()...)
+	req = append(req, 0x0d, 0x0a)
+	// [Addr][Len][0x0d, 0x0a][Seq][Data]
+	for seq := range 2 {
+		req = append(req, addr.Bytes()...)
+		req = append(req, 0, 6, 0x0d, 0x0a, 0, byte(seq), 'p', 'i', 'n', 'g')
+	}
+	go client.Write(req)
+
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for seq := range 2 {
+		raddr, err := socks.ReadAddr(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raddr.String() != "127.0.0.1:0" {
+			t.Errorf("reply addr error: %v", raddr)
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatal(err)
+		}
+		b = make([]byte, int(binary.BigEndian.Uint16(b)))
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatal(err)
+		}
+		// [Seq][RTT][Data]
+		if len(b) != 10 || binary.BigEndian.Uint16(b) != uint16(seq) || !bytes.Equal(b[6:], []byte("ping")) {
+			t.Fatalf("reply error: %v", b)
+		}
+	}
+}
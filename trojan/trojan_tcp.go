@@ -1,6 +1,7 @@
 package trojan
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -44,12 +45,59 @@ func copyBuffer(w io.Writer, r io.Reader, buf []byte) (n int64, err error) {
 // HandleTCP is ...
 // trojan TCP stream
 func HandleTCP(r io.Reader, w io.Writer, addr net.Addr, d Dialer) (int64, int64, error) {
-	rc, err := d.Dial("tcp", addr.String())
+	return HandleTCPContext(context.Background(), r, w, addr, d)
+}
+
+// HandleTCPContext is ...
+// addr is rewritten by the Rewriter of ctx if any.
+func HandleTCPContext(ctx context.Context, r io.Reader, w io.Writer, addr net.Addr, d Dialer) (int64, int64, error) {
+	network, target := "tcp", addr.String()
+	if rw := RewriterFromContext(ctx); rw != nil {
+		network, target = rw.Rewrite(ctx, network, target)
+	}
+	rc, err := DialTarget(ctx, d, network, target)
 	if err != nil {
 		return 0, 0, err
 	}
 	defer rc.Close()
 
+	return Relay(r, w, rc)
+}
+
+// DialTarget dials a rewritten target, unix sockets are local to
+// this host and are not dialed through d.
+func DialTarget(ctx context.Context, d Dialer, network, addr string) (net.Conn, error) {
+	switch network {
+	case "unix":
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	case NetworkSinkhole:
+		c, peer := net.Pipe()
+		go io.Copy(io.Discard, peer)
+		return &sinkholeConn{Conn: c, peer: peer}, nil
+	}
+	return DialContext(ctx, d, network, addr)
+}
+
+// sinkholeConn discards all writes and reads EOF once its write side is closed
+type sinkholeConn struct {
+	net.Conn
+	peer net.Conn
+}
+
+// CloseWrite is ...
+func (c *sinkholeConn) CloseWrite() error {
+	return c.peer.Close()
+}
+
+// Close is ...
+func (c *sinkholeConn) Close() error {
+	c.peer.Close()
+	return c.Conn.Close()
+}
+
+// Relay copies data between the client and an established connection
+// until both directions are finished, rc is not closed.
+func Relay(r io.Reader, w io.Writer, rc net.Conn) (int64, int64, error) {
 	type Result struct {
 		Num int64
 		Err error